@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// parseAcrescentarA interpreta o campo append_to do formulário: o nome de
+// um CSV de saída existente, gerado pelo servidor, ao qual as novas
+// empresas são acrescentadas. Vazio mantém um arquivo novo por job.
+func parseAcrescentarA(valor, formato string, inline bool) (string, error) {
+	nome := strings.TrimSpace(valor)
+	if nome == "" {
+		return "", nil
+	}
+	if formato != formatoCSV || !strings.HasSuffix(nome, extensaoSaida(formatoCSV)) {
+		return "", fmt.Errorf("append_to só aceita saídas CSV")
+	}
+	if inline {
+		return "", fmt.Errorf("append_to não pode ser usado com inline=1")
+	}
+	if !nomeSaidaValido(nome) {
+		return "", fmt.Errorf("append_to inválido: %q", nome)
+	}
+	if _, err := os.Stat(caminhoSaida(nome)); err != nil {
+		return "", fmt.Errorf("append_to: arquivo %q não encontrado", nome)
+	}
+	return nome, nil
+}
+
+// lerCNPJsGravados lê um CSV de saída existente e devolve os CNPJs já
+// gravados nele. O cabeçalho precisa ser igual ao que o job gravaria, para
+// que as linhas acrescentadas fiquem nas mesmas colunas.
+func lerCNPJsGravados(nome string, cabecalho []string) (map[string]struct{}, error) {
+	file, err := os.Open(nome)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	raw := bufio.NewReader(file)
+	if inicio, _ := raw.Peek(len(bomUTF8)); bytes.Equal(inicio, bomUTF8) {
+		raw.Discard(len(bomUTF8))
+	}
+	reader := csv.NewReader(raw)
+
+	existente, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("append_to: erro ao ler o cabeçalho de %q: %w", nome, err)
+	}
+	if !slices.Equal(existente, cabecalho) {
+		return nil, fmt.Errorf("append_to: as colunas de %q não correspondem às deste job", nome)
+	}
+	coluna := slices.Index(cabecalho, "CNPJ")
+	if coluna < 0 {
+		return nil, fmt.Errorf("append_to exige a coluna CNPJ na saída")
+	}
+
+	gravados := make(map[string]struct{})
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return gravados, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("append_to: erro ao ler %q: %w", nome, err)
+		}
+		gravados[record[coluna]] = struct{}{}
+	}
+}
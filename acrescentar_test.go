@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadAcrescentaLote(t *testing.T) {
+	a, b, c := cnpjTeste("112223330001"), cnpjTeste("191312430001"), cnpjTeste("114447770001")
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{a: empresaTeste("A"), b: empresaTeste("B"), c: empresaTeste("C")}})
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", map[string]string{"workers": "1"},
+		arquivoTeste{"janeiro.csv", linhaReceita(a, "", "", "") + linhaReceita(b, "", "", "")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("primeiro lote: %s", mensagemErro(rec))
+	}
+	nomes, _ := filepath.Glob(filepath.Join(diretorioSaida, "empresas_*.csv"))
+	nomes = slices.DeleteFunc(nomes, func(n string) bool { return strings.HasSuffix(n, "_erros.csv") })
+	if len(nomes) != 1 {
+		t.Fatalf("saídas do primeiro lote = %v", nomes)
+	}
+
+	// Sem o cache, B é consultado de novo e só o arquivo evita a duplicata
+	processedCNPJs = novoCacheLRU[time.Time](maxEntradasCachePadrao)
+	rec = enviarFormulario(t, uploadHandler, "/upload?wait=1", map[string]string{"workers": "1", "append_to": filepath.Base(nomes[0])},
+		arquivoTeste{"fevereiro.csv", linhaReceita(b, "", "", "") + linhaReceita(c, "", "", "")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("segundo lote: %s", mensagemErro(rec))
+	}
+
+	saida := lerArquivoSaida(t, "empresas_")
+	if n := strings.Count(saida, "CNPJ,"); n != 1 {
+		t.Errorf("%d cabeçalhos no arquivo acrescentado, quer 1:\n%s", n, saida)
+	}
+	cabecalho, linhas := lerSaidaCSV(t, saida)
+	if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, []string{a, b, c}) {
+		t.Errorf("CNPJs = %v, quer %v", got, []string{a, b, c})
+	}
+
+	for _, appendTo := range []string{"inexistente.csv", "../" + filepath.Base(nomes[0])} {
+		rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", map[string]string{"append_to": appendTo},
+			arquivoTeste{"marco.csv", linhaReceita(c, "", "", "")})
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("append_to=%q: status = %d, quer 400", appendTo, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+func TestMain(m *testing.M) {
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// provedorFalso responde às consultas com as empresas cadastradas, sem
+// acessar a rede; CNPJs ausentes dão ErrCNPJNotFound.
+type provedorFalso struct {
+	mu        sync.Mutex
+	empresas  map[string]Empresa
+	consultas map[string]int
+}
+
+func (p *provedorFalso) Consultar(_ context.Context, cnpj string) (*Empresa, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.consultas == nil {
+		p.consultas = make(map[string]int)
+	}
+	p.consultas[cnpj]++
+	empresa, ok := p.empresas[cnpj]
+	if !ok {
+		return nil, ErrCNPJNotFound
+	}
+	empresa.CNPJ = cnpj
+	return &empresa, nil
+}
+
+// totalConsultas devolve quantas consultas o provedor recebeu.
+func (p *provedorFalso) totalConsultas() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	total := 0
+	for _, n := range p.consultas {
+		total += n
+	}
+	return total
+}
+
+// usarAmbienteTeste isola o teste do estado global do servidor: consultas
+// vão para p, as saídas para um diretório temporário e o cache começa
+// vazio, sem as consultas ainda em andamento de testes anteriores. Tudo é
+// restaurado ao fim.
+func usarAmbienteTeste(t *testing.T, p provedor) {
+	t.Helper()
+	provedorAnterior, diretorioAnterior, cacheAnterior, grupoAnterior := provedorCNPJ, diretorioSaida, processedCNPJs, consultasEmAndamento
+	t.Cleanup(func() {
+		provedorCNPJ, diretorioSaida, processedCNPJs, consultasEmAndamento = provedorAnterior, diretorioAnterior, cacheAnterior, grupoAnterior
+	})
+	provedorCNPJ = p
+	diretorioSaida = t.TempDir()
+	processedCNPJs = novoCacheLRU[time.Time](maxEntradasCachePadrao)
+	consultasEmAndamento = &singleflight.Group{}
+}
+
+// cnpjTeste completa base, de 12 dígitos, com os dígitos verificadores.
+func cnpjTeste(base string) string {
+	digitos := make([]int, 0, 14)
+	for _, r := range base {
+		digitos = append(digitos, int(r-'0'))
+	}
+	digitos = append(digitos, digitoVerificador(digitos, []int{5, 4, 3, 2, 9, 8, 7, 6, 5, 4, 3, 2}))
+	digitos = append(digitos, digitoVerificador(digitos, []int{6, 5, 4, 3, 2, 9, 8, 7, 6, 5, 4, 3, 2}))
+	var sb strings.Builder
+	for _, d := range digitos {
+		sb.WriteString(strconv.Itoa(d))
+	}
+	return sb.String()
+}
+
+// cnpjsTeste devolve n CNPJs válidos e distintos.
+func cnpjsTeste(n int) []string {
+	cnpjs := make([]string, n)
+	for i := range cnpjs {
+		cnpjs[i] = cnpjTeste(fmt.Sprintf("%08d0001", 10000000+i))
+	}
+	return cnpjs
+}
+
+// linhaReceita monta uma linha no layout dos arquivos de estabelecimentos
+// da Receita: CNPJ dividido nas colunas 0 a 2, DDD na 21, telefone na 22
+// e e-mail na 27, separadas por ponto e vírgula.
+func linhaReceita(cnpj, ddd, telefone, email string) string {
+	campos := make([]string, 30)
+	campos[0], campos[1], campos[2] = cnpj[:8], cnpj[8:12], cnpj[12:]
+	campos[21], campos[22], campos[27] = ddd, telefone, email
+	return `"` + strings.Join(campos, `";"`) + `"` + "\n"
+}
+
+// arquivoTeste é um arquivo enviado no campo "file" do formulário.
+type arquivoTeste struct {
+	nome     string
+	conteudo string
+}
+
+// enviarFormulario envia um formulário multipart a handler e devolve a
+// resposta. Sem "rps" nos campos, usa o máximo, para o teste não esperar
+// pelo limitador.
+func enviarFormulario(t *testing.T, handler http.HandlerFunc, alvo string, campos map[string]string, arquivos ...arquivoTeste) *httptest.ResponseRecorder {
+	t.Helper()
+	var corpo bytes.Buffer
+	mw := multipart.NewWriter(&corpo)
+	if _, ok := campos["rps"]; !ok {
+		mw.WriteField("rps", fmt.Sprint(rpsMaximo))
+	}
+	for nome, valor := range campos {
+		mw.WriteField(nome, valor)
+	}
+	for _, a := range arquivos {
+		fw, err := mw.CreateFormFile("file", a.nome)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(fw, a.conteudo)
+	}
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, alvo, &corpo)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+// lerSaidaCSV lê a saída CSV de um job e devolve o cabeçalho e as linhas.
+func lerSaidaCSV(t *testing.T, saida string) ([]string, [][]string) {
+	t.Helper()
+	registros, err := csv.NewReader(strings.NewReader(saida)).ReadAll()
+	if err != nil {
+		t.Fatalf("saída CSV inválida: %v\n%s", err, saida)
+	}
+	if len(registros) == 0 {
+		t.Fatalf("saída sem cabeçalho: %q", saida)
+	}
+	return registros[0], registros[1:]
+}
+
+// coluna devolve os valores da coluna nome das linhas de uma saída CSV.
+func coluna(t *testing.T, cabecalho []string, linhas [][]string, nome string) []string {
+	t.Helper()
+	indice := -1
+	for i, c := range cabecalho {
+		if c == nome {
+			indice = i
+		}
+	}
+	if indice < 0 {
+		t.Fatalf("coluna %q ausente em %v", nome, cabecalho)
+	}
+	valores := make([]string, len(linhas))
+	for i, l := range linhas {
+		valores[i] = l[indice]
+	}
+	return valores
+}
+
+// empresaTeste devolve uma empresa ativa de São Paulo com capital de
+// 100 mil, que passa pelos filtros padrão.
+func empresaTeste(razao string) Empresa {
+	return Empresa{
+		RazaoSocial:       razao,
+		CapitalSocial:     100000,
+		UF:                "SP",
+		Municipio:         "SAO PAULO",
+		Cep:               "01310100",
+		SituacaoCadastral: "ATIVA",
+	}
+}
+
+// mensagemErro resume uma resposta para as mensagens de falha.
+func mensagemErro(rec *httptest.ResponseRecorder) string {
+	return fmt.Sprintf("status %d: %s", rec.Code, strings.TrimSpace(rec.Body.String()))
+}
+
+// lerArquivoSaida devolve o conteúdo do único arquivo de diretorioSaida cujo
+// nome começa com prefixo, sem contar o de erros.
+func lerArquivoSaida(t *testing.T, prefixo string) string {
+	t.Helper()
+	nomes, err := filepath.Glob(filepath.Join(diretorioSaida, prefixo+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nomes = slices.DeleteFunc(nomes, func(n string) bool { return strings.Contains(filepath.Base(n), "erros") })
+	if len(nomes) != 1 {
+		t.Fatalf("arquivos de saída com o prefixo %q: %v, quer um", prefixo, nomes)
+	}
+	dados, err := os.ReadFile(nomes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(dados)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+)
+
+// reinoAutenticacao é o realm informado em WWW-Authenticate.
+const reinoAutenticacao = "Busca_empresas_BR"
+
+// rotasAbertas dispensam autenticação, para que probes e coletores de
+// métricas não precisem das credenciais.
+var rotasAbertas = map[string]bool{
+	"/healthz": true,
+	"/metrics": true,
+}
+
+// credenciaisAcesso são o usuário e a senha exigidos por HTTP Basic Auth,
+// configurados por BASIC_AUTH_USER e BASIC_AUTH_PASSWORD; sem elas o
+// servidor fica aberto.
+var credenciaisAcesso struct {
+	usuario, senha [sha256.Size]byte
+	ativas         bool
+}
+
+// configurarAutenticacao ativa a autenticação com usuario e senha. Os dois
+// vazios a mantêm desativada; apenas um deles é erro de configuração.
+func configurarAutenticacao(usuario, senha string) error {
+	if usuario == "" && senha == "" {
+		return nil
+	}
+	if usuario == "" || senha == "" {
+		return errors.New("BASIC_AUTH_USER e BASIC_AUTH_PASSWORD precisam ser informados juntos")
+	}
+	credenciaisAcesso.usuario = sha256.Sum256([]byte(usuario))
+	credenciaisAcesso.senha = sha256.Sum256([]byte(senha))
+	credenciaisAcesso.ativas = true
+	return nil
+}
+
+// exigirAutenticacao protege com HTTP Basic Auth todas as rotas de h, menos
+// as de rotasAbertas, respondendo 401 a credenciais ausentes ou erradas.
+func exigirAutenticacao(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !credenciaisAcesso.ativas || rotasAbertas[r.URL.Path] || credenciaisValidas(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+reinoAutenticacao+`", charset="UTF-8"`)
+		http.Error(w, "Autenticação necessária", http.StatusUnauthorized)
+	})
+}
+
+// credenciaisValidas compara as credenciais da requisição com as
+// configuradas em tempo constante. Os hashes têm o mesmo tamanho, então a
+// comparação também não revela o comprimento do usuário nem da senha.
+func credenciaisValidas(r *http.Request) bool {
+	usuario, senha, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	u := sha256.Sum256([]byte(usuario))
+	s := sha256.Sum256([]byte(senha))
+	usuarioOK := subtle.ConstantTimeCompare(u[:], credenciaisAcesso.usuario[:])
+	senhaOK := subtle.ConstantTimeCompare(s[:], credenciaisAcesso.senha[:])
+	return usuarioOK&senhaOK == 1
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// usarCredenciais configura a autenticação durante o teste.
+func usarCredenciais(t *testing.T, usuario, senha string) {
+	t.Helper()
+	anterior := credenciaisAcesso
+	t.Cleanup(func() { credenciaisAcesso = anterior })
+	if err := configurarAutenticacao(usuario, senha); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExigirAutenticacao(t *testing.T) {
+	usarCredenciais(t, "admin", "s3nha")
+	handler := exigirAutenticacao(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	casos := []struct {
+		nome, rota     string
+		usuario, senha string
+		comCredenciais bool
+		want           int
+	}{
+		{"upload sem credenciais", "/upload", "", "", false, http.StatusUnauthorized},
+		{"jobs com senha errada", "/jobs", "admin", "senha", true, http.StatusUnauthorized},
+		{"reprocess com usuário errado", "/reprocess", "root", "s3nha", true, http.StatusUnauthorized},
+		{"senha com prefixo da correta", "/upload", "admin", "s3n", true, http.StatusUnauthorized},
+		{"upload autorizado", "/upload", "admin", "s3nha", true, http.StatusOK},
+		{"jobs autorizado", "/jobs/abc", "admin", "s3nha", true, http.StatusOK},
+		{"healthz aberto", "/healthz", "", "", false, http.StatusOK},
+		{"metrics aberto", "/metrics", "", "", false, http.StatusOK},
+	}
+	for _, c := range casos {
+		req := httptest.NewRequest(http.MethodPost, c.rota, nil)
+		if c.comCredenciais {
+			req.SetBasicAuth(c.usuario, c.senha)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != c.want {
+			t.Errorf("%s: status = %d, quer %d", c.nome, rec.Code, c.want)
+		}
+		desafio := rec.Header().Get("WWW-Authenticate")
+		if c.want == http.StatusUnauthorized && !strings.HasPrefix(desafio, `Basic realm="`+reinoAutenticacao+`"`) {
+			t.Errorf("%s: WWW-Authenticate = %q", c.nome, desafio)
+		}
+	}
+}
+
+func TestAutenticacaoDesativada(t *testing.T) {
+	usarCredenciais(t, "", "")
+	handler := exigirAutenticacao(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/upload", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("sem credenciais configuradas: status = %d, quer 200", rec.Code)
+	}
+
+	if err := configurarAutenticacao("admin", ""); err == nil {
+		t.Error("usuário sem senha aceito")
+	}
+	if err := configurarAutenticacao("", "s3nha"); err == nil {
+		t.Error("senha sem usuário aceita")
+	}
+}
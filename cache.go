@@ -0,0 +1,180 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Intervalo entre gravações periódicas do cache em disco.
+const intervaloSalvarCache = 5 * time.Minute
+
+// maxEntradasCachePadrao limita o cache de CNPJs processados quando
+// CNPJ_CACHE_MAX_ENTRIES não está definida.
+const maxEntradasCachePadrao = 1_000_000
+
+// cacheLRU guarda um valor por chave, limitado a max entradas. Ao ficar
+// cheio descarta a chave usada há mais tempo. Guarda quando cada CNPJ foi
+// consultado, cuja validade (TTL) é verificada por quem consulta, em
+// emCache, e as coordenadas de cada CEP.
+type cacheLRU[V any] struct {
+	mu       sync.Mutex
+	max      int
+	ordem    *list.List // frente: usado mais recentemente
+	entradas map[string]*list.Element
+}
+
+type entradaCache[V any] struct {
+	chave string
+	valor V
+}
+
+func novoCacheLRU[V any](max int) *cacheLRU[V] {
+	return &cacheLRU[V]{
+		max:      max,
+		ordem:    list.New(),
+		entradas: make(map[string]*list.Element),
+	}
+}
+
+// Get devolve o valor da chave e a marca como usada.
+func (c *cacheLRU[V]) Get(chave string) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entradas[chave]
+	if !ok {
+		var vazio V
+		return vazio, false
+	}
+	c.ordem.MoveToFront(e)
+	return e.Value.(*entradaCache[V]).valor, true
+}
+
+// Set registra o valor da chave, descartando a menos usada se o cache
+// estiver cheio.
+func (c *cacheLRU[V]) Set(chave string, valor V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entradas[chave]; ok {
+		e.Value.(*entradaCache[V]).valor = valor
+		c.ordem.MoveToFront(e)
+		return
+	}
+
+	c.entradas[chave] = c.ordem.PushFront(&entradaCache[V]{chave: chave, valor: valor})
+	if c.ordem.Len() > c.max {
+		antiga := c.ordem.Back()
+		c.ordem.Remove(antiga)
+		delete(c.entradas, antiga.Value.(*entradaCache[V]).chave)
+	}
+}
+
+// Remove descarta a chave do cache, usado para entradas já vencidas.
+func (c *cacheLRU[V]) Remove(chave string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entradas[chave]; ok {
+		c.ordem.Remove(e)
+		delete(c.entradas, chave)
+	}
+}
+
+func (c *cacheLRU[V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ordem.Len()
+}
+
+// copia devolve as entradas do cache para gravação em disco.
+func (c *cacheLRU[V]) copia() map[string]V {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entradas := make(map[string]V, len(c.entradas))
+	for chave, e := range c.entradas {
+		entradas[chave] = e.Value.(*entradaCache[V]).valor
+	}
+	return entradas
+}
+
+// carregarCache lê o cache de CNPJs processados de caminho, descartando as
+// entradas mais antigas que ttl. As entradas são inseridas da mais antiga
+// para a mais recente, de modo que um arquivo maior que o limite do cache
+// mantenha as consultas mais recentes. Um arquivo inexistente não é erro.
+func carregarCache(caminho string, ttl time.Duration) error {
+	dados, err := os.ReadFile(caminho)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entradas map[string]time.Time
+	if err := json.Unmarshal(dados, &entradas); err != nil {
+		return err
+	}
+
+	cnpjs := make([]string, 0, len(entradas))
+	for cnpj, processado := range entradas {
+		if time.Since(processado) < ttl {
+			cnpjs = append(cnpjs, cnpj)
+		}
+	}
+	sort.Slice(cnpjs, func(i, j int) bool {
+		return entradas[cnpjs[i]].Before(entradas[cnpjs[j]])
+	})
+	for _, cnpj := range cnpjs {
+		processedCNPJs.Set(cnpj, entradas[cnpj])
+	}
+	return nil
+}
+
+// salvarCache grava o cache de CNPJs processados em caminho.
+func salvarCache(caminho string) error {
+	dados, err := json.Marshal(processedCNPJs.copia())
+	if err != nil {
+		return err
+	}
+	return gravarAtomicamente(caminho, dados)
+}
+
+// gravarAtomicamente grava dados em caminho. A escrita é feita em um
+// arquivo temporário renomeado ao final, para que uma falha no meio da
+// gravação não corrompa o conteúdo anterior.
+func gravarAtomicamente(caminho string, dados []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(caminho), filepath.Base(caminho)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(dados); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), caminho)
+}
+
+// salvarCachePeriodicamente grava o cache em disco a cada intervaloSalvarCache.
+func salvarCachePeriodicamente(caminho string) {
+	ticker := time.NewTicker(intervaloSalvarCache)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := salvarCache(caminho); err != nil {
+			slog.Error("Erro ao salvar cache", "event", "cache_save_failed", "path", caminho, "error", err)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCacheArquivoIdaEVolta(t *testing.T) {
+	usarAmbienteTeste(t, &provedorFalso{})
+	caminho := filepath.Join(t.TempDir(), "cache.json")
+	recente := time.Now().Add(-10 * time.Minute).Round(0)
+	antigo := time.Now().Add(-30 * time.Minute).Round(0)
+	processedCNPJs.Set("11222333000181", recente)
+	processedCNPJs.Set("19131243000197", antigo)
+
+	if err := salvarCache(caminho); err != nil {
+		t.Fatalf("salvarCache: %v", err)
+	}
+	processedCNPJs = novoCacheLRU[time.Time](maxEntradasCachePadrao)
+	if err := carregarCache(caminho, time.Hour); err != nil {
+		t.Fatalf("carregarCache: %v", err)
+	}
+
+	if n := processedCNPJs.Len(); n != 2 {
+		t.Fatalf("%d CNPJs carregados, quer 2", n)
+	}
+	for cnpj, want := range map[string]time.Time{"11222333000181": recente, "19131243000197": antigo} {
+		if got, _ := processedCNPJs.Get(cnpj); !got.Equal(want) {
+			t.Errorf("%s: processado em %v, quer %v", cnpj, got, want)
+		}
+	}
+}
+
+func TestCarregarCacheDescartaVencidos(t *testing.T) {
+	usarAmbienteTeste(t, &provedorFalso{})
+	caminho := filepath.Join(t.TempDir(), "cache.json")
+	processedCNPJs.Set("11222333000181", time.Now().Add(-time.Hour))
+	processedCNPJs.Set("19131243000197", time.Now().Add(-3*time.Hour))
+	if err := salvarCache(caminho); err != nil {
+		t.Fatalf("salvarCache: %v", err)
+	}
+
+	processedCNPJs = novoCacheLRU[time.Time](maxEntradasCachePadrao)
+	if err := carregarCache(caminho, 2*time.Hour); err != nil {
+		t.Fatalf("carregarCache: %v", err)
+	}
+	if _, ok := processedCNPJs.Get("11222333000181"); !ok {
+		t.Error("CNPJ dentro da janela não foi carregado")
+	}
+	if _, ok := processedCNPJs.Get("19131243000197"); ok {
+		t.Error("CNPJ fora da janela foi carregado")
+	}
+}
+
+func TestCarregarCacheArquivo(t *testing.T) {
+	usarAmbienteTeste(t, &provedorFalso{})
+	dir := t.TempDir()
+	if err := carregarCache(filepath.Join(dir, "inexistente.json"), time.Hour); err != nil {
+		t.Errorf("arquivo inexistente: %v, quer nil", err)
+	}
+
+	corrompido := filepath.Join(dir, "corrompido.json")
+	if err := os.WriteFile(corrompido, []byte("{nao e json"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := carregarCache(corrompido, time.Hour); err == nil {
+		t.Error("arquivo corrompido carregado sem erro")
+	}
+}
+
+func TestCacheLRUDescartaMenosUsado(t *testing.T) {
+	instante := func(s int) time.Time { return time.Unix(int64(s), 0) }
+	c := novoCacheLRU[time.Time](3)
+	c.Set("a", instante(1))
+	c.Set("b", instante(2))
+	c.Set("c", instante(3))
+	c.Get("a")               // "b" passa a ser o menos usado
+	c.Set("c", instante(30)) // atualizar também conta como uso
+	c.Set("d", instante(4))
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("b, o menos usado, continua no cache cheio")
+	}
+	for chave, want := range map[string]time.Time{"a": instante(1), "c": instante(30), "d": instante(4)} {
+		if got, ok := c.Get(chave); !ok || !got.Equal(want) {
+			t.Errorf("Get(%q) = %v, %v; quer %v", chave, got, ok, want)
+		}
+	}
+	if n := c.Len(); n != 3 {
+		t.Errorf("Len = %d, quer 3", n)
+	}
+	c.Remove("a")
+	if _, ok := c.Get("a"); ok || c.Len() != 2 {
+		t.Errorf("Remove não descartou a chave: Len = %d", c.Len())
+	}
+}
+
+func TestEmCacheComTTL(t *testing.T) {
+	usarAmbienteTeste(t, &provedorFalso{})
+	processedCNPJs = novoCacheLRU[time.Time](2)
+	processedCNPJs.Set("recente", time.Now().Add(-time.Minute))
+	processedCNPJs.Set("vencido", time.Now().Add(-3*time.Hour))
+
+	if !emCache("recente", 2*time.Hour) {
+		t.Error("CNPJ dentro do TTL fora do cache")
+	}
+	// Uma entrada vencida é descartada na consulta, abrindo espaço no cache
+	if emCache("vencido", 2*time.Hour) {
+		t.Error("CNPJ vencido dado como em cache")
+	}
+	if n := processedCNPJs.Len(); n != 1 {
+		t.Errorf("Len = %d, quer 1 depois de descartar o vencido", n)
+	}
+	processedCNPJs.Set("novo", time.Now())
+	if !emCache("recente", 2*time.Hour) || !emCache("novo", 2*time.Hour) {
+		t.Error("entradas válidas descartadas ao inserir no espaço do vencido")
+	}
+	if emCache("ausente", 2*time.Hour) {
+		t.Error("CNPJ nunca consultado dado como em cache")
+	}
+}
+
+func TestCarregarCacheMantemMaisRecentes(t *testing.T) {
+	usarAmbienteTeste(t, &provedorFalso{})
+	caminho := filepath.Join(t.TempDir(), "cache.json")
+	for i, cnpj := range []string{"antigo", "medio", "recente"} {
+		processedCNPJs.Set(cnpj, time.Now().Add(-time.Duration(3-i)*time.Minute))
+	}
+	if err := salvarCache(caminho); err != nil {
+		t.Fatal(err)
+	}
+
+	// Um arquivo maior que o limite mantém as consultas mais recentes
+	processedCNPJs = novoCacheLRU[time.Time](2)
+	if err := carregarCache(caminho, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := processedCNPJs.Get("antigo"); ok || processedCNPJs.Len() != 2 {
+		t.Errorf("cache carregado com %d entradas, incluindo a mais antiga = %v", processedCNPJs.Len(), ok)
+	}
+}
+
+func TestUploadSemCache(t *testing.T) {
+	cacheado, novo := cnpjTeste("112223330001"), cnpjTeste("191312430001")
+	p := &provedorFalso{empresas: map[string]Empresa{cacheado: empresaTeste("A"), novo: empresaTeste("B")}}
+	usarAmbienteTeste(t, p)
+	consultadoEm := time.Now().Add(-10 * time.Minute).Round(0)
+	processedCNPJs.Set(cacheado, consultadoEm)
+
+	enviar := func(campos map[string]string, cnpjs ...string) []string {
+		t.Helper()
+		var entrada strings.Builder
+		for _, cnpj := range cnpjs {
+			entrada.WriteString(linhaReceita(cnpj, "", "", ""))
+		}
+		rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", campos, arquivoTeste{"entrada.csv", entrada.String()})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("/upload: %s", mensagemErro(rec))
+		}
+		cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+		return coluna(t, cabecalho, linhas, "CNPJ")
+	}
+
+	if got := enviar(nil, cacheado); len(got) != 0 || p.totalConsultas() != 0 {
+		t.Fatalf("sem no_cache: saída %v, %d consultas; quer o CNPJ pulado pelo cache", got, p.totalConsultas())
+	}
+	got := enviar(map[string]string{"no_cache": "1", "ordered": "1"}, cacheado, novo)
+	if !slices.Equal(got, []string{cacheado, novo}) || p.consultas[cacheado] != 1 {
+		t.Errorf("com no_cache: saída %v, %d consultas do CNPJ em cache; quer consultado de novo", got, p.consultas[cacheado])
+	}
+
+	// O cache dos demais jobs continua como estava
+	if em, ok := processedCNPJs.Get(cacheado); !ok || !em.Equal(consultadoEm) {
+		t.Errorf("entrada do cache = %v, %v; quer a original %v", em, ok, consultadoEm)
+	}
+	if _, ok := processedCNPJs.Get(novo); ok {
+		t.Error("CNPJ consultado com no_cache entrou no cache")
+	}
+	if got := enviar(nil, cacheado); len(got) != 0 || p.consultas[cacheado] != 1 {
+		t.Errorf("depois do no_cache: saída %v; quer o CNPJ ainda pulado pelo cache", got)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// parseCapital interpreta um capital social escrito como número ou texto,
+// como "1250000.5", "1.250.000,00" ou "R$ 1.250.000,00". Símbolos de moeda
+// e separadores de milhar são descartados; a vírgula é o separador decimal
+// da notação brasileira. Um ponto isolado seguido de exatamente três dígitos
+// ("1.250") também é lido como separador de milhar.
+func parseCapital(valor string) (float64, error) {
+	limpo := strings.NewReplacer("R$", "", " ", "", "\u00a0", "").Replace(strings.TrimSpace(valor))
+
+	virgula := strings.LastIndex(limpo, ",")
+	ponto := strings.LastIndex(limpo, ".")
+	switch {
+	case virgula >= 0 && virgula > ponto:
+		// 1.250.000,00: pontos de milhar e vírgula decimal
+		limpo = strings.ReplaceAll(limpo[:virgula], ".", "") + "." + limpo[virgula+1:]
+	case virgula >= 0:
+		// 1,250,000.00: vírgulas de milhar e ponto decimal
+		limpo = strings.ReplaceAll(limpo, ",", "")
+	case strings.Count(limpo, ".") > 1 || (ponto >= 0 && len(limpo)-ponto-1 == 3):
+		limpo = strings.ReplaceAll(limpo, ".", "")
+	}
+
+	capital, err := strconv.ParseFloat(limpo, 64)
+	if err != nil || capital < 0 || math.IsNaN(capital) || math.IsInf(capital, 0) {
+		return 0, fmt.Errorf("capital social inválido: %q", valor)
+	}
+	return capital, nil
+}
+
+// Modos do filtro de capital social (campo capital_modo): acima do mínimo,
+// como sempre foi, apenas capital zero ou sem filtro de capital.
+const (
+	capitalModoMaior     = "maior"
+	capitalModoIgualZero = "igual_zero"
+	capitalModoTodos     = "todos"
+)
+
+// parseCapitalModo valida o campo capital_modo; vazio é capitalModoMaior.
+func parseCapitalModo(valor string) (string, error) {
+	switch modo := strings.ToLower(strings.TrimSpace(valor)); modo {
+	case "":
+		return capitalModoMaior, nil
+	case capitalModoMaior, capitalModoIgualZero, capitalModoTodos:
+		return modo, nil
+	}
+	return "", fmt.Errorf("capital_modo inválido: %q (use maior, igual_zero ou todos)", valor)
+}
+
+// capitalAtende aplica o filtro de capital social do modo. Em
+// capitalModoIgualZero só passam as empresas com capital zero, que inclui
+// o capital ausente ou null na resposta; um capital ilegível falha a
+// consulta em capitalJSON e nunca chega aqui como zero.
+func capitalAtende(capital float64, modo string, capitalMinimo, capitalMaximo float64) bool {
+	switch modo {
+	case capitalModoIgualZero:
+		return capital == 0
+	case capitalModoTodos:
+		return true
+	}
+	return dentroDaFaixa(capital, capitalMinimo, capitalMaximo)
+}
+
+// capitalJSON é um capital social da API, aceito tanto como número quanto
+// como texto no formato de parseCapital. Vazio ou null resultam em zero.
+type capitalJSON float64
+
+func (c *capitalJSON) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if string(b) == "null" {
+		*c = 0
+		return nil
+	}
+
+	// Números JSON não passam pela heurística de separadores de parseCapital
+	if len(b) == 0 || b[0] != '"' {
+		var capital float64
+		if err := json.Unmarshal(b, &capital); err != nil {
+			return err
+		}
+		*c = capitalJSON(capital)
+		return nil
+	}
+
+	var texto string
+	if err := json.Unmarshal(b, &texto); err != nil {
+		return err
+	}
+	if strings.TrimSpace(texto) == "" {
+		*c = 0
+		return nil
+	}
+
+	capital, err := parseCapital(texto)
+	if err != nil {
+		return &json.UnmarshalTypeError{Value: "string " + texto, Type: reflect.TypeOf(*c)}
+	}
+	*c = capitalJSON(capital)
+	return nil
+}
+
+// UnmarshalJSON lê uma Empresa aceitando capital_social como número ou
+// texto (ver parseCapital), para que um provedor que envie "1.250.000,00"
+// não resulte em capital zero e na empresa descartada pelo filtro.
+func (e *Empresa) UnmarshalJSON(b []byte) error {
+	type empresaJSON Empresa
+	aux := struct {
+		*empresaJSON
+		CapitalSocial capitalJSON `json:"capital_social"`
+	}{empresaJSON: (*empresaJSON)(e)}
+
+	if err := json.Unmarshal(b, &aux); err != nil {
+		return err
+	}
+	e.CapitalSocial = float64(aux.CapitalSocial)
+	return nil
+}
+
+// parsePercentil interpreta o campo top_percentile, uma porcentagem entre 0
+// e 100 aceita com ponto ou vírgula decimal; vazio ou zero grava todas as
+// empresas qualificadas.
+func parsePercentil(valor string) (float64, error) {
+	valor = strings.TrimSpace(valor)
+	if valor == "" {
+		return 0, nil
+	}
+	p, err := strconv.ParseFloat(strings.Replace(valor, ",", ".", 1), 64)
+	if err != nil || p < 0 || p > 100 || math.IsNaN(p) {
+		return 0, fmt.Errorf("top_percentile inválido: %q (use uma porcentagem entre 0 e 100)", valor)
+	}
+	return p, nil
+}
+
+// quantidadePercentil devolve quantas de n empresas formam os p% de maior
+// capital, arredondando para cima: com qualquer empresa qualificada ao menos
+// uma é gravada.
+func quantidadePercentil(n int, p float64) int {
+	if p <= 0 {
+		return n
+	}
+	return min(n, int(math.Ceil(float64(n)*p/100)))
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCapital(t *testing.T) {
+	casos := []struct {
+		valor string
+		want  float64
+	}{
+		{"1250000", 1250000},
+		{"1250000.5", 1250000.5},
+		{"1250000,50", 1250000.5},
+		{"1.250.000,00", 1250000},
+		{"R$ 1.250.000,00", 1250000},
+		{"R$1.250.000,75", 1250000.75},
+		{"R$ 1.250,00", 1250},
+		{"1,250,000.00", 1250000},
+		{"1.250.000", 1250000},
+		{"1.250", 1250},
+		{"12.5", 12.5},
+		{" 0,00 ", 0},
+	}
+	for _, c := range casos {
+		if got, err := parseCapital(c.valor); err != nil || got != c.want {
+			t.Errorf("parseCapital(%q) = %v, %v; quer %v", c.valor, got, err, c.want)
+		}
+	}
+	for _, valor := range []string{"", "R$", "abc", "-100", "1,2,3,4", "NaN", "Inf"} {
+		if got, err := parseCapital(valor); err == nil {
+			t.Errorf("parseCapital(%q) = %v, quer erro", valor, got)
+		}
+	}
+}
+
+func TestEmpresaUnmarshalCapital(t *testing.T) {
+	casos := []struct {
+		json string
+		want float64
+	}{
+		{`{"razao_social":"A","capital_social":1250000.5}`, 1250000.5},
+		{`{"razao_social":"A","capital_social":"1.250.000,50"}`, 1250000.5},
+		{`{"razao_social":"A","capital_social":"R$ 50.000,00"}`, 50000},
+		{`{"razao_social":"A","capital_social":"1000"}`, 1000},
+		{`{"razao_social":"A","capital_social":""}`, 0},
+		{`{"razao_social":"A","capital_social":null}`, 0},
+		{`{"razao_social":"A"}`, 0},
+	}
+	for _, c := range casos {
+		var e Empresa
+		if err := json.Unmarshal([]byte(c.json), &e); err != nil || e.CapitalSocial != c.want || e.RazaoSocial != "A" {
+			t.Errorf("Unmarshal(%s) = capital %v, razão %q, %v; quer %v", c.json, e.CapitalSocial, e.RazaoSocial, err, c.want)
+		}
+	}
+	var e Empresa
+	if err := json.Unmarshal([]byte(`{"capital_social":"muito"}`), &e); err == nil {
+		t.Error("capital ilegível aceito como zero")
+	}
+}
+
+func TestCapitalAtende(t *testing.T) {
+	casos := []struct {
+		capital float64
+		modo    string
+		want    bool
+	}{
+		{100000, capitalModoMaior, true},
+		{50000, capitalModoMaior, false},
+		{0, capitalModoMaior, false},
+		{0, capitalModoIgualZero, true},
+		{0.01, capitalModoIgualZero, false},
+		{100000, capitalModoIgualZero, false},
+		{0, capitalModoTodos, true},
+		{1e9, capitalModoTodos, true},
+	}
+	for _, c := range casos {
+		if got := capitalAtende(c.capital, c.modo, 50000, 0); got != c.want {
+			t.Errorf("capitalAtende(%v, %s) = %v, quer %v", c.capital, c.modo, got, c.want)
+		}
+	}
+	if _, err := parseCapitalModo("zero"); err == nil {
+		t.Error("capital_modo inválido aceito")
+	}
+}
+
+func TestUploadCapitalModo(t *testing.T) {
+	zero, ausente, pequeno, grande, ilegivel := cnpjTeste("112223330001"), cnpjTeste("191312430001"),
+		cnpjTeste("114447770001"), cnpjTeste("123456780001"), cnpjTeste("987654320001")
+	resposta := func(cnpj, razao, capital string) respostaFalsa {
+		return respostaFalsa{http.StatusOK, `{"cnpj":"` + cnpj + `","razao_social":"` + razao + `"` + capital +
+			`,"uf":"SP","descricao_situacao_cadastral":"ATIVA"}`}
+	}
+	respostas := map[string]respostaFalsa{
+		"/mr/" + zero:     resposta(zero, "ZERO", `,"capital_social":0`),
+		"/mr/" + ausente:  resposta(ausente, "AUSENTE", ""),
+		"/mr/" + pequeno:  resposta(pequeno, "PEQUENO", `,"capital_social":1000`),
+		"/mr/" + grande:   resposta(grande, "GRANDE", `,"capital_social":"R$ 100.000,00"`),
+		"/mr/" + ilegivel: resposta(ilegivel, "ILEGIVEL", `,"capital_social":"abc"`),
+	}
+	var entrada strings.Builder
+	for _, cnpj := range []string{zero, ausente, pequeno, grande, ilegivel} {
+		entrada.WriteString(linhaReceita(cnpj, "", "", ""))
+	}
+
+	for modo, want := range map[string][]string{
+		"":           {"GRANDE"},
+		"igual_zero": {"AUSENTE", "ZERO"},
+		"todos":      {"AUSENTE", "GRANDE", "PEQUENO", "ZERO"},
+	} {
+		t.Run("modo "+modo, func(t *testing.T) {
+			transporte := &transporteFalso{respostas: respostas}
+			usarAmbienteTeste(t, minhaReceita{baseURL: "http://minhareceita.teste/mr", cliente: &http.Client{Transport: transporte}})
+
+			rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", map[string]string{"capital_modo": modo},
+				arquivoTeste{"entrada.csv", entrada.String()})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("/upload: %s", mensagemErro(rec))
+			}
+			cabecalho, linhas := lerSaidaCSV(t, lerArquivoSaida(t, "empresas_"))
+			got := coluna(t, cabecalho, linhas, "RazaoSocial")
+			slices.Sort(got)
+			if !slices.Equal(got, want) {
+				t.Errorf("empresas gravadas = %v, quer %v", got, want)
+			}
+
+			// O capital ilegível é falha da consulta, não capital zero
+			caminhos, _ := filepath.Glob(filepath.Join(diretorioSaida, "*_erros.csv"))
+			if len(caminhos) != 1 {
+				t.Fatalf("arquivos de erros = %v, quer 1", caminhos)
+			}
+			dados, err := os.ReadFile(caminhos[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, erros := lerSaidaCSV(t, string(dados)); len(erros) != 1 || erros[0][0] != ilegivel || erros[0][1] != motivoParse {
+				t.Errorf("erros = %q, quer só %s com %s", erros, ilegivel, motivoParse)
+			}
+		})
+	}
+
+	usarAmbienteTeste(t, &provedorFalso{})
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"capital_modo": "zero"},
+		arquivoTeste{"entrada.csv", entrada.String()})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("capital_modo inválido: status = %d, quer 400", rec.Code)
+	}
+}
+
+func TestQuantidadePercentil(t *testing.T) {
+	casos := []struct {
+		n    int
+		p    float64
+		want int
+	}{
+		{10, 30, 3},
+		{10, 25, 3}, // arredonda para cima
+		{3, 1, 1},
+		{10, 100, 10},
+		{10, 0, 10},
+		{0, 50, 0},
+	}
+	for _, c := range casos {
+		if got := quantidadePercentil(c.n, c.p); got != c.want {
+			t.Errorf("quantidadePercentil(%d, %v) = %d, quer %d", c.n, c.p, got, c.want)
+		}
+	}
+	if p, err := parsePercentil(" 12,5 "); err != nil || p != 12.5 {
+		t.Errorf("parsePercentil(12,5) = %v, %v", p, err)
+	}
+	for _, valor := range []string{"-1", "101", "NaN", "dez"} {
+		if _, err := parsePercentil(valor); err == nil {
+			t.Errorf("parsePercentil(%q) aceito", valor)
+		}
+	}
+}
+
+func TestUploadTopPercentil(t *testing.T) {
+	cnpjs := cnpjsTeste(11)
+	empresas := make(map[string]Empresa, len(cnpjs))
+	var entrada strings.Builder
+	for i, cnpj := range cnpjs {
+		e := empresaTeste(fmt.Sprintf("EMPRESA %02d", i))
+		e.CapitalSocial = float64(100000 * (i + 1))
+		empresas[cnpj] = e
+		entrada.WriteString(linhaReceita(cnpj, "", "", ""))
+	}
+	// Empate com a maior, chegando antes dela, e uma fora do filtro de capital
+	empate := empresas[cnpjs[0]]
+	empate.CapitalSocial = 1000000
+	empresas[cnpjs[0]] = empate
+	pequena := empresas[cnpjs[10]]
+	pequena.CapitalSocial = 1000
+	empresas[cnpjs[10]] = pequena
+	usarAmbienteTeste(t, &provedorFalso{empresas: empresas})
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", map[string]string{"top_percentile": "30", "ordered": "1"},
+		arquivoTeste{"entrada.csv", entrada.String()})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	if !strings.Contains(rec.Body.String(), "qualificadas não gravadas: 7<") {
+		t.Errorf("resumo sem as 7 empresas fora do percentil:\n%s", rec.Body.String())
+	}
+	cabecalho, linhas := lerSaidaCSV(t, lerArquivoSaida(t, "empresas_"))
+	want := []string{"EMPRESA 00", "EMPRESA 09", "EMPRESA 08"}
+	if got := coluna(t, cabecalho, linhas, "RazaoSocial"); !slices.Equal(got, want) {
+		t.Errorf("empresas gravadas = %v, quer as 30%% de maior capital %v", got, want)
+	}
+
+	rec = enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"top_percentile": "30", "limit": "2"},
+		arquivoTeste{"entrada.csv", entrada.String()})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("top_percentile com limit: status = %d, quer 400", rec.Code)
+	}
+}
+
+// provedorRetendoUm responde na hora a todos os CNPJs menos retido, que
+// espera liberar ser fechado.
+type provedorRetendoUm struct {
+	provedorRetido
+	retido string
+}
+
+func (p *provedorRetendoUm) Consultar(ctx context.Context, cnpj string) (*Empresa, error) {
+	if cnpj == p.retido {
+		return p.provedorRetido.Consultar(ctx, cnpj)
+	}
+	return p.provedorFalso.Consultar(ctx, cnpj)
+}
+
+func TestTopPercentilInformaRetidas(t *testing.T) {
+	cnpjs := cnpjsTeste(4)
+	p := &provedorRetendoUm{provedorRetido: provedorRetido{provedorFalso: provedorFalso{empresas: map[string]Empresa{}}, liberar: make(chan struct{})}, retido: cnpjs[3]}
+	var entrada strings.Builder
+	for _, cnpj := range cnpjs {
+		p.empresas[cnpj] = empresaTeste("EMPRESA")
+		entrada.WriteString(linhaReceita(cnpj, "", "", ""))
+	}
+	usarAmbienteTeste(t, p)
+
+	rec := enviarFormulario(t, uploadHandler, "/upload", map[string]string{"top_percentile": "50"}, arquivoTeste{"entrada.csv", entrada.String()})
+	if rec.Code != http.StatusAccepted {
+		close(p.liberar)
+		t.Fatalf("/upload: %s, quer 202", mensagemErro(rec))
+	}
+	id := rec.Header().Get("X-Job-ID")
+
+	// As três empresas já consultadas aparecem como retidas, não encontradas
+	var job Job
+	for limite := time.Now().Add(5 * time.Second); job.Held < 3 && time.Now().Before(limite); time.Sleep(10 * time.Millisecond) {
+		consultarJob(t, "/jobs/"+id, &job)
+	}
+	close(p.liberar)
+	if job.Held != 3 || job.Matched != 0 {
+		t.Errorf("job em andamento = %+v, quer 3 retidas e nenhuma encontrada", job)
+	}
+
+	job = esperarJob(t, id)
+	if job.Status != statusDone || job.Held != 0 || job.Matched != 2 {
+		t.Errorf("job concluído = %+v, quer done com 2 encontradas e nenhuma retida", job)
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Registros concluídos entre duas gravações do checkpoint de um job e
+// diretório dos checkpoints; podem ser ajustados pelas variáveis de ambiente
+// JOB_CHECKPOINT_EVERY e JOB_CHECKPOINT_DIR.
+const (
+	intervaloCheckpointPadrao  = 100
+	diretorioCheckpointsPadrao = "checkpoints"
+)
+
+var (
+	intervaloCheckpoint = intervaloCheckpointPadrao
+
+	// diretorioCheckpoints guarda os checkpoints e as cópias das entradas
+	// dos jobs que podem ser retomados, definido em main; vazio desativa os
+	// checkpoints
+	diretorioCheckpoints string
+)
+
+// checkpointJob é o estado gravado em disco de um job em segundo plano, o
+// suficiente para retomá-lo depois de um reinício do servidor. Linhas é a
+// quantidade de registros da entrada, a partir do primeiro, já concluídos:
+// todos foram gravados na saída ou no arquivo de erros, ou descartados.
+type checkpointJob struct {
+	ID          string     `json:"id"`
+	Filename    string     `json:"filename"`
+	Entrada     string     `json:"input"`
+	Saida       string     `json:"output"`
+	Reprocessar bool       `json:"reprocess,omitempty"`
+	Campos      url.Values `json:"fields"`
+	Linhas      int64      `json:"rows_done"`
+	IniciadoEm  time.Time  `json:"started_at"`
+	Atualizado  time.Time  `json:"updated_at"`
+
+	mu sync.Mutex
+}
+
+var (
+	// checkpointsRetomaveis são os jobs interrompidos encontrados em disco
+	// na inicialização, à espera de POST /jobs/{id}/resume
+	checkpointsRetomaveis = make(map[string]*checkpointJob)
+	checkpointsMutex      sync.Mutex
+)
+
+// linhasJob acompanha quais registros da entrada de um job já foram
+// concluídos. Os registros são enviados aos workers em ordem e concluídos
+// fora de ordem; lidos conta os registros lidos e pendentes guarda os que
+// foram para os workers e ainda não terminaram. Os métodos aceitam um
+// *linhasJob nil, que não acompanha nada.
+type linhasJob struct {
+	mu        sync.Mutex
+	lidos     int64
+	pendentes map[int64]struct{}
+
+	// aoAvancar, quando definido, recebe a quantidade de registros
+	// concluídos em sequência sempre que ela muda
+	aoAvancar func(concluidos int64)
+}
+
+// novasLinhasJob acompanha um job cujos primeiros inicio registros já foram
+// concluídos.
+func novasLinhasJob(inicio int64) *linhasJob {
+	return &linhasJob{lidos: inicio, pendentes: make(map[int64]struct{})}
+}
+
+// lido registra que todos os registros antes de linha já foram lidos e,
+// se não foram para os workers, concluídos.
+func (l *linhasJob) lido(linha int64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lidos = linha
+	l.avancar()
+}
+
+// iniciar registra o envio do registro linha aos workers.
+func (l *linhasJob) iniciar(linha int64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.pendentes[linha] = struct{}{}
+}
+
+// concluir registra o fim do registro linha. Registros com empresa a gravar
+// só são concluídos depois da escrita na saída.
+func (l *linhasJob) concluir(linha int64) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.pendentes, linha)
+	l.avancar()
+}
+
+// concluidas devolve a quantidade de registros, a partir do primeiro, já
+// concluídos; é também a linha do registro pendente mais antigo.
+func (l *linhasJob) concluidas() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.primeiraPendente()
+}
+
+func (l *linhasJob) primeiraPendente() int64 {
+	concluidos := l.lidos
+	for linha := range l.pendentes {
+		concluidos = min(concluidos, linha)
+	}
+	return concluidos
+}
+
+// avancar avisa aoAvancar; deve ser chamado com l.mu travado.
+func (l *linhasJob) avancar() {
+	if l.aoAvancar != nil {
+		l.aoAvancar(l.primeiraPendente())
+	}
+}
+
+// caminhoCheckpoint devolve o arquivo do checkpoint do job id.
+func caminhoCheckpoint(id string) string {
+	return filepath.Join(diretorioCheckpoints, id+".json")
+}
+
+// novoCheckpoint cria e grava o checkpoint de um job que começa após
+// linhas.concluidas() registros já concluídos, substituindo o checkpoint
+// retomável de mesmo ID. O checkpoint é gravado de novo conforme linhas
+// avança.
+func novoCheckpoint(id, filename, entrada, saida string, reprocessar bool, campos url.Values, linhas *linhasJob) *checkpointJob {
+	cp := &checkpointJob{
+		ID:          id,
+		Filename:    filename,
+		Entrada:     entrada,
+		Saida:       saida,
+		Reprocessar: reprocessar,
+		Campos:      campos,
+		Linhas:      linhas.concluidas(),
+		IniciadoEm:  time.Now(),
+	}
+
+	checkpointsMutex.Lock()
+	delete(checkpointsRetomaveis, id)
+	checkpointsMutex.Unlock()
+
+	cp.mu.Lock()
+	cp.salvar()
+	cp.mu.Unlock()
+	linhas.aoAvancar = cp.avancar
+	return cp
+}
+
+// avancar grava o checkpoint quando a quantidade de registros concluídos
+// em sequência cresceu intervaloCheckpoint desde a última gravação.
+func (cp *checkpointJob) avancar(concluidos int64) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if concluidos-cp.Linhas < int64(intervaloCheckpoint) {
+		return
+	}
+	cp.Linhas = concluidos
+	cp.salvar()
+}
+
+// salvar grava o checkpoint em disco; falhas são apenas registradas no
+// log, pois o job continua mesmo sem poder ser retomado. Deve ser chamado
+// com cp.mu travado.
+func (cp *checkpointJob) salvar() {
+	cp.Atualizado = time.Now()
+	dados, err := json.Marshal(cp)
+	if err == nil {
+		err = gravarAtomicamente(caminhoCheckpoint(cp.ID), dados)
+	}
+	if err != nil {
+		slog.Error("Erro ao gravar o checkpoint do job", "event", "checkpoint_save_failed", "job_id", cp.ID, "error", err)
+	}
+}
+
+// encerrar conclui o checkpoint ao fim do job. Interrompido pelo
+// encerramento do servidor, o job mantém o checkpoint e a cópia da entrada
+// para ser retomado; nas demais situações ambos são removidos.
+func (cp *checkpointJob) encerrar(status string) {
+	if cp == nil {
+		return
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if status == statusInterrupted {
+		cp.salvar()
+		slog.Info("Checkpoint mantido para retomar o job", "event", "checkpoint_kept", "job_id", cp.ID, "rows_done", cp.Linhas)
+		return
+	}
+	os.Remove(caminhoCheckpoint(cp.ID))
+	os.Remove(cp.Entrada)
+}
+
+// carregarCheckpoints lê os checkpoints deixados por uma execução anterior
+// do servidor e lista cada job em /jobs como interrompido e retomável.
+// Checkpoints ilegíveis ou sem a cópia da entrada são ignorados.
+func carregarCheckpoints() error {
+	arquivos, err := filepath.Glob(filepath.Join(diretorioCheckpoints, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, arquivo := range arquivos {
+		dados, err := os.ReadFile(arquivo)
+		if err != nil {
+			return err
+		}
+		cp := &checkpointJob{}
+		if err := json.Unmarshal(dados, cp); err != nil || !jobIDValido.MatchString(cp.ID) {
+			slog.Warn("Checkpoint ilegível ignorado", "event", "checkpoint_invalid", "path", arquivo, "error", err)
+			continue
+		}
+		if _, err := os.Stat(cp.Entrada); err != nil {
+			slog.Warn("Checkpoint sem a cópia da entrada ignorado", "event", "checkpoint_invalid", "path", arquivo, "error", err)
+			continue
+		}
+
+		checkpointsMutex.Lock()
+		checkpointsRetomaveis[cp.ID] = cp
+		checkpointsMutex.Unlock()
+		registrarJobRetomavel(cp)
+		slog.Info("Job interrompido pode ser retomado", "event", "job_resumable", "job_id", cp.ID,
+			"filename", cp.Filename, "rows_done", cp.Linhas)
+	}
+	return nil
+}
+
+// retomarJobHandler responde POST /jobs/{id}/resume retomando um job
+// interrompido por um reinício do servidor. O job repete os campos do
+// envio original, pula os registros já concluídos e acrescenta as empresas
+// ao mesmo arquivo de saída, como append_to; registros gravados depois do
+// último checkpoint não são gravados de novo.
+func retomarJobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	checkpointsMutex.Lock()
+	cp := checkpointsRetomaveis[r.PathValue("id")]
+	checkpointsMutex.Unlock()
+	if cp == nil {
+		http.Error(w, "Job não encontrado ou não retomável", http.StatusNotFound)
+		return
+	}
+
+	campos := make(url.Values, len(cp.Campos))
+	for campo, valores := range cp.Campos {
+		campos[campo] = append([]string(nil), valores...)
+	}
+	campos.Set("job_id", cp.ID)
+	campos.Set("append_to", cp.Saida)
+	campos.Del("dry_run")
+
+	// Com o formulário já preenchido, ParseMultipartForm em processarUpload
+	// não lê o corpo; sem query o job segue em segundo plano
+	r.Form, r.PostForm = campos, campos
+	r.MultipartForm = &multipart.Form{}
+	r.URL.RawQuery = ""
+	processarUpload(w, r, cp.Reprocessar, func(*http.Request) ([]entradaJob, error) {
+		file, err := os.Open(cp.Entrada)
+		if err != nil {
+			return nil, err
+		}
+		return []entradaJob{{nome: cp.Filename, conteudo: file, independente: true, caminho: cp.Entrada, retomarDe: cp.Linhas}}, nil
+	})
+}
+
+// camposCheckpoint copia os campos do formulário a repetir na retomada,
+// sem os parâmetros de query que valem só para a requisição original.
+func camposCheckpoint(r *http.Request) url.Values {
+	campos := make(url.Values)
+	for campo, valores := range r.Form {
+		if campo == "inline" || campo == "wait" {
+			continue
+		}
+		campos[campo] = append([]string(nil), valores...)
+	}
+	return campos
+}
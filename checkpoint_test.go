@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetomarJobAposReinicio(t *testing.T) {
+	cnpjs := cnpjsTeste(12)
+	empresas := make(map[string]Empresa, len(cnpjs))
+	var entrada strings.Builder
+	for _, cnpj := range cnpjs {
+		entrada.WriteString(linhaReceita(cnpj, "", "", ""))
+		empresas[cnpj] = empresaTeste("EMPRESA " + cnpj)
+	}
+	// O servidor "cai" ao receber a consulta do quinto registro
+	p := &provedorInterrompido{provedorFalso: provedorFalso{empresas: empresas}, apos: 4}
+	usarAmbienteTeste(t, p)
+	contextoAnterior, diretorioAnterior, intervaloAnterior := contextoJobs, diretorioCheckpoints, intervaloCheckpoint
+	t.Cleanup(func() {
+		contextoJobs, diretorioCheckpoints, intervaloCheckpoint = contextoAnterior, diretorioAnterior, intervaloAnterior
+	})
+	contextoJobs, p.cancelar = context.WithCancel(context.Background())
+	diretorioCheckpoints = t.TempDir()
+	intervaloCheckpoint = 1
+
+	rec := enviarFormulario(t, uploadHandler, "/upload", map[string]string{"workers": "1"},
+		arquivoTeste{"entrada.csv", entrada.String()})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("/upload: %s, quer 202", mensagemErro(rec))
+	}
+	id := rec.Header().Get("X-Job-ID")
+	if job := esperarJob(t, id); job.Status != statusInterrupted {
+		t.Fatalf("status = %q, quer %q", job.Status, statusInterrupted)
+	}
+
+	dados, err := os.ReadFile(caminhoCheckpoint(id))
+	if err != nil {
+		t.Fatalf("checkpoint não mantido: %v", err)
+	}
+	var cp checkpointJob
+	if err := json.Unmarshal(dados, &cp); err != nil {
+		t.Fatal(err)
+	}
+	cabecalho, linhas := lerSaidaCSV(t, lerArquivoSaida(t, "empresas_"))
+	antes := coluna(t, cabecalho, linhas, "CNPJ")
+	if cp.Linhas == 0 || cp.Linhas >= int64(len(cnpjs)) || cp.Linhas != int64(len(antes)) {
+		t.Fatalf("checkpoint em %d registros com %d gravados, quer um ponto no meio da entrada", cp.Linhas, len(antes))
+	}
+
+	// Reinício: o servidor volta com o cache vazio e lê os checkpoints
+	novo := &provedorFalso{empresas: empresas}
+	provedorCNPJ = novo
+	processedCNPJs = novoCacheLRU[time.Time](maxEntradasCachePadrao)
+	contextoJobs = context.Background()
+	if err := carregarCheckpoints(); err != nil {
+		t.Fatalf("carregarCheckpoints: %v", err)
+	}
+	var listado Job
+	consultarJob(t, "/jobs/"+id, &listado)
+	if !listado.Resumable || listado.Processed != cp.Linhas {
+		t.Errorf("job listado = %+v, quer retomável com %d registros", listado, cp.Linhas)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs/{id}/resume", retomarJobHandler)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/jobs/"+id+"/resume", nil))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("resume: %s, quer 202", mensagemErro(rec))
+	}
+	if job := esperarJob(t, id); job.Status != statusDone {
+		t.Fatalf("status após retomar = %q, quer %q", job.Status, statusDone)
+	}
+
+	// Nenhum registro consultado de novo e nenhum pulado
+	if n := novo.totalConsultas(); n != len(cnpjs)-len(antes) {
+		t.Errorf("%d consultas após retomar, quer %d", n, len(cnpjs)-len(antes))
+	}
+	cabecalho, linhas = lerSaidaCSV(t, lerArquivoSaida(t, "empresas_"))
+	if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, cnpjs) {
+		t.Errorf("CNPJs na saída = %v, quer cada um uma vez, na ordem da entrada", got)
+	}
+	if _, err := os.Stat(caminhoCheckpoint(id)); !os.IsNotExist(err) {
+		t.Errorf("checkpoint do job concluído não removido: %v", err)
+	}
+
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/jobs/"+id+"/resume", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("segunda retomada: status = %d, quer 404", rec.Code)
+	}
+}
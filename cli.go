@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// opcoesCLI são as flags da linha de comando. Com -input o programa
+// processa o arquivo e termina, sem iniciar o servidor HTTP.
+type opcoesCLI struct {
+	Input          string
+	Output         string
+	Formato        string
+	Encoding       string
+	Delimitador    string
+	Comentario     string
+	AspasFlexiveis bool
+	CapitalMinimo  float64
+	CapitalMaximo  float64
+	RPS            string
+	Workers        string
+	SomenteAtivas  bool
+	BOM            bool
+	UFs            string
+	CNAEs          string
+}
+
+// parseFlagsCLI interpreta os argumentos da linha de comando.
+func parseFlagsCLI(args []string) (opcoesCLI, error) {
+	var o opcoesCLI
+	fs := flag.NewFlagSet("busca_empresas", flag.ContinueOnError)
+	fs.StringVar(&o.Input, "input", "", "CSV de entrada; quando informado, processa o arquivo sem iniciar o servidor")
+	fs.StringVar(&o.Output, "output", "", "arquivo de saída (padrão: nome gerado como no servidor)")
+	fs.StringVar(&o.Formato, "format", formatoCSV, "formato de saída: csv, jsonl ou xlsx")
+	fs.StringVar(&o.Encoding, "encoding", encodingAuto, "codificação da entrada: auto, utf-8 ou iso-8859-1")
+	fs.StringVar(&o.Delimitador, "delimiter", "", "delimitador da entrada (um caractere ou tab); vazio para detectar")
+	fs.StringVar(&o.Comentario, "comment", "", "caractere que marca linhas de comentário na entrada, como #")
+	fs.BoolVar(&o.AspasFlexiveis, "lazy-quotes", opcoesLeitorPadrao.AspasFlexiveis, "aceita aspas fora do padrão RFC 4180 na entrada")
+	// O capital aceita a notação de parseCapital, como 1.250.000,00
+	o.CapitalMinimo = capitalMinimoPadrao
+	fs.Func("capital-minimo", fmt.Sprintf("capital social mínimo (R$) (padrão %d)", capitalMinimoPadrao), func(v string) (err error) {
+		o.CapitalMinimo, err = parseCapital(v)
+		return err
+	})
+	fs.Func("capital-maximo", "capital social máximo (R$); 0 para sem limite", func(v string) (err error) {
+		o.CapitalMaximo, err = parseCapital(v)
+		return err
+	})
+	fs.StringVar(&o.RPS, "rps", "1", "requisições por segundo à API (0.1 a 20)")
+	fs.StringVar(&o.Workers, "workers", "4", "consultas simultâneas (1 a 32)")
+	fs.BoolVar(&o.SomenteAtivas, "somente-ativas", false, "somente empresas com situação cadastral ATIVA")
+	fs.BoolVar(&o.BOM, "bom", false, "grava o CSV de saída com BOM UTF-8")
+	fs.StringVar(&o.UFs, "uf", "", "UFs aceitas, separadas por vírgula")
+	fs.StringVar(&o.CNAEs, "cnae", "", "CNAEs principais aceitos, separados por vírgula")
+	if err := fs.Parse(args); err != nil {
+		return o, err
+	}
+	if fs.NArg() > 0 {
+		return o, fmt.Errorf("argumentos inesperados: %s", strings.Join(fs.Args(), " "))
+	}
+	return o, nil
+}
+
+// executarCLI processa o arquivo de -input com o mesmo pipeline do servidor,
+// gravando a saída em -output e o CSV de erros ao lado dela.
+func executarCLI(ctx context.Context, o opcoesCLI) error {
+	if o.CapitalMaximo > 0 && o.CapitalMaximo < o.CapitalMinimo {
+		return errors.New("capital-maximo não pode ser menor que capital-minimo")
+	}
+	formato, err := parseFormatoSaida(o.Formato)
+	if err != nil {
+		return err
+	}
+	encoding, err := parseEncoding(o.Encoding)
+	if err != nil {
+		return err
+	}
+	ufs, err := parseUFs(o.UFs)
+	if err != nil {
+		return err
+	}
+	cnaes, err := parseCNAEs(o.CNAEs)
+	if err != nil {
+		return err
+	}
+
+	opcoesEntrada := opcoesLeitor{AspasFlexiveis: o.AspasFlexiveis}
+	if opcoesEntrada.Delimitador, err = parseCaractereCSV("delimiter", o.Delimitador); err != nil {
+		return err
+	}
+	if opcoesEntrada.Comentario, err = parseCaractereCSV("comment", o.Comentario); err != nil {
+		return err
+	}
+	if err := opcoesEntrada.validar(); err != nil {
+		return err
+	}
+
+	entrada, err := os.Open(o.Input)
+	if err != nil {
+		return err
+	}
+	defer entrada.Close()
+
+	reader, err := novoLeitorEntrada(o.Input, entrada, encoding, opcoesEntrada)
+	if err != nil {
+		return fmt.Errorf("%s: %w", o.Input, err)
+	}
+
+	// Um -output explícito é sobrescrito; o nome gerado nunca sobrescreve
+	// arquivos de outra execução
+	output := o.Output
+	criar := os.Create
+	if output == "" {
+		criar = criarArquivoSaida
+		output = nomeBaseSaida(camposNomeSaida{
+			Inicio:        time.Now(),
+			CapitalMinimo: o.CapitalMinimo,
+			CapitalMaximo: o.CapitalMaximo,
+			UFs:           ufs,
+			CNAEs:         cnaes,
+		}) + extensaoSaida(formato)
+		output = caminhoSaida(output)
+	}
+	saidaFile, err := criar(output)
+	if err != nil {
+		return err
+	}
+	defer saidaFile.Close()
+
+	saida := novoEscritorSaida(saidaFile, formato, opcoesSaida{BOM: o.BOM})
+	if err := saida.Cabecalho(); err != nil {
+		return err
+	}
+
+	errosFileName := nomeArquivoErros(strings.TrimSuffix(output, filepath.Ext(output)))
+	errosFile, err := criar(errosFileName)
+	if err != nil {
+		return err
+	}
+	defer errosFile.Close()
+
+	errosCSV := csv.NewWriter(errosFile)
+	if err := errosCSV.Write(cabecalhoErros); err != nil {
+		return err
+	}
+
+	limiter := newRateLimiter(parseRPS(o.RPS))
+	defer limiter.Stop()
+
+	inicio := time.Now()
+	resumo := processRecords(ctx, []*csv.Reader{reader}, saida, jobConfig{
+		CapitalMinimo: o.CapitalMinimo,
+		CapitalMaximo: o.CapitalMaximo,
+		Workers:       parseInteiroCampo(o.Workers, workersPadrao, 1, workersMaximo),
+		SomenteAtivas: o.SomenteAtivas,
+		Colunas:       mapeamentoPadrao,
+		CNAEs:         cnaes,
+		UFs:           ufs,
+		Provedor:      provedorCNPJ,
+		Limiter:       limiter,
+		CacheTTL:      cacheTTL,
+		Timeout:       timeoutConsulta,
+		ErrosCSV:      errosCSV,
+	})
+
+	if err := saida.Fechar(); err != nil {
+		return err
+	}
+	errosCSV.Flush()
+	if err := errosCSV.Error(); err != nil {
+		return err
+	}
+
+	slog.Info("Processamento finalizado", "event", "cli_finished", "input", o.Input, "output", output,
+		"errors", errosFileName, "processed", resumo.Processados.Load(), "matched", resumo.Encontradas.Load(),
+		"errors_count", resumo.Erros.Load(), "duration_ms", time.Since(inicio).Milliseconds())
+
+	if ctx.Err() != nil {
+		return errors.New("processamento interrompido; resultados parciais gravados")
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExecutarCLI(t *testing.T) {
+	ativa, baixada, pequena := cnpjTeste("112223330001"), cnpjTeste("191312430001"), cnpjTeste("114447770001")
+	semBaixa := empresaTeste("BAIXADA LTDA")
+	semBaixa.SituacaoCadastral = "BAIXADA"
+	semCapital := empresaTeste("PEQUENA LTDA")
+	semCapital.CapitalSocial = 1000
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{
+		ativa: empresaTeste("ATIVA LTDA"), baixada: semBaixa, pequena: semCapital,
+	}})
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "estabelecimentos.csv")
+	fixture := linhaReceita(ativa, "11", "32345678", "") + linhaReceita(baixada, "", "", "") +
+		linhaReceita(pequena, "", "", "") + linhaReceita(cnpjTeste("999999990001"), "", "", "")
+	if err := os.WriteFile(input, []byte(fixture), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := parseFlagsCLI([]string{"-input", input, "-output", filepath.Join(dir, "saida.csv"),
+		"-rps", "20", "-somente-ativas", "-capital-minimo", "50000"})
+	if err != nil {
+		t.Fatalf("parseFlagsCLI: %v", err)
+	}
+	if err := executarCLI(context.Background(), o); err != nil {
+		t.Fatalf("executarCLI: %v", err)
+	}
+
+	saida, err := os.ReadFile(filepath.Join(dir, "saida.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cabecalho, linhas := lerSaidaCSV(t, string(saida))
+	if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, []string{ativa}) {
+		t.Errorf("CNPJs na saída = %v, quer só a empresa ativa acima do capital", got)
+	}
+	erros, err := os.ReadFile(filepath.Join(dir, "saida_erros.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(erros), cnpjTeste("999999990001")) {
+		t.Errorf("CSV de erros sem o CNPJ não encontrado:\n%s", erros)
+	}
+}
+
+func TestParseFlagsCLI(t *testing.T) {
+	o, err := parseFlagsCLI(nil)
+	if err != nil {
+		t.Fatalf("sem argumentos: %v", err)
+	}
+	if o.Input != "" || o.CapitalMinimo != capitalMinimoPadrao || o.Formato != formatoCSV {
+		t.Errorf("padrões = %+v", o)
+	}
+	if _, err := parseFlagsCLI([]string{"-input", "a.csv", "extra"}); err == nil {
+		t.Error("argumento posicional aceito")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Configuração padrão do pool de conexões com os provedores. O limite por
+// host acompanha o máximo de workers, para que consultas simultâneas não
+// fiquem presas às 2 conexões ociosas do transporte padrão.
+const (
+	timeoutClienteHTTP       = 30 * time.Second
+	maxConexoesOciosasPadrao = 100
+	maxOciosasPorHostPadrao  = workersMaximo
+	tempoConexaoOciosaPadrao = 90 * time.Second
+)
+
+// User-Agent enviado aos provedores. O contato permite que o operador da API
+// identifique e procure quem faz muitas consultas, em vez de bloqueá-lo.
+const (
+	produtoUserAgent = "Busca_empresas_BR/1.0"
+	contatoPadrao    = "https://github.com/dilsonlima/Busca_empresas_BR"
+)
+
+// userAgent é definido na inicialização por montarUserAgent.
+var userAgent = montarUserAgent("", "")
+
+// montarUserAgent devolve o User-Agent das consultas: agente, quando
+// informado (HTTP_USER_AGENT), substitui o valor inteiro; caso contrário o
+// produto é seguido do contato (CNPJ_CONTACT), como um e-mail ou URL.
+func montarUserAgent(agente, contato string) string {
+	if agente = strings.TrimSpace(agente); agente != "" {
+		return agente
+	}
+	if contato = strings.TrimSpace(contato); contato == "" {
+		contato = contatoPadrao
+	}
+	return produtoUserAgent + " (+" + contato + ")"
+}
+
+// cabecalhoChaveAPIPadrao recebe as chaves de UPSTREAM_API_KEY e
+// BRASILAPI_API_KEY quando o cabeçalho de cada uma não está definido.
+const cabecalhoChaveAPIPadrao = "X-API-Key"
+
+// credencialAPI é uma chave de API e o cabeçalho que a leva. Vazia, nenhum
+// cabeçalho é enviado. A chave nunca vai para o log.
+type credencialAPI struct {
+	cabecalho, valor string
+}
+
+// autenticar acrescenta a chave a req.
+func (c credencialAPI) autenticar(req *http.Request) {
+	if c.valor != "" {
+		req.Header.Set(c.cabecalho, c.valor)
+	}
+}
+
+// Chaves de cada provedor, entregues por novoProvedor apenas ao provedor de
+// destino: a do minhareceita não vai para a BrasilAPI no failover, nem o
+// contrário, e os demais serviços não recebem nenhuma.
+var (
+	// chaveAPI é a chave de uma instância própria do minhareceita
+	// (UPSTREAM_API_KEY e UPSTREAM_API_KEY_HEADER)
+	chaveAPI credencialAPI
+
+	// chaveBrasilAPI é a chave de uma BrasilAPI atrás de um gateway
+	// autenticado (BRASILAPI_API_KEY e BRASILAPI_API_KEY_HEADER)
+	chaveBrasilAPI credencialAPI
+)
+
+// novaCredencial monta a credencial com a chave valor, enviada no cabeçalho
+// cabecalho ou em cabecalhoChaveAPIPadrao. Com cabecalho Authorization, valor
+// deve incluir o esquema, como "Bearer <chave>".
+func novaCredencial(valor, cabecalho string) credencialAPI {
+	c := credencialAPI{cabecalho: strings.TrimSpace(cabecalho), valor: strings.TrimSpace(valor)}
+	if c.cabecalho == "" {
+		c.cabecalho = cabecalhoChaveAPIPadrao
+	}
+	return c
+}
+
+// novoClienteHTTP monta o cliente usado nas consultas, com o pool ajustável
+// pelas variáveis HTTP_MAX_IDLE_CONNS, HTTP_MAX_IDLE_CONNS_PER_HOST e
+// HTTP_IDLE_CONN_TIMEOUT.
+func novoClienteHTTP() *http.Client {
+	transporte := http.DefaultTransport.(*http.Transport).Clone()
+	transporte.MaxIdleConns = parseInteiroCampo(os.Getenv("HTTP_MAX_IDLE_CONNS"),
+		maxConexoesOciosasPadrao, 1, math.MaxInt)
+	transporte.MaxIdleConnsPerHost = parseInteiroCampo(os.Getenv("HTTP_MAX_IDLE_CONNS_PER_HOST"),
+		maxOciosasPorHostPadrao, 1, math.MaxInt)
+	transporte.IdleConnTimeout = parseDuracao(os.Getenv("HTTP_IDLE_CONN_TIMEOUT"), tempoConexaoOciosaPadrao)
+	transporte.ForceAttemptHTTP2 = true
+
+	return &http.Client{Timeout: timeoutClienteHTTP, Transport: transporte}
+}
+
+// errDestinoInterno recusa conexões pedidas por usuários, como as de
+// /upload-url e callback_url, a endereços da rede do próprio servidor.
+var errDestinoInterno = errors.New("destino em endereço interno não permitido")
+
+// faixasNaoPublicas completam os endereços recusados por enderecoPublico
+// além de loopback, link-local (inclusive 169.254.169.254, de metadados de
+// nuvem), redes privadas e multicast.
+var faixasNaoPublicas = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // CGNAT
+	netip.MustParsePrefix("198.18.0.0/15"), // testes de desempenho
+}
+
+// enderecoPublico informa se ip é um endereço unicast da internet, que
+// pode receber as conexões pedidas pelos usuários.
+func enderecoPublico(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, faixa := range faixasNaoPublicas {
+		if faixa.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// novoClienteExterno monta um cliente para URLs informadas pelos usuários.
+// O endereço é conferido por permitir no momento da conexão, depois da
+// resolução do nome, o que vale também para redirecionamentos e para nomes
+// que resolvem para a rede interna. Sem proxy, pois com ele a conexão iria
+// ao proxy e não ao destino conferido.
+func novoClienteExterno(permitir func(netip.Addr) bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, endereco string, _ syscall.RawConn) error {
+			destino, err := netip.ParseAddrPort(endereco)
+			if err != nil || !permitir(destino.Addr()) {
+				return fmt.Errorf("%w: %s", errDestinoInterno, endereco)
+			}
+			return nil
+		},
+	}
+	transporte := http.DefaultTransport.(*http.Transport).Clone()
+	transporte.Proxy = nil
+	transporte.DialContext = dialer.DialContext
+	return &http.Client{Transport: transporte}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNovoClienteHTTP(t *testing.T) {
+	t.Setenv("HTTP_MAX_IDLE_CONNS", "")
+	t.Setenv("HTTP_MAX_IDLE_CONNS_PER_HOST", "")
+	t.Setenv("HTTP_IDLE_CONN_TIMEOUT", "")
+	c := novoClienteHTTP()
+	transporte, ok := c.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("transporte = %T, quer *http.Transport", c.Transport)
+	}
+	if c.Timeout != 30*time.Second {
+		t.Errorf("Timeout = %v, quer 30s", c.Timeout)
+	}
+	if transporte.MaxIdleConns != maxConexoesOciosasPadrao || transporte.MaxIdleConnsPerHost != workersMaximo ||
+		transporte.IdleConnTimeout != tempoConexaoOciosaPadrao || !transporte.ForceAttemptHTTP2 {
+		t.Errorf("padrões: MaxIdleConns %d, MaxIdleConnsPerHost %d, IdleConnTimeout %v, HTTP/2 %v",
+			transporte.MaxIdleConns, transporte.MaxIdleConnsPerHost, transporte.IdleConnTimeout, transporte.ForceAttemptHTTP2)
+	}
+
+	t.Setenv("HTTP_MAX_IDLE_CONNS", "64")
+	t.Setenv("HTTP_MAX_IDLE_CONNS_PER_HOST", "8")
+	t.Setenv("HTTP_IDLE_CONN_TIMEOUT", "15s")
+	transporte = novoClienteHTTP().Transport.(*http.Transport)
+	if transporte.MaxIdleConns != 64 || transporte.MaxIdleConnsPerHost != 8 || transporte.IdleConnTimeout != 15*time.Second {
+		t.Errorf("configurado: MaxIdleConns %d, MaxIdleConnsPerHost %d, IdleConnTimeout %v",
+			transporte.MaxIdleConns, transporte.MaxIdleConnsPerHost, transporte.IdleConnTimeout)
+	}
+	if http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost == 8 {
+		t.Error("novoClienteHTTP alterou o http.DefaultTransport")
+	}
+}
+
+func TestUserAgentNasConsultas(t *testing.T) {
+	anterior := userAgent
+	t.Cleanup(func() { userAgent = anterior })
+	userAgent = montarUserAgent("", "dados@empresa.com.br")
+
+	usarTentativas(t, 1)
+	transporte := &transporteFalso{respostas: map[string]respostaFalsa{
+		"/mr/11222333000181":  {http.StatusServiceUnavailable, `{}`},
+		"/api/11222333000181": {http.StatusOK, `{"cnpj":"11222333000181","razao_social":"A"}`},
+	}}
+	cliente := &http.Client{Transport: transporte}
+	p := failover{
+		primario:   minhaReceita{baseURL: "http://minhareceita.teste/mr", cliente: cliente},
+		secundario: brasilAPI{baseURL: "http://brasilapi.teste/api", cliente: cliente},
+	}
+	if _, err := p.Consultar(context.Background(), "11222333000181"); err != nil {
+		t.Fatalf("Consultar: %v", err)
+	}
+	want := produtoUserAgent + " (+dados@empresa.com.br)"
+	if got := transporte.cabecalho("User-Agent"); !slices.Equal(got, []string{want, want}) {
+		t.Errorf("User-Agent = %q, quer %q em todas as requisições", got, want)
+	}
+}
+
+func TestMontarUserAgent(t *testing.T) {
+	casos := []struct{ agente, contato, want string }{
+		{"", "", produtoUserAgent + " (+" + contatoPadrao + ")"},
+		{"", " ops@empresa.com.br ", produtoUserAgent + " (+ops@empresa.com.br)"},
+		{"MeuRobo/2.0", "ops@empresa.com.br", "MeuRobo/2.0"},
+	}
+	for _, c := range casos {
+		if got := montarUserAgent(c.agente, c.contato); got != c.want {
+			t.Errorf("montarUserAgent(%q, %q) = %q, quer %q", c.agente, c.contato, got, c.want)
+		}
+	}
+}
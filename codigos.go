@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// codigoTexto é um código numérico da API (como o código IBGE do
+// município), que alguns provedores enviam como número e outros como
+// texto. É guardado como texto; null, vazio ou zero resultam em vazio.
+type codigoTexto string
+
+func (c *codigoTexto) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if string(b) == "null" {
+		*c = ""
+		return nil
+	}
+
+	var texto string
+	if len(b) > 0 && b[0] == '"' {
+		if err := json.Unmarshal(b, &texto); err != nil {
+			return err
+		}
+	} else {
+		var numero json.Number
+		if err := json.Unmarshal(b, &numero); err != nil {
+			return err
+		}
+		texto = numero.String()
+	}
+
+	texto = strings.TrimSpace(texto)
+	if strings.Trim(texto, "0") == "" {
+		texto = ""
+	}
+	*c = codigoTexto(texto)
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestCodigoMunicipioIBGE(t *testing.T) {
+	casos := map[string]codigoTexto{
+		`{"razao_social":"A","codigo_municipio_ibge":3550308}`:   "3550308",
+		`{"razao_social":"A","codigo_municipio_ibge":"3550308"}`: "3550308",
+		`{"razao_social":"A","codigo_municipio_ibge":null}`:      "",
+		`{"razao_social":"A","codigo_municipio_ibge":0}`:         "",
+		`{"razao_social":"A"}`:                                   "",
+	}
+	for payload, want := range casos {
+		var e Empresa
+		if err := json.Unmarshal([]byte(payload), &e); err != nil || e.CodigoMunicipio != want {
+			t.Errorf("Unmarshal(%s) = %q, %v; quer %q", payload, e.CodigoMunicipio, err, want)
+		}
+	}
+	var e Empresa
+	if err := json.Unmarshal([]byte(`{"codigo_municipio_ibge":true}`), &e); err == nil {
+		t.Error("código IBGE booleano aceito")
+	}
+}
+
+func TestUploadColunaCodigoMunicipio(t *testing.T) {
+	comCodigo, semCodigo := cnpjTeste("112223330001"), cnpjTeste("191312430001")
+	empresa := empresaTeste("A")
+	empresa.CodigoMunicipio = "3550308"
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{comCodigo: empresa, semCodigo: empresaTeste("B")}})
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"workers": "1"},
+		arquivoTeste{"entrada.csv", linhaReceita(comCodigo, "", "", "") + linhaReceita(semCodigo, "", "", "")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+	if got := coluna(t, cabecalho, linhas, "CodigoMunicipioIBGE"); !slices.Equal(got, []string{"3550308", ""}) {
+		t.Errorf("CodigoMunicipioIBGE = %q", got)
+	}
+}
+
+func TestParseNaturezas(t *testing.T) {
+	got, err := parseNaturezas(" 206-2, 2135 ,,213-5")
+	if err != nil {
+		t.Fatalf("parseNaturezas: %v", err)
+	}
+	if want := []string{"2062", "2135"}; !slices.Equal(slices.Sorted(maps.Keys(got)), want) {
+		t.Errorf("naturezas = %v, quer %v", got, want)
+	}
+	for _, valor := range []string{"206", "2062-1", "abc"} {
+		if _, err := parseNaturezas(valor); err == nil {
+			t.Errorf("parseNaturezas(%q) aceito", valor)
+		}
+	}
+}
+
+func TestFiltroNaturezaJuridica(t *testing.T) {
+	ltda, mei, sa := cnpjTeste("112223330001"), cnpjTeste("191312430001"), cnpjTeste("114447770001")
+	empresas := map[string]Empresa{}
+	for cnpj, natureza := range map[string][2]string{
+		ltda: {"206-2", "Sociedade Empresária Limitada"},
+		mei:  {"2135", "Empresário (Individual)"},
+		sa:   {"2054", "Sociedade Anônima Fechada"},
+	} {
+		e := empresaTeste("EMPRESA")
+		e.NaturezaJuridicaCodigo, e.NaturezaJuridicaDescricao = codigoTexto(natureza[0]), natureza[1]
+		empresas[cnpj] = e
+	}
+	usarAmbienteTeste(t, &provedorFalso{empresas: empresas})
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"natureza": "2062,205-4", "workers": "1"},
+		arquivoTeste{"entrada.csv", linhaReceita(ltda, "", "", "") + linhaReceita(mei, "", "", "") + linhaReceita(sa, "", "", "")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+	if got := coluna(t, cabecalho, linhas, "NaturezaJuridicaCodigo"); !slices.Equal(got, []string{"2062", "2054"}) {
+		t.Errorf("NaturezaJuridicaCodigo = %q, quer os códigos sem traço das naturezas pedidas", got)
+	}
+	if got := coluna(t, cabecalho, linhas, "NaturezaJuridicaDescricao"); !slices.Equal(got,
+		[]string{"Sociedade Empresária Limitada", "Sociedade Anônima Fechada"}) {
+		t.Errorf("NaturezaJuridicaDescricao = %q", got)
+	}
+
+	rec = enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"natureza": "20"},
+		arquivoTeste{"entrada.csv", linhaReceita(ltda, "", "", "")})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("natureza inválida: status = %d, quer 400", rec.Code)
+	}
+}
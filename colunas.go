@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// Maior índice de coluna aceito no mapeamento, para recusar valores absurdos.
+const indiceColunaMaximo = 1000
+
+// semColuna marca no mapeamento um campo ausente do arquivo de entrada,
+// lido sempre como vazio.
+const semColuna = -1
+
+// Modos de leitura do CNPJ no campo cnpj_mode do formulário.
+const (
+	modoCNPJAuto   = "auto"   // single quando a coluna col_cnpj tem 14 dígitos, senão split
+	modoCNPJSplit  = "split"  // CNPJ básico, ordem e DV em colunas separadas
+	modoCNPJSingle = "single" // CNPJ completo em uma coluna, com ou sem pontuação
+)
+
+// Modos de tratamento da primeira linha no campo has_header do formulário.
+const (
+	cabecalhoAuto = "auto" // pula a primeira linha se ela parecer um cabeçalho
+	cabecalhoSim  = "sim"  // a primeira linha é sempre um cabeçalho
+	cabecalhoNao  = "nao"  // a primeira linha é sempre um registro
+)
+
+// tamanhosPartesCNPJ são os tamanhos do CNPJ básico, da ordem e do DV no
+// modo split com as três partes usuais.
+var tamanhosPartesCNPJ = []int{8, 4, 2}
+
+// mapeamentoColunas indica em quais colunas (base zero) do arquivo de
+// entrada estão os campos usados no processamento.
+type mapeamentoColunas struct {
+	ModoCNPJ  string
+	CNPJ      []int // partes concatenadas para formar o CNPJ no modo split
+	CNPJUnico int   // coluna com o CNPJ completo no modo single
+	DDD       int
+	Telefone  int
+	Email     int
+
+	// Repassadas são copiadas sem alteração para colunas extras da saída
+	Repassadas []colunaRepassada
+}
+
+// colunaRepassada é uma coluna da entrada levada para a saída como veio
+// (passthrough_cols), com o nome de coluna escolhido pelo usuário.
+type colunaRepassada struct {
+	Indice int
+	Nome   string
+}
+
+// mapeamentoErros lê o CSV de erros gerado por um job (CNPJ, Motivo), que
+// tem o CNPJ completo na primeira coluna e nenhum contato.
+var mapeamentoErros = mapeamentoColunas{
+	ModoCNPJ:  modoCNPJSingle,
+	CNPJUnico: 0,
+	DDD:       semColuna,
+	Telefone:  semColuna,
+	Email:     semColuna,
+}
+
+// mapeamentoPadrao corresponde ao layout dos arquivos de estabelecimentos
+// da Receita: CNPJ básico, ordem e DV nas três primeiras colunas.
+var mapeamentoPadrao = mapeamentoColunas{
+	ModoCNPJ:  modoCNPJAuto,
+	CNPJ:      []int{0, 1, 2},
+	CNPJUnico: 0,
+	DDD:       21,
+	Telefone:  22,
+	Email:     27,
+}
+
+// maiorIndice devolve o maior índice usado pelo mapeamento. No modo
+// automático as partes do modo split são verificadas em extrairCNPJ.
+func (m mapeamentoColunas) maiorIndice() int {
+	maior := max(m.DDD, m.Telefone, m.Email)
+	for _, r := range m.Repassadas {
+		maior = max(maior, r.Indice)
+	}
+	if m.ModoCNPJ == modoCNPJSplit {
+		for _, i := range m.CNPJ {
+			maior = max(maior, i)
+		}
+	} else {
+		maior = max(maior, m.CNPJUnico)
+	}
+	return maior
+}
+
+// cabe informa se o registro tem todas as colunas do mapeamento.
+func (m mapeamentoColunas) cabe(record []string) bool {
+	return len(record) > m.maiorIndice()
+}
+
+// campo lê a coluna i do registro, ou vazio quando o campo não foi mapeado.
+func campo(record []string, i int) string {
+	if i == semColuna {
+		return ""
+	}
+	return strings.Trim(record[i], `" `)
+}
+
+// extrairCNPJ lê o CNPJ do registro conforme o modo configurado. O registro
+// já deve ter passado por cabe.
+func (m mapeamentoColunas) extrairCNPJ(record []string) (string, bool) {
+	modo := m.ModoCNPJ
+	if modo == modoCNPJAuto {
+		modo = modoCNPJSplit
+		if len(somenteDigitos(record[m.CNPJUnico])) == 14 {
+			modo = modoCNPJSingle
+		}
+	}
+
+	if modo == modoCNPJSingle {
+		return somenteDigitos(record[m.CNPJUnico]), true
+	}
+
+	// Com as três partes usuais cada uma deve ter o seu tamanho: uma linha
+	// desalinhada pode somar 14 caracteres juntando campos errados
+	var cnpj strings.Builder
+	for n, i := range m.CNPJ {
+		if i >= len(record) {
+			return "", false
+		}
+		parte := strings.Trim(record[i], `" `)
+		if len(m.CNPJ) == len(tamanhosPartesCNPJ) && len(parte) != tamanhosPartesCNPJ[n] {
+			slog.Warn("Parte do CNPJ com tamanho inválido", "event", "cnpj_part_malformed",
+				"column", i, "value", parte, "expected_length", tamanhosPartesCNPJ[n])
+			return "", false
+		}
+		cnpj.WriteString(parte)
+	}
+	return cnpj.String(), true
+}
+
+// parseMapeamento lê os campos cnpj_mode, col_cnpj_parts, col_cnpj,
+// col_ddd, col_telefone, col_email e passthrough_cols do formulário. Campos
+// ausentes mantêm o valor padrão.
+func parseMapeamento(valor func(string) string) (mapeamentoColunas, error) {
+	m := mapeamentoPadrao
+
+	switch modo := strings.ToLower(strings.TrimSpace(valor("cnpj_mode"))); modo {
+	case "":
+	case modoCNPJAuto, modoCNPJSplit, modoCNPJSingle:
+		m.ModoCNPJ = modo
+	default:
+		return m, fmt.Errorf("cnpj_mode inválido: %q (use auto, split ou single)", modo)
+	}
+
+	if partes := strings.TrimSpace(valor("col_cnpj_parts")); partes != "" {
+		m.CNPJ = nil
+		for _, item := range strings.Split(partes, ",") {
+			i, err := parseIndiceColuna("col_cnpj_parts", item)
+			if err != nil {
+				return m, err
+			}
+			m.CNPJ = append(m.CNPJ, i)
+		}
+	}
+
+	for _, campo := range []struct {
+		nome    string
+		destino *int
+	}{
+		{"col_cnpj", &m.CNPJUnico},
+		{"col_ddd", &m.DDD},
+		{"col_telefone", &m.Telefone},
+		{"col_email", &m.Email},
+	} {
+		item := strings.TrimSpace(valor(campo.nome))
+		if item == "" {
+			continue
+		}
+		i, err := parseIndiceColuna(campo.nome, item)
+		if err != nil {
+			return m, err
+		}
+		*campo.destino = i
+	}
+
+	repassadas, err := parseColunasRepassadas(valor("passthrough_cols"))
+	if err != nil {
+		return m, err
+	}
+	m.Repassadas = repassadas
+	return m, nil
+}
+
+// parseColunasRepassadas interpreta o campo passthrough_cols: pares
+// índice:nome separados por vírgula, como "30:Pontuacao,31:Responsavel". Os
+// nomes não podem repetir nem coincidir com as colunas da saída.
+func parseColunasRepassadas(valor string) ([]colunaRepassada, error) {
+	if strings.TrimSpace(valor) == "" {
+		return nil, nil
+	}
+
+	usados := make(map[string]struct{})
+	for _, nome := range (opcoesSaida{Socios: true, Coordenadas: true, Simples: true, Matched: true}).cabecalhoCompleto() {
+		usados[strings.ToLower(nome)] = struct{}{}
+	}
+
+	var repassadas []colunaRepassada
+	for _, item := range strings.Split(valor, ",") {
+		indice, nome, ok := strings.Cut(item, ":")
+		nome = strings.TrimSpace(nome)
+		if !ok || nome == "" {
+			return nil, fmt.Errorf("passthrough_cols: use índice:nome, como 30:Pontuacao (recebido %q)", strings.TrimSpace(item))
+		}
+		i, err := parseIndiceColuna("passthrough_cols", indice)
+		if err != nil {
+			return nil, err
+		}
+		if _, repetido := usados[strings.ToLower(nome)]; repetido {
+			return nil, fmt.Errorf("passthrough_cols: nome de coluna repetido ou já usado na saída: %q", nome)
+		}
+		usados[strings.ToLower(nome)] = struct{}{}
+		repassadas = append(repassadas, colunaRepassada{Indice: i, Nome: nome})
+	}
+	return repassadas, nil
+}
+
+// nomesRepassadas devolve os nomes das colunas repassadas, na ordem da saída.
+func nomesRepassadas(repassadas []colunaRepassada) []string {
+	nomes := make([]string, len(repassadas))
+	for i, r := range repassadas {
+		nomes[i] = r.Nome
+	}
+	return nomes
+}
+
+func parseIndiceColuna(campo, item string) (int, error) {
+	i, err := strconv.Atoi(strings.TrimSpace(item))
+	if err != nil || i < 0 || i > indiceColunaMaximo {
+		return 0, fmt.Errorf("%s: índice de coluna inválido: %q", campo, item)
+	}
+	return i, nil
+}
+
+// parseCabecalhoEntrada interpreta o campo has_header: vazio ou "auto" para
+// detectar, 1/true/sim para pular sempre a primeira linha e 0/false/nao
+// para nunca pular.
+func parseCabecalhoEntrada(valor string) (string, error) {
+	switch v := strings.ToLower(strings.TrimSpace(valor)); {
+	case v == "" || v == cabecalhoAuto:
+		return cabecalhoAuto, nil
+	case parseFlag(v):
+		return cabecalhoSim, nil
+	case v == "0" || v == "false" || v == "off" || v == cabecalhoNao || v == "não" || v == "n":
+		return cabecalhoNao, nil
+	}
+	return "", fmt.Errorf("has_header inválido: %q (use auto, 1 ou 0)", valor)
+}
+
+// leitorRegistros devolve uma função que lê os registros de reader pulando
+// o cabeçalho conforme modo. No modo automático a primeira linha é um
+// cabeçalho quando o CNPJ dela não é válido e o da segunda é; o aviso
+// indica, depois da primeira leitura, se alguma linha foi pulada.
+func leitorRegistros(reader *csv.Reader, colunas mapeamentoColunas, modo string) (ler func() ([]string, error), pulado *bool) {
+	pulado = new(bool)
+	var pendentes []func() ([]string, error)
+	primeira := true
+
+	ler = func() ([]string, error) {
+		if len(pendentes) > 0 {
+			proximo := pendentes[0]
+			pendentes = pendentes[1:]
+			return proximo()
+		}
+		if !primeira || modo == cabecalhoNao {
+			primeira = false
+			return reader.Read()
+		}
+		primeira = false
+
+		record, err := reader.Read()
+		if err != nil {
+			return record, err
+		}
+		if modo == cabecalhoSim {
+			*pulado = true
+			return reader.Read()
+		}
+
+		if _, ok := extrairTarefa(record, colunas); ok {
+			return record, nil
+		}
+		segundo, errSegundo := reader.Read()
+		if errSegundo == nil {
+			if _, ok := extrairTarefa(segundo, colunas); ok {
+				*pulado = true
+				slog.Debug("Cabeçalho detectado no arquivo de entrada", "event", "input_header_skipped", "header", strings.Join(record, ","))
+				return segundo, nil
+			}
+		}
+		pendentes = append(pendentes, func() ([]string, error) { return segundo, errSegundo })
+		return record, nil
+	}
+	return ler, pulado
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadLayoutRemapeado(t *testing.T) {
+	a, b := cnpjTeste("112223330001"), cnpjTeste("191312430001")
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{a: empresaTeste("A"), b: empresaTeste("B")}})
+
+	// Layout próprio: e-mail, DDD, telefone e as partes do CNPJ no fim; a
+	// última linha não tem todas as colunas mapeadas e é ignorada
+	entrada := "contato@a.com.br;11;32345678;" + a[:8] + ";" + a[8:12] + ";" + a[12:] + "\n" +
+		"contato@b.com.br;21;987654321;" + b[:8] + ";" + b[8:12] + ";" + b[12:] + "\n" +
+		"contato@c.com.br;31;32345678\n"
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{
+		"workers": "1", "cnpj_mode": "split", "col_cnpj_parts": "3,4,5", "col_ddd": "1", "col_telefone": "2", "col_email": "0",
+	}, arquivoTeste{"entrada.csv", entrada})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+	for nome, want := range map[string][]string{
+		"CNPJ":     {a, b},
+		"DDD":      {"11", "21"},
+		"Telefone": {"+55 (11) 3234-5678", "+55 (21) 98765-4321"},
+		"Email":    {"contato@a.com.br", "contato@b.com.br"},
+	} {
+		if got := coluna(t, cabecalho, linhas, nome); !slices.Equal(got, want) {
+			t.Errorf("%s = %q, quer %q", nome, got, want)
+		}
+	}
+}
+
+func TestParseMapeamento(t *testing.T) {
+	campos := map[string]string{"col_ddd": "5", "col_email": "7"}
+	m, err := parseMapeamento(func(nome string) string { return campos[nome] })
+	if err != nil {
+		t.Fatalf("parseMapeamento: %v", err)
+	}
+	if m.DDD != 5 || m.Email != 7 || m.Telefone != mapeamentoPadrao.Telefone || !slices.Equal(m.CNPJ, mapeamentoPadrao.CNPJ) {
+		t.Errorf("mapeamento = %+v; campos ausentes devem manter o padrão", m)
+	}
+	if !m.cabe(make([]string, 28)) || m.cabe(make([]string, 22)) {
+		t.Errorf("cabe com maior índice %d", m.maiorIndice())
+	}
+
+	for _, invalido := range []map[string]string{
+		{"col_ddd": "-1"},
+		{"col_email": "abc"},
+		{"col_cnpj_parts": "0,x,2"},
+		{"cnpj_mode": "triplo"},
+	} {
+		if _, err := parseMapeamento(func(nome string) string { return invalido[nome] }); err == nil {
+			t.Errorf("parseMapeamento(%v) aceito", invalido)
+		}
+	}
+}
+
+func TestExtrairCNPJ(t *testing.T) {
+	split := []string{"11222333", "0001", "81", "SP"}
+	single := []string{"11.222.333/0001-81", "SP"}
+	comModo := func(modo string) mapeamentoColunas {
+		m := mapeamentoPadrao
+		m.ModoCNPJ = modo
+		return m
+	}
+
+	casos := []struct {
+		nome   string
+		m      mapeamentoColunas
+		record []string
+		want   string
+		ok     bool
+	}{
+		{"split", comModo(modoCNPJSplit), split, "11222333000181", true},
+		{"split com parte desalinhada", comModo(modoCNPJSplit), []string{"1122233", "30001", "81"}, "", false},
+		{"single com pontuação", comModo(modoCNPJSingle), single, "11222333000181", true},
+		{"auto detecta split", comModo(modoCNPJAuto), split, "11222333000181", true},
+		{"auto detecta single", comModo(modoCNPJAuto), single, "11222333000181", true},
+	}
+	for _, c := range casos {
+		got, ok := c.m.extrairCNPJ(c.record)
+		if got != c.want || ok != c.ok {
+			t.Errorf("%s: extrairCNPJ(%q) = %q, %v; quer %q, %v", c.nome, c.record, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestUploadCNPJColunaUnica(t *testing.T) {
+	a, b := cnpjTeste("112223330001"), cnpjTeste("191312430001")
+	entrada := "RAZAO;CNPJ;DDD;TELEFONE;EMAIL\n" +
+		"EMPRESA A;" + a[:2] + "." + a[2:5] + "." + a[5:8] + "/" + a[8:12] + "-" + a[12:] + ";11;32345678;\n" +
+		"EMPRESA B;" + b + ";;;\n"
+
+	for _, modo := range []string{"single", "auto"} {
+		t.Run(modo, func(t *testing.T) {
+			usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{a: empresaTeste("A"), b: empresaTeste("B")}})
+			rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{
+				"workers": "1", "cnpj_mode": modo, "col_cnpj": "1", "col_ddd": "2", "col_telefone": "3", "col_email": "4",
+			}, arquivoTeste{"entrada.csv", entrada})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("/upload: %s", mensagemErro(rec))
+			}
+			cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+			if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, []string{a, b}) {
+				t.Errorf("CNPJs = %v, quer %v", got, []string{a, b})
+			}
+		})
+	}
+}
+
+func TestUploadPartesCNPJComTamanhoInvalido(t *testing.T) {
+	valido, desalinhado, curto := cnpjTeste("112223330001"), cnpjTeste("191312430001"), cnpjTeste("114447770001")
+	p := &provedorFalso{empresas: map[string]Empresa{valido: empresaTeste("A"), desalinhado: empresaTeste("B"), curto: empresaTeste("C")}}
+	usarAmbienteTeste(t, p)
+
+	// A linha desalinhada ainda soma 14 dígitos, os de um CNPJ existente
+	partes := func(cnpj string, tamanhos ...int) string {
+		campos := make([]string, 30)
+		for i, n := range tamanhos {
+			campos[i], cnpj = cnpj[:n], cnpj[n:]
+		}
+		return strings.Join(campos, ";") + "\n"
+	}
+	entrada := linhaReceita(valido, "", "", "") + partes(desalinhado, 7, 5, 2) + partes(curto, 8, 4, 1)
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", nil, arquivoTeste{"entrada.csv", entrada})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+	if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, []string{valido}) {
+		t.Errorf("CNPJs = %v, quer só o da linha com partes de 8, 4 e 2 dígitos", got)
+	}
+	if n := p.totalConsultas(); n != 1 {
+		t.Errorf("%d consultas, quer 1; linhas com partes inválidas não vão ao provedor", n)
+	}
+}
+
+func TestLeitorRegistrosCabecalho(t *testing.T) {
+	a, b := cnpjTeste("112223330001"), cnpjTeste("191312430001")
+	m := mapeamentoColunas{ModoCNPJ: modoCNPJSingle, CNPJUnico: 0, DDD: semColuna, Telefone: semColuna, Email: semColuna}
+	comCabecalho := "CNPJ;RAZAO\n" + a + ";A\n" + b + ";B\n"
+	semCabecalho := a + ";A\n" + b + ";B\n"
+
+	casos := []struct {
+		nome    string
+		entrada string
+		modo    string
+		want    []string
+		pulado  bool
+	}{
+		{"auto com cabeçalho", comCabecalho, cabecalhoAuto, []string{a, b}, true},
+		{"auto sem cabeçalho", semCabecalho, cabecalhoAuto, []string{a, b}, false},
+		{"auto com duas linhas inválidas", "CNPJ;RAZAO\nx;y\n" + a + ";A\n", cabecalhoAuto, []string{"CNPJ", "x", a}, false},
+		{"has_header=1", semCabecalho, cabecalhoSim, []string{b}, true},
+		{"has_header=0", comCabecalho, cabecalhoNao, []string{"CNPJ", a, b}, false},
+	}
+	for _, c := range casos {
+		reader := csv.NewReader(strings.NewReader(c.entrada))
+		reader.Comma = ';'
+		ler, pulado := leitorRegistros(reader, m, c.modo)
+		var got []string
+		for {
+			record, err := ler()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", c.nome, err)
+			}
+			got = append(got, record[0])
+		}
+		if !slices.Equal(got, c.want) || *pulado != c.pulado {
+			t.Errorf("%s: registros = %v, pulado %v; quer %v, %v", c.nome, got, *pulado, c.want, c.pulado)
+		}
+	}
+}
+
+func TestUploadCabecalhoColunaUnica(t *testing.T) {
+	a, b := cnpjTeste("112223330001"), cnpjTeste("191312430001")
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{a: empresaTeste("A"), b: empresaTeste("B")}})
+	campos := map[string]string{"cnpj_mode": "single", "col_cnpj": "0", "col_ddd": "1", "col_telefone": "2", "col_email": "3", "workers": "1"}
+	registros := a + ";11;32345678;\n" + b + ";;;\n"
+
+	for _, entrada := range []string{"CNPJ;DDD;TELEFONE;EMAIL\n" + registros, registros} {
+		processedCNPJs = novoCacheLRU[time.Time](maxEntradasCachePadrao)
+		rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", campos, arquivoTeste{"entrada.csv", entrada})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("/upload: %s", mensagemErro(rec))
+		}
+		cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+		if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, []string{a, b}) {
+			t.Errorf("CNPJs = %v, quer %v\nentrada:\n%s", got, []string{a, b}, entrada)
+		}
+	}
+	if rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"has_header": "talvez"},
+		arquivoTeste{"entrada.csv", a + "\n"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("has_header inválido: status = %d, quer 400", rec.Code)
+	}
+}
+
+func TestMaiorIndiceDoMapeamento(t *testing.T) {
+	casos := []struct {
+		nome string
+		m    mapeamentoColunas
+		want int
+	}{
+		{"layout da Receita", mapeamentoPadrao, 27},
+		{"compacto", mapeamentoColunas{ModoCNPJ: modoCNPJSplit, CNPJ: []int{0, 1, 2}, DDD: 3, Telefone: 4, Email: 5}, 5},
+		{"CNPJ depois dos contatos", mapeamentoColunas{ModoCNPJ: modoCNPJSingle, CNPJUnico: 9, DDD: 1, Telefone: 2, Email: semColuna}, 9},
+		{"repassada", mapeamentoColunas{ModoCNPJ: modoCNPJSingle, DDD: semColuna, Telefone: semColuna, Email: semColuna,
+			Repassadas: []colunaRepassada{{Indice: 12}}}, 12},
+	}
+	for _, c := range casos {
+		if got := c.m.maiorIndice(); got != c.want {
+			t.Errorf("%s: maiorIndice = %d, quer %d", c.nome, got, c.want)
+		}
+	}
+}
+
+func TestUploadLinhasCurtasPeloMapeamento(t *testing.T) {
+	completa, curta := cnpjTeste("112223330001"), cnpjTeste("191312430001")
+	p := &provedorFalso{empresas: map[string]Empresa{completa: empresaTeste("A"), curta: empresaTeste("B")}}
+	usarAmbienteTeste(t, p)
+
+	// Seis colunas bastam com o e-mail na coluna 5; a linha sem ela é descartada
+	entrada := completa[:8] + ";" + completa[8:12] + ";" + completa[12:] + ";11;32345678;a@empresa.com.br\n" +
+		curta[:8] + ";" + curta[8:12] + ";" + curta[12:] + ";11;32345678\n"
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{
+		"col_ddd": "3", "col_telefone": "4", "col_email": "5",
+	}, arquivoTeste{"entrada.csv", entrada})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+	if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, []string{completa}) {
+		t.Errorf("CNPJs = %v, quer só o da linha com 6 colunas", got)
+	}
+	if n := p.totalConsultas(); n != 1 {
+		t.Errorf("%d consultas, quer 1", n)
+	}
+}
+
+func TestParseColunasRepassadas(t *testing.T) {
+	got, err := parseColunasRepassadas(" 30:Pontuacao , 31:Responsavel ")
+	if want := []colunaRepassada{{Indice: 30, Nome: "Pontuacao"}, {Indice: 31, Nome: "Responsavel"}}; err != nil || !slices.Equal(got, want) {
+		t.Errorf("parseColunasRepassadas = %+v, %v; quer %+v", got, err, want)
+	}
+	for _, valor := range []string{"30", "30:", "x:Pontuacao", "-1:Pontuacao", "30:A,31:a", "30:RazaoSocial", "30:matched"} {
+		if got, err := parseColunasRepassadas(valor); err == nil {
+			t.Errorf("parseColunasRepassadas(%q) = %+v, quer erro", valor, got)
+		}
+	}
+}
+
+func TestUploadColunasRepassadas(t *testing.T) {
+	completa, curta := cnpjTeste("112223330001"), cnpjTeste("191312430001")
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{completa: empresaTeste("A"), curta: empresaTeste("B")}})
+	// A linha curta não tem a coluna 31 e é descartada sem consulta
+	entrada := strings.TrimSuffix(linhaReceita(completa, "", "", ""), "\n") + `;"87";"Ana; Vendas"` + "\n" +
+		strings.TrimSuffix(linhaReceita(curta, "", "", ""), "\n") + `;"12"` + "\n"
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"passthrough_cols": "30:Pontuacao,31:Responsavel"},
+		arquivoTeste{"entrada.csv", entrada})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+	if n := len(cabecalho); n < 3 || !slices.Equal(cabecalho[n-2:], []string{"Pontuacao", "Responsavel"}) {
+		t.Errorf("cabeçalho = %v, quer as colunas repassadas ao fim", cabecalho)
+	}
+	if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, []string{completa}) {
+		t.Fatalf("CNPJs = %v, quer só a linha com as colunas repassadas", got)
+	}
+	if got := coluna(t, cabecalho, linhas, "RazaoSocial"); !slices.Equal(got, []string{"A"}) {
+		t.Errorf("RazaoSocial = %v, quer os dados da API ao lado das colunas repassadas", got)
+	}
+	if got := linhas[0][len(linhas[0])-2:]; !slices.Equal(got, []string{"87", "Ana; Vendas"}) {
+		t.Errorf("colunas repassadas = %q", got)
+	}
+
+	rec = enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"passthrough_cols": "30:UF"},
+		arquivoTeste{"entrada.csv", entrada})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("passthrough_cols com nome já usado: status = %d, quer 400", rec.Code)
+	}
+}
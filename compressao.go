@@ -0,0 +1,50 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Compressões aceitas no campo compress do formulário.
+const (
+	semCompressao   = ""
+	compressaoGzip  = "gzip"
+	extensaoGzip    = ".gz"
+	codificacaoGzip = "gzip"
+)
+
+// parseCompressao interpreta o campo compress. A compressão vale para CSV e
+// JSON Lines; o XLSX já é um arquivo compactado.
+func parseCompressao(valor, formato string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(valor)) {
+	case "", "none":
+		return semCompressao, nil
+	case compressaoGzip:
+		if formato == formatoXLSX {
+			return "", fmt.Errorf("compress=gzip não se aplica a saídas xlsx")
+		}
+		return compressaoGzip, nil
+	}
+	return "", fmt.Errorf("compress inválido: %q (use gzip)", valor)
+}
+
+// comprimirSaida envolve destino em um gzip.Writer. fechar precisa ser
+// chamado depois de concluída a saída: só o Close grava o final do gzip,
+// sem o qual o arquivo fica truncado.
+func comprimirSaida(destino io.Writer) (w io.Writer, fechar func() error) {
+	gz := gzip.NewWriter(destino)
+	return gz, gz.Close
+}
+
+// aceitaGzip informa se o cliente aceita respostas com Content-Encoding gzip.
+func aceitaGzip(acceptEncoding string) bool {
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		codificacao, parametros, _ := strings.Cut(strings.TrimSpace(item), ";")
+		if strings.EqualFold(strings.TrimSpace(codificacao), codificacaoGzip) {
+			return strings.ReplaceAll(parametros, " ", "") != "q=0"
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaidaGzipIgualAoCSV(t *testing.T) {
+	cnpjs := cnpjsTeste(3)
+	empresas := map[string]Empresa{}
+	var entrada strings.Builder
+	for _, cnpj := range cnpjs {
+		empresas[cnpj] = empresaTeste("EMPRESA")
+		entrada.WriteString(linhaReceita(cnpj, "11", "32345678", ""))
+	}
+	usarAmbienteTeste(t, &provedorFalso{empresas: empresas})
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"workers": "1"},
+		arquivoTeste{"entrada.csv", entrada.String()})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload sem compressão: %s", mensagemErro(rec))
+	}
+	semCompressao := rec.Body.String()
+
+	processedCNPJs = novoCacheLRU[time.Time](maxEntradasCachePadrao)
+	rec = enviarFormulario(t, uploadHandler, "/upload?wait=1", map[string]string{"workers": "1", "compress": "gzip"},
+		arquivoTeste{"entrada.csv", entrada.String()})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload com compress=gzip: %s", mensagemErro(rec))
+	}
+	nomes, _ := filepath.Glob(filepath.Join(diretorioSaida, "empresas_*.csv.gz"))
+	if len(nomes) != 1 {
+		t.Fatalf("saídas .csv.gz = %v, quer 1", nomes)
+	}
+	arquivo, err := os.Open(nomes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer arquivo.Close()
+	// Um gzip sem o final gravado pelo Close falha na leitura com EOF inesperado
+	gz, err := gzip.NewReader(arquivo)
+	if err != nil {
+		t.Fatalf("gzip inválido: %v", err)
+	}
+	descomprimido, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatalf("gzip truncado: %v", err)
+	}
+	if string(descomprimido) != semCompressao {
+		t.Errorf("descomprimido = %q, quer %q", descomprimido, semCompressao)
+	}
+
+	nome := filepath.Base(nomes[0])
+	baixar := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/download?file="+nome, nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rec := httptest.NewRecorder()
+		downloadHandler(rec, req)
+		return rec
+	}
+	rec = baixar("gzip, deflate")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Encoding") != "gzip" ||
+		!strings.Contains(rec.Header().Get("Content-Disposition"), strings.TrimSuffix(nome, ".gz")+`"`) {
+		t.Errorf("download com gzip: %d, cabeçalhos %v", rec.Code, rec.Header())
+	}
+	if rec := baixar(""); rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != semCompressao {
+		t.Errorf("download sem gzip: Content-Encoding %q, corpo %q", rec.Header().Get("Content-Encoding"), rec.Body.String())
+	}
+}
+
+func TestParseCompressao(t *testing.T) {
+	for _, c := range []struct{ valor, formato, want string }{
+		{"", formatoCSV, semCompressao},
+		{"none", formatoCSV, semCompressao},
+		{" GZIP ", formatoCSV, compressaoGzip},
+		{"gzip", formatoJSONL, compressaoGzip},
+	} {
+		if got, err := parseCompressao(c.valor, c.formato); err != nil || got != c.want {
+			t.Errorf("parseCompressao(%q, %s) = %q, %v; quer %q", c.valor, c.formato, got, err, c.want)
+		}
+	}
+	for _, c := range [][2]string{{"gzip", formatoXLSX}, {"zip", formatoCSV}} {
+		if _, err := parseCompressao(c[0], c[1]); err == nil {
+			t.Errorf("parseCompressao(%q, %s) aceito", c[0], c[1])
+		}
+	}
+	if !aceitaGzip("deflate, gzip;q=0.8") || aceitaGzip("gzip;q=0") || aceitaGzip("br") {
+		t.Error("aceitaGzip não segue o Accept-Encoding")
+	}
+}
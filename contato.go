@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+)
+
+// somenteDigitos remove de s todos os caracteres que não são dígitos.
+func somenteDigitos(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// normalizeCEP devolve o CEP no formato "NNNNN-NNN", aceitando-o com ou sem
+// pontuação. CEPs que não têm exatamente 8 dígitos ficam em branco.
+func normalizeCEP(cep string) string {
+	digitos := somenteDigitos(cep)
+	if len(digitos) != 8 {
+		return ""
+	}
+	return digitos[:5] + "-" + digitos[5:]
+}
+
+// normalizePhone limpa DDD e telefone vindos do arquivo de entrada e, quando
+// juntos formam 10 (fixo) ou 11 (celular) dígitos, devolve o DDD e o número
+// formatado como "+55 (DD) NNNNN-NNNN". Telefones que já trazem o DDD são
+// reconhecidos. Números fora do padrão são devolvidos sem alteração, com
+// ok igual a false.
+func normalizePhone(ddd, telefone string) (dddNormalizado, telefoneNormalizado string, ok bool) {
+	numero := somenteDigitos(telefone)
+	if len(numero) != 10 && len(numero) != 11 {
+		numero = strings.TrimPrefix(somenteDigitos(ddd), "0") + numero
+	}
+	if len(numero) != 10 && len(numero) != 11 {
+		return ddd, telefone, false
+	}
+
+	codigoArea, local := numero[:2], numero[2:]
+	if codigoArea[0] == '0' {
+		return ddd, telefone, false
+	}
+
+	meio := len(local) - 4
+	return codigoArea, fmt.Sprintf("+55 (%s) %s-%s", codigoArea, local[:meio], local[meio:]), true
+}
+
+// normalizeEmail remove espaços e converte o e-mail para minúsculas,
+// validando-o com net/mail. E-mails inválidos viram uma célula vazia, com ok
+// igual a false; um e-mail vazio não é considerado inválido.
+func normalizeEmail(email string) (normalizado string, ok bool) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if email == "" {
+		return "", true
+	}
+
+	// ParseAddress também aceita a forma "Nome <email>"; só o endereço puro vale
+	endereco, err := mail.ParseAddress(email)
+	if err != nil || endereco.Address != email {
+		return "", false
+	}
+	return email, true
+}
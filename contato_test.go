@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeCEP(t *testing.T) {
+	casos := []struct{ nome, cep, want string }{
+		{"formatado", "01310-100", "01310-100"},
+		{"sem formatação", "01310100", "01310-100"},
+		{"com ponto e espaços", " 01.310-100 ", "01310-100"},
+		{"curto", "1310100", ""},
+		{"longo", "013101000", ""},
+		{"letras", "CEP 0131-010", ""},
+		{"vazio", "", ""},
+	}
+	for _, c := range casos {
+		if got := normalizeCEP(c.cep); got != c.want {
+			t.Errorf("%s: normalizeCEP(%q) = %q, quer %q", c.nome, c.cep, got, c.want)
+		}
+	}
+}
+
+func TestNormalizePhone(t *testing.T) {
+	casos := []struct {
+		nome, ddd, telefone string
+		wantDDD, want       string
+		ok                  bool
+	}{
+		{"fixo", "11", "3234-5678", "11", "+55 (11) 3234-5678", true},
+		{"celular", "21", "98765-4321", "21", "+55 (21) 98765-4321", true},
+		{"com espaços e parênteses", " (11) ", " 3234 5678 ", "11", "+55 (11) 3234-5678", true},
+		{"DDD com zero de operadora", "011", "32345678", "11", "+55 (11) 3234-5678", true},
+		{"telefone já com DDD", "", "(31) 99876-5432", "31", "+55 (31) 99876-5432", true},
+		{"sem DDD", "", "32345678", "", "32345678", false},
+		{"curto demais", "11", "1234", "11", "1234", false},
+		{"lixo", "xx", "ramal 12", "xx", "ramal 12", false},
+		{"DDD começando com zero", "", "0132345678", "", "0132345678", false},
+		{"vazio", "", "", "", "", false},
+	}
+	for _, c := range casos {
+		ddd, telefone, ok := normalizePhone(c.ddd, c.telefone)
+		if ddd != c.wantDDD || telefone != c.want || ok != c.ok {
+			t.Errorf("%s: normalizePhone(%q, %q) = %q, %q, %v; quer %q, %q, %v",
+				c.nome, c.ddd, c.telefone, ddd, telefone, ok, c.wantDDD, c.want, c.ok)
+		}
+	}
+}
+
+func TestUploadNormalizaTelefone(t *testing.T) {
+	valido, invalido := cnpjTeste("112223330001"), cnpjTeste("191312430001")
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{valido: empresaTeste("A"), invalido: empresaTeste("B")}})
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", map[string]string{"workers": "1"}, arquivoTeste{"entrada.csv",
+		linhaReceita(valido, "11", "9 8765-4321", "") + linhaReceita(invalido, "11", "ramal 12", "")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	if !strings.Contains(rec.Body.String(), "telefone fora do padrão, mantido como no arquivo: 1<") {
+		t.Errorf("resumo sem o telefone fora do padrão:\n%s", rec.Body.String())
+	}
+	cabecalho, linhas := lerSaidaCSV(t, lerArquivoSaida(t, "empresas_"))
+	if got, want := coluna(t, cabecalho, linhas, "Telefone"), []string{"+55 (11) 98765-4321", "ramal 12"}; !slices.Equal(got, want) {
+		t.Errorf("Telefone = %q, quer %q", got, want)
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	casos := []struct {
+		entrada, want string
+		ok            bool
+	}{
+		{"contato@empresa.com.br", "contato@empresa.com.br", true},
+		{"Contato@Empresa.COM.BR", "contato@empresa.com.br", true},
+		{"  vendas@empresa.com \t", "vendas@empresa.com", true},
+		{"", "", true},
+		{"   ", "", true},
+		{"contato@", "", false},
+		{"contato empresa.com", "", false},
+		{"@empresa.com", "", false},
+		{"Fulano <fulano@empresa.com>", "", false},
+		{"a@b@c.com", "", false},
+	}
+	for _, c := range casos {
+		if got, ok := normalizeEmail(c.entrada); got != c.want || ok != c.ok {
+			t.Errorf("normalizeEmail(%q) = %q, %v; quer %q, %v", c.entrada, got, ok, c.want, c.ok)
+		}
+	}
+}
+
+func TestUploadNormalizaEmail(t *testing.T) {
+	valido, invalido := cnpjTeste("112223330001"), cnpjTeste("191312430001")
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{valido: empresaTeste("A"), invalido: empresaTeste("B")}})
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", map[string]string{"workers": "1"}, arquivoTeste{"entrada.csv",
+		linhaReceita(valido, "", "", " Contato@Empresa.com.br ") + linhaReceita(invalido, "", "", "contato@")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	cabecalho, linhas := lerSaidaCSV(t, lerArquivoSaida(t, "empresas_"))
+	if got, want := coluna(t, cabecalho, linhas, "Email"), []string{"contato@empresa.com.br", ""}; !slices.Equal(got, want) {
+		t.Errorf("Email = %q, quer %q", got, want)
+	}
+
+	caminhos, _ := filepath.Glob(filepath.Join(diretorioSaida, "*_erros.csv"))
+	if len(caminhos) != 1 {
+		t.Fatalf("arquivos de erros = %v", caminhos)
+	}
+	dados, err := os.ReadFile(caminhos[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := invalido + "," + motivoEmailInvalido; !strings.Contains(string(dados), want) {
+		t.Errorf("arquivo de erros sem %q:\n%s", want, dados)
+	}
+	if strings.Contains(string(dados), valido) {
+		t.Errorf("CNPJ com e-mail válido no arquivo de erros:\n%s", dados)
+	}
+}
+
+func TestUploadExigeContato(t *testing.T) {
+	completo, soEmail, soTelefone, emailInvalido, semContato, capitalBaixo :=
+		cnpjTeste("112223330001"), cnpjTeste("191312430001"), cnpjTeste("114447770001"),
+		cnpjTeste("123456780001"), cnpjTeste("987654320001"), cnpjTeste("135791350001")
+	pequena := empresaTeste("F")
+	pequena.CapitalSocial = 1000
+	empresas := map[string]Empresa{completo: empresaTeste("A"), soEmail: empresaTeste("B"), soTelefone: empresaTeste("C"),
+		emailInvalido: empresaTeste("D"), semContato: empresaTeste("E"), capitalBaixo: pequena}
+	entrada := linhaReceita(completo, "11", "32345678", "a@empresa.com.br") + linhaReceita(soEmail, "", "", "b@empresa.com.br") +
+		linhaReceita(soTelefone, "11", "32345678", "") + linhaReceita(emailInvalido, "", "", "sem arroba") +
+		linhaReceita(semContato, "", "", "") + linhaReceita(capitalBaixo, "11", "32345678", "f@empresa.com.br")
+
+	casos := []struct {
+		nome        string
+		campos      map[string]string
+		want        []string
+		descartadas int
+	}{
+		{"sem exigência", nil, []string{"A", "B", "C", "D", "E"}, 0},
+		{"e-mail", map[string]string{"require_email": "1"}, []string{"A", "B"}, 3},
+		{"telefone", map[string]string{"require_telefone": "1"}, []string{"A", "C"}, 3},
+		{"ambos", map[string]string{"require_email": "1", "require_telefone": "1"}, []string{"A"}, 4},
+	}
+	for _, c := range casos {
+		t.Run(c.nome, func(t *testing.T) {
+			usarAmbienteTeste(t, &provedorFalso{empresas: empresas})
+			campos := map[string]string{"capital_minimo": "50000"}
+			maps.Copy(campos, c.campos)
+
+			rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", campos, arquivoTeste{"entrada.csv", entrada})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("/upload: %s", mensagemErro(rec))
+			}
+			// A empresa barrada pelo capital não conta como sem contato
+			if want := fmt.Sprintf("falta de e-mail ou telefone exigido: %d<", c.descartadas); !strings.Contains(rec.Body.String(), want) {
+				t.Errorf("resumo sem %q:\n%s", want, rec.Body.String())
+			}
+			cabecalho, linhas := lerSaidaCSV(t, lerArquivoSaida(t, "empresas_"))
+			got := coluna(t, cabecalho, linhas, "RazaoSocial")
+			slices.Sort(got)
+			if !slices.Equal(got, c.want) {
+				t.Errorf("empresas gravadas = %v, quer %v", got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// layoutData é o formato das datas da API e das colunas de data da saída.
+const layoutData = "2006-01-02"
+
+// dataISO é uma data no formato YYYY-MM-DD. Vazio, null ou uma data fora
+// do formato na API resultam na data zero, gravada como vazio na saída,
+// para que uma data malformada não descarte a empresa inteira.
+type dataISO struct {
+	time.Time
+}
+
+func (d *dataISO) UnmarshalJSON(b []byte) error {
+	var s string
+	if string(b) == "null" {
+		d.Time = time.Time{}
+		return nil
+	}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	t, err := parseData(s)
+	if err != nil {
+		t = time.Time{}
+	}
+	d.Time = t
+	return nil
+}
+
+func (d dataISO) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d dataISO) String() string {
+	if d.IsZero() {
+		return ""
+	}
+	return d.Format(layoutData)
+}
+
+// parseData interpreta uma data YYYY-MM-DD; vazio resulta na data zero.
+func parseData(valor string) (time.Time, error) {
+	valor = strings.TrimSpace(valor)
+	if valor == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(layoutData, valor)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("data inválida: %q (use AAAA-MM-DD)", valor)
+	}
+	return t, nil
+}
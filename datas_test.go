@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestDataISOUnmarshal(t *testing.T) {
+	casos := map[string]string{
+		`"2010-05-20"`:   "2010-05-20",
+		`" 1999-12-31 "`: "1999-12-31",
+		`""`:             "",
+		`null`:           "",
+		`"20/05/2010"`:   "", // fora do formato não descarta a empresa
+	}
+	for entrada, want := range casos {
+		var d dataISO
+		if err := json.Unmarshal([]byte(entrada), &d); err != nil {
+			t.Errorf("Unmarshal(%s): %v", entrada, err)
+			continue
+		}
+		if got := d.String(); got != want {
+			t.Errorf("Unmarshal(%s) = %q, quer %q", entrada, got, want)
+		}
+	}
+	if err := json.Unmarshal([]byte(`20100520`), new(dataISO)); err == nil {
+		t.Error("número aceito como data")
+	}
+
+	var e Empresa
+	if err := json.Unmarshal([]byte(`{"cnpj":"11222333000181","data_inicio_atividade":"2015-03-02"}`), &e); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.DataInicioAtividade.String(); got != "2015-03-02" {
+		t.Errorf("DataInicioAtividade = %q, quer 2015-03-02", got)
+	}
+}
+
+func TestFiltroFundadaApos(t *testing.T) {
+	antiga, nova, semData := cnpjTeste("112223330001"), cnpjTeste("191312430001"), cnpjTeste("114447770001")
+	empresas := map[string]Empresa{antiga: empresaTeste("A"), nova: empresaTeste("B"), semData: empresaTeste("C")}
+	for cnpj, data := range map[string]string{antiga: "1998-07-01", nova: "2020-01-15"} {
+		e := empresas[cnpj]
+		inicio, _ := parseData(data)
+		e.DataInicioAtividade = dataISO{inicio}
+		empresas[cnpj] = e
+	}
+	entrada := linhaReceita(antiga, "", "", "") + linhaReceita(nova, "", "", "") + linhaReceita(semData, "", "", "")
+
+	casos := []struct {
+		nome, fundadaApos string
+		want, datas       []string
+	}{
+		{"sem filtro", "", []string{antiga, nova, semData}, []string{"1998-07-01", "2020-01-15", ""}},
+		{"após 2000", "2000-01-01", []string{nova}, []string{"2020-01-15"}},
+		{"no próprio dia", "2020-01-15", []string{nova}, []string{"2020-01-15"}},
+	}
+	for _, c := range casos {
+		t.Run(c.nome, func(t *testing.T) {
+			usarAmbienteTeste(t, &provedorFalso{empresas: empresas})
+			rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"workers": "1", "fundada_apos": c.fundadaApos},
+				arquivoTeste{"entrada.csv", entrada})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("/upload: %s", mensagemErro(rec))
+			}
+			cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+			if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, c.want) {
+				t.Errorf("CNPJs = %v, quer %v", got, c.want)
+			}
+			if got := coluna(t, cabecalho, linhas, "DataInicioAtividade"); !slices.Equal(got, c.datas) {
+				t.Errorf("DataInicioAtividade = %q, quer %q", got, c.datas)
+			}
+		})
+	}
+
+	usarAmbienteTeste(t, &provedorFalso{})
+	rec := enviarFormulario(t, uploadHandler, "/upload", map[string]string{"fundada_apos": "15/01/2020"},
+		arquivoTeste{"entrada.csv", entrada})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("fundada_apos fora do formato: %s, quer 400", mensagemErro(rec))
+	}
+}
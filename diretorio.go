@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// diretorioSaida recebe os arquivos de saída e de erros dos jobs; pode ser
+// ajustado pela variável de ambiente OUTPUT_DIR.
+var diretorioSaida = "."
+
+// caminhoSaida devolve o caminho em diretorioSaida de um arquivo de saída.
+// nome já deve ter passado por nomeSaidaValido ou ter sido gerado pelo servidor.
+func caminhoSaida(nome string) string {
+	return filepath.Join(diretorioSaida, nome)
+}
+
+// criarArquivoSaida cria um arquivo de saída novo em caminho, falhando com
+// fs.ErrExist em vez de truncar um arquivo de outro job com o mesmo nome.
+func criarArquivoSaida(caminho string) (*os.File, error) {
+	return os.OpenFile(caminho, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+}
+
+// prepararDiretorioSaida cria o diretório de saída, se necessário, e
+// confirma na inicialização que é possível gravar nele, em vez de o erro
+// aparecer só no primeiro job.
+func prepararDiretorioSaida(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("OUTPUT_DIR: %w", err)
+	}
+	teste, err := os.CreateTemp(dir, ".teste-gravacao-*")
+	if err != nil {
+		return fmt.Errorf("OUTPUT_DIR: sem permissão de gravação em %q: %w", dir, err)
+	}
+	teste.Close()
+	return os.Remove(teste.Name())
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiretorioSaidaConfigurado(t *testing.T) {
+	cnpj := cnpjTeste("112223330001")
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{cnpj: empresaTeste("A")}})
+	diretorioSaida = filepath.Join(t.TempDir(), "saidas", "empresas")
+	if err := prepararDiretorioSaida(diretorioSaida); err != nil {
+		t.Fatalf("prepararDiretorioSaida: %v", err)
+	}
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", nil, arquivoTeste{"entrada.csv", linhaReceita(cnpj, "", "", "")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	_, linhas := lerSaidaCSV(t, lerArquivoSaida(t, "empresas_"))
+	if len(linhas) != 1 {
+		t.Errorf("%d linhas no arquivo do diretório configurado, quer 1", len(linhas))
+	}
+	// O teste de gravação não deixa arquivos para trás
+	if restos, _ := filepath.Glob(filepath.Join(diretorioSaida, ".teste-gravacao-*")); len(restos) != 0 {
+		t.Errorf("arquivos de teste deixados em OUTPUT_DIR: %v", restos)
+	}
+}
+
+func TestDiretorioSaidaIndisponivel(t *testing.T) {
+	arquivo := filepath.Join(t.TempDir(), "arquivo")
+	if err := os.WriteFile(arquivo, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := prepararDiretorioSaida(filepath.Join(arquivo, "saidas")); err == nil {
+		t.Error("diretório dentro de um arquivo aceito")
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Falhas consecutivas do upstream que abrem o disjuntor e tempo que ele
+// fica aberto antes de deixar passar uma consulta de teste; ajustáveis pelas
+// variáveis de ambiente UPSTREAM_BREAKER_FAILURES (0 desativa) e
+// UPSTREAM_BREAKER_COOLDOWN.
+const (
+	falhasDisjuntorPadrao = 5
+	pausaDisjuntorPadrao  = 30 * time.Second
+)
+
+// ErrUpstreamIndisponivel é devolvido sem consultar o provedor enquanto o
+// disjuntor está aberto.
+var ErrUpstreamIndisponivel = errors.New("upstream indisponível (disjuntor aberto)")
+
+// errPrazoConsulta é a causa do contexto de uma consulta ao upstream cujo
+// prazo próprio, timeoutConsulta, esgotou. Só esse prazo conta como falha
+// do upstream no disjuntor; o de max_duration é do job.
+var errPrazoConsulta = errors.New("prazo da consulta ao upstream esgotado")
+
+// disjuntor interrompe as consultas ao upstream depois de limite falhas
+// seguidas, para que um job não espere o timeout de cada CNPJ com o
+// provedor fora do ar. Passada a pausa, uma única consulta de teste é
+// liberada: com sucesso o disjuntor fecha, com falha abre de novo.
+type disjuntor struct {
+	mu        sync.Mutex
+	limite    int
+	pausa     time.Duration
+	falhas    int
+	abertoAte time.Time
+	testando  bool
+}
+
+// disjuntorUpstream protege todas as consultas de CNPJ do servidor. Os
+// limites são definidos em main; sem limite o disjuntor nunca abre.
+var disjuntorUpstream = &disjuntor{}
+
+// aberto informa se o disjuntor está recusando as consultas, para que os
+// workers dispensem o CNPJ antes de esperar o limitador.
+func (d *disjuntor) aberto() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.limite > 0 && d.falhas >= d.limite && (d.testando || time.Now().Before(d.abertoAte))
+}
+
+// permitir informa se uma consulta pode ir ao upstream e se ela é a
+// consulta de teste do disjuntor meio aberto.
+func (d *disjuntor) permitir() (ok, teste bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.limite <= 0 || d.falhas < d.limite {
+		return true, false
+	}
+	if d.testando || time.Now().Before(d.abertoAte) {
+		return false, false
+	}
+	d.testando = true
+	return true, true
+}
+
+// registrar conta o resultado de uma consulta liberada por permitir, feita
+// com ctx. Só erros de disponibilidade (rede, 429, 5xx e timeout) contam
+// como falha; CNPJs inexistentes e respostas inválidas mostram que o
+// upstream responde.
+func (d *disjuntor) registrar(ctx context.Context, teste bool, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.limite <= 0 {
+		return
+	}
+	if teste {
+		d.testando = false
+	}
+	if ctx.Err() != nil && !errors.Is(context.Cause(ctx), errPrazoConsulta) {
+		// Consulta interrompida pelo job, cancelado ou no fim de
+		// max_duration, sem resposta do upstream
+		return
+	}
+	if !falhaUpstream(err) {
+		if d.falhas >= d.limite {
+			slog.Info("Upstream respondendo; disjuntor fechado", "event", "breaker_closed")
+		}
+		d.falhas = 0
+		return
+	}
+
+	d.falhas++
+	if d.falhas == d.limite || teste {
+		d.abertoAte = time.Now().Add(d.pausa)
+		slog.Warn("Upstream indisponível; disjuntor aberto", "event", "breaker_open",
+			"consecutive_failures", d.falhas, "cooldown_ms", d.pausa.Milliseconds(), "error", err)
+	}
+}
+
+// falhaUpstream informa se err indica o upstream fora do ar.
+func falhaUpstream(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch classificarErro(err) {
+	case motivoIndisponivel, motivoTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// provedorForaDoAr conta as consultas e responde todas como um upstream
+// fora do ar, depois de atraso.
+type provedorForaDoAr struct {
+	provedorFalso
+	atraso time.Duration
+}
+
+func (p *provedorForaDoAr) Consultar(ctx context.Context, cnpj string) (*Empresa, error) {
+	time.Sleep(p.atraso)
+	p.provedorFalso.Consultar(ctx, cnpj)
+	return nil, &erroTransitorio{err: errors.New("status code não OK: 503")}
+}
+
+// usarDisjuntor faz as consultas do teste passarem por d.
+func usarDisjuntor(t *testing.T, d *disjuntor) {
+	t.Helper()
+	anterior := disjuntorUpstream
+	t.Cleanup(func() { disjuntorUpstream = anterior })
+	disjuntorUpstream = d
+}
+
+func TestDisjuntorAbreETesta(t *testing.T) {
+	d := &disjuntor{limite: 3, pausa: 50 * time.Millisecond}
+	falha := &erroTransitorio{err: errors.New("status code não OK: 503")}
+	ctx := context.Background()
+
+	// CNPJs inexistentes mostram que o upstream responde e zeram a contagem
+	d.registrar(ctx, false, falha)
+	d.registrar(ctx, false, falha)
+	d.registrar(ctx, false, ErrCNPJNotFound)
+	d.registrar(ctx, false, falha)
+	d.registrar(ctx, false, falha)
+	if d.aberto() {
+		t.Fatal("disjuntor aberto antes de 3 falhas seguidas")
+	}
+	d.registrar(ctx, false, falha)
+	if ok, _ := d.permitir(); ok || !d.aberto() {
+		t.Fatal("disjuntor não abriu depois de 3 falhas seguidas")
+	}
+
+	// Passada a pausa, só uma consulta de teste é liberada; a falha dela reabre
+	time.Sleep(60 * time.Millisecond)
+	if ok, teste := d.permitir(); !ok || !teste {
+		t.Fatalf("permitir após a pausa = %v, %v; quer a consulta de teste", ok, teste)
+	}
+	if ok, _ := d.permitir(); ok {
+		t.Error("segunda consulta liberada durante o teste")
+	}
+	d.registrar(ctx, true, falha)
+	if ok, _ := d.permitir(); ok {
+		t.Error("disjuntor liberou consulta depois da falha do teste")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	_, teste := d.permitir()
+	d.registrar(ctx, teste, nil)
+	if ok, teste := d.permitir(); !ok || teste || d.aberto() {
+		t.Errorf("disjuntor não fechou com o sucesso do teste: %v, %v", ok, teste)
+	}
+}
+
+func TestDisjuntorIgnoraConsultasInterrompidasPeloJob(t *testing.T) {
+	d := &disjuntor{limite: 1, pausa: time.Minute}
+	cancelado, cancelar := context.WithCancel(context.Background())
+	cancelar()
+	fimDoJob, cancelarJob := context.WithTimeout(context.Background(), 0)
+	defer cancelarJob()
+	consultaNoFimDoJob, cancelarConsulta := context.WithTimeoutCause(fimDoJob, time.Minute, errPrazoConsulta)
+	defer cancelarConsulta()
+
+	for nome, ctx := range map[string]context.Context{"job cancelado": cancelado, "max_duration": consultaNoFimDoJob} {
+		d.registrar(ctx, false, ctx.Err())
+		if d.aberto() {
+			t.Fatalf("%s: disjuntor aberto por uma consulta interrompida pelo job", nome)
+		}
+	}
+
+	// O prazo da própria consulta esgotado é um upstream lento
+	lenta, cancelarLenta := context.WithTimeoutCause(context.Background(), 0, errPrazoConsulta)
+	defer cancelarLenta()
+	d.registrar(lenta, false, lenta.Err())
+	if !d.aberto() {
+		t.Error("disjuntor fechado depois do timeout da consulta")
+	}
+}
+
+func TestUploadComDisjuntorFalhaRapido(t *testing.T) {
+	cnpjs := cnpjsTeste(20)
+	p := &provedorForaDoAr{atraso: 30 * time.Millisecond}
+	usarAmbienteTeste(t, p)
+	usarDisjuntor(t, &disjuntor{limite: 3, pausa: time.Minute})
+	var entrada strings.Builder
+	for _, cnpj := range cnpjs {
+		entrada.WriteString(linhaReceita(cnpj, "", "", ""))
+	}
+
+	inicio := time.Now()
+	rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", map[string]string{"workers": "1"},
+		arquivoTeste{"entrada.csv", entrada.String()})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	if n := p.totalConsultas(); n != 3 {
+		t.Errorf("%d consultas ao upstream, quer 3; as demais devem falhar na hora", n)
+	}
+	// Sem o disjuntor seriam 20 consultas, mais de 1s só com o limitador
+	if duracao := time.Since(inicio); duracao > 800*time.Millisecond {
+		t.Errorf("job levou %v com o upstream fora do ar", duracao)
+	}
+
+	caminhos, _ := filepath.Glob(filepath.Join(diretorioSaida, "*_erros.csv"))
+	if len(caminhos) != 1 {
+		t.Fatalf("arquivos de erros = %v, quer 1", caminhos)
+	}
+	dados, err := os.ReadFile(caminhos[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, erros := lerSaidaCSV(t, string(dados))
+	motivos := map[string]int{}
+	for _, e := range erros {
+		motivos[e[1]]++
+	}
+	if motivos[motivoIndisponivel] != 3 || motivos[motivoDisjuntor] != 17 {
+		t.Errorf("motivos no CSV de erros = %v, quer 3 %s e 17 %s", motivos, motivoIndisponivel, motivoDisjuntor)
+	}
+}
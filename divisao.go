@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Valores aceitos no campo split_by do formulário.
+const (
+	semDivisao = ""
+	divisaoUF  = "uf"
+)
+
+// ufDesconhecida nomeia o arquivo das empresas sem UF válida.
+const ufDesconhecida = "SEM_UF"
+
+// parseDivisao interpreta o campo split_by. Vazio grava um único arquivo.
+func parseDivisao(valor string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(valor)) {
+	case "":
+		return semDivisao, nil
+	case divisaoUF:
+		return divisaoUF, nil
+	}
+	return "", fmt.Errorf("split_by inválido: %q (use uf)", valor)
+}
+
+// saidaPorUF grava cada empresa no arquivo da sua UF, criado na primeira
+// empresa do estado com o nome base seguido de _UF. As chamadas são
+// serializadas por escreverResultado, como nas demais saídas.
+type saidaPorUF struct {
+	base      string // caminho sem extensão
+	extensao  string
+	formato   string
+	opcoes    opcoesSaida
+	comprimir bool
+
+	arquivos map[string]*arquivoUF
+}
+
+type arquivoUF struct {
+	nome   string
+	file   *os.File
+	saida  escritorSaida
+	fechar func() error // conclui o gzip; nil sem compressão
+}
+
+func novaSaidaPorUF(base, formato string, opcoes opcoesSaida, compressao string) *saidaPorUF {
+	s := &saidaPorUF{
+		base:      base,
+		extensao:  extensaoSaida(formato),
+		formato:   formato,
+		opcoes:    opcoes,
+		comprimir: compressao == compressaoGzip,
+		arquivos:  make(map[string]*arquivoUF),
+	}
+	if s.comprimir {
+		s.extensao += extensaoGzip
+	}
+	return s
+}
+
+// Cabecalho não grava nada: cada arquivo recebe o cabeçalho ao ser criado.
+func (s *saidaPorUF) Cabecalho() error {
+	return nil
+}
+
+func (s *saidaPorUF) Escrever(res resultado) error {
+	uf := ufArquivo(res.empresa.UF)
+	arquivo, ok := s.arquivos[uf]
+	if !ok {
+		var err error
+		if arquivo, err = s.abrir(uf); err != nil {
+			return err
+		}
+		s.arquivos[uf] = arquivo
+	}
+	return arquivo.saida.Escrever(res)
+}
+
+// abrir cria o arquivo de uma UF e grava o seu cabeçalho.
+func (s *saidaPorUF) abrir(uf string) (*arquivoUF, error) {
+	caminho := s.base + "_" + uf + s.extensao
+	file, err := criarArquivoSaida(caminho)
+	if err != nil {
+		return nil, err
+	}
+	arquivo := &arquivoUF{nome: filepath.Base(caminho), file: file}
+
+	var destino io.Writer = file
+	if s.comprimir {
+		destino, arquivo.fechar = comprimirSaida(file)
+	}
+	arquivo.saida = novoEscritorSaida(destino, s.formato, s.opcoes)
+	if err := arquivo.saida.Cabecalho(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return arquivo, nil
+}
+
+func (s *saidaPorUF) Flush() error {
+	for _, arquivo := range s.arquivos {
+		if err := arquivo.saida.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fechar conclui todos os arquivos, mesmo quando um deles falha.
+func (s *saidaPorUF) Fechar() error {
+	var erros []error
+	for _, arquivo := range s.arquivos {
+		erros = append(erros, arquivo.saida.Fechar())
+		if arquivo.fechar != nil {
+			erros = append(erros, arquivo.fechar())
+		}
+		erros = append(erros, arquivo.file.Close())
+	}
+	return errors.Join(erros...)
+}
+
+// nomes devolve os arquivos criados, em ordem alfabética.
+func (s *saidaPorUF) nomes() []string {
+	nomes := make([]string, 0, len(s.arquivos))
+	for _, arquivo := range s.arquivos {
+		nomes = append(nomes, arquivo.nome)
+	}
+	sort.Strings(nomes)
+	return nomes
+}
+
+// ufArquivo normaliza a UF para o nome do arquivo; valores que não são duas
+// letras vão para ufDesconhecida.
+func ufArquivo(uf string) string {
+	uf = strings.ToUpper(strings.TrimSpace(uf))
+	if len(uf) != 2 || uf[0] < 'A' || uf[0] > 'Z' || uf[1] < 'A' || uf[1] > 'Z' {
+		return ufDesconhecida
+	}
+	return uf
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaidaDivididaPorUF(t *testing.T) {
+	cnpjs := cnpjsTeste(6)
+	empresas := map[string]Empresa{}
+	ufs := []string{"SP", "RJ", "SP", "MG", "rj", ""}
+	var entrada strings.Builder
+	for i, cnpj := range cnpjs {
+		e := empresaTeste("EMPRESA")
+		e.UF = ufs[i]
+		empresas[cnpj] = e
+		entrada.WriteString(linhaReceita(cnpj, "", "", ""))
+	}
+	usarAmbienteTeste(t, &provedorFalso{empresas: empresas})
+
+	rec := enviarFormulario(t, uploadHandler, "/upload", map[string]string{"split_by": "uf", "workers": "1"},
+		arquivoTeste{"entrada.csv", entrada.String()})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("/upload: %s, quer 202", mensagemErro(rec))
+	}
+	job := esperarJob(t, rec.Header().Get("X-Job-ID"))
+	if job.Status != statusDone || len(job.Files) != 4 {
+		t.Fatalf("job = %+v, quer 4 arquivos", job)
+	}
+
+	want := map[string][]string{
+		"SP":           {cnpjs[0], cnpjs[2]},
+		"RJ":           {cnpjs[1], cnpjs[4]},
+		"MG":           {cnpjs[3]},
+		ufDesconhecida: {cnpjs[5]},
+	}
+	for uf, cnpjsUF := range want {
+		i := slices.IndexFunc(job.Files, func(nome string) bool { return strings.HasSuffix(nome, "_"+uf+".csv") })
+		if i < 0 {
+			t.Errorf("sem arquivo de %s em %v", uf, job.Files)
+			continue
+		}
+		dados, err := os.ReadFile(filepath.Join(diretorioSaida, job.Files[i]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		cabecalho, linhas := lerSaidaCSV(t, string(dados))
+		if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, cnpjsUF) {
+			t.Errorf("arquivo de %s = %v, quer %v", uf, got, cnpjsUF)
+		}
+	}
+
+	// O resumo com wait=1 lista os arquivos gerados
+	processedCNPJs = novoCacheLRU[time.Time](maxEntradasCachePadrao)
+	rec = enviarFormulario(t, uploadHandler, "/upload?wait=1", map[string]string{"split_by": "uf"},
+		arquivoTeste{"entrada.csv", entrada.String()})
+	for _, uf := range []string{"SP", "RJ", "MG", ufDesconhecida} {
+		if !strings.Contains(rec.Body.String(), "_"+uf+".csv") {
+			t.Errorf("resumo sem o arquivo de %s:\n%s", uf, rec.Body.String())
+		}
+	}
+
+	if rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"split_by": "uf"},
+		arquivoTeste{"entrada.csv", entrada.String()}); rec.Code != http.StatusBadRequest {
+		t.Errorf("split_by com inline: status = %d, quer 400", rec.Code)
+	}
+}
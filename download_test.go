@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// baixar faz um GET em alvo pelo downloadHandler.
+func baixar(alvo string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	downloadHandler(rec, httptest.NewRequest(http.MethodGet, alvo, nil))
+	return rec
+}
+
+func TestDownloadHandler(t *testing.T) {
+	usarAmbienteTeste(t, &provedorFalso{})
+	nome := "empresas_capital_maior_50000_20240101_120000.csv"
+	conteudo := "CNPJ,RazaoSocial\n11222333000181,A\n"
+	if err := os.WriteFile(filepath.Join(diretorioSaida, nome), []byte(conteudo), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := baixar("/download?file=" + nome)
+	if rec.Code != http.StatusOK || rec.Body.String() != conteudo {
+		t.Fatalf("download: status %d, corpo %q", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if cd := rec.Header().Get("Content-Disposition"); cd != `attachment; filename="`+nome+`"` {
+		t.Errorf("Content-Disposition = %q", cd)
+	}
+
+	if rec := baixar("/download?file=empresas_capital_maior_1.csv"); rec.Code != http.StatusNotFound {
+		t.Errorf("arquivo inexistente: status = %d, quer 404", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	downloadHandler(rec, httptest.NewRequest(http.MethodPost, "/download?file="+nome, nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST: status = %d, quer 405", rec.Code)
+	}
+}
+
+func TestDownloadRejeitaNomesInvalidos(t *testing.T) {
+	usarAmbienteTeste(t, &provedorFalso{})
+	for _, nome := range []string{
+		"",
+		"main.go",
+		"../empresas_capital_maior_50000.csv",
+		"empresas_capital_maior_..%2Fmain.go",
+		"dir%2Fempresas_capital_maior_50000.csv",
+		"dir%5Cempresas_capital_maior_50000.csv",
+		"empresas_capital_maior_50000.txt",
+	} {
+		if rec := baixar("/download?file=" + nome); rec.Code != http.StatusBadRequest {
+			t.Errorf("file=%s: status = %d, quer 400", nome, rec.Code)
+		}
+	}
+}
+
+func TestDownloadRemoveAposEnvio(t *testing.T) {
+	usarAmbienteTeste(t, &provedorFalso{})
+	nome := "empresas_capital_maior_50000_20240101_120000.csv"
+	conteudo := "CNPJ;RazaoSocial\n11222333000181;A\n"
+	if err := os.WriteFile(filepath.Join(diretorioSaida, nome), []byte(conteudo), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	baixar := func(alvo string, cabecalhos map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, alvo, nil)
+		for chave, valor := range cabecalhos {
+			req.Header.Set(chave, valor)
+		}
+		rec := httptest.NewRecorder()
+		downloadHandler(rec, req)
+		return rec
+	}
+	existe := func() bool {
+		_, err := os.Stat(filepath.Join(diretorioSaida, nome))
+		return err == nil
+	}
+
+	if rec := baixar("/download?file="+nome, nil); rec.Code != http.StatusOK || !existe() {
+		t.Fatalf("download sem delete_after_download: status %d, arquivo mantido %v", rec.Code, existe())
+	}
+	// Envios parciais ou sem corpo mantêm o arquivo
+	alvo := "/download?file=" + nome + "&delete_after_download=1"
+	if rec := baixar(alvo, map[string]string{"Range": "bytes=0-3"}); rec.Code != http.StatusPartialContent || !existe() {
+		t.Errorf("download com Range: status %d, arquivo mantido %v", rec.Code, existe())
+	}
+	amanha := time.Now().Add(24 * time.Hour).UTC().Format(http.TimeFormat)
+	if rec := baixar(alvo, map[string]string{"If-Modified-Since": amanha}); rec.Code != http.StatusNotModified || !existe() {
+		t.Errorf("download com 304: status %d, arquivo mantido %v", rec.Code, existe())
+	}
+
+	rec := baixar(alvo, nil)
+	if rec.Code != http.StatusOK || rec.Body.String() != conteudo {
+		t.Fatalf("download completo: status %d, corpo %q", rec.Code, rec.Body.String())
+	}
+	if existe() {
+		t.Error("arquivo continua no servidor após o download completo")
+	}
+	if rec := baixar(alvo, nil); rec.Code != http.StatusNotFound {
+		t.Errorf("segundo download: status = %d, quer 404", rec.Code)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// respostaDryRun é o corpo JSON de um upload com dry_run=1: as contagens
+// do arquivo sem nenhuma consulta à API.
+type respostaDryRun struct {
+	TotalRows   int64 `json:"total_rows"`
+	Unreadable  int64 `json:"unreadable_rows"`
+	ValidCNPJs  int64 `json:"valid_cnpjs"`
+	UniqueCNPJs int64 `json:"unique_cnpjs"`
+	Duplicates  int64 `json:"duplicates"`
+	CacheHits   int64 `json:"cache_hits"`
+	ToQuery     int64 `json:"to_query"`
+}
+
+// responderDryRun escreve as contagens de um processamento em dry run.
+func responderDryRun(w http.ResponseWriter, resumo *resumoProcessamento) {
+	unicos := resumo.Validos.Load() - resumo.Duplicados.Load()
+	resposta := respostaDryRun{
+		TotalRows:   resumo.Total.Load(),
+		Unreadable:  resumo.Ilegiveis.Load(),
+		ValidCNPJs:  resumo.Validos.Load(),
+		UniqueCNPJs: unicos,
+		Duplicates:  resumo.Duplicados.Load(),
+		CacheHits:   resumo.EmCache.Load(),
+		ToQuery:     unicos - resumo.EmCache.Load(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resposta)
+}
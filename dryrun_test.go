@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDryRunContaSemConsultar(t *testing.T) {
+	a, b, emCache := cnpjTeste("112223330001"), cnpjTeste("191312430001"), cnpjTeste("114447770001")
+	transporte := &transporteFalso{}
+	usarAmbienteTeste(t, minhaReceita{baseURL: "http://minhareceita.teste", cliente: &http.Client{Transport: transporte}})
+	processedCNPJs.Set(emCache, time.Now())
+
+	entrada := linhaReceita(a, "", "", "") + linhaReceita(b, "", "", "") + linhaReceita(a, "", "", "") +
+		linhaReceita("11222333000199", "", "", "") + linhaReceita(emCache, "", "", "")
+	rec := enviarFormulario(t, uploadHandler, "/upload", map[string]string{"dry_run": "1"}, arquivoTeste{"entrada.csv", entrada})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	var got respostaDryRun
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("resposta não é JSON: %q", rec.Body.String())
+	}
+	want := respostaDryRun{TotalRows: 5, ValidCNPJs: 4, UniqueCNPJs: 3, Duplicates: 1, CacheHits: 1, ToQuery: 2}
+	if got != want {
+		t.Errorf("contagens = %+v, quer %+v", got, want)
+	}
+	if urls := transporte.urls(); len(urls) != 0 {
+		t.Errorf("dry run consultou a API: %v", urls)
+	}
+}
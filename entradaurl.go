@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// tamanhoMaximoURLPadrao limita o arquivo baixado por /upload-url quando
+// UPLOAD_URL_MAX_BYTES não está definida.
+const tamanhoMaximoURLPadrao = 10 << 30
+
+// errEntradaGrande indica um arquivo de /upload-url acima do tamanho máximo.
+var errEntradaGrande = errors.New("arquivo de entrada acima do tamanho máximo")
+
+var (
+	// tamanhoMaximoURL pode ser ajustado pela variável UPLOAD_URL_MAX_BYTES
+	tamanhoMaximoURL int64 = tamanhoMaximoURLPadrao
+
+	// clienteDownload baixa as entradas de /upload-url sem o timeout total
+	// do cliente das consultas, que interromperia arquivos grandes, e só de
+	// endereços públicos
+	clienteDownload = novoClienteExterno(enderecoPublico)
+)
+
+// uploadURLHandler responde POST /upload-url. O corpo é um objeto JSON com a
+// URL do arquivo de entrada em "url"; os demais campos têm o significado dos
+// campos do formulário de /upload, como {"url": "...", "uf": "SP,RJ"}. O
+// arquivo é lido durante o processamento, sem cópia local, e pode estar
+// compactado com gzip.
+func uploadURLHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	campos, err := lerCamposJSON(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Erro ao analisar o corpo JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	endereco, err := parseURLEntrada(campos.Get("url"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Com o formulário já preenchido, ParseMultipartForm em processarUpload
+	// não lê o corpo
+	r.Form, r.PostForm = campos, campos
+	r.MultipartForm = &multipart.Form{}
+	processarUpload(w, r, false, func(*http.Request) ([]entradaJob, error) {
+		entrada, err := baixarEntrada(endereco)
+		if err != nil {
+			return nil, err
+		}
+		return []entradaJob{entrada}, nil
+	})
+}
+
+// lerCamposJSON converte o objeto JSON do corpo em valores de formulário.
+// Números e booleanos viram texto; listas são unidas por vírgula.
+func lerCamposJSON(corpo io.Reader) (url.Values, error) {
+	dec := json.NewDecoder(corpo)
+	dec.UseNumber()
+	var objeto map[string]any
+	if err := dec.Decode(&objeto); err != nil {
+		return nil, err
+	}
+
+	campos := make(url.Values)
+	for chave, valor := range objeto {
+		texto, err := textoCampoJSON(valor)
+		if err != nil {
+			return nil, fmt.Errorf("campo %q: %w", chave, err)
+		}
+		campos.Set(chave, texto)
+	}
+	return campos, nil
+}
+
+func textoCampoJSON(valor any) (string, error) {
+	switch v := valor.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number, bool:
+		return fmt.Sprint(v), nil
+	case []any:
+		itens := make([]string, len(v))
+		for i, item := range v {
+			texto, err := textoCampoJSON(item)
+			if err != nil {
+				return "", err
+			}
+			itens[i] = texto
+		}
+		return strings.Join(itens, ","), nil
+	}
+	return "", errors.New("use texto, número, booleano ou lista")
+}
+
+// parseURLEntrada valida a URL do arquivo de entrada: http ou https absoluta.
+// O destino só é conferido na conexão, por clienteDownload, que recusa
+// endereços internos.
+func parseURLEntrada(valor string) (*url.URL, error) {
+	valor = strings.TrimSpace(valor)
+	if valor == "" {
+		return nil, errors.New(`informe a URL do arquivo de entrada em "url"`)
+	}
+	u, err := url.Parse(valor)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("url inválida: %q (use uma URL http ou https)", valor)
+	}
+	return u, nil
+}
+
+// baixarEntrada inicia o download do arquivo de entrada. O corpo da resposta
+// é lido pelo job, com um contexto que sobrevive à requisição a
+// /upload-url, e falha ao passar de tamanhoMaximoURL. O nome da URL não
+// precisa terminar em .csv: o conteúdo baixado é conferido como nos uploads.
+func baixarEntrada(endereco *url.URL) (entradaJob, error) {
+	req, err := http.NewRequestWithContext(contextoJobs, http.MethodGet, endereco.String(), nil)
+	if err != nil {
+		return entradaJob{}, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := clienteDownload.Do(req)
+	if errors.Is(err, errDestinoInterno) {
+		return entradaJob{}, &erroEntrada{status: http.StatusBadRequest, err: fmt.Errorf("url inválida: %w", err)}
+	}
+	if err != nil {
+		return entradaJob{}, &erroEntrada{status: http.StatusBadGateway, err: fmt.Errorf("erro ao baixar o arquivo: %w", err)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return entradaJob{}, &erroEntrada{status: http.StatusBadGateway, err: fmt.Errorf("erro ao baixar o arquivo: status code não OK: %d", resp.StatusCode)}
+	}
+	if resp.ContentLength > tamanhoMaximoURL {
+		resp.Body.Close()
+		return entradaJob{}, &erroEntrada{status: http.StatusRequestEntityTooLarge,
+			err: fmt.Errorf("%w (%d bytes; máximo %d)", errEntradaGrande, resp.ContentLength, tamanhoMaximoURL)}
+	}
+
+	return entradaJob{
+		nome:         nomeArquivoURL(endereco, resp.Header.Get("Content-Disposition")),
+		conteudo:     &leitorLimitado{ReadCloser: resp.Body, restante: tamanhoMaximoURL},
+		independente: true,
+		semExtensao:  true,
+	}, nil
+}
+
+// nomeArquivoURL usa o nome do Content-Disposition ou, sem ele, o último
+// segmento do caminho da URL.
+func nomeArquivoURL(endereco *url.URL, disposicao string) string {
+	if _, params, err := mime.ParseMediaType(disposicao); err == nil && params["filename"] != "" {
+		return path.Base(params["filename"])
+	}
+	return path.Base(endereco.Path)
+}
+
+// leitorLimitado devolve errEntradaGrande ao passar de restante bytes, em
+// vez de truncar o arquivo em silêncio como io.LimitReader.
+type leitorLimitado struct {
+	io.ReadCloser
+	restante int64
+}
+
+func (l *leitorLimitado) Read(p []byte) (int, error) {
+	if l.restante <= 0 {
+		// Um byte a mais distingue um arquivo do tamanho exato do limite
+		var b [1]byte
+		if n, _ := l.ReadCloser.Read(b[:]); n > 0 {
+			return 0, errEntradaGrande
+		}
+		return l.ReadCloser.Read(p)
+	}
+	if int64(len(p)) > l.restante {
+		p = p[:l.restante]
+	}
+	n, err := l.ReadCloser.Read(p)
+	l.restante -= int64(n)
+	return n, err
+}
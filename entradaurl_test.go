@@ -0,0 +1,166 @@
+package main
+
+import (
+	"compress/gzip"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// usarClienteDownload troca clienteDownload durante o teste.
+func usarClienteDownload(t *testing.T, c *http.Client) {
+	t.Helper()
+	anterior := clienteDownload
+	t.Cleanup(func() { clienteDownload = anterior })
+	clienteDownload = c
+}
+
+// enviarURL envia a /upload-url o corpo JSON e devolve a resposta.
+func enviarURL(corpo string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/upload-url?inline=1", strings.NewReader(corpo))
+	rec := httptest.NewRecorder()
+	uploadURLHandler(rec, req)
+	return rec
+}
+
+func TestUploadURLProcessaArquivoBaixado(t *testing.T) {
+	ativa, semCapital := cnpjTeste("112223330001"), cnpjTeste("191312430001")
+	p := &provedorFalso{empresas: map[string]Empresa{ativa: empresaTeste("EMPRESA GRANDE LTDA")}}
+	pequena := empresaTeste("EMPRESA PEQUENA LTDA")
+	pequena.CapitalSocial = 1000
+	p.empresas[semCapital] = pequena
+	usarAmbienteTeste(t, p)
+	// O servidor de teste escuta em 127.0.0.1, recusado pelo cliente padrão
+	usarClienteDownload(t, novoClienteExterno(func(netip.Addr) bool { return true }))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="Estabelecimentos0.csv.gz"`)
+		gz := gzip.NewWriter(w)
+		gz.Write([]byte(linhaReceita(ativa, "11", "32345678", "contato@empresa.com.br") +
+			linhaReceita(semCapital, "21", "22223333", "")))
+		gz.Close()
+	}))
+	defer srv.Close()
+
+	rec := enviarURL(`{"url": "` + srv.URL + `/dados/Estabelecimentos0.csv.gz", "rps": 20}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload-url: %s", mensagemErro(rec))
+	}
+	cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+	if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, []string{ativa}) {
+		t.Errorf("CNPJs na saída = %v, quer só %s", got, ativa)
+	}
+	if got := coluna(t, cabecalho, linhas, "Email"); len(got) != 1 || got[0] != "contato@empresa.com.br" {
+		t.Errorf("e-mail = %v", got)
+	}
+}
+
+func TestUploadURLSemExtensaoConfereConteudo(t *testing.T) {
+	ativa := cnpjTeste("112223330001")
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{ativa: empresaTeste("EMPRESA GRANDE LTDA")}})
+	usarClienteDownload(t, novoClienteExterno(func(netip.Addr) bool { return true }))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("id") == "2" {
+			w.Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
+			w.Write([]byte("PK\x03\x04\x14\x00\x06\x00"))
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv")
+		w.Write([]byte(linhaReceita(ativa, "11", "32345678", "")))
+	}))
+	defer srv.Close()
+
+	rec := enviarURL(`{"url": "` + srv.URL + `/export?id=1", "rps": 20}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload-url de /export?id=1: %s", mensagemErro(rec))
+	}
+	cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+	if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, []string{ativa}) {
+		t.Errorf("CNPJs na saída = %v, quer só %s", got, ativa)
+	}
+
+	if rec := enviarURL(`{"url": "` + srv.URL + `/export?id=2"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("/upload-url de uma planilha: %s, quer 400", mensagemErro(rec))
+	}
+}
+
+func TestUploadURLRecusaEnderecoInterno(t *testing.T) {
+	usarAmbienteTeste(t, &provedorFalso{})
+	var pedidos atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pedidos.Add(1)
+	}))
+	defer srv.Close()
+
+	rec := enviarURL(`{"url": "` + srv.URL + `/entrada.csv"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("/upload-url para %s: %s, quer 400", srv.URL, mensagemErro(rec))
+	}
+	if n := pedidos.Load(); n != 0 {
+		t.Errorf("servidor interno recebeu %d pedidos", n)
+	}
+}
+
+func TestUploadURLRecusaRedirecionamentoInterno(t *testing.T) {
+	usarAmbienteTeste(t, &provedorFalso{})
+	ouvinte, err := net.Listen("tcp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("127.0.0.2 indisponível: %v", err)
+	}
+	var pedidos atomic.Int32
+	interno := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pedidos.Add(1)
+	}))
+	interno.Listener.Close()
+	interno.Listener = ouvinte
+	interno.Start()
+	defer interno.Close()
+	redireciona := httptest.NewServer(http.RedirectHandler(interno.URL+"/entrada.csv", http.StatusFound))
+	defer redireciona.Close()
+
+	// Só o servidor que redireciona, em 127.0.0.1, é aceito
+	aceito := netip.MustParseAddr("127.0.0.1")
+	usarClienteDownload(t, novoClienteExterno(func(ip netip.Addr) bool { return ip == aceito }))
+
+	rec := enviarURL(`{"url": "` + redireciona.URL + `/entrada.csv"}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("/upload-url: %s, quer 400", mensagemErro(rec))
+	}
+	if n := pedidos.Load(); n != 0 {
+		t.Errorf("servidor interno recebeu %d pedidos pelo redirecionamento", n)
+	}
+}
+
+func TestEnderecoPublico(t *testing.T) {
+	casos := map[string]bool{
+		"8.8.8.8":             true,
+		"200.152.38.1":        true,
+		"2001:4860::8888":     true,
+		"127.0.0.1":           false,
+		"::1":                 false,
+		"10.1.2.3":            false,
+		"172.16.0.1":          false,
+		"192.168.0.10":        false,
+		"169.254.169.254":     false,
+		"fe80::1":             false,
+		"fd00::1":             false,
+		"100.64.0.1":          false,
+		"0.0.0.0":             false,
+		"::":                  false,
+		"224.0.0.1":           false,
+		"::ffff:127.0.0.1":    false,
+		"::ffff:192.168.1.1":  false,
+		"::ffff:200.152.38.1": true,
+	}
+	for endereco, want := range casos {
+		if got := enderecoPublico(netip.MustParseAddr(endereco)); got != want {
+			t.Errorf("enderecoPublico(%s) = %v, quer %v", endereco, got, want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+)
+
+// Motivos registrados na coluna Motivo do CSV de erros.
+const (
+	motivoNaoEncontrado = "not-found"
+	motivoTimeout       = "timeout"
+	motivoParse         = "parse-error"
+	motivoIndisponivel  = "upstream-error"
+	motivoRequisicao    = "request-error"
+	motivoEmailInvalido = "invalid-email"
+	motivoOrcamento     = "budget-exhausted"
+	motivoPrazo         = "timed-out"
+	motivoDisjuntor     = "upstream-unavailable"
+)
+
+// cabecalhoErros são as colunas do CSV de erros.
+var cabecalhoErros = []string{"CNPJ", "Motivo"}
+
+// nomeArquivoErros deriva o nome do CSV de erros a partir do nome base
+// (sem extensão) do arquivo de saída.
+func nomeArquivoErros(baseFileName string) string {
+	return baseFileName + "_erros.csv"
+}
+
+// classificarErro traduz o erro de uma consulta para o motivo do CSV de erros.
+func classificarErro(err error) string {
+	var netErr net.Error
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var transitorio *erroTransitorio
+
+	switch {
+	case errors.Is(err, ErrUpstreamIndisponivel):
+		return motivoDisjuntor
+	case errors.Is(err, ErrCNPJNotFound):
+		return motivoNaoEncontrado
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return motivoTimeout
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr):
+		return motivoParse
+	case errors.As(err, &transitorio):
+		return motivoIndisponivel
+	}
+	return motivoRequisicao
+}
+
+// motivoRepetivel informa se o registro de um CSV de erros (CNPJ, Motivo)
+// descreve uma consulta que não chegou a gravar a empresa. Com
+// motivoEmailInvalido a empresa foi gravada, apenas sem o e-mail.
+func motivoRepetivel(record []string) bool {
+	return len(record) < 2 || record[1] != motivoEmailInvalido
+}
+
+// registrarErro grava um CNPJ que não pôde ser processado no CSV de erros.
+// errosCSV pode ser nil, quando o job não mantém arquivo de erros.
+func registrarErro(errosCSV *csv.Writer, cnpj, motivo string) {
+	if errosCSV == nil {
+		return
+	}
+
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+
+	if err := errosCSV.Write([]string{cnpj, motivo}); err != nil {
+		slog.Error("Erro ao escrever no arquivo de erros", "event", "errors_write_failed", "cnpj", cnpj, "error", err)
+	}
+	errosCSV.Flush()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// provedorComErros falha as consultas dos CNPJs em falhas com o erro
+// correspondente e responde as demais como provedorFalso.
+type provedorComErros struct {
+	provedorFalso
+	falhas map[string]error
+}
+
+func (p *provedorComErros) Consultar(ctx context.Context, cnpj string) (*Empresa, error) {
+	if err, ok := p.falhas[cnpj]; ok {
+		return nil, err
+	}
+	return p.provedorFalso.Consultar(ctx, cnpj)
+}
+
+func TestArquivoErrosListaFalhas(t *testing.T) {
+	cnpjs := cnpjsTeste(5)
+	p := &provedorComErros{
+		provedorFalso: provedorFalso{empresas: map[string]Empresa{cnpjs[0]: empresaTeste("A"), cnpjs[1]: empresaTeste("B")}},
+		falhas: map[string]error{
+			cnpjs[3]: json.Unmarshal([]byte("{"), &Empresa{}),
+			cnpjs[4]: &erroTransitorio{err: errors.New("status code não OK: 503")},
+		},
+	}
+	usarAmbienteTeste(t, p)
+
+	var entrada strings.Builder
+	for _, cnpj := range cnpjs {
+		entrada.WriteString(linhaReceita(cnpj, "", "", ""))
+	}
+	rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", nil, arquivoTeste{"entrada.csv", entrada.String()})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+
+	caminhos, err := filepath.Glob(filepath.Join(diretorioSaida, "*_erros.csv"))
+	if err != nil || len(caminhos) != 1 {
+		t.Fatalf("arquivos de erros = %v, %v; quer 1", caminhos, err)
+	}
+	if nome := filepath.Base(caminhos[0]); !strings.Contains(rec.Body.String(), nome) {
+		t.Errorf("resposta não cita o arquivo de erros %s:\n%s", nome, rec.Body.String())
+	}
+	dados, err := os.ReadFile(caminhos[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	registros, err := csv.NewReader(bytes.NewReader(dados)).ReadAll()
+	if err != nil {
+		t.Fatalf("CSV de erros inválido: %v", err)
+	}
+	if len(registros) == 0 || !slices.Equal(registros[0], cabecalhoErros) {
+		t.Fatalf("CSV de erros sem cabeçalho: %q", registros)
+	}
+	got := registros[1:]
+	slices.SortFunc(got, func(a, b []string) int { return strings.Compare(a[0], b[0]) })
+	want := [][]string{
+		{cnpjs[2], motivoNaoEncontrado},
+		{cnpjs[3], motivoParse},
+		{cnpjs[4], motivoIndisponivel},
+	}
+	if !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("erros = %q, quer %q", got, want)
+	}
+}
+
+func TestClassificarErro(t *testing.T) {
+	casos := []struct {
+		err  error
+		want string
+	}{
+		{ErrCNPJNotFound, motivoNaoEncontrado},
+		{fmt.Errorf("consulta: %w", ErrCNPJNotFound), motivoNaoEncontrado},
+		{context.DeadlineExceeded, motivoTimeout},
+		{json.Unmarshal([]byte("{"), &Empresa{}), motivoParse},
+		{json.Unmarshal([]byte(`"x"`), new(int)), motivoParse},
+		{&erroTransitorio{err: errors.New("status code não OK: 502")}, motivoIndisponivel},
+		{errors.New("status code não OK: 403"), motivoRequisicao},
+	}
+	for _, c := range casos {
+		if got := classificarErro(c.err); got != c.want {
+			t.Errorf("classificarErro(%v) = %q, quer %q", c.err, got, c.want)
+		}
+	}
+}
+
+// cnpjsEnfileirados lê entrada com cfg e devolve os CNPJs enviados aos
+// workers, na ordem.
+func cnpjsEnfileirados(t *testing.T, entrada string, cfg jobConfig) []string {
+	t.Helper()
+	tarefas := make(chan tarefa)
+	var cnpjs []string
+	feito := make(chan struct{})
+	go func() {
+		defer close(feito)
+		for tf := range tarefas {
+			cnpjs = append(cnpjs, tf.cnpj)
+		}
+	}()
+	enfileirarTarefas(context.Background(), []*csv.Reader{csv.NewReader(strings.NewReader(entrada))}, tarefas, cfg, &resumoProcessamento{})
+	close(tarefas)
+	<-feito
+	return cnpjs
+}
+
+func TestReprocessarPulaEmpresasJaGravadas(t *testing.T) {
+	entrada := "CNPJ,Motivo\n" +
+		"11222333000181,not-found\n" +
+		"19131243000197,invalid-email\n" +
+		"11444777000161,timeout\n"
+	cfg := jobConfig{Colunas: mapeamentoErros, IgnorarCache: true, Reprocessar: true}
+
+	got := cnpjsEnfileirados(t, entrada, cfg)
+	if want := []string{"11222333000181", "11444777000161"}; !slices.Equal(got, want) {
+		t.Errorf("CNPJs reprocessados = %v, quer %v", got, want)
+	}
+}
+
+func TestReprocessarErros(t *testing.T) {
+	cnpjs := cnpjsTeste(3)
+	p := &provedorFalso{empresas: map[string]Empresa{cnpjs[0]: empresaTeste("A"), cnpjs[1]: empresaTeste("B")}}
+	usarAmbienteTeste(t, p)
+	// O reprocessamento ignora o cache: os CNPJs acabaram de ser consultados
+	for _, cnpj := range cnpjs {
+		processedCNPJs.Set(cnpj, time.Now())
+	}
+
+	entrada := "CNPJ,Motivo\n" + cnpjs[0] + ",timeout\n" + cnpjs[1] + ",upstream-error\n" + cnpjs[2] + ",not-found\n"
+	rec := enviarFormulario(t, reprocessHandler, "/reprocess?wait=1", map[string]string{"workers": "1"},
+		arquivoTeste{"empresas_erros.csv", entrada})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/reprocess: %s", mensagemErro(rec))
+	}
+	if n := p.totalConsultas(); n != 3 {
+		t.Errorf("%d consultas, quer as 3 do arquivo de erros", n)
+	}
+
+	cabecalho, linhas := lerSaidaCSV(t, lerArquivoSaida(t, "empresas_"))
+	if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, cnpjs[:2]) {
+		t.Errorf("CNPJs recuperados = %v, quer %v", got, cnpjs[:2])
+	}
+	caminhos, _ := filepath.Glob(filepath.Join(diretorioSaida, "*_reprocessado_erros.csv"))
+	if len(caminhos) != 1 {
+		t.Fatalf("arquivos de erros do reprocessamento = %v", caminhos)
+	}
+	dados, err := os.ReadFile(caminhos[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	registros, err := csv.NewReader(bytes.NewReader(dados)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]string{cabecalhoErros, {cnpjs[2], motivoNaoEncontrado}}; !slices.EqualFunc(registros, want, slices.Equal) {
+		t.Errorf("novo arquivo de erros = %q, quer %q", registros, want)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// errCEPNaoEncontrado indica que o geocodificador não conhece o CEP; o
+// resultado vazio é guardado no cache como os demais.
+var errCEPNaoEncontrado = errors.New("CEP não encontrado")
+
+// coordenadas são a latitude e a longitude de um CEP, em graus decimais como
+// devolvidos pelo geocodificador. Ficam vazias quando desconhecidas.
+type coordenadas struct {
+	Latitude  string
+	Longitude string
+}
+
+// geocodificador converte um CEP (8 dígitos) em coordenadas. Implementações
+// respeitam o prazo de ctx, como os provedores de CNPJ.
+type geocodificador interface {
+	Geocodificar(ctx context.Context, cep string) (coordenadas, error)
+}
+
+// URLs padrão dos serviços de geocodificação. VIACEP_URL e GEOCODE_URL
+// substituem, respectivamente, a do ViaCEP e a do provedor de coordenadas
+// escolhido em GEOCODE_PROVIDER.
+const (
+	viaCEPURLPadrao       = "https://viacep.com.br/ws"
+	nominatimURLPadrao    = "https://nominatim.openstreetmap.org"
+	brasilAPICEPURLPadrao = "https://brasilapi.com.br/api/cep/v2"
+)
+
+// Provedores de coordenadas aceitos em GEOCODE_PROVIDER.
+const (
+	geocodeNominatim = "nominatim" // ViaCEP e busca do endereço no Nominatim (OpenStreetMap)
+	geocodeBrasilAPI = "brasilapi" // API de CEP v2 da BrasilAPI, que já traz as coordenadas
+)
+
+// rpsNominatim é o máximo da política de uso do Nominatim público; vale
+// para todos os jobs, pois o geocodificador é compartilhado.
+const rpsNominatim = 1
+
+// maxEntradasGeocodePadrao limita o cache de coordenadas quando
+// GEOCODE_CACHE_MAX_ENTRIES não está definida.
+const maxEntradasGeocodePadrao = 100_000
+
+var (
+	// viaCEPURL completa o endereço dos CEPs; pode ser alterada pela
+	// variável VIACEP_URL
+	viaCEPURL = viaCEPURLPadrao
+
+	// geocodeURL aponta para o provedor de coordenadas; vazia usa a URL
+	// padrão do provedor. Pode ser alterada pela variável GEOCODE_URL
+	geocodeURL = ""
+
+	// geocodificadorCEP é usado com geocode=1, montado em main por
+	// novoGeocodificador; cada job o recebe em jobConfig.Geocodificador
+	geocodificadorCEP geocodificador = viaCEP{baseURL: viaCEPURL, cliente: client,
+		localizador: nominatim{baseURL: nominatimURLPadrao, cliente: client}}
+
+	// coordenadasPorCEP guarda as coordenadas já obtidas, inclusive as vazias
+	// de CEPs desconhecidos, para que empresas do mesmo CEP não repitam a
+	// consulta. Falhas transitórias não são guardadas.
+	coordenadasPorCEP = novoCacheLRU[coordenadas](maxEntradasGeocodePadrao)
+)
+
+// novoGeocodificador monta o geocodificador do provedor de GEOCODE_PROVIDER,
+// vazio para o padrão (nominatim), com as consultas feitas por cliente.
+// baseURL substitui a URL padrão do provedor de coordenadas.
+func novoGeocodificador(provedor, baseURL string, cliente *http.Client) (geocodificador, error) {
+	switch strings.ToLower(strings.TrimSpace(provedor)) {
+	case "", geocodeNominatim:
+		if baseURL == "" {
+			baseURL = nominatimURLPadrao
+		}
+		return viaCEP{baseURL: viaCEPURL, cliente: cliente,
+			localizador: nominatim{baseURL: baseURL, cliente: cliente, limiter: newRateLimiter(rpsNominatim)}}, nil
+	case geocodeBrasilAPI:
+		if baseURL == "" {
+			baseURL = brasilAPICEPURLPadrao
+		}
+		return brasilAPICEP{baseURL: baseURL, cliente: cliente}, nil
+	}
+	return nil, fmt.Errorf("GEOCODE_PROVIDER inválido: %q (use %s ou %s)", provedor, geocodeNominatim, geocodeBrasilAPI)
+}
+
+// geocodificarCEP devolve as coordenadas do CEP, consultando o geocodificador
+// só na primeira vez em que o CEP aparece. Falhas deixam as coordenadas
+// vazias sem interromper o job.
+func geocodificarCEP(ctx context.Context, g geocodificador, cep string) coordenadas {
+	cep = somenteDigitos(cep)
+	if len(cep) != 8 {
+		return coordenadas{}
+	}
+	if c, ok := coordenadasPorCEP.Get(cep); ok {
+		return c
+	}
+
+	c, err := g.Geocodificar(ctx, cep)
+	if err != nil && !errors.Is(err, errCEPNaoEncontrado) {
+		if ctx.Err() == nil {
+			slog.Warn("Erro ao geocodificar CEP", "event", "geocode_failed", "cep", cep, "error", err)
+		}
+		return coordenadas{}
+	}
+	coordenadasPorCEP.Set(cep, c)
+	return c
+}
+
+// enderecoCEP é o endereço de um CEP, usado para buscar as suas coordenadas.
+type enderecoCEP struct {
+	CEP        string
+	Logradouro string
+	Bairro     string
+	Municipio  string
+	UF         string
+}
+
+// localizador obtém as coordenadas de um endereço já completado pelo CEP.
+type localizador interface {
+	Localizar(ctx context.Context, endereco enderecoCEP) (coordenadas, error)
+}
+
+// viaCEP completa o endereço do CEP pelo ViaCEP, que não tem coordenadas, e
+// as obtém do endereço com o localizador configurado.
+type viaCEP struct {
+	baseURL     string
+	cliente     *http.Client
+	localizador localizador
+}
+
+// viaCEPResposta é a parte usada da resposta de /ws/{cep}/json/. CEPs
+// desconhecidos vêm com "erro": true, por vezes como texto.
+type viaCEPResposta struct {
+	Logradouro string          `json:"logradouro"`
+	Bairro     string          `json:"bairro"`
+	Localidade string          `json:"localidade"`
+	UF         string          `json:"uf"`
+	Erro       json.RawMessage `json:"erro"`
+}
+
+func (g viaCEP) Geocodificar(ctx context.Context, cep string) (coordenadas, error) {
+	var dados viaCEPResposta
+	err := obterJSON(ctx, g.cliente, fmt.Sprintf("%s/%s/json/", g.baseURL, cep), &dados)
+	if err != nil {
+		return coordenadas{}, err
+	}
+	if erro := strings.Trim(string(dados.Erro), `"`); erro != "" && erro != "false" {
+		return coordenadas{}, errCEPNaoEncontrado
+	}
+	return g.localizador.Localizar(ctx, enderecoCEP{
+		CEP:        cep,
+		Logradouro: dados.Logradouro,
+		Bairro:     dados.Bairro,
+		Municipio:  dados.Localidade,
+		UF:         dados.UF,
+	})
+}
+
+// nominatim busca as coordenadas do endereço na API de busca estruturada do
+// Nominatim. O serviço público aceita uma requisição por segundo,
+// respeitada por limiter; com uma instância própria em GEOCODE_URL o limite
+// continua valendo.
+type nominatim struct {
+	baseURL string
+	cliente *http.Client
+	limiter *rateLimiter // nil não limita
+}
+
+// nominatimResultado é a parte usada de cada resultado de /search.
+type nominatimResultado struct {
+	Lat string `json:"lat"`
+	Lon string `json:"lon"`
+}
+
+func (g nominatim) Localizar(ctx context.Context, e enderecoCEP) (coordenadas, error) {
+	consulta := url.Values{
+		"format":  {"jsonv2"},
+		"limit":   {"1"},
+		"country": {"Brasil"},
+		"city":    {e.Municipio},
+		"state":   {e.UF},
+	}
+	// CEPs gerais de município não têm logradouro
+	if e.Logradouro != "" {
+		consulta.Set("street", e.Logradouro)
+	}
+	if g.limiter != nil {
+		if err := g.limiter.Wait(ctx); err != nil {
+			return coordenadas{}, err
+		}
+	}
+
+	var resultados []nominatimResultado
+	if err := obterJSON(ctx, g.cliente, g.baseURL+"/search?"+consulta.Encode(), &resultados); err != nil {
+		return coordenadas{}, err
+	}
+	if len(resultados) == 0 {
+		return coordenadas{}, errCEPNaoEncontrado
+	}
+	return coordenadas{
+		Latitude:  strings.TrimSpace(resultados[0].Lat),
+		Longitude: strings.TrimSpace(resultados[0].Lon),
+	}, nil
+}
+
+// obterJSON faz o GET de endereco e decodifica a resposta em destino. 404 e
+// 400, devolvido pelo ViaCEP a CEPs malformados, viram errCEPNaoEncontrado.
+func obterJSON(ctx context.Context, cliente *http.Client, endereco string, destino any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endereco, nil)
+	if err != nil {
+		return fmt.Errorf("erro ao montar requisição: %w", err)
+	}
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := cliente.Do(req)
+	if err != nil {
+		return fmt.Errorf("erro na requisição HTTP: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusBadRequest {
+		return errCEPNaoEncontrado
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code não OK: %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(destino); err != nil {
+		return fmt.Errorf("erro ao decodificar JSON: %w", err)
+	}
+	return nil
+}
+
+// brasilAPICEP consulta /api/cep/v2/{cep} da BrasilAPI, que completa o
+// endereço e inclui as coordenadas quando as conhece, dispensando o ViaCEP.
+type brasilAPICEP struct {
+	baseURL string
+	cliente *http.Client
+}
+
+// brasilAPICEPResposta é a parte usada da resposta de /api/cep/v2/{cep}.
+type brasilAPICEPResposta struct {
+	Location struct {
+		Coordinates struct {
+			Latitude  json.RawMessage `json:"latitude"`
+			Longitude json.RawMessage `json:"longitude"`
+		} `json:"coordinates"`
+	} `json:"location"`
+}
+
+func (g brasilAPICEP) Geocodificar(ctx context.Context, cep string) (coordenadas, error) {
+	var dados brasilAPICEPResposta
+	if err := obterJSON(ctx, g.cliente, fmt.Sprintf("%s/%s", g.baseURL, cep), &dados); err != nil {
+		return coordenadas{}, err
+	}
+	return coordenadas{
+		Latitude:  textoCoordenada(dados.Location.Coordinates.Latitude),
+		Longitude: textoCoordenada(dados.Location.Coordinates.Longitude),
+	}, nil
+}
+
+// textoCoordenada aceita a coordenada como texto ou número JSON.
+func textoCoordenada(valor json.RawMessage) string {
+	var texto string
+	if json.Unmarshal(valor, &texto) == nil {
+		return strings.TrimSpace(texto)
+	}
+	var numero json.Number
+	if json.Unmarshal(valor, &numero) == nil {
+		return numero.String()
+	}
+	return ""
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// geocodificadorFalso devolve coordenadas prontas por CEP e conta as
+// consultas; CEPs ausentes falham como um provedor fora do ar.
+type geocodificadorFalso struct {
+	mu        sync.Mutex
+	porCEP    map[string]coordenadas
+	consultas int
+}
+
+func (g *geocodificadorFalso) Geocodificar(_ context.Context, cep string) (coordenadas, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.consultas++
+	c, ok := g.porCEP[cep]
+	if !ok {
+		return coordenadas{}, errors.New("status code não OK: 503")
+	}
+	return c, nil
+}
+
+// usarCacheCoordenadas troca o cache de coordenadas por um vazio de até max
+// entradas durante o teste.
+func usarCacheCoordenadas(t *testing.T, max int) {
+	t.Helper()
+	anterior := coordenadasPorCEP
+	t.Cleanup(func() { coordenadasPorCEP = anterior })
+	coordenadasPorCEP = novoCacheLRU[coordenadas](max)
+}
+
+// usarGeocodificador faz os jobs do teste geocodificarem com g, partindo de
+// um cache de coordenadas vazio.
+func usarGeocodificador(t *testing.T, g geocodificador) {
+	t.Helper()
+	anterior := geocodificadorCEP
+	t.Cleanup(func() { geocodificadorCEP = anterior })
+	geocodificadorCEP = g
+	usarCacheCoordenadas(t, maxEntradasGeocodePadrao)
+}
+
+func TestViaCEPComNominatim(t *testing.T) {
+	transporte := &transporteFalso{respostas: map[string]respostaFalsa{
+		"/ws/01310100/json/": {http.StatusOK, `{"cep":"01310-100","logradouro":"Avenida Paulista","bairro":"Bela Vista",` +
+			`"localidade":"São Paulo","uf":"SP"}`},
+		"/osm/search": {http.StatusOK, `[{"lat":"-23.5613","lon":"-46.6565","display_name":"Avenida Paulista"}]`},
+	}}
+	cliente := &http.Client{Transport: transporte}
+	g := viaCEP{baseURL: "http://viacep.teste/ws", cliente: cliente,
+		localizador: nominatim{baseURL: "http://nominatim.teste/osm", cliente: cliente}}
+
+	c, err := g.Geocodificar(context.Background(), "01310100")
+	if err != nil {
+		t.Fatalf("Geocodificar: %v", err)
+	}
+	if c != (coordenadas{Latitude: "-23.5613", Longitude: "-46.6565"}) {
+		t.Errorf("coordenadas = %+v", c)
+	}
+	urls := transporte.urls()
+	if len(urls) != 2 {
+		t.Fatalf("URLs pedidas = %v", urls)
+	}
+	busca := transporte.requisicoes[1].URL.Query()
+	if busca.Get("street") != "Avenida Paulista" || busca.Get("city") != "São Paulo" || busca.Get("state") != "SP" {
+		t.Errorf("busca no Nominatim = %v, quer o endereço completado pelo ViaCEP", busca)
+	}
+}
+
+func TestViaCEPNaoEncontrado(t *testing.T) {
+	transporte := &transporteFalso{respostas: map[string]respostaFalsa{
+		"/ws/99999999/json/": {http.StatusOK, `{"erro": "true"}`},
+		"/ws/00000000/json/": {http.StatusOK, `{"erro": true}`},
+	}}
+	cliente := &http.Client{Transport: transporte}
+	g := viaCEP{baseURL: "http://viacep.teste/ws", cliente: cliente,
+		localizador: nominatim{baseURL: "http://nominatim.teste", cliente: cliente}}
+
+	for _, cep := range []string{"99999999", "00000000"} {
+		if _, err := g.Geocodificar(context.Background(), cep); !errors.Is(err, errCEPNaoEncontrado) {
+			t.Errorf("Geocodificar(%s): erro = %v, quer errCEPNaoEncontrado", cep, err)
+		}
+	}
+	if n := len(transporte.urls()); n != 2 {
+		t.Errorf("%d requisições; CEP desconhecido não deve ir ao Nominatim", n)
+	}
+}
+
+func TestNovoGeocodificador(t *testing.T) {
+	if g, err := novoGeocodificador("", "", http.DefaultClient); err != nil {
+		t.Errorf("padrão: %v", err)
+	} else if v, ok := g.(viaCEP); !ok || v.localizador.(nominatim).baseURL != nominatimURLPadrao {
+		t.Errorf("padrão = %#v, quer ViaCEP com o Nominatim público", g)
+	} else {
+		v.localizador.(nominatim).limiter.Stop()
+	}
+	if g, err := novoGeocodificador("BrasilAPI", "http://cep.teste", http.DefaultClient); err != nil {
+		t.Errorf("brasilapi: %v", err)
+	} else if b, ok := g.(brasilAPICEP); !ok || b.baseURL != "http://cep.teste" {
+		t.Errorf("brasilapi = %#v", g)
+	}
+	if _, err := novoGeocodificador("google", "", http.DefaultClient); err == nil {
+		t.Error("provedor desconhecido aceito")
+	}
+}
+
+func TestGeocodificarCEPCache(t *testing.T) {
+	usarCacheCoordenadas(t, 2)
+	g := &geocodificadorFalso{porCEP: map[string]coordenadas{
+		"01310100": {"-23.56", "-46.65"},
+		"20040002": {"-22.90", "-43.17"},
+		"30130010": {"-19.92", "-43.94"},
+	}}
+	ctx := context.Background()
+
+	geocodificarCEP(ctx, g, "01310-100")
+	if c := geocodificarCEP(ctx, g, "01310100"); c.Latitude != "-23.56" || g.consultas != 1 {
+		t.Errorf("segunda consulta do CEP: %+v, %d consultas; quer 1, do cache", c, g.consultas)
+	}
+	// Falhas não são guardadas e deixam as coordenadas vazias
+	if c := geocodificarCEP(ctx, g, "40000000"); c != (coordenadas{}) {
+		t.Errorf("falha do provedor deu %+v", c)
+	}
+	geocodificarCEP(ctx, g, "40000000")
+	if g.consultas != 3 {
+		t.Errorf("%d consultas; CEP com falha deve ser tentado de novo", g.consultas)
+	}
+	// O cache não passa do limite, descartando o CEP usado há mais tempo
+	geocodificarCEP(ctx, g, "20040002")
+	geocodificarCEP(ctx, g, "30130010")
+	if n := coordenadasPorCEP.Len(); n != 2 {
+		t.Errorf("cache com %d CEPs, quer 2", n)
+	}
+	if _, ok := coordenadasPorCEP.Get("01310100"); ok {
+		t.Error("CEP mais antigo continua no cache cheio")
+	}
+}
+
+func TestUploadComGeocode(t *testing.T) {
+	comCEP, semCoordenadas := cnpjTeste("112223330001"), cnpjTeste("191312430001")
+	outra := empresaTeste("SEM COORDENADAS LTDA")
+	outra.Cep = "40000000"
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{comCEP: empresaTeste("A"), semCoordenadas: outra}})
+	usarGeocodificador(t, &geocodificadorFalso{porCEP: map[string]coordenadas{"01310100": {"-23.56", "-46.65"}}})
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"geocode": "1", "workers": "1"},
+		arquivoTeste{"entrada.csv", linhaReceita(comCEP, "", "", "") + linhaReceita(semCoordenadas, "", "", "")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+	if got := coluna(t, cabecalho, linhas, "Latitude"); !slices.Equal(got, []string{"-23.56", ""}) {
+		t.Errorf("Latitude = %q, quer vazia quando o provedor falha", got)
+	}
+	if got := coluna(t, cabecalho, linhas, "Longitude"); !slices.Equal(got, []string{"-46.65", ""}) {
+		t.Errorf("Longitude = %q", got)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Validade da última verificação do upstream, para que probes frequentes
+// não gerem uma requisição à API a cada chamada.
+const validadeVerificacaoUpstream = 30 * time.Second
+
+var (
+	inicioServidor = time.Now()
+
+	verificacaoUpstream struct {
+		sync.Mutex
+		em        time.Time
+		acessivel bool
+	}
+)
+
+// respostaHealthz é o corpo JSON de /healthz.
+type respostaHealthz struct {
+	Status    string `json:"status"`
+	CacheSize int    `json:"cache_size"`
+	Uptime    string `json:"uptime"`
+	Upstream  *bool  `json:"upstream_reachable,omitempty"`
+}
+
+// healthzHandler responde às verificações de liveness/readiness. Com
+// ?upstream=1 também informa se a API configurada está acessível.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	resposta := respostaHealthz{
+		Status:    "ok",
+		CacheSize: processedCNPJs.Len(),
+		Uptime:    time.Since(inicioServidor).Round(time.Second).String(),
+	}
+	if r.URL.Query().Get("upstream") == "1" {
+		acessivel := upstreamAcessivel(r.Context(), client, minhaReceitaURL)
+		resposta.Upstream = &acessivel
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resposta)
+}
+
+// upstreamAcessivel faz um HEAD por cliente na API principal em baseURL,
+// reaproveitando o resultado por validadeVerificacaoUpstream.
+func upstreamAcessivel(ctx context.Context, cliente *http.Client, baseURL string) bool {
+	verificacaoUpstream.Lock()
+	defer verificacaoUpstream.Unlock()
+
+	if time.Since(verificacaoUpstream.em) < validadeVerificacaoUpstream {
+		return verificacaoUpstream.acessivel
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	acessivel := false
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, baseURL, nil)
+	if err == nil {
+		if resp, err := cliente.Do(req); err == nil {
+			resp.Body.Close()
+			acessivel = resp.StatusCode < 500
+		}
+	}
+
+	verificacaoUpstream.em = time.Now()
+	verificacaoUpstream.acessivel = acessivel
+	return acessivel
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// usarVerificacaoUpstream descarta a última verificação do upstream antes e
+// depois do teste.
+func usarVerificacaoUpstream(t *testing.T) {
+	t.Helper()
+	limpar := func() {
+		verificacaoUpstream.Lock()
+		verificacaoUpstream.em, verificacaoUpstream.acessivel = time.Time{}, false
+		verificacaoUpstream.Unlock()
+	}
+	limpar()
+	t.Cleanup(limpar)
+}
+
+func TestHealthz(t *testing.T) {
+	usarAmbienteTeste(t, &provedorFalso{})
+	processedCNPJs.Set("11222333000181", time.Now())
+
+	rec := httptest.NewRecorder()
+	healthzHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, quer 200", rec.Code)
+	}
+	if tipo := rec.Header().Get("Content-Type"); tipo != "application/json" {
+		t.Errorf("Content-Type = %q", tipo)
+	}
+	var corpo map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &corpo); err != nil {
+		t.Fatalf("JSON inválido %q: %v", rec.Body.String(), err)
+	}
+	if corpo["status"] != "ok" || corpo["cache_size"] != 1.0 {
+		t.Errorf("corpo = %v", corpo)
+	}
+	if _, err := time.ParseDuration(corpo["uptime"].(string)); err != nil {
+		t.Errorf("uptime = %v: %v", corpo["uptime"], err)
+	}
+	if _, ok := corpo["upstream_reachable"]; ok {
+		t.Error("upstream verificado sem ?upstream=1")
+	}
+}
+
+func TestUpstreamAcessivel(t *testing.T) {
+	usarVerificacaoUpstream(t)
+	var heads atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			heads.Add(1)
+		}
+	}))
+	defer srv.Close()
+
+	ctx := context.Background()
+	if !upstreamAcessivel(ctx, srv.Client(), srv.URL) {
+		t.Error("upstream respondendo 200 dado como inacessível")
+	}
+	// Probes seguidos reaproveitam a última verificação
+	upstreamAcessivel(ctx, srv.Client(), srv.URL)
+	if n := heads.Load(); n != 1 {
+		t.Errorf("%d HEADs, quer 1 dentro da validade", n)
+	}
+
+	usarVerificacaoUpstream(t)
+	srv.Close()
+	if upstreamAcessivel(ctx, srv.Client(), srv.URL) {
+		t.Error("upstream fora do ar dado como acessível")
+	}
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/charmap"
+)
+
+// Quantidade máxima de bytes da primeira linha usada para detectar o delimitador.
+const tamanhoAmostraDelimitador = 64 << 10
+
+// bomUTF8 é a marca de ordem de bytes UTF-8 (EF BB BF).
+var bomUTF8 = []byte{0xEF, 0xBB, 0xBF}
+
+// errNaoCSV indica um arquivo de entrada recusado por arquivoPareceCSV.
+var errNaoCSV = errors.New("o arquivo de entrada não é um CSV")
+
+// opcoesLeitor ajusta a leitura da entrada para exportações fora do padrão.
+type opcoesLeitor struct {
+	// Delimitador separa os campos; zero para detectar pela primeira linha
+	Delimitador rune
+
+	// Comentario marca, no início da linha, linhas a ignorar; zero para nenhum
+	Comentario rune
+
+	// AspasFlexiveis aceita aspas fora do padrão RFC 4180 dentro dos campos
+	AspasFlexiveis bool
+
+	// SemExtensao dispensa a extensão .csv no nome; só o conteúdo é conferido
+	SemExtensao bool
+}
+
+// opcoesLeitorPadrao são as opções usadas quando o formulário não as informa.
+var opcoesLeitorPadrao = opcoesLeitor{AspasFlexiveis: true}
+
+// parseOpcoesLeitor lê os campos delimiter, comment e lazy_quotes do
+// formulário. delimiter e comment aceitam um único caractere (ou "tab");
+// lazy_quotes=0 exige aspas conforme a RFC 4180.
+func parseOpcoesLeitor(valor func(string) string) (opcoesLeitor, error) {
+	opcoes := opcoesLeitorPadrao
+	var err error
+	if opcoes.Delimitador, err = parseCaractereCSV("delimiter", valor("delimiter")); err != nil {
+		return opcoes, err
+	}
+	if opcoes.Comentario, err = parseCaractereCSV("comment", valor("comment")); err != nil {
+		return opcoes, err
+	}
+	if v := strings.TrimSpace(valor("lazy_quotes")); v != "" {
+		opcoes.AspasFlexiveis = parseFlag(v)
+	}
+	return opcoes, opcoes.validar()
+}
+
+// parseCaractereCSV interpreta um caractere de configuração do leitor CSV.
+// Vazio devolve zero.
+func parseCaractereCSV(campo, valor string) (rune, error) {
+	if valor == "" {
+		return 0, nil
+	}
+	if strings.EqualFold(valor, "tab") || valor == `\t` {
+		return '\t', nil
+	}
+	c, tamanho := utf8.DecodeRuneInString(valor)
+	if tamanho != len(valor) || c == utf8.RuneError {
+		return 0, fmt.Errorf("%s inválido: %q (informe um único caractere)", campo, valor)
+	}
+	return c, nil
+}
+
+// validar recusa as combinações que o csv.Reader não aceita.
+func (o opcoesLeitor) validar() error {
+	invalido := func(c rune) bool {
+		return c == '"' || c == '\r' || c == '\n' || c == utf8.RuneError
+	}
+	if o.Delimitador != 0 && invalido(o.Delimitador) {
+		return fmt.Errorf("delimiter inválido: %q", o.Delimitador)
+	}
+	if o.Comentario != 0 && invalido(o.Comentario) {
+		return fmt.Errorf("comment inválido: %q", o.Comentario)
+	}
+	if o.Comentario != 0 && o.Comentario == o.Delimitador {
+		return fmt.Errorf("comment e delimiter não podem ser o mesmo caractere (%q)", o.Comentario)
+	}
+	return nil
+}
+
+// novoLeitorEntrada prepara a leitura de um arquivo de entrada: descompacta
+// gzip, verifica se parece CSV, converte a codificação e os finais de linha
+// e, quando opcoes não fixa o delimitador, o detecta pela primeira linha que
+// não é comentário.
+// Usado pelo servidor e pela linha de comando.
+func novoLeitorEntrada(nome string, origem io.Reader, encoding string, opcoes opcoesLeitor) (*csv.Reader, error) {
+	raw := bufio.NewReaderSize(origem, tamanhoAmostraDelimitador)
+	nome, raw, err := descompactarEntrada(nome, raw)
+	if err != nil {
+		return nil, err
+	}
+	if !arquivoPareceCSV(nome, raw, opcoes.SemExtensao) {
+		return nil, errNaoCSV
+	}
+	input := bufio.NewReaderSize(novoFinaisLinhaReader(decodificarEntrada(raw, encoding), opcoes.Delimitador), tamanhoAmostraDelimitador)
+
+	reader := csv.NewReader(input)
+	reader.Comma = opcoes.Delimitador
+	if reader.Comma == 0 {
+		reader.Comma = detectarDelimitador(lerPrimeiraLinha(input, opcoes.Comentario))
+	}
+	// Um comentário igual ao delimitador detectado é recusado pelo csv.Reader
+	if opcoes.Comentario == reader.Comma {
+		return nil, fmt.Errorf("comment não pode ser igual ao delimitador do arquivo (%q)", reader.Comma)
+	}
+	reader.Comment = opcoes.Comentario
+	reader.LazyQuotes = opcoes.AspasFlexiveis
+	// Linhas com quantidade de colunas diferente são tratadas por registro
+	reader.FieldsPerRecord = -1
+	return reader, nil
+}
+
+// descompactarEntrada reconhece uploads gzip pela extensão .gz ou pelos
+// bytes mágicos 1f 8b e os descompacta durante a leitura. Devolve o nome do
+// arquivo sem o .gz, para a verificação de extensão de arquivoPareceCSV.
+func descompactarEntrada(nome string, r *bufio.Reader) (string, *bufio.Reader, error) {
+	magico, _ := r.Peek(2)
+	ehGzip := strings.EqualFold(filepath.Ext(nome), ".gz") || bytes.Equal(magico, []byte{0x1f, 0x8b})
+	if !ehGzip {
+		return nome, r, nil
+	}
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nome, nil, fmt.Errorf("arquivo gzip inválido: %w", err)
+	}
+	if strings.EqualFold(filepath.Ext(nome), ".gz") {
+		nome = nome[:len(nome)-len(".gz")]
+	}
+	return nome, bufio.NewReaderSize(gz, tamanhoAmostraDelimitador), nil
+}
+
+// arquivoPareceCSV rejeita uploads sem extensão .csv, a menos que
+// semExtensao a dispense, ou cujo conteúdo inicial é identificado como
+// binário (planilhas xlsx, PDFs, imagens). CSVs costumam ser detectados como
+// text/plain, que é aceito.
+func arquivoPareceCSV(nome string, r *bufio.Reader, semExtensao bool) bool {
+	if !semExtensao && !strings.EqualFold(filepath.Ext(nome), ".csv") {
+		return false
+	}
+
+	amostra, _ := r.Peek(512)
+	return len(amostra) == 0 || strings.HasPrefix(http.DetectContentType(amostra), "text/")
+}
+
+// detectarDelimitador escolhe entre ';', ',' e tabulação o caractere mais
+// frequente na primeira linha. Em caso de empate ou quando nenhum aparece,
+// usa ';', o delimitador do layout da Receita.
+func detectarDelimitador(primeiraLinha string) rune {
+	candidatos := []rune{';', ',', '\t'}
+
+	melhor, maior, empate := ';', 0, false
+	for _, c := range candidatos {
+		n := strings.Count(primeiraLinha, string(c))
+		switch {
+		case n > maior:
+			melhor, maior, empate = c, n, false
+		case n == maior && n > 0:
+			empate = true
+		}
+	}
+
+	if maior == 0 || empate {
+		return ';'
+	}
+	return melhor
+}
+
+// lerPrimeiraLinha devolve a primeira linha de r que não começa com
+// comentario, sem consumi-la. Com comentario zero é a primeira linha.
+func lerPrimeiraLinha(r *bufio.Reader, comentario rune) string {
+	amostra, _ := r.Peek(tamanhoAmostraDelimitador)
+	for {
+		linha, resto, _ := bytes.Cut(amostra, []byte("\n"))
+		if comentario == 0 || len(resto) == 0 || !bytes.HasPrefix(linha, []byte(string(comentario))) {
+			return string(linha)
+		}
+		amostra = resto
+	}
+}
+
+// Codificações aceitas no campo encoding do formulário.
+const (
+	encodingAuto   = "auto"
+	encodingUTF8   = "utf-8"
+	encodingLatin1 = "iso-8859-1"
+)
+
+// parseEncoding normaliza o campo encoding do formulário. Vazio equivale a
+// detecção automática.
+func parseEncoding(valor string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(valor)) {
+	case "", encodingAuto:
+		return encodingAuto, nil
+	case encodingUTF8, "utf8":
+		return encodingUTF8, nil
+	case encodingLatin1, "latin1", "latin-1", "iso8859-1":
+		return encodingLatin1, nil
+	}
+	return "", fmt.Errorf("encoding inválido: %q (use auto, utf-8 ou iso-8859-1)", valor)
+}
+
+// decodificarEntrada devolve um leitor UTF-8 para o arquivo de entrada. Em
+// modo automático uma amostra do início do arquivo é verificada e, quando
+// não é UTF-8 válido, o conteúdo é tratado como ISO-8859-1 (Latin-1), o
+// formato comum das exportações da Receita.
+func decodificarEntrada(r *bufio.Reader, encoding string) *bufio.Reader {
+	// O BOM que o Excel grava no início do arquivo não faz parte do primeiro
+	// campo e indica UTF-8
+	if inicio, _ := r.Peek(len(bomUTF8)); bytes.Equal(inicio, bomUTF8) {
+		r.Discard(len(bomUTF8))
+		encoding = encodingUTF8
+	}
+
+	if encoding == encodingAuto {
+		amostra, err := r.Peek(tamanhoAmostraDelimitador)
+		if amostraUTF8Valida(amostra, err == nil) {
+			encoding = encodingUTF8
+		} else {
+			encoding = encodingLatin1
+		}
+	}
+
+	if encoding == encodingLatin1 {
+		return bufio.NewReaderSize(charmap.ISO8859_1.NewDecoder().Reader(r), tamanhoAmostraDelimitador)
+	}
+	return r
+}
+
+// amostraUTF8Valida verifica a amostra ignorando um caractere multibyte
+// cortado no final quando a amostra não cobre o arquivo inteiro.
+func amostraUTF8Valida(amostra []byte, cortada bool) bool {
+	if cortada {
+		if inicio := ultimoInicioRune(amostra); inicio >= 0 && !utf8.FullRune(amostra[inicio:]) {
+			amostra = amostra[:inicio]
+		}
+	}
+	return utf8.Valid(amostra)
+}
+
+// ultimoInicioRune devolve a posição do último byte que inicia um caractere
+// UTF-8 nos últimos utf8.UTFMax bytes, ou -1 se não houver.
+func ultimoInicioRune(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// finaisLinhaReader converte em '\n' os '\r' isolados usados como final de
+// linha por arquivos do Mac antigo ou gerados em sistemas misturados, que o
+// csv.Reader não reconhece: sem a conversão o arquivo inteiro seria uma só
+// linha. "\r\n" passa como veio, e '\r' dentro de campos entre aspas é
+// mantido. Como no csv.Reader, só uma aspa no primeiro byte do campo o abre
+// entre aspas; uma aspa no meio de um campo, como em ab"c, é texto, e ""
+// dentro das aspas é uma aspa escapada.
+type finaisLinhaReader struct {
+	src   io.Reader
+	lido  [4096]byte
+	saida []byte
+	pos   int
+
+	// delimitadores são os bytes que separam os campos; sem o delimitador
+	// fixado pelo usuário, todos os candidatos de detectarDelimitador
+	delimitadores string
+
+	inicio bool // o próximo byte é o primeiro de um campo
+	aspas  bool // dentro de um campo entre aspas
+	fechou bool // a última aspa fechou o campo, ou era a primeira de um ""
+	cr     bool // último byte lido foi um '\r' fora de aspas, à espera do seguinte
+}
+
+// novoFinaisLinhaReader converte os finais de linha de src para um arquivo
+// separado por delimitador; zero considera todos os candidatos.
+func novoFinaisLinhaReader(src io.Reader, delimitador rune) *finaisLinhaReader {
+	delimitadores := ";,\t"
+	if delimitador != 0 && delimitador < utf8.RuneSelf {
+		delimitadores = string(delimitador)
+	}
+	return &finaisLinhaReader{src: src, delimitadores: delimitadores, inicio: true}
+}
+
+func (f *finaisLinhaReader) Read(p []byte) (int, error) {
+	for f.pos == len(f.saida) {
+		n, err := f.src.Read(f.lido[:])
+		f.saida, f.pos = f.saida[:0], 0
+		for _, b := range f.lido[:n] {
+			if f.cr {
+				f.cr = false
+				f.inicio = true
+				if b == '\n' {
+					f.saida = append(f.saida, '\r')
+				} else {
+					f.saida = append(f.saida, '\n')
+				}
+			}
+			if f.classificar(b) {
+				f.saida = append(f.saida, b)
+			}
+		}
+		if n == 0 && err != nil {
+			if !f.cr {
+				return 0, err
+			}
+			// '\r' no fim do arquivo também encerra a última linha
+			f.cr = false
+			f.saida = append(f.saida, '\n')
+		}
+	}
+
+	n := copy(p, f.saida[f.pos:])
+	f.pos += n
+	return n, nil
+}
+
+// classificar atualiza o estado dos campos com o byte b e informa se ele
+// segue para a saída; um '\r' fora de aspas fica pendente em cr até se saber
+// se é seguido de '\n'.
+func (f *finaisLinhaReader) classificar(b byte) bool {
+	if f.aspas {
+		if b == '"' {
+			f.aspas, f.fechou = false, true
+		}
+		return true
+	}
+	if f.fechou {
+		f.fechou = false
+		if b == '"' {
+			f.aspas = true
+			return true
+		}
+	}
+	inicio := f.inicio
+	f.inicio = b == '\n' || strings.IndexByte(f.delimitadores, b) >= 0
+	switch {
+	case b == '"' && inicio:
+		f.aspas = true
+	case b == '\r':
+		f.cr = true
+		return false
+	}
+	return true
+}
+
+// entradaJob é o arquivo de entrada de um job e o nome usado para
+// reconhecer sua extensão.
+type entradaJob struct {
+	nome     string
+	conteudo io.ReadCloser
+
+	// independente indica que conteudo continua legível depois do fim da
+	// requisição, dispensando a cópia dos jobs em segundo plano
+	independente bool
+
+	// semExtensao dispensa a extensão .csv no nome, que as URLs de
+	// /upload-url nem sempre têm, como em /export?id=1
+	semExtensao bool
+
+	// caminho e retomarDe identificam a retomada de um job: a cópia da
+	// entrada guardada pelo checkpoint e os registros já concluídos
+	caminho   string
+	retomarDe int64
+}
+
+// origemEntrada obtém os arquivos de entrada de uma requisição a
+// processarUpload, processados em sequência como uma única entrada.
+type origemEntrada func(r *http.Request) ([]entradaJob, error)
+
+// arquivoFormulario lê os arquivos do campo file do formulário multipart,
+// que pode ser repetido para enviar vários arquivos, como as partes mensais
+// de uma mesma base.
+func arquivoFormulario(r *http.Request) ([]entradaJob, error) {
+	if r.MultipartForm == nil || len(r.MultipartForm.File["file"]) == 0 {
+		return nil, http.ErrMissingFile
+	}
+	var entradas []entradaJob
+	for _, header := range r.MultipartForm.File["file"] {
+		file, err := header.Open()
+		if err != nil {
+			for _, e := range entradas {
+				e.conteudo.Close()
+			}
+			return nil, fmt.Errorf("%s: %w", header.Filename, err)
+		}
+		entradas = append(entradas, entradaJob{nome: header.Filename, conteudo: file})
+	}
+	return entradas, nil
+}
+
+// nomeEntradas descreve os arquivos de entrada de um job em /jobs, nos logs
+// e no resumo.
+func nomeEntradas(entradas []entradaJob) string {
+	nomes := make([]string, len(entradas))
+	for i, e := range entradas {
+		nomes[i] = e.nome
+	}
+	return strings.Join(nomes, ", ")
+}
+
+// erroEntrada é uma falha ao obter o arquivo de entrada com o status HTTP
+// a responder; as demais falhas respondem 400.
+type erroEntrada struct {
+	status int
+	err    error
+}
+
+func (e *erroEntrada) Error() string { return e.err.Error() }
+func (e *erroEntrada) Unwrap() error { return e.err }
+
+func statusErroEntrada(err error) int {
+	var e *erroEntrada
+	if errors.As(err, &e) {
+		return e.status
+	}
+	return http.StatusBadRequest
+}
+
+// copiarUpload grava o arquivo enviado em um arquivo temporário próprio em
+// dir, ou no diretório temporário do sistema se dir for vazio. Os arquivos
+// do formulário multipart são removidos ao fim da requisição, então jobs em
+// segundo plano precisam de uma cópia que sobreviva a ela.
+func copiarUpload(origem io.Reader, dir string) (*os.File, error) {
+	destino, err := os.CreateTemp(dir, "upload-*.csv")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(destino, origem); err != nil {
+		destino.Close()
+		os.Remove(destino.Name())
+		return nil, err
+	}
+	if _, err := destino.Seek(0, io.SeekStart); err != nil {
+		destino.Close()
+		os.Remove(destino.Name())
+		return nil, err
+	}
+	return destino, nil
+}
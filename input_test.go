@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDetectarDelimitador(t *testing.T) {
+	casos := []struct {
+		linha string
+		want  rune
+	}{
+		{`"CNPJ";"RAZAO";"UF"`, ';'},
+		{"CNPJ,RAZAO,UF", ','},
+		{"CNPJ\tRAZAO\tUF", '\t'},
+		{`"CNPJ";"RAZAO, LTDA";"UF"`, ';'}, // vírgula dentro de campo em minoria
+		{"CNPJ,RAZAO;UF", ';'},             // empate
+		{"CNPJ", ';'},                      // nenhum candidato
+		{"", ';'},                          // arquivo vazio
+		{"CNPJ\tRAZAO\tUF,MUNICIPIO", '\t'},
+	}
+	for _, c := range casos {
+		if got := detectarDelimitador(c.linha); got != c.want {
+			t.Errorf("detectarDelimitador(%q) = %q, quer %q", c.linha, got, c.want)
+		}
+	}
+}
+
+func TestLerPrimeiraLinha(t *testing.T) {
+	r := bufio.NewReaderSize(strings.NewReader("CNPJ,UF\n11222333000181,SP\n"), tamanhoAmostraDelimitador)
+	if got := lerPrimeiraLinha(r, 0); got != "CNPJ,UF" {
+		t.Errorf("primeira linha = %q, quer CNPJ,UF", got)
+	}
+	// A amostra não consome a entrada
+	if resto, _ := r.ReadString(0); resto != "CNPJ,UF\n11222333000181,SP\n" {
+		t.Errorf("entrada depois da amostra = %q", resto)
+	}
+}
+
+func TestUploadDetectaDelimitador(t *testing.T) {
+	cnpj := cnpjTeste("112223330001")
+	linha := strings.TrimSuffix(linhaReceita(cnpj, "11", "33334444", ""), "\n")
+	for nome, delimitador := range map[string]string{"vírgula": ",", "tabulação": "\t"} {
+		t.Run(nome, func(t *testing.T) {
+			usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{cnpj: empresaTeste("EMPRESA")}})
+			entrada := strings.ReplaceAll(linha, `";"`, `"`+delimitador+`"`) + "\n"
+			rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", nil, arquivoTeste{"entrada.csv", entrada})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("/upload: %s", mensagemErro(rec))
+			}
+			cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+			if got := coluna(t, cabecalho, linhas, "Telefone"); !slices.Equal(got, []string{"+55 (11) 3333-4444"}) {
+				t.Errorf("Telefone = %v, quer [+55 (11) 3333-4444]", got)
+			}
+		})
+	}
+}
+
+func TestDecodificarEntrada(t *testing.T) {
+	latin1 := "CNPJ;MUNICIPIO\n11222333000181;S\xe3o Paulo - Funda\xe7\xe3o\n"
+	emUTF8 := "CNPJ;MUNICIPIO\n11222333000181;São Paulo - Fundação\n"
+
+	casos := []struct {
+		nome, encoding, entrada string
+	}{
+		{"detectado", encodingAuto, latin1},
+		{"forçado", encodingLatin1, latin1},
+		{"UTF-8 mantido", encodingAuto, emUTF8},
+	}
+	for _, c := range casos {
+		r := decodificarEntrada(bufio.NewReaderSize(strings.NewReader(c.entrada), tamanhoAmostraDelimitador), c.encoding)
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("%s: %v", c.nome, err)
+		}
+		if string(got) != emUTF8 {
+			t.Errorf("%s: entrada decodificada = %q, quer %q", c.nome, got, emUTF8)
+		}
+	}
+}
+
+func TestAmostraUTF8Cortada(t *testing.T) {
+	// "ã" cortado no fim de uma amostra parcial não faz o arquivo parecer Latin-1
+	if !amostraUTF8Valida([]byte("S\xc3"), true) {
+		t.Error("amostra cortada no meio de um caractere tratada como inválida")
+	}
+	if amostraUTF8Valida([]byte("S\xc3"), false) {
+		t.Error("arquivo terminado no meio de um caractere tratado como UTF-8")
+	}
+}
+
+func TestParseEncoding(t *testing.T) {
+	for valor, want := range map[string]string{"": encodingAuto, "AUTO": encodingAuto, "utf8": encodingUTF8, " Latin1 ": encodingLatin1} {
+		if got, err := parseEncoding(valor); err != nil || got != want {
+			t.Errorf("parseEncoding(%q) = %q, %v; quer %q", valor, got, err, want)
+		}
+	}
+	if _, err := parseEncoding("cp1252"); err == nil {
+		t.Error("encoding desconhecido aceito")
+	}
+}
+
+func TestUploadRecusaArquivoNaoCSV(t *testing.T) {
+	cnpj := cnpjTeste("112223330001")
+	casos := []struct {
+		nome   string
+		arq    arquivoTeste
+		status int
+	}{
+		{"planilha xlsx", arquivoTeste{"empresas.xlsx", "PK\x03\x04\x14\x00\x06\x00"}, http.StatusBadRequest},
+		{"PDF renomeado", arquivoTeste{"empresas.csv", "%PDF-1.7\n%\xe2\xe3\xcf\xd3\n1 0 obj"}, http.StatusBadRequest},
+		{"CSV válido", arquivoTeste{"Empresas.CSV", linhaReceita(cnpj, "", "", "")}, http.StatusOK},
+	}
+	for _, c := range casos {
+		t.Run(c.nome, func(t *testing.T) {
+			usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{cnpj: empresaTeste("A")}})
+			rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", nil, c.arq)
+			if rec.Code != c.status {
+				t.Fatalf("/upload de %s: %s, quer %d", c.arq.nome, mensagemErro(rec), c.status)
+			}
+			if c.status == http.StatusBadRequest && !strings.Contains(rec.Body.String(), "CSV") {
+				t.Errorf("mensagem sem pedir um CSV: %q", rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestUploadGzipIgualAoCSV(t *testing.T) {
+	cnpjs := cnpjsTeste(3)
+	empresas := map[string]Empresa{}
+	var entrada strings.Builder
+	for _, cnpj := range cnpjs {
+		empresas[cnpj] = empresaTeste("EMPRESA")
+		entrada.WriteString(linhaReceita(cnpj, "11", "32345678", ""))
+	}
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(entrada.String()))
+	w.Close()
+
+	enviar := func(arq arquivoTeste) *httptest.ResponseRecorder {
+		t.Helper()
+		usarAmbienteTeste(t, &provedorFalso{empresas: empresas})
+		return enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"workers": "1"}, arq)
+	}
+	rec := enviar(arquivoTeste{"entrada.csv", entrada.String()})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload do CSV: %s", mensagemErro(rec))
+	}
+	_, linhasCSV := lerSaidaCSV(t, rec.Body.String())
+
+	// Pela extensão e pelos bytes mágicos, mesmo com o nome sem .gz
+	for _, nome := range []string{"entrada.csv.gz", "entrada.csv"} {
+		rec := enviar(arquivoTeste{nome, gz.String()})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("/upload de %s: %s", nome, mensagemErro(rec))
+		}
+		if _, linhas := lerSaidaCSV(t, rec.Body.String()); !reflect.DeepEqual(linhas, linhasCSV) || len(linhas) != 3 {
+			t.Errorf("%s: linhas = %q, quer as do CSV %q", nome, linhas, linhasCSV)
+		}
+	}
+
+	if rec := enviar(arquivoTeste{"entrada.csv.gz", "\x1f\x8bnao e gzip"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("gzip corrompido: %s, quer 400", mensagemErro(rec))
+	}
+}
+
+func TestEntradaComBOM(t *testing.T) {
+	primeiro, segundo := cnpjTeste("112223330001"), cnpjTeste("191312430001")
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{primeiro: empresaTeste("A"), segundo: empresaTeste("B")}})
+	entrada := arquivoTeste{"entrada.csv", "\ufeff" + linhaReceita(primeiro, "", "", "") + linhaReceita(segundo, "", "", "")}
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"workers": "1"}, entrada)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	if strings.HasPrefix(rec.Body.String(), "\ufeff") {
+		t.Error("saída com BOM sem bom=1")
+	}
+	cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+	if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, []string{primeiro, segundo}) {
+		t.Errorf("CNPJs = %v, quer o primeiro registro intacto", got)
+	}
+
+	rec = enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"bom": "1"}, entrada)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload com bom=1: %s", mensagemErro(rec))
+	}
+	if !strings.HasPrefix(rec.Body.String(), "\ufeffCNPJ,") {
+		t.Errorf("saída com bom=1 começa com %q", rec.Body.String()[:min(10, rec.Body.Len())])
+	}
+}
+
+func TestEntradaComLinhasDeComentario(t *testing.T) {
+	a, b := cnpjTeste("112223330001"), cnpjTeste("191312430001")
+	p := &provedorFalso{empresas: map[string]Empresa{a: empresaTeste("A"), b: empresaTeste("B")}}
+	usarAmbienteTeste(t, p)
+	// O comentário inicial tem mais vírgulas que ponto e vírgula, e não deve
+	// pesar na detecção do delimitador
+	entrada := "# exportado em 01/02/2024, filtro: SP, RJ, MG\n" + linhaReceita(a, "", "", "") +
+		"# " + b + " removido da lista; não consultar\n" + linhaReceita(b, "", "", "")
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"comment": "#", "workers": "1"},
+		arquivoTeste{"entrada.csv", entrada})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+	if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, []string{a, b}) {
+		t.Errorf("CNPJs = %v, quer %v", got, []string{a, b})
+	}
+	if n := p.totalConsultas(); n != 2 {
+		t.Errorf("%d consultas, quer 2", n)
+	}
+}
+
+func TestEntradaAspasFlexiveis(t *testing.T) {
+	cnpj := cnpjTeste("112223330001")
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{cnpj: empresaTeste("A")}})
+	campos := make([]string, 30)
+	campos[0], campos[1], campos[2], campos[3] = cnpj[:8], cnpj[8:12], cnpj[12:], `EMPRESA "A" LTDA`
+	entrada := arquivoTeste{"entrada.csv", strings.Join(campos, ";") + "\n"}
+
+	// Aceitas por padrão; com lazy_quotes=0 a linha fora do RFC 4180 é recusada
+	for lazy, want := range map[string]int{"": 1, "0": 0} {
+		processedCNPJs = novoCacheLRU[time.Time](maxEntradasCachePadrao)
+		rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"lazy_quotes": lazy}, entrada)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("/upload com lazy_quotes=%q: %s", lazy, mensagemErro(rec))
+		}
+		if _, linhas := lerSaidaCSV(t, rec.Body.String()); len(linhas) != want {
+			t.Errorf("%d linhas com lazy_quotes=%q, quer %d", len(linhas), lazy, want)
+		}
+	}
+}
+
+func TestParseOpcoesLeitor(t *testing.T) {
+	formulario := func(campos map[string]string) func(string) string {
+		return func(nome string) string { return campos[nome] }
+	}
+	o, err := parseOpcoesLeitor(formulario(map[string]string{"delimiter": "tab", "comment": "#", "lazy_quotes": "0"}))
+	if err != nil || o.Delimitador != '\t' || o.Comentario != '#' || o.AspasFlexiveis {
+		t.Errorf("parseOpcoesLeitor = %+v, %v", o, err)
+	}
+	for _, campos := range []map[string]string{
+		{"delimiter": ";", "comment": ";"},
+		{"delimiter": `"`},
+		{"comment": "\n"},
+		{"delimiter": ";;"},
+	} {
+		if _, err := parseOpcoesLeitor(formulario(campos)); err == nil {
+			t.Errorf("parseOpcoesLeitor(%q) aceito", campos)
+		}
+	}
+}
+
+func TestUploadVariosArquivos(t *testing.T) {
+	janeiro, fevereiro, repetido, ausente := cnpjTeste("112223330001"), cnpjTeste("191312430001"),
+		cnpjTeste("114447770001"), cnpjTeste("123456780001")
+	p := &provedorFalso{empresas: map[string]Empresa{janeiro: empresaTeste("A"), fevereiro: empresaTeste("B"), repetido: empresaTeste("C")}}
+	usarAmbienteTeste(t, p)
+
+	// Um dos arquivos vem com ; e o outro com , como delimitador
+	rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", map[string]string{"ordered": "1"},
+		arquivoTeste{"janeiro.csv", linhaReceita(janeiro, "", "", "") + linhaReceita(repetido, "", "", "")},
+		arquivoTeste{"fevereiro.csv", strings.ReplaceAll(linhaReceita(repetido, "", "", "")+
+			linhaReceita(fevereiro, "", "", "")+linhaReceita(ausente, "", "", ""), ";", ",")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	corpo := rec.Body.String()
+	for _, want := range []string{"janeiro.csv, fevereiro.csv", "consultados uma única vez: 1<", "Registros lidos: 5 ",
+		"não encontrados na base: 1<"} {
+		if !strings.Contains(corpo, want) {
+			t.Errorf("resumo sem %q:\n%s", want, corpo)
+		}
+	}
+
+	cabecalho, linhas := lerSaidaCSV(t, lerArquivoSaida(t, "empresas_"))
+	if got, want := coluna(t, cabecalho, linhas, "CNPJ"), []string{janeiro, repetido, fevereiro}; !slices.Equal(got, want) {
+		t.Errorf("CNPJs na saída = %v, quer %v", got, want)
+	}
+	if n := p.totalConsultas(); n != 4 {
+		t.Errorf("%d consultas, quer 4; o CNPJ repetido entre os arquivos é consultado uma vez", n)
+	}
+}
+
+func lerRegistros(t *testing.T, entrada string, opcoes opcoesLeitor) [][]string {
+	t.Helper()
+	reader, err := novoLeitorEntrada("entrada.csv", strings.NewReader(entrada), "", opcoes)
+	if err != nil {
+		t.Fatalf("novoLeitorEntrada: %v", err)
+	}
+	var registros [][]string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return registros
+		}
+		if errors.Is(err, csv.ErrBareQuote) {
+			registros = append(registros, []string{"<aspa solta>"})
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		registros = append(registros, record)
+	}
+}
+
+func TestFinaisLinhaCRIsolado(t *testing.T) {
+	casos := []struct {
+		nome    string
+		entrada string
+		opcoes  opcoesLeitor
+		want    [][]string
+	}{
+		{
+			nome:    "só \\r",
+			entrada: "cnpj;email\r11222333000181;a@b.com\r19131243000197;\r",
+			want:    [][]string{{"cnpj", "email"}, {"11222333000181", "a@b.com"}, {"19131243000197", ""}},
+		},
+		{
+			nome:    "aspa no meio de um campo não abre aspas",
+			entrada: "cnpj\r11222333000181\rab\"c\r19131243000197\r",
+			want:    [][]string{{"cnpj"}, {"11222333000181"}, {"<aspa solta>"}, {"19131243000197"}},
+		},
+		{
+			nome:    "aspa no meio de um campo com lazy_quotes",
+			entrada: "cnpj;nome\r11222333000181;ab\"c\r19131243000197;x\r",
+			opcoes:  opcoesLeitor{AspasFlexiveis: true},
+			want:    [][]string{{"cnpj", "nome"}, {"11222333000181", "ab\"c"}, {"19131243000197", "x"}},
+		},
+		{
+			nome:    "\\r dentro de aspas é mantido",
+			entrada: "\"a\rb\";x\r\"c\"\"d\r\";y\r",
+			want:    [][]string{{"a\rb", "x"}, {"c\"d\r", "y"}},
+		},
+		{
+			nome:    "aspas depois do delimitador fixado",
+			entrada: "a|\"b\rc\"\rd|e\r",
+			opcoes:  opcoesLeitor{Delimitador: '|'},
+			want:    [][]string{{"a", "b\rc"}, {"d", "e"}},
+		},
+		{
+			nome:    "\\r\\n e \\r misturados",
+			entrada: "cnpj\r\n11222333000181\r19131243000197\n11444777000161",
+			want:    [][]string{{"cnpj"}, {"11222333000181"}, {"19131243000197"}, {"11444777000161"}},
+		},
+	}
+	for _, c := range casos {
+		t.Run(c.nome, func(t *testing.T) {
+			if got := lerRegistros(t, c.entrada, c.opcoes); !reflect.DeepEqual(got, c.want) {
+				t.Errorf("registros = %q, quer %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestFinaisLinhaLeituraPicada(t *testing.T) {
+	// Os estados de aspas e de '\r' pendente atravessam as leituras da origem
+	entrada := "cnpj;nome\r11222333000181;\"A\rB\"\r\n19131243000197;ab\"c\r"
+	f := novoFinaisLinhaReader(io.MultiReader(fatiar(entrada)...), 0)
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "cnpj;nome\n11222333000181;\"A\rB\"\r\n19131243000197;ab\"c\n"; string(got) != want {
+		t.Errorf("saída = %q, quer %q", got, want)
+	}
+}
+
+func fatiar(s string) []io.Reader {
+	leitores := make([]io.Reader, len(s))
+	for i := range len(s) {
+		leitores[i] = strings.NewReader(s[i : i+1])
+	}
+	return leitores
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Situações de um job em /jobs.
+const (
+	statusRunning         = "running"
+	statusDone            = "done"
+	statusInterrupted     = "interrupted"
+	statusCancelled       = "cancelled"
+	statusBudgetExhausted = "budget_exhausted"
+	statusTimedOut        = "timed_out"
+	statusMalformedInput  = "malformed_input"
+)
+
+// Tempo que um job concluído continua listado em /jobs.
+const retencaoJobs = 24 * time.Hour
+
+// Job é o estado de um processamento de arquivo exposto em /jobs.
+type Job struct {
+	ID         string     `json:"id"`
+	Filename   string     `json:"filename"`
+	Status     string     `json:"status"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Processed  int64      `json:"processed"`
+	Matched    int64      `json:"matched"`
+	OutputPath string     `json:"output_path"`
+
+	// Held conta as empresas qualificadas retidas por top_percentile, ainda
+	// fora de Matched, que só são gravadas no fim do job
+	Held int64 `json:"held,omitempty"`
+
+	// Files lista os arquivos de saída com split_by, preenchido ao fim do job
+	Files []string `json:"files,omitempty"`
+
+	// EffectiveRPS é a taxa de consultas atual, reduzida após respostas 429
+	EffectiveRPS float64 `json:"effective_rps,omitempty"`
+
+	// Stats resume as empresas gravadas; presente quando o job termina
+	Stats *estatisticas `json:"stats,omitempty"`
+
+	// Error descreve o motivo de um job encerrado antes do fim da entrada,
+	// como o arquivo malformado
+	Error string `json:"error,omitempty"`
+
+	// Resumable indica um job interrompido por um reinício do servidor que
+	// pode ser retomado em POST /jobs/{id}/resume
+	Resumable bool `json:"resumable,omitempty"`
+}
+
+// registroJob guarda um Job protegido por mutex, atualizado pelo
+// processamento enquanto é lido pelos handlers.
+type registroJob struct {
+	mu  sync.Mutex
+	job Job
+
+	// cancelar interrompe o contexto do processamento; cancelado registra
+	// que a interrupção foi pedida em POST /jobs/{id}/cancel
+	cancelar  context.CancelFunc
+	cancelado bool
+}
+
+var (
+	jobs      = make(map[string]*registroJob)
+	jobsMutex sync.Mutex
+
+	// chavesIdempotencia associa cada Idempotency-Key ao job que ela criou;
+	// protegido por jobsMutex
+	chavesIdempotencia = make(map[string]chaveIdempotencia)
+)
+
+// chaveIdempotencia é uma Idempotency-Key recebida em em.
+type chaveIdempotencia struct {
+	jobID string
+	em    time.Time
+}
+
+// registrarJob cria um job em andamento no registro, descartando os jobs
+// concluídos há mais de retencaoJobs. cancelar interrompe o contexto do
+// processamento do job.
+func registrarJob(id, filename, outputPath string, cancelar context.CancelFunc) *registroJob {
+	j := &registroJob{job: Job{
+		ID:         id,
+		Filename:   filename,
+		Status:     statusRunning,
+		StartedAt:  time.Now(),
+		OutputPath: outputPath,
+	}, cancelar: cancelar}
+
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	for id, existente := range jobs {
+		if s := existente.snapshot(); s.FinishedAt != nil && time.Since(*s.FinishedAt) > retencaoJobs {
+			delete(jobs, id)
+		}
+	}
+	jobs[id] = j
+
+	return j
+}
+
+// registrarJobRetomavel lista em /jobs, como interrompido, o job de um
+// checkpoint encontrado na inicialização.
+func registrarJobRetomavel(cp *checkpointJob) {
+	j := &registroJob{job: Job{
+		ID:         cp.ID,
+		Filename:   cp.Filename,
+		Status:     statusInterrupted,
+		StartedAt:  cp.IniciadoEm,
+		FinishedAt: &cp.Atualizado,
+		Processed:  cp.Linhas,
+		OutputPath: caminhoSaida(cp.Saida),
+		Resumable:  true,
+	}}
+
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	jobs[cp.ID] = j
+}
+
+// reservarIdempotencia associa a Idempotency-Key chave ao job jobID. Quando
+// a chave já pertence a um job em andamento ou recebido há menos de
+// retencaoJobs, devolve esse job e false; o job é nil se a requisição que o
+// cria ainda não o registrou.
+func reservarIdempotencia(chave, jobID string) (*registroJob, bool) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	for c, existente := range chavesIdempotencia {
+		if time.Since(existente.em) <= retencaoJobs {
+			continue
+		}
+		if j := jobs[existente.jobID]; j == nil || j.snapshot().Status != statusRunning {
+			delete(chavesIdempotencia, c)
+		}
+	}
+
+	if existente, ok := chavesIdempotencia[chave]; ok {
+		return jobs[existente.jobID], false
+	}
+	chavesIdempotencia[chave] = chaveIdempotencia{jobID: jobID, em: time.Now()}
+	return nil, true
+}
+
+// liberarIdempotencia desfaz a reserva de uma requisição cujo job não chegou
+// a iniciar, para que a chave possa ser reenviada.
+func liberarIdempotencia(chave, jobID string) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	if chavesIdempotencia[chave].jobID == jobID {
+		delete(chavesIdempotencia, chave)
+	}
+}
+
+// saidaEmUso informa se algum job em andamento grava no arquivo de saída
+// informado.
+func saidaEmUso(outputPath string) bool {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	for _, j := range jobs {
+		if s := j.snapshot(); s.Status == statusRunning && s.OutputPath == outputPath {
+			return true
+		}
+	}
+	return false
+}
+
+// atualizar registra o progresso do job e a taxa efetiva de consultas.
+func (j *registroJob) atualizar(processados, encontradas, retidas int64, rps float64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.job.Processed = processados
+	j.job.Matched = encontradas
+	j.job.Held = retidas
+	j.job.EffectiveRPS = rps
+}
+
+// finalizar marca o job como encerrado com a situação informada.
+func (j *registroJob) finalizar(status string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	agora := time.Now()
+	j.job.Status = status
+	j.job.FinishedAt = &agora
+}
+
+// definirErro registra o motivo do encerramento antecipado do job.
+func (j *registroJob) definirErro(err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.job.Error = err.Error()
+}
+
+// definirEstatisticas registra o resumo das empresas gravadas pelo job.
+func (j *registroJob) definirEstatisticas(est estatisticas) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.job.Stats = &est
+}
+
+// definirArquivos registra os arquivos de saída gerados com split_by.
+func (j *registroJob) definirArquivos(nomes []string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.job.Files = nomes
+}
+
+// interromper cancela o processamento de um job em andamento e informa se
+// havia algo a cancelar.
+func (j *registroJob) interromper() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.job.Status != statusRunning {
+		return false
+	}
+	j.cancelado = true
+	j.cancelar()
+	return true
+}
+
+// foiCancelado informa se o job foi interrompido por POST /jobs/{id}/cancel.
+func (j *registroJob) foiCancelado() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.cancelado
+}
+
+// snapshot devolve uma cópia do estado atual do job.
+func (j *registroJob) snapshot() Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.job
+}
+
+// jobHandler responde GET /jobs/{id} com o estado do job.
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jobsMutex.Lock()
+	j := jobs[r.PathValue("id")]
+	jobsMutex.Unlock()
+
+	if j == nil {
+		http.Error(w, "Job não encontrado", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(j.snapshot())
+}
+
+// jobsHandler responde GET /jobs com todos os jobs, do mais recente ao
+// mais antigo.
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jobsMutex.Lock()
+	lista := make([]Job, 0, len(jobs))
+	for _, j := range jobs {
+		lista = append(lista, j.snapshot())
+	}
+	jobsMutex.Unlock()
+
+	sort.Slice(lista, func(a, b int) bool {
+		return lista[a].StartedAt.After(lista[b].StartedAt)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(lista)
+}
+
+// responderJobExistente responde a uma requisição repetida com a situação
+// do job criado pela primeira, ou 409 se ele ainda não foi registrado.
+func responderJobExistente(w http.ResponseWriter, j *registroJob) {
+	if j == nil {
+		http.Error(w, "Já existe uma requisição em andamento com esta Idempotency-Key", http.StatusConflict)
+		return
+	}
+	job := j.snapshot()
+	w.Header().Set("X-Job-ID", job.ID)
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(job)
+}
+
+// cancelarJobHandler responde POST /jobs/{id}/cancel interrompendo o job. O
+// processamento para entre registros e a saída fica com o que já foi gravado.
+func cancelarJobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jobsMutex.Lock()
+	j := jobs[r.PathValue("id")]
+	jobsMutex.Unlock()
+
+	if j == nil {
+		http.Error(w, "Job não encontrado", http.StatusNotFound)
+		return
+	}
+	if !j.interromper() {
+		http.Error(w, "Job já encerrado", http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(j.snapshot())
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rotasJobs monta as rotas de /jobs como em main.
+func rotasJobs() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", jobsHandler)
+	mux.HandleFunc("/jobs/{id}", jobHandler)
+	mux.HandleFunc("/jobs/{id}/cancel", cancelarJobHandler)
+	return mux
+}
+
+// consultarJob decodifica a resposta de GET alvo em destino.
+func consultarJob(t *testing.T, alvo string, destino any) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	rotasJobs().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, alvo, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET %s: %s", alvo, mensagemErro(rec))
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), destino); err != nil {
+		t.Fatalf("GET %s: JSON inválido %q: %v", alvo, rec.Body.String(), err)
+	}
+}
+
+// esperarJob consulta /jobs/{id} até o job sair de running.
+func esperarJob(t *testing.T, id string) Job {
+	t.Helper()
+	limite := time.Now().Add(5 * time.Second)
+	for {
+		var job Job
+		consultarJob(t, "/jobs/"+id, &job)
+		if job.Status != statusRunning || time.Now().After(limite) {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJobStatusDeRunningADone(t *testing.T) {
+	cnpjs := cnpjsTeste(3)
+	p := &provedorRetido{provedorFalso: provedorFalso{empresas: map[string]Empresa{cnpjs[0]: empresaTeste("A")}}, liberar: make(chan struct{})}
+	usarAmbienteTeste(t, p)
+
+	rec := enviarFormulario(t, uploadHandler, "/upload", nil, arquivoTeste{"entrada.csv",
+		linhaReceita(cnpjs[0], "", "", "") + linhaReceita(cnpjs[1], "", "", "") + linhaReceita(cnpjs[2], "", "", "")})
+	if rec.Code != http.StatusAccepted {
+		close(p.liberar)
+		t.Fatalf("/upload: %s, quer 202", mensagemErro(rec))
+	}
+	id := rec.Header().Get("X-Job-ID")
+
+	var job Job
+	consultarJob(t, "/jobs/"+id, &job)
+	if job.Status != statusRunning || job.Filename != "entrada.csv" || job.FinishedAt != nil {
+		t.Errorf("job antes das consultas = %+v, quer running", job)
+	}
+	close(p.liberar)
+
+	job = esperarJob(t, id)
+	if job.Status != statusDone || job.FinishedAt == nil || job.Processed != 3 || job.Matched != 1 {
+		t.Errorf("job concluído = %+v, quer done com 3 processados e 1 encontrada", job)
+	}
+
+	var lista []Job
+	consultarJob(t, "/jobs", &lista)
+	encontrado := false
+	for _, j := range lista {
+		encontrado = encontrado || j.ID == id
+	}
+	if !encontrado {
+		t.Errorf("job %s ausente de /jobs", id)
+	}
+}
+
+func TestJobDesconhecido(t *testing.T) {
+	rec := httptest.NewRecorder()
+	rotasJobs().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/jobs/inexistente", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, quer 404", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	rotasJobs().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/jobs", strings.NewReader("")))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("DELETE /jobs = %d, quer 405", rec.Code)
+	}
+}
+
+func TestUploadAssincrono(t *testing.T) {
+	cnpj := cnpjTeste("112223330001")
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{cnpj: empresaTeste("A")}})
+
+	rec := enviarFormulario(t, uploadHandler, "/upload", nil, arquivoTeste{"entrada.csv", linhaReceita(cnpj, "", "", "")})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("/upload: %s, quer 202", mensagemErro(rec))
+	}
+	id := rec.Header().Get("X-Job-ID")
+	if id == "" || rec.Header().Get("Location") != "/jobs/"+id || !strings.Contains(rec.Body.String(), id) {
+		t.Errorf("resposta sem o job: X-Job-ID %q, Location %q\n%s", id, rec.Header().Get("Location"), rec.Body.String())
+	}
+
+	if job := esperarJob(t, id); job.Status != statusDone || job.Matched != 1 {
+		t.Fatalf("job = %+v, quer done com 1 encontrada", job)
+	}
+	_, linhas := lerSaidaCSV(t, lerArquivoSaida(t, "empresas_"))
+	if len(linhas) != 1 {
+		t.Errorf("%d linhas gravadas pelo job, quer 1", len(linhas))
+	}
+}
+
+func TestUploadSincronoComWait(t *testing.T) {
+	cnpj := cnpjTeste("112223330001")
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{cnpj: empresaTeste("A")}})
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", nil, arquivoTeste{"entrada.csv", linhaReceita(cnpj, "", "", "")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload?wait=1: %s, quer 200", mensagemErro(rec))
+	}
+	// Com wait=1 o job já terminou quando a resposta chega
+	var job Job
+	consultarJob(t, "/jobs/"+rec.Header().Get("X-Job-ID"), &job)
+	if job.Status != statusDone {
+		t.Errorf("job = %+v, quer done", job)
+	}
+}
+
+// provedorParcial responde às primeiras respondidas consultas e retém as
+// seguintes até o contexto ser cancelado.
+type provedorParcial struct {
+	provedorFalso
+	respondidas int
+}
+
+func (p *provedorParcial) Consultar(ctx context.Context, cnpj string) (*Empresa, error) {
+	p.mu.Lock()
+	p.respondidas--
+	retida := p.respondidas < 0
+	p.mu.Unlock()
+	if retida {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return p.provedorFalso.Consultar(ctx, cnpj)
+}
+
+func TestCancelarJob(t *testing.T) {
+	cnpjs := cnpjsTeste(10)
+	p := &provedorParcial{provedorFalso: provedorFalso{empresas: map[string]Empresa{}}, respondidas: 2}
+	var entrada strings.Builder
+	for _, cnpj := range cnpjs {
+		entrada.WriteString(linhaReceita(cnpj, "", "", ""))
+		p.empresas[cnpj] = empresaTeste("EMPRESA")
+	}
+	usarAmbienteTeste(t, p)
+
+	rec := enviarFormulario(t, uploadHandler, "/upload", map[string]string{"workers": "1"},
+		arquivoTeste{"entrada.csv", entrada.String()})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("/upload: %s, quer 202", mensagemErro(rec))
+	}
+	id := rec.Header().Get("X-Job-ID")
+	// Espera as duas consultas respondidas antes de cancelar
+	for limite := time.Now().Add(5 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+		var job Job
+		if consultarJob(t, "/jobs/"+id, &job); job.Processed >= 2 || time.Now().After(limite) {
+			break
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	rotasJobs().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/jobs/"+id+"/cancel", nil))
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("cancel: %s, quer 202", mensagemErro(rec))
+	}
+	if job := esperarJob(t, id); job.Status != statusCancelled || job.FinishedAt == nil {
+		t.Fatalf("job = %+v, quer cancelled", job)
+	}
+	_, linhas := lerSaidaCSV(t, lerArquivoSaida(t, "empresas_"))
+	if len(linhas) != 2 {
+		t.Errorf("%d linhas na saída parcial, quer as 2 consultadas antes do cancelamento", len(linhas))
+	}
+
+	// Um job encerrado não pode ser cancelado de novo
+	rec = httptest.NewRecorder()
+	rotasJobs().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/jobs/"+id+"/cancel", nil))
+	if rec.Code != http.StatusConflict {
+		t.Errorf("segundo cancel = %d, quer 409", rec.Code)
+	}
+}
+
+func TestJobComDuracaoMaxima(t *testing.T) {
+	cnpjs := cnpjsTeste(10)
+	p := &provedorParcial{provedorFalso: provedorFalso{empresas: map[string]Empresa{}}, respondidas: 2}
+	var entrada strings.Builder
+	for _, cnpj := range cnpjs {
+		entrada.WriteString(linhaReceita(cnpj, "", "", ""))
+		p.empresas[cnpj] = empresaTeste("EMPRESA")
+	}
+	usarAmbienteTeste(t, p)
+
+	inicio := time.Now()
+	rec := enviarFormulario(t, uploadHandler, "/upload", map[string]string{"workers": "1", "max_duration": "200ms"},
+		arquivoTeste{"entrada.csv", entrada.String()})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("/upload: %s, quer 202", mensagemErro(rec))
+	}
+	job := esperarJob(t, rec.Header().Get("X-Job-ID"))
+	if job.Status != statusTimedOut || job.Matched != 2 {
+		t.Fatalf("job = %+v, quer timed_out com 2 empresas", job)
+	}
+	if d := time.Since(inicio); d > 2*time.Second {
+		t.Errorf("job encerrado %s depois do início; o prazo era de 200ms", d)
+	}
+
+	_, linhas := lerSaidaCSV(t, lerArquivoSaida(t, "empresas_"))
+	if len(linhas) != 2 {
+		t.Errorf("%d linhas na saída, quer as 2 consultadas no prazo", len(linhas))
+	}
+	caminhos, _ := filepath.Glob(filepath.Join(diretorioSaida, "*_erros.csv"))
+	if len(caminhos) != 1 {
+		t.Fatalf("arquivos de erros = %v, quer 1", caminhos)
+	}
+	dados, err := os.ReadFile(caminhos[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, erros := lerSaidaCSV(t, string(dados))
+	if len(erros) != 8 {
+		t.Errorf("%d CNPJs no CSV de erros, quer os 8 restantes: %q", len(erros), erros)
+	}
+	for _, e := range erros {
+		if e[1] != motivoPrazo {
+			t.Errorf("linha de erro %q, quer %s", e, motivoPrazo)
+		}
+	}
+
+	if rec := enviarFormulario(t, uploadHandler, "/upload", map[string]string{"max_duration": "duas horas"},
+		arquivoTeste{"entrada.csv", entrada.String()}); rec.Code != http.StatusBadRequest {
+		t.Errorf("max_duration inválido: status = %d, quer 400", rec.Code)
+	}
+}
+
+// comIdempotencia envia as requisições a uploadHandler com a Idempotency-Key chave.
+func comIdempotencia(t *testing.T, chave string) http.HandlerFunc {
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		delete(chavesIdempotencia, chave)
+		jobsMutex.Unlock()
+	})
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Set("Idempotency-Key", chave)
+		uploadHandler(w, r)
+	}
+}
+
+func TestIdempotencyKeyEvitaJobDuplicado(t *testing.T) {
+	cnpj := cnpjTeste("112223330001")
+	p := &provedorRetido{provedorFalso: provedorFalso{empresas: map[string]Empresa{cnpj: empresaTeste("A")}}, liberar: make(chan struct{})}
+	usarAmbienteTeste(t, p)
+	entrada := arquivoTeste{"entrada.csv", linhaReceita(cnpj, "", "", "")}
+	handler := comIdempotencia(t, "reenvio-"+t.Name())
+
+	primeiro := enviarFormulario(t, handler, "/upload", nil, entrada)
+	if primeiro.Code != http.StatusAccepted {
+		close(p.liberar)
+		t.Fatalf("/upload: %s, quer 202", mensagemErro(primeiro))
+	}
+	id := primeiro.Header().Get("X-Job-ID")
+	// Reenviada com o job em andamento e depois de concluído
+	if rec := enviarFormulario(t, handler, "/upload", nil, entrada); rec.Header().Get("X-Job-ID") != id {
+		t.Errorf("reenvio em andamento: job %q, quer %q (%s)", rec.Header().Get("X-Job-ID"), id, mensagemErro(rec))
+	}
+	close(p.liberar)
+	esperarJob(t, id)
+	rec := enviarFormulario(t, handler, "/upload", nil, entrada)
+	var job Job
+	if err := json.Unmarshal(rec.Body.Bytes(), &job); err != nil || job.ID != id || job.Status != statusDone {
+		t.Errorf("reenvio após o fim = %s, quer o job %s concluído", mensagemErro(rec), id)
+	}
+
+	if n := p.totalConsultas(); n != 1 {
+		t.Errorf("%d consultas, quer 1; só um job deve rodar", n)
+	}
+	lerArquivoSaida(t, "empresas_")
+
+	// Outra chave inicia um job novo
+	outro := enviarFormulario(t, comIdempotencia(t, "outra-"+t.Name()), "/upload", nil, entrada)
+	if outro.Code != http.StatusAccepted || outro.Header().Get("X-Job-ID") == id {
+		t.Errorf("chave diferente: %s, job %q", mensagemErro(outro), outro.Header().Get("X-Job-ID"))
+	}
+	esperarJob(t, outro.Header().Get("X-Job-ID"))
+}
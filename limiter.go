@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Limites aceitos para o campo rps (requisições por segundo à API).
+// Valores fora da faixa são ajustados para o limite mais próximo.
+const (
+	rpsPadrao = 1.0
+	rpsMinimo = 0.1
+	rpsMaximo = 20.0
+)
+
+// Ajuste adaptativo da taxa (AIMD): a cada 429 recebido da API a taxa
+// efetiva cai pela metade; depois de intervaloAumento sem nenhum 429 ela
+// sobe passoAumento do rps configurado, que é também o teto.
+const (
+	fatorReducao = 0.5
+	passoAumento = 0.1 // fração do rps configurado somada em cada aumento
+)
+
+// Os intervalos do ajuste são lidos na criação de cada rateLimiter; os
+// testes os encurtam.
+var (
+	intervaloAjuste  = time.Second
+	intervaloAumento = 5 * time.Second
+)
+
+// respostas429 conta as respostas 429 da API em todo o processo. Cada
+// rateLimiter compara o contador com o último valor visto, de modo que um
+// 429 recebido por qualquer job reduz a taxa de todos.
+var respostas429 atomic.Int64
+
+// rateLimiter é um token bucket simples alimentado por um time.Ticker.
+// Cada chamada a Wait consome um token; o bucket guarda no máximo um,
+// então não há rajadas acima da taxa efetiva. A taxa efetiva começa no
+// rps configurado e se adapta a respostas 429, entre rpsMinimo e esse rps.
+type rateLimiter struct {
+	tokens chan struct{}
+	ticker *time.Ticker
+	stop   chan struct{}
+
+	maxima float64
+	taxa   atomic.Uint64 // math.Float64bits da taxa efetiva
+}
+
+func newRateLimiter(rps float64) *rateLimiter {
+	l := &rateLimiter{
+		tokens: make(chan struct{}, 1),
+		ticker: time.NewTicker(intervaloTaxa(rps)),
+		stop:   make(chan struct{}),
+		maxima: rps,
+	}
+	l.taxa.Store(math.Float64bits(rps))
+	// A primeira requisição não precisa esperar
+	l.tokens <- struct{}{}
+
+	// Os 429 anteriores ao limitador não contam, mas os recebidos antes de a
+	// goroutine começar, sim
+	visto := respostas429.Load()
+	ajusteCada, aumentoApos := intervaloAjuste, intervaloAumento
+	go func() {
+		ajuste := time.NewTicker(ajusteCada)
+		defer ajuste.Stop()
+		ultimoAjuste := time.Now()
+
+		for {
+			select {
+			case <-l.ticker.C:
+				select {
+				case l.tokens <- struct{}{}:
+				default:
+				}
+			case <-ajuste.C:
+				taxa := l.Taxa()
+				if n := respostas429.Load(); n != visto {
+					visto = n
+					taxa = max(rpsMinimo, taxa*fatorReducao)
+				} else if taxa < l.maxima && time.Since(ultimoAjuste) >= aumentoApos {
+					taxa = min(l.maxima, taxa+l.maxima*passoAumento)
+				} else {
+					continue
+				}
+				ultimoAjuste = time.Now()
+				l.definirTaxa(taxa)
+			case <-l.stop:
+				return
+			}
+		}
+	}()
+
+	return l
+}
+
+// Taxa devolve a taxa efetiva atual, em requisições por segundo.
+func (l *rateLimiter) Taxa() float64 {
+	return math.Float64frombits(l.taxa.Load())
+}
+
+func (l *rateLimiter) definirTaxa(rps float64) {
+	if rps == l.Taxa() {
+		return
+	}
+	l.taxa.Store(math.Float64bits(rps))
+	l.ticker.Reset(intervaloTaxa(rps))
+	slog.Info("Taxa de consultas ajustada", "event", "rate_adjusted", "rps", rps, "max_rps", l.maxima)
+}
+
+func intervaloTaxa(rps float64) time.Duration {
+	return time.Duration(float64(time.Second) / rps)
+}
+
+// Wait bloqueia até haver um token disponível ou o contexto ser cancelado.
+func (l *rateLimiter) Wait(ctx context.Context) error {
+	select {
+	case <-l.tokens:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stop libera o ticker e a goroutine que alimenta o bucket.
+func (l *rateLimiter) Stop() {
+	l.ticker.Stop()
+	close(l.stop)
+}
+
+// parseRPS interpreta o campo rps do formulário, aplicando o padrão quando
+// ausente ou inválido e limitando o valor à faixa [rpsMinimo, rpsMaximo].
+func parseRPS(valor string) float64 {
+	rps, err := strconv.ParseFloat(strings.Replace(strings.TrimSpace(valor), ",", ".", 1), 64)
+	if err != nil || math.IsNaN(rps) {
+		return rpsPadrao
+	}
+	if rps < rpsMinimo {
+		return rpsMinimo
+	}
+	if rps > rpsMaximo {
+		return rpsMaximo
+	}
+	return rps
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// usarIntervalosAjuste encurta os intervalos do ajuste adaptativo da taxa
+// durante o teste.
+func usarIntervalosAjuste(t *testing.T, ajuste, aumento time.Duration) {
+	t.Helper()
+	ajusteAnterior, aumentoAnterior := intervaloAjuste, intervaloAumento
+	t.Cleanup(func() { intervaloAjuste, intervaloAumento = ajusteAnterior, aumentoAnterior })
+	intervaloAjuste, intervaloAumento = ajuste, aumento
+}
+
+// esperarTaxa espera a taxa efetiva de l chegar a want, registrando cada
+// valor observado no caminho.
+func esperarTaxa(t *testing.T, l *rateLimiter, want float64) []float64 {
+	t.Helper()
+	observadas := []float64{l.Taxa()}
+	for limite := time.Now().Add(5 * time.Second); l.Taxa() != want; time.Sleep(2 * time.Millisecond) {
+		if time.Now().After(limite) {
+			t.Fatalf("taxa efetiva = %v após %v, quer %v; observadas %v", l.Taxa(), 5*time.Second, want, observadas)
+		}
+		if taxa := l.Taxa(); taxa != observadas[len(observadas)-1] {
+			observadas = append(observadas, taxa)
+		}
+	}
+	return append(observadas, want)
+}
+
+func TestLimitadorAdaptativoCom429(t *testing.T) {
+	usarTentativas(t, 1)
+	usarIntervalosAjuste(t, 5*time.Millisecond, 20*time.Millisecond)
+	l := newRateLimiter(10)
+	defer l.Stop()
+
+	transporte := &transporteFalso{respostas: map[string]respostaFalsa{
+		"/mr/11222333000181": {http.StatusTooManyRequests, `{}`},
+	}}
+	p := minhaReceita{baseURL: "http://minhareceita.teste/mr", cliente: &http.Client{Transport: transporte}}
+	if _, err := p.Consultar(context.Background(), "11222333000181"); err == nil {
+		t.Fatal("429 aceito como resposta")
+	}
+	esperarTaxa(t, l, 5)
+
+	// Sem novos 429 a taxa volta aos poucos ao rps configurado, sem passar dele
+	subida := esperarTaxa(t, l, 10)
+	for i := 1; i < len(subida); i++ {
+		if subida[i] < subida[i-1] || subida[i]-subida[i-1] > 1+1e-9 {
+			t.Errorf("taxa foi de %v para %v; quer aumentos de até 1", subida[i-1], subida[i])
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if taxa := l.Taxa(); taxa != 10 {
+		t.Errorf("taxa = %v depois de recuperada, quer o teto de 10", taxa)
+	}
+}
+
+func TestLimitadorAdaptativoRespeitaMinimo(t *testing.T) {
+	usarIntervalosAjuste(t, 5*time.Millisecond, time.Hour)
+	l := newRateLimiter(0.15)
+	defer l.Stop()
+
+	respostas429.Add(1)
+	esperarTaxa(t, l, rpsMinimo)
+	respostas429.Add(1)
+	time.Sleep(30 * time.Millisecond)
+	if taxa := l.Taxa(); taxa != rpsMinimo {
+		t.Errorf("taxa = %v após outro 429, quer o mínimo %v", taxa, rpsMinimo)
+	}
+}
+
+func TestJobExpoeTaxaEfetiva(t *testing.T) {
+	cnpj := cnpjTeste("112223330001")
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{cnpj: empresaTeste("A")}})
+
+	rec := enviarFormulario(t, uploadHandler, "/upload", map[string]string{"rps": "5"}, arquivoTeste{"entrada.csv", linhaReceita(cnpj, "", "", "")})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("/upload: %s, quer 202", mensagemErro(rec))
+	}
+	if job := esperarJob(t, rec.Header().Get("X-Job-ID")); job.EffectiveRPS != 5 {
+		t.Errorf("effective_rps = %v, quer 5", job.EffectiveRPS)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// configurarLog instala o logger padrão conforme LOG_LEVEL (debug, info,
+// warn ou error; info por padrão) e LOG_FORMAT (json por padrão ou text).
+func configurarLog(saida io.Writer) error {
+	var nivel slog.Level
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		if err := nivel.UnmarshalText([]byte(v)); err != nil {
+			return fmt.Errorf("LOG_LEVEL inválido %q: use debug, info, warn ou error", v)
+		}
+	}
+	opcoes := &slog.HandlerOptions{Level: nivel}
+
+	var handler slog.Handler
+	switch strings.ToLower(os.Getenv("LOG_FORMAT")) {
+	case "", "json":
+		handler = slog.NewJSONHandler(saida, opcoes)
+	case "text":
+		handler = slog.NewTextHandler(saida, opcoes)
+	default:
+		return fmt.Errorf("LOG_FORMAT inválido %q: use json ou text", os.Getenv("LOG_FORMAT"))
+	}
+
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
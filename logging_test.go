@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// saidaLog guarda as linhas de log do teste; o processamento escreve de
+// vários workers.
+type saidaLog struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (s *saidaLog) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.Write(p)
+}
+
+func (s *saidaLog) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buf.String()
+}
+
+// usarLog configura o logger com LOG_LEVEL e LOG_FORMAT dados, gravando em
+// uma saidaLog, e restaura o logger do teste ao fim.
+func usarLog(t *testing.T, nivel, formato string) *saidaLog {
+	t.Helper()
+	anterior := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(anterior) })
+	t.Setenv("LOG_LEVEL", nivel)
+	t.Setenv("LOG_FORMAT", formato)
+	saida := &saidaLog{}
+	if err := configurarLog(saida); err != nil {
+		t.Fatalf("configurarLog: %v", err)
+	}
+	return saida
+}
+
+// eventosLog decodifica as linhas JSON do log, indexadas pelo campo event.
+func eventosLog(t *testing.T, saida string) map[string]map[string]any {
+	t.Helper()
+	eventos := make(map[string]map[string]any)
+	for _, linha := range strings.Split(strings.TrimSpace(saida), "\n") {
+		var campos map[string]any
+		if err := json.Unmarshal([]byte(linha), &campos); err != nil {
+			t.Fatalf("linha de log não é JSON: %q", linha)
+		}
+		if evento, ok := campos["event"].(string); ok {
+			eventos[evento] = campos
+		}
+	}
+	return eventos
+}
+
+func TestLogJSONComCampos(t *testing.T) {
+	encontrado, ausente := cnpjTeste("112223330001"), cnpjTeste("191312430001")
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{encontrado: empresaTeste("A")}})
+	saida := usarLog(t, "debug", "")
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", nil,
+		arquivoTeste{"entrada.csv", linhaReceita(encontrado, "", "", "") + linhaReceita(ausente, "", "", "")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+
+	eventos := eventosLog(t, saida.String())
+	for evento, chaves := range map[string][]string{
+		"lookup_ok":        {"time", "level", "msg", "cnpj", "duration_ms"},
+		"lookup_not_found": {"time", "level", "msg", "cnpj", "duration_ms"},
+		"job_finished":     {"job_id", "status", "processed", "matched", "duration_ms"},
+	} {
+		campos, ok := eventos[evento]
+		if !ok {
+			t.Errorf("evento %s ausente do log:\n%s", evento, saida)
+			continue
+		}
+		for _, chave := range chaves {
+			if _, ok := campos[chave]; !ok {
+				t.Errorf("evento %s sem a chave %s: %v", evento, chave, campos)
+			}
+		}
+	}
+	if eventos["lookup_not_found"]["cnpj"] != ausente || eventos["job_finished"]["status"] != statusDone {
+		t.Errorf("valores dos eventos = %v, %v", eventos["lookup_not_found"], eventos["job_finished"])
+	}
+}
+
+func TestLogNivelEFormato(t *testing.T) {
+	saida := usarLog(t, "warn", "")
+	slog.Info("descartado", "event", "info_event")
+	slog.Warn("mantido", "event", "warn_event")
+	if eventos := eventosLog(t, saida.String()); len(eventos) != 1 || eventos["warn_event"] == nil {
+		t.Errorf("com LOG_LEVEL=warn: %v", eventos)
+	}
+
+	saida = usarLog(t, "", "text")
+	slog.Info("legível", "event", "text_event", "cnpj", "11222333000181")
+	if got := saida.String(); !strings.Contains(got, "level=INFO") || !strings.Contains(got, "event=text_event") {
+		t.Errorf("com LOG_FORMAT=text: %q", got)
+	}
+
+	for _, c := range [][2]string{{"verboso", ""}, {"", "xml"}} {
+		t.Setenv("LOG_LEVEL", c[0])
+		t.Setenv("LOG_FORMAT", c[1])
+		if err := configurarLog(&saidaLog{}); err == nil {
+			t.Errorf("LOG_LEVEL=%q LOG_FORMAT=%q aceitos", c[0], c[1])
+		}
+	}
+}
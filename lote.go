@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Tamanho padrão e máximo dos lotes de CNPJs enviados a provedores com
+// consulta em lote; o padrão pode ser ajustado por CNPJ_BATCH_SIZE.
+const (
+	tamanhoLotePadrao = 50
+	tamanhoLoteMaximo = 500
+)
+
+// Tempo que um worker espera por mais tarefas para completar um lote antes
+// de enviar o que já tem.
+const esperaLote = 100 * time.Millisecond
+
+// tamanhoLote é a quantidade máxima de CNPJs por requisição em lote.
+var tamanhoLote = tamanhoLotePadrao
+
+// provedorLote é um provedor que também consulta vários CNPJs em uma só
+// requisição; os jobs o usam no lugar de Consultar em lotes de até
+// tamanhoLote. BatchConsultar devolve as empresas na ordem de cnpjs, com nil
+// para os ausentes da base; falhas de CNPJs isolados vêm em errosLote, e
+// qualquer outro erro falha o lote inteiro.
+//
+// Nem o minhareceita.org nem a BrasilAPI têm consulta em lote: o provedor
+// padrão consulta um CNPJ por requisição.
+type provedorLote interface {
+	provedor
+	BatchConsultar(ctx context.Context, cnpjs []string) ([]*Empresa, error)
+}
+
+// errosLote associa a cada CNPJ de um lote a falha da sua consulta, quando
+// apenas parte do lote falhou.
+type errosLote map[string]error
+
+func (e errosLote) Error() string {
+	return fmt.Sprintf("%d CNPJs do lote falharam", len(e))
+}
+
+// consultarCNPJsLote consulta um lote no provedor configurado e devolve,
+// para cada CNPJ, a empresa ou o erro da sua consulta, como consultarCNPJ.
+// Consultas em lote não passam por consultasEmAndamento.
+func consultarCNPJsLote(ctx context.Context, lote provedorLote, cnpjs []string) ([]*Empresa, []error) {
+	erros := make([]error, len(cnpjs))
+	liberada, teste := disjuntorUpstream.permitir()
+	if !liberada {
+		for i := range erros {
+			erros[i] = ErrUpstreamIndisponivel
+		}
+		return make([]*Empresa, len(cnpjs)), erros
+	}
+
+	inicio := time.Now()
+	empresas, err := lote.BatchConsultar(ctx, cnpjs)
+	disjuntorUpstream.registrar(ctx, teste, err)
+	duracao := time.Since(inicio)
+
+	var porCNPJ errosLote
+	if errors.As(err, &porCNPJ) {
+		err = nil
+	}
+
+	resultados := make([]*Empresa, len(cnpjs))
+	for i, cnpj := range cnpjs {
+		switch {
+		case err != nil:
+			erros[i] = err
+		case porCNPJ[cnpj] != nil:
+			erros[i] = porCNPJ[cnpj]
+		case empresas[i] == nil:
+			erros[i] = ErrCNPJNotFound
+		default:
+			resultados[i] = empresas[i]
+			normalizarEmpresa(resultados[i])
+			metricas.consulta("ok", duracao)
+			continue
+		}
+		metricas.consulta(classificarErro(erros[i]), duracao)
+	}
+	return resultados, erros
+}
+
+// agruparLotes monta, na ordem da entrada, os lotes de até tamanhoLote
+// tarefas consultados pelos workers. Um só agrupador lê tarefas: se cada
+// worker juntasse o seu lote, os workers disputariam as mesmas tarefas e
+// um lote que caberia em uma requisição sairia dividido em vários, conforme
+// o escalonamento.
+func agruparLotes(ctx context.Context, tarefas <-chan tarefa, cfg jobConfig, resumo *resumoProcessamento) <-chan []tarefa {
+	lotes := make(chan []tarefa)
+	go func() {
+		defer close(lotes)
+		for t := range tarefas {
+			lote := juntarLote(t, tarefas)
+			select {
+			case lotes <- lote:
+			case <-ctx.Done():
+				if !prazoEsgotado(ctx) {
+					return
+				}
+				for _, p := range lote {
+					resumo.recusarPorPrazo(p, cfg)
+				}
+			}
+		}
+	}()
+	return lotes
+}
+
+// consultarLotes é o laço de um worker quando o provedor consulta em lote:
+// respeita o limitador uma vez por lote de agruparLotes e trata cada CNPJ
+// do lote como consultarTarefa.
+func consultarLotes(ctx context.Context, provedor provedorLote, lotes <-chan []tarefa, resultados chan<- resultado, cfg jobConfig, resumo *resumoProcessamento) {
+	for lote := range lotes {
+		if prazoEsgotado(ctx) {
+			for _, p := range lote {
+				resumo.recusarPorPrazo(p, cfg)
+			}
+			continue
+		}
+		// O orçamento de max_requests conta cada CNPJ do lote
+		var pendentes []tarefa
+		for _, p := range lote {
+			if disjuntorUpstream.aberto() {
+				resumo.recusarPorDisjuntor(p, cfg)
+			} else if resumo.reservarConsulta(cfg.MaxRequisicoes) {
+				pendentes = append(pendentes, p)
+			} else {
+				resumo.recusarPorOrcamento(p, cfg)
+			}
+		}
+		if len(pendentes) == 0 {
+			continue
+		}
+
+		if err := cfg.Limiter.Wait(ctx); err != nil {
+			if prazoEsgotado(ctx) {
+				for _, p := range pendentes {
+					resumo.recusarPorPrazo(p, cfg)
+				}
+				continue
+			}
+			slog.Info("Processamento interrompido", "event", "job_cancelled", "error", err)
+			return
+		}
+
+		cnpjs := make([]string, len(pendentes))
+		for i, p := range pendentes {
+			cnpjs[i] = p.cnpj
+		}
+		inicio := time.Now()
+		consultaCtx, cancel := context.WithTimeoutCause(ctx, cfg.Timeout, errPrazoConsulta)
+		empresas, erros := consultarCNPJsLote(consultaCtx, provedor, cnpjs)
+		cancel()
+		duracao := time.Since(inicio)
+
+		for i, p := range pendentes {
+			if empresa, ok := tratarConsulta(ctx, p, empresas[i], erros[i], duracao, cfg, resumo); ok || (empresa != nil && cfg.IncluirTodas) {
+				resultados <- novoResultado(ctx, p, empresa, ok, cfg)
+			} else if !consultaInterrompida(ctx) {
+				cfg.Linhas.concluir(p.linha)
+			}
+			resumo.processado()
+		}
+	}
+}
+
+// juntarLote completa um lote a partir da primeira tarefa com as que
+// chegarem em até esperaLote, sem passar de tamanhoLote.
+func juntarLote(primeira tarefa, tarefas <-chan tarefa) []tarefa {
+	lote := []tarefa{primeira}
+	prazo := time.NewTimer(esperaLote)
+	defer prazo.Stop()
+	for len(lote) < tamanhoLote {
+		select {
+		case t, ok := <-tarefas:
+			if !ok {
+				return lote
+			}
+			lote = append(lote, t)
+		case <-prazo.C:
+			return lote
+		}
+	}
+	return lote
+}
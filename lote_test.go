@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// provedorLoteFalso responde em lote com as empresas de provedorFalso,
+// guarda os lotes recebidos e falha os CNPJs de falhas individualmente.
+type provedorLoteFalso struct {
+	provedorFalso
+	lotes  [][]string
+	falhas map[string]error
+}
+
+func (p *provedorLoteFalso) BatchConsultar(_ context.Context, cnpjs []string) ([]*Empresa, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lotes = append(p.lotes, slices.Clone(cnpjs))
+	empresas := make([]*Empresa, len(cnpjs))
+	falhas := errosLote{}
+	for i, cnpj := range cnpjs {
+		if err, ok := p.falhas[cnpj]; ok {
+			falhas[cnpj] = err
+		} else if e, ok := p.empresas[cnpj]; ok {
+			empresas[i] = &e
+		}
+	}
+	if len(falhas) > 0 {
+		return empresas, falhas
+	}
+	return empresas, nil
+}
+
+// usarTamanhoLote define o tamanho máximo dos lotes durante o teste.
+func usarTamanhoLote(t *testing.T, n int) {
+	t.Helper()
+	anterior := tamanhoLote
+	t.Cleanup(func() { tamanhoLote = anterior })
+	tamanhoLote = n
+}
+
+func TestUploadDivideEmLotes(t *testing.T) {
+	usarTamanhoLote(t, 3)
+	cnpjs := cnpjsTeste(8)
+	p := &provedorLoteFalso{provedorFalso: provedorFalso{empresas: map[string]Empresa{}}}
+	var entrada strings.Builder
+	for _, cnpj := range cnpjs {
+		p.empresas[cnpj] = empresaTeste("EMPRESA")
+		entrada.WriteString(linhaReceita(cnpj, "", "", ""))
+	}
+	usarAmbienteTeste(t, p)
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"workers": "4", "ordered": "1"},
+		arquivoTeste{"entrada.csv", entrada.String()})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+	if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, cnpjs) {
+		t.Errorf("CNPJs = %v, quer %v", got, cnpjs)
+	}
+	// Os lotes seguem a ordem da entrada, mas os workers os consultam em
+	// qualquer ordem
+	slices.SortFunc(p.lotes, func(a, b []string) int { return strings.Compare(a[0], b[0]) })
+	if want := [][]string{cnpjs[:3], cnpjs[3:6], cnpjs[6:]}; !slices.EqualFunc(p.lotes, want, slices.Equal) {
+		t.Errorf("lotes = %v, quer %v", p.lotes, want)
+	}
+	if n := p.totalConsultas(); n != 0 {
+		t.Errorf("%d consultas individuais com provedor em lote, quer 0", n)
+	}
+}
+
+func TestUploadLoteComFalhaParcial(t *testing.T) {
+	encontrada, ausente, ilegivel, indisponivel := cnpjTeste("112223330001"), cnpjTeste("191312430001"),
+		cnpjTeste("114447770001"), cnpjTeste("123456780001")
+	p := &provedorLoteFalso{
+		provedorFalso: provedorFalso{empresas: map[string]Empresa{encontrada: empresaTeste("A"), ilegivel: empresaTeste("C")}},
+		falhas: map[string]error{
+			ilegivel:     json.Unmarshal([]byte("{"), &Empresa{}),
+			indisponivel: &erroTransitorio{err: errors.New("status code não OK: 503")},
+		},
+	}
+	usarAmbienteTeste(t, p)
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", map[string]string{"workers": "4"}, arquivoTeste{"entrada.csv",
+		linhaReceita(encontrada, "", "", "") + linhaReceita(ausente, "", "", "") +
+			linhaReceita(ilegivel, "", "", "") + linhaReceita(indisponivel, "", "", "")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	if len(p.lotes) != 1 {
+		t.Errorf("lotes = %v, quer um só", p.lotes)
+	}
+	cabecalho, linhas := lerSaidaCSV(t, lerArquivoSaida(t, "empresas_"))
+	if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, []string{encontrada}) {
+		t.Errorf("CNPJs = %v, quer só o encontrado", got)
+	}
+
+	caminhos, _ := filepath.Glob(filepath.Join(diretorioSaida, "*_erros.csv"))
+	if len(caminhos) != 1 {
+		t.Fatalf("arquivos de erros = %v, quer 1", caminhos)
+	}
+	dados, err := os.ReadFile(caminhos[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, got := lerSaidaCSV(t, string(dados))
+	slices.SortFunc(got, func(a, b []string) int { return strings.Compare(a[0], b[0]) })
+	want := [][]string{{ilegivel, motivoParse}, {indisponivel, motivoIndisponivel}, {ausente, motivoNaoEncontrado}}
+	slices.SortFunc(want, func(a, b []string) int { return strings.Compare(a[0], b[0]) })
+	if !slices.EqualFunc(got, want, slices.Equal) {
+		t.Errorf("CSV de erros = %q, quer %q", got, want)
+	}
+}
+
+func TestAgruparLotesEncerraComJobCancelado(t *testing.T) {
+	usarTamanhoLote(t, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	tarefas := make(chan tarefa)
+	lotes := agruparLotes(ctx, tarefas, jobConfig{}, &resumoProcessamento{})
+	tarefas <- tarefa{cnpj: "a"}
+	tarefas <- tarefa{cnpj: "b"}
+
+	// Sem workers o lote completo não tem quem o receba; com o job
+	// cancelado o agrupador o descarta e encerra
+	cancel()
+	close(tarefas)
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case lote, ok := <-lotes:
+		if ok {
+			t.Errorf("lote %v entregue depois do cancelamento", lote)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("agrupador não encerrou após o cancelamento do job")
+	}
+}
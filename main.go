@@ -1,42 +1,264 @@
 package main
 
 import (
+	"cmp"
+	"compress/gzip"
+	"context"
 	"encoding/csv"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
+	"math"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 type Empresa struct {
-	CNPJ          string  `json:"cnpj"`
-	RazaoSocial   string  `json:"razao_social"`
-	NomeFantasia  string  `json:"nome_fantasia"`
-	CapitalSocial float64 `json:"capital_social"`
-	Logradouro    string  `json:"logradouro"`
-	Municipio     string  `json:"municipio"`
-	UF            string  `json:"uf"`
-	Cep           string  `json:"cep"`
+	CNPJ                      string      `json:"cnpj"`
+	RazaoSocial               string      `json:"razao_social"`
+	NomeFantasia              string      `json:"nome_fantasia"`
+	CapitalSocial             float64     `json:"capital_social"`
+	Logradouro                string      `json:"logradouro"`
+	Numero                    string      `json:"numero"`
+	Complemento               string      `json:"complemento"`
+	Bairro                    string      `json:"bairro"`
+	Municipio                 string      `json:"municipio"`
+	CodigoMunicipio           codigoTexto `json:"codigo_municipio_ibge"`
+	UF                        string      `json:"uf"`
+	Cep                       string      `json:"cep"`
+	SituacaoCadastral         string      `json:"descricao_situacao_cadastral"`
+	CnaePrincipalCodigo       int         `json:"cnae_fiscal"`
+	CnaePrincipalDescricao    string      `json:"cnae_fiscal_descricao"`
+	DataInicioAtividade       dataISO     `json:"data_inicio_atividade"`
+	Porte                     string      `json:"porte"`
+	NaturezaJuridicaCodigo    codigoTexto `json:"codigo_natureza_juridica"`
+	NaturezaJuridicaDescricao string      `json:"natureza_juridica"`
+	Socios                    []Socio     `json:"qsa,omitempty"`
+
+	// OpcaoSimples e OpcaoMEI indicam a opção pelo Simples Nacional e pelo
+	// MEI; nil quando a API não informa (null)
+	OpcaoSimples *bool `json:"opcao_pelo_simples"`
+	OpcaoMEI     *bool `json:"opcao_pelo_mei"`
+}
+
+// Socio é um integrante do quadro de sócios e administradores (QSA).
+type Socio struct {
+	Nome         string `json:"nome_socio"`
+	Qualificacao string `json:"qualificacao_socio"`
 }
 
+const capitalMinimoPadrao = 50000
+
+// maxErrosConsecutivosPadrao é o limite de registros inválidos seguidos
+// da entrada (max_consecutive_errors) a partir do qual o job desiste do
+// arquivo por parecer malformado.
+const maxErrosConsecutivosPadrao = 1000
+
+// cacheTTLPadrao é a janela em que um CNPJ já consultado não é consultado
+// novamente, quando CNPJ_CACHE_TTL não está definida.
+const cacheTTLPadrao = 2 * time.Hour
+
+// timeoutConsultaPadrao limita cada consulta de CNPJ, incluindo novas
+// tentativas e failover, quando CNPJ_TIMEOUT_CONSULTA não está definida.
+const timeoutConsultaPadrao = 10 * time.Second
+
+// Tempo máximo de espera pelos handlers em andamento no encerramento.
+const tempoEncerramento = 30 * time.Second
+
 var (
-	client         = &http.Client{Timeout: 30 * time.Second}
-	processedCNPJs = make(map[string]time.Time)
+	client         = novoClienteHTTP()
+	processedCNPJs = novoCacheLRU[time.Time](maxEntradasCachePadrao)
 	fileMutex      sync.Mutex
+
+	// maxTentativas pode ser ajustado pela variável de ambiente CNPJ_MAX_TENTATIVAS
+	maxTentativas = 3
+
+	// minhaReceitaURL pode apontar para uma instância própria pela variável
+	// de ambiente MINHA_RECEITA_URL
+	minhaReceitaURL = "https://minhareceita.org"
+
+	// brasilAPIURL é o provedor secundário, usado quando o minhareceita.org
+	// está indisponível; pode ser alterado pela variável BRASILAPI_URL
+	brasilAPIURL = "https://brasilapi.com.br/api/cnpj/v1"
+
+	// provedorCNPJ é a fonte padrão das consultas dos jobs, montada em main
+	// com client; cada job a recebe em jobConfig.Provedor
+	provedorCNPJ = novoProvedor(client)
+
+	// cacheTTL pode ser ajustado pela variável de ambiente CNPJ_CACHE_TTL
+	cacheTTL = cacheTTLPadrao
+
+	// timeoutConsulta pode ser ajustado pela variável de ambiente CNPJ_TIMEOUT_CONSULTA
+	timeoutConsulta = timeoutConsultaPadrao
+
+	// contextoJobs é cancelado no encerramento do servidor para interromper
+	// os jobs em andamento
+	contextoJobs = context.Background()
 )
 
 func main() {
-	http.HandleFunc("/upload", uploadHandler)
+	if err := configurarLog(os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	cli, err := parseFlagsCLI(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		os.Exit(2)
+	}
+
+	maxTentativas = parseInteiroCampo(os.Getenv("CNPJ_MAX_TENTATIVAS"), maxTentativas, 1, 10)
+	cacheTTL = parseDuracao(os.Getenv("CNPJ_CACHE_TTL"), cacheTTLPadrao)
+	timeoutConsulta = parseDuracao(os.Getenv("CNPJ_TIMEOUT_CONSULTA"), timeoutConsultaPadrao)
+	processedCNPJs = novoCacheLRU[time.Time](parseInteiroCampo(os.Getenv("CNPJ_CACHE_MAX_ENTRIES"), maxEntradasCachePadrao, 1, math.MaxInt))
+	minhaReceitaURL = urlBaseConfigurada("MINHA_RECEITA_URL", minhaReceitaURL)
+	brasilAPIURL = urlBaseConfigurada("BRASILAPI_URL", brasilAPIURL)
+	viaCEPURL = urlBaseConfigurada("VIACEP_URL", viaCEPURL)
+	geocodeURL = urlBaseConfigurada("GEOCODE_URL", geocodeURL)
+	coordenadasPorCEP = novoCacheLRU[coordenadas](parseInteiroCampo(os.Getenv("GEOCODE_CACHE_MAX_ENTRIES"), maxEntradasGeocodePadrao, 1, math.MaxInt))
+	tamanhoLote = parseInteiroCampo(os.Getenv("CNPJ_BATCH_SIZE"), tamanhoLotePadrao, 1, tamanhoLoteMaximo)
+	userAgent = montarUserAgent(os.Getenv("HTTP_USER_AGENT"), os.Getenv("CNPJ_CONTACT"))
+	chaveAPI = novaCredencial(os.Getenv("UPSTREAM_API_KEY"), os.Getenv("UPSTREAM_API_KEY_HEADER"))
+	chaveBrasilAPI = novaCredencial(os.Getenv("BRASILAPI_API_KEY"), os.Getenv("BRASILAPI_API_KEY_HEADER"))
+	disjuntorUpstream.limite = parseInteiroCampo(os.Getenv("UPSTREAM_BREAKER_FAILURES"), falhasDisjuntorPadrao, 0, math.MaxInt)
+	disjuntorUpstream.pausa = parseDuracao(os.Getenv("UPSTREAM_BREAKER_COOLDOWN"), pausaDisjuntorPadrao)
+	tamanhoMaximoURL = int64(parseInteiroCampo(os.Getenv("UPLOAD_URL_MAX_BYTES"), tamanhoMaximoURLPadrao, 1, math.MaxInt))
+	client = novoClienteHTTP()
+	provedorCNPJ = novoProvedor(client)
+	geocodificadorCEP, err = novoGeocodificador(os.Getenv("GEOCODE_PROVIDER"), geocodeURL, client)
+	if err != nil {
+		slog.Error("Provedor de geocodificação inválido", "event", "geocode_provider_invalid", "error", err)
+		os.Exit(1)
+	}
+
+	if dir := os.Getenv("OUTPUT_DIR"); dir != "" {
+		diretorioSaida = dir
+	}
+	if err := configurarModeloNome(os.Getenv("OUTPUT_NAME_TEMPLATE")); err != nil {
+		slog.Error("Modelo de nome de saída inválido", "event", "output_name_template_invalid", "error", err)
+		os.Exit(1)
+	}
+	if err := prepararDiretorioSaida(diretorioSaida); err != nil {
+		slog.Error("Diretório de saída indisponível", "event", "output_dir_unavailable", "path", diretorioSaida, "error", err)
+		os.Exit(1)
+	}
+
+	cacheFile := os.Getenv("CNPJ_CACHE_FILE")
+	if cacheFile == "" {
+		cacheFile = "cache_cnpjs.json"
+	}
+	if err := carregarCache(cacheFile, cacheTTL); err != nil {
+		slog.Error("Erro ao carregar cache", "event", "cache_load_failed", "path", cacheFile, "error", err)
+	}
+
+	sinal, pararSinais := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer pararSinais()
+
+	// Na linha de comando o arquivo é processado e o programa termina
+	if cli.Input != "" {
+		errCLI := executarCLI(sinal, cli)
+		if err := salvarCache(cacheFile); err != nil {
+			slog.Error("Erro ao salvar cache", "event", "cache_save_failed", "path", cacheFile, "error", err)
+		}
+		if errCLI != nil {
+			fmt.Fprintln(os.Stderr, errCLI)
+			pararSinais()
+			os.Exit(1)
+		}
+		return
+	}
+
+	go salvarCachePeriodicamente(cacheFile)
+
+	// Jobs interrompidos por um reinício ficam listados em /jobs para serem
+	// retomados; JOB_CHECKPOINT_DIR=off desativa os checkpoints
+	switch dir := os.Getenv("JOB_CHECKPOINT_DIR"); dir {
+	case "off":
+		diretorioCheckpoints = ""
+	case "":
+		diretorioCheckpoints = diretorioCheckpointsPadrao
+	default:
+		diretorioCheckpoints = dir
+	}
+	intervaloCheckpoint = parseInteiroCampo(os.Getenv("JOB_CHECKPOINT_EVERY"), intervaloCheckpointPadrao, 1, math.MaxInt)
+	if diretorioCheckpoints != "" {
+		err := os.MkdirAll(diretorioCheckpoints, 0o755)
+		if err == nil {
+			err = carregarCheckpoints()
+		}
+		if err != nil {
+			slog.Error("Checkpoints indisponíveis; jobs não poderão ser retomados", "event", "checkpoint_dir_unavailable",
+				"path", diretorioCheckpoints, "error", err)
+			diretorioCheckpoints = ""
+		}
+	}
+
+	var cancelarJobs context.CancelFunc
+	contextoJobs, cancelarJobs = context.WithCancel(context.Background())
+	defer cancelarJobs()
+
+	http.HandleFunc("/upload", semPrazo(uploadHandler))
+	http.HandleFunc("/reprocess", semPrazo(reprocessHandler))
+	http.HandleFunc("/upload-url", semPrazo(uploadURLHandler))
+	http.HandleFunc("/preview", semPrazo(previewHandler))
+	http.HandleFunc("/download", semPrazo(downloadHandler))
+	http.HandleFunc("/progress/{jobID}", semPrazo(progressHandler))
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/metrics", metricsHandler)
+	http.HandleFunc("/stats", statsHandler)
+	http.HandleFunc("/version", versionHandler)
+	http.HandleFunc("/jobs", jobsHandler)
+	http.HandleFunc("/jobs/{id}", jobHandler)
+	http.HandleFunc("/jobs/{id}/cancel", cancelarJobHandler)
+	http.HandleFunc("/jobs/{id}/resume", semPrazo(retomarJobHandler))
 	http.HandleFunc("/", indexHandler)
 
-	fmt.Println("Servidor iniciado na porta 8080...")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	if err := configurarAutenticacao(os.Getenv("BASIC_AUTH_USER"), os.Getenv("BASIC_AUTH_PASSWORD")); err != nil {
+		slog.Error("Autenticação mal configurada", "event", "auth_config_invalid", "error", err)
+		os.Exit(1)
+	}
+
+	srv := novoServidor(":8080")
+	srv.Handler = exigirAutenticacao(http.DefaultServeMux)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Erro ao iniciar o servidor", "event", "server_failed", "error", err)
+			os.Exit(1)
+		}
+	}()
+	slog.Info("Servidor iniciado na porta 8080", "event", "server_started", "addr", srv.Addr)
+
+	// Com Ctrl-C ou SIGTERM os jobs param entre um registro e outro, os
+	// handlers terminam de gravar as saídas e o cache é salvo antes de sair
+	<-sinal.Done()
+	slog.Info("Encerrando servidor", "event", "server_stopping")
+	cancelarJobs()
+
+	ctx, cancel := context.WithTimeout(context.Background(), tempoEncerramento)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("Erro ao encerrar o servidor", "event", "server_stop_failed", "error", err)
+	}
+
+	if err := salvarCache(cacheFile); err != nil {
+		slog.Error("Erro ao salvar cache", "event", "cache_save_failed", "path", cacheFile, "error", err)
+	}
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
@@ -46,7 +268,184 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 		<body>
 			<h1>Upload de Arquivo CSV</h1>
 			<form action="/upload" method="post" enctype="multipart/form-data">
-				<input type="file" name="file" accept=".csv" required>
+				<input type="file" name="file" accept=".csv,.gz" multiple required>
+				<label>Filtro de capital social:
+					<select name="capital_modo">
+						<option value="maior" selected>Acima do mínimo</option>
+						<option value="igual_zero">Igual a zero ou não informado</option>
+						<option value="todos">Qualquer capital</option>
+					</select>
+				</label>
+				<label>Capital social mínimo (R$):
+					<input type="number" name="capital_minimo" min="0" step="0.01" value="50000">
+				</label>
+				<label>Capital social máximo (R$, vazio para sem limite):
+					<input type="number" name="capital_maximo" min="0" step="0.01">
+				</label>
+				<label>Requisições por segundo (0.1 a 20):
+					<input type="number" name="rps" min="0.1" max="20" step="0.1" value="1">
+				</label>
+				<label>Consultas simultâneas (1 a 32):
+					<input type="number" name="workers" min="1" max="32" value="4">
+				</label>
+				<label>
+					<input type="checkbox" name="somente_ativas" value="1"> Somente empresas com situação cadastral ATIVA
+				</label>
+				<label>
+					<input type="checkbox" name="somente_simples" value="1"> Somente empresas optantes pelo Simples Nacional
+				</label>
+				<label>CNAEs principais (separados por vírgula, vazio para todos):
+					<input type="text" name="cnae" placeholder="6201501, 4711302">
+				</label>
+				<label>UFs (separadas por vírgula, vazio para todas):
+					<input type="text" name="uf" placeholder="SP,RJ,MG">
+				</label>
+				<label>Municípios (separados por vírgula, vazio para todos):
+					<input type="text" name="municipio" placeholder="São Paulo, Campinas">
+				</label>
+				<label>Nome contém (vazio para qualquer nome):
+					<input type="text" name="nome_contem" placeholder="transporte">
+					<select name="nome_campo">
+						<option value="ambos" selected>Razão social ou nome fantasia</option>
+						<option value="razao_social">Razão social</option>
+						<option value="nome_fantasia">Nome fantasia</option>
+					</select>
+				</label>
+				<label>Fundadas a partir de (vazio para qualquer data):
+					<input type="date" name="fundada_apos">
+				</label>
+				<label>Portes (ME, EPP, DEMAIS; separados por vírgula, vazio para todos):
+					<input type="text" name="porte" placeholder="ME,EPP">
+				</label>
+				<label>Naturezas jurídicas (códigos separados por vírgula, vazio para todas):
+					<input type="text" name="natureza" placeholder="206-2, 205-4">
+				</label>
+				<label>
+					<input type="checkbox" name="include_socios" value="1"> Incluir o quadro de sócios
+				</label>
+				<label>
+					<input type="checkbox" name="include_simples" value="1"> Incluir a opção pelo Simples Nacional e pelo MEI
+				</label>
+				<label>
+					<input type="checkbox" name="geocode" value="1"> Incluir latitude e longitude do CEP
+				</label>
+				<label>
+					<input type="checkbox" name="include_all" value="1"> Gravar todas as empresas consultadas, com a coluna Matched indicando as que passaram pelos filtros
+				</label>
+				<label>
+					<input type="checkbox" name="ordered" value="1"> Gravar as empresas na ordem do arquivo de entrada
+				</label>
+				<label>
+					<input type="checkbox" name="require_email" value="1"> Somente empresas com e-mail válido
+				</label>
+				<label>
+					<input type="checkbox" name="require_telefone" value="1"> Somente empresas com telefone válido
+				</label>
+				<label>Limite de empresas gravadas (0 para todas):
+					<input type="number" name="limit" min="0" value="0">
+				</label>
+				<label>Empresas qualificadas a ignorar antes de gravar:
+					<input type="number" name="offset" min="0" value="0">
+				</label>
+				<label>Porcentagem de maior capital social a gravar (0 para todas; as empresas qualificadas ficam em memória até o fim do job, cerca de 1 GB por milhão):
+					<input type="number" name="top_percentile" min="0" max="100" step="any" value="0">
+				</label>
+				<label>Máximo de consultas à API neste job (0 para sem limite):
+					<input type="number" name="max_requests" min="0" value="0">
+				</label>
+				<label>Registros inválidos seguidos para abandonar o arquivo (0 para sem limite):
+					<input type="number" name="max_consecutive_errors" min="0" value="1000">
+				</label>
+				<label>URL notificada por POST ao fim do job (opcional):
+					<input type="url" name="callback_url" placeholder="https://exemplo.com/hooks/busca">
+				</label>
+				<label>Duração máxima do job (ex.: 2h ou 30m; vazio para sem limite):
+					<input type="text" name="max_duration" placeholder="2h">
+				</label>
+				<label>Colunas do CSV de saída (separadas por vírgula, na ordem desejada; vazio para todas):
+					<input type="text" name="columns" placeholder="CNPJ,RazaoSocial">
+				</label>
+				<label>
+					<input type="checkbox" name="bom" value="1"> Gravar o CSV com BOM UTF-8 (para abrir no Excel)
+				</label>
+				<label>Separador decimal do capital social no CSV:
+					<select name="decimal_separator">
+						<option value="." selected>Ponto (1234.56)</option>
+						<option value=",">Vírgula (1234,56)</option>
+					</select>
+				</label>
+				<label>Gravar também em banco SQLite (nome do arquivo, opcional):
+					<input type="text" name="output_db" placeholder="empresas.db">
+				</label>
+				<label>Acrescentar a um CSV de saída existente (nome do arquivo, opcional):
+					<input type="text" name="append_to" placeholder="empresas_capital_maior_50000_20240101_120000.csv">
+				</label>
+				<label>
+					<input type="checkbox" name="no_cache" value="1"> Consultar todos os CNPJs na API, sem usar nem atualizar o cache
+				</label>
+				<label>
+					<input type="checkbox" name="dry_run" value="1"> Apenas validar e contar, sem consultar a API
+				</label>
+				<label>Formato de saída:
+					<select name="output_format">
+						<option value="csv">CSV</option>
+						<option value="jsonl">JSON Lines</option>
+						<option value="xlsx">Excel (XLSX)</option>
+					</select>
+				</label>
+				<label>Dividir a saída:
+					<select name="split_by">
+						<option value="">Um único arquivo</option>
+						<option value="uf">Um arquivo por UF</option>
+					</select>
+				</label>
+				<label>Compressão da saída:
+					<select name="compress">
+						<option value="">Nenhuma</option>
+						<option value="gzip">gzip (.gz)</option>
+					</select>
+				</label>
+				<fieldset>
+					<legend>Colunas do arquivo de entrada (índices a partir de 0)</legend>
+					<label>Primeira linha:
+						<select name="has_header">
+							<option value="auto">Detectar cabeçalho automaticamente</option>
+							<option value="1">É um cabeçalho</option>
+							<option value="0">É um registro</option>
+						</select>
+					</label>
+					<label>CNPJ:
+						<select name="cnpj_mode">
+							<option value="auto">Detectar automaticamente</option>
+							<option value="split">Dividido em partes (layout da Receita)</option>
+							<option value="single">Completo em uma coluna</option>
+						</select>
+					</label>
+					<label>Partes do CNPJ: <input type="text" name="col_cnpj_parts" placeholder="0,1,2"></label>
+					<label>Coluna do CNPJ completo: <input type="number" name="col_cnpj" min="0" placeholder="0"></label>
+					<label>DDD: <input type="number" name="col_ddd" min="0" placeholder="21"></label>
+					<label>Telefone: <input type="number" name="col_telefone" min="0" placeholder="22"></label>
+					<label>E-mail: <input type="number" name="col_email" min="0" placeholder="27"></label>
+				</fieldset>
+				<label>Codificação do arquivo:
+					<select name="encoding">
+						<option value="auto">Detectar automaticamente</option>
+						<option value="utf-8">UTF-8</option>
+						<option value="iso-8859-1">ISO-8859-1 (Latin-1)</option>
+					</select>
+				</label>
+				<label>Delimitador (vazio para detectar; "tab" para tabulação):
+					<input type="text" name="delimiter" maxlength="3" placeholder=";">
+				</label>
+				<label>Caractere de comentário (linhas iniciadas por ele são ignoradas):
+					<input type="text" name="comment" maxlength="1" placeholder="#">
+				</label>
+				<label>Aspas:
+					<select name="lazy_quotes">
+						<option value="1">Tolerar aspas fora do padrão</option>
+						<option value="0">Exigir aspas conforme a RFC 4180</option>
+					</select>
+				</label>
 				<button type="submit">Enviar</button>
 			</form>
 		</body>
@@ -55,6 +454,20 @@ func indexHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	processarUpload(w, r, false, arquivoFormulario)
+}
+
+// reprocessHandler recebe o CSV de erros de um job anterior e consulta de
+// novo apenas aqueles CNPJs, ignorando o cache, com os mesmos campos de
+// formulário de /upload. O resultado sai em arquivos novos de saída e erros.
+func reprocessHandler(w http.ResponseWriter, r *http.Request) {
+	processarUpload(w, r, true, arquivoFormulario)
+}
+
+// processarUpload trata um arquivo enviado a /upload ou, com reprocessar,
+// um CSV de erros enviado a /reprocess. abrir obtém o arquivo de entrada,
+// que em /upload-url é baixado de uma URL.
+func processarUpload(w http.ResponseWriter, r *http.Request, reprocessar bool, abrir origemEntrada) {
 	if r.Method != "POST" {
 		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
 		return
@@ -65,160 +478,1874 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	file, header, err := r.FormFile("file")
+	capitalModo, err := parseCapitalModo(r.FormValue("capital_modo"))
 	if err != nil {
-		http.Error(w, "Erro ao obter o arquivo: "+err.Error(), http.StatusBadRequest)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer file.Close()
+	capitalMinimo := parseCapitalCampo(r.FormValue("capital_minimo"), capitalMinimoPadrao)
+	capitalMaximo := parseCapitalCampo(r.FormValue("capital_maximo"), 0)
+	if capitalModo == capitalModoMaior && capitalMaximo > 0 && capitalMaximo < capitalMinimo {
+		http.Error(w, "Capital social máximo não pode ser menor que o mínimo", http.StatusBadRequest)
+		return
+	}
+	rps := parseRPS(r.FormValue("rps"))
+	workers := parseInteiroCampo(r.FormValue("workers"), workersPadrao, 1, workersMaximo)
+	limite := parseInteiroCampo(r.FormValue("limit"), 0, 0, math.MaxInt)
+	maxRequisicoes := parseInteiroCampo(r.FormValue("max_requests"), 0, 0, math.MaxInt)
+	maxErrosConsecutivos := parseInteiroCampo(r.FormValue("max_consecutive_errors"), maxErrosConsecutivosPadrao, 0, math.MaxInt)
+	deslocamento := parseInteiroCampo(r.FormValue("offset"), 0, 0, math.MaxInt)
+	percentil, err := parsePercentil(r.FormValue("top_percentile"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	somenteAtivas := parseFlag(r.FormValue("somente_ativas"))
+	somenteSimples := parseFlag(r.FormValue("somente_simples"))
+	incluirSocios := parseFlag(r.FormValue("include_socios"))
+	incluirSimples := parseFlag(r.FormValue("include_simples"))
+	geocodificar := parseFlag(r.FormValue("geocode"))
+	incluirTodas := parseFlag(r.FormValue("include_all"))
+	exigirEmail := parseFlag(r.FormValue("require_email"))
+	exigirTelefone := parseFlag(r.FormValue("require_telefone"))
+	ordenada := parseFlag(r.FormValue("ordered"))
+	semCache := parseFlag(r.FormValue("no_cache"))
+	bom := parseFlag(r.FormValue("bom"))
+	if percentil > 0 && (limite > 0 || deslocamento > 0 || incluirTodas) {
+		http.Error(w, "top_percentile não pode ser usado com limit, offset nem include_all", http.StatusBadRequest)
+		return
+	}
+	virgulaDecimal, err := parseSeparadorDecimal(r.FormValue("decimal_separator"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	outputDB, err := parseSaidaBanco(r.FormValue("output_db"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cnaes, err := parseCNAEs(r.FormValue("cnae"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ufs, err := parseUFs(r.FormValue("uf"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	municipios := parseMunicipios(r.FormValue("municipio"))
+	nomeContem := normalizarTexto(r.FormValue("nome_contem"))
+	nomeCampo, err := parseCampoNome(r.FormValue("nome_campo"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	portes, err := parsePortes(r.FormValue("porte"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	naturezas, err := parseNaturezas(r.FormValue("natureza"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	callbackURL, err := parseCallbackURL(r.FormValue("callback_url"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	duracaoMaxima, err := parseDuracaoMaxima(r.FormValue("max_duration"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fundadaApos, err := parseData(r.FormValue("fundada_apos"))
+	if err != nil {
+		http.Error(w, "fundada_apos: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	encoding, err := parseEncoding(r.FormValue("encoding"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	formato, err := parseFormatoSaida(r.FormValue("output_format"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	colunas, err := parseMapeamento(r.FormValue)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cabecalho, err := parseCabecalhoEntrada(r.FormValue("has_header"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opcoesEntrada, err := parseOpcoesLeitor(r.FormValue)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if reprocessar {
+		if len(colunas.Repassadas) > 0 {
+			http.Error(w, "passthrough_cols não pode ser usado no reprocessamento", http.StatusBadRequest)
+			return
+		}
+		colunas = mapeamentoErros
+	}
+	repassadas := nomesRepassadas(colunas.Repassadas)
+	colunasSaida, err := parseColunasSaida(r.FormValue("columns"), opcoesSaida{Socios: incluirSocios,
+		Coordenadas: geocodificar, Simples: incluirSimples, Matched: incluirTodas, Repassadas: repassadas})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Com ?inline=1 o resultado é devolvido na própria resposta em vez de salvo no servidor
+	inline := r.URL.Query().Get("inline") == "1"
+	// Com append_to as empresas vão para o fim de um CSV de saída existente
+	acrescentarA, err := parseAcrescentarA(r.FormValue("append_to"), formato, inline)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	compressao, err := parseCompressao(r.FormValue("compress"), formato)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if compressao != semCompressao && acrescentarA != "" {
+		http.Error(w, "append_to não pode ser usado com compress", http.StatusBadRequest)
+		return
+	}
+	// Com split_by=uf cada UF tem o seu arquivo de saída
+	divisao, err := parseDivisao(r.FormValue("split_by"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if divisao != semDivisao && (inline || acrescentarA != "") {
+		http.Error(w, "split_by não pode ser usado com inline nem com append_to", http.StatusBadRequest)
+		return
+	}
+	opcoes := opcoesSaida{
+		Socios:         incluirSocios,
+		Simples:        incluirSimples,
+		Coordenadas:    geocodificar,
+		Matched:        incluirTodas,
+		Repassadas:     repassadas,
+		Colunas:        colunasSaida,
+		BOM:            bom,
+		Continuacao:    acrescentarA != "",
+		VirgulaDecimal: virgulaDecimal,
+	}
+	// Fora do modo inline o processamento segue em segundo plano e a resposta
+	// sai na hora; ?wait=1 mantém o comportamento antigo de esperar o fim
+	emSegundoPlano := !inline && r.URL.Query().Get("wait") != "1"
+	// Com dry_run=1 o arquivo só é lido e contado, sem consultas nem saídas
+	dryRun := parseFlag(r.FormValue("dry_run"))
+	if dryRun {
+		emSegundoPlano = false
+	}
 
-	outputFileName := "empresas_capital_maior_50000_" + time.Now().Format("20060102_150405") + ".csv"
-	outputFile, err := os.Create(outputFileName)
+	entradas, err := abrir(r)
 	if err != nil {
-		http.Error(w, "Erro ao criar arquivo de saída: "+err.Error(), http.StatusInternalServerError)
+		http.Error(w, "Erro ao obter o arquivo: "+err.Error(), statusErroEntrada(err))
+		return
+	}
+	entrada := entradas[0]
+	nomeEntrada := nomeEntradas(entradas)
+
+	// Recursos abertos para o job são liberados por ele ao terminar, que pode
+	// ser depois do fim da requisição; se o job não chegar a iniciar, o
+	// próprio handler os libera
+	var liberar []func()
+	iniciado := false
+	defer func() {
+		if !iniciado {
+			liberarRecursos(liberar)
+		}
+	}()
+	for _, e := range entradas {
+		conteudo := e.conteudo
+		if e.independente {
+			liberar = append(liberar, func() { conteudo.Close() })
+		} else {
+			defer conteudo.Close()
+		}
+	}
+
+	// Jobs em segundo plano com saída CSV num único arquivo, a partir de uma
+	// única entrada, guardam um checkpoint para serem retomados depois de um
+	// reinício do servidor; a cópia da entrada fica então com o checkpoint,
+	// que a remove. Com top_percentile nada é gravado antes do fim do job,
+	// então não há o que retomar
+	retomavel := emSegundoPlano && diretorioCheckpoints != "" && formato == formatoCSV &&
+		compressao == semCompressao && divisao == semDivisao && len(entradas) == 1 && percentil == 0
+	var checkpoint *checkpointJob
+	caminhoEntrada := entrada.caminho
+	// Com vários arquivos, todos são lidos em sequência pelo mesmo job, como
+	// se fossem um só: os CNPJs repetidos entre eles também são ignorados
+	readers := make([]*csv.Reader, 0, len(entradas))
+	for _, e := range entradas {
+		var origem io.Reader = e.conteudo
+		if emSegundoPlano && !e.independente {
+			dir := ""
+			if retomavel {
+				dir = diretorioCheckpoints
+			}
+			copia, err := copiarUpload(e.conteudo, dir)
+			if err != nil {
+				http.Error(w, "Erro ao armazenar o arquivo: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			liberar = append(liberar, func() {
+				copia.Close()
+				if checkpoint == nil {
+					os.Remove(copia.Name())
+				}
+			})
+			origem = copia
+			caminhoEntrada = copia.Name()
+		}
+
+		opcoesArquivo := opcoesEntrada
+		opcoesArquivo.SemExtensao = e.semExtensao
+		reader, err := novoLeitorEntrada(e.nome, origem, encoding, opcoesArquivo)
+		if errors.Is(err, errNaoCSV) {
+			http.Error(w, "Por favor, envie um arquivo CSV: "+e.nome, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(w, e.nome+": "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		readers = append(readers, reader)
+	}
+
+	if dryRun {
+		resumo := processRecords(r.Context(), readers, nil, jobConfig{
+			Colunas:   colunas,
+			Cabecalho: cabecalho,
+			CacheTTL:  cacheTTL,
+			DryRun:    true,
+		})
+		responderDryRun(w, resumo)
+		return
+	}
+
+	jobID := r.FormValue("job_id")
+	if jobID == "" {
+		jobID = novoJobID()
+	} else if !jobIDValido.MatchString(jobID) {
+		http.Error(w, "job_id inválido: use até 64 letras, dígitos, '_' ou '-'", http.StatusBadRequest)
 		return
 	}
-	defer outputFile.Close()
+	// Um reenvio com a mesma Idempotency-Key recebe o job já criado em vez
+	// de iniciar outro
+	if chave := strings.TrimSpace(r.Header.Get("Idempotency-Key")); chave != "" {
+		existente, ok := reservarIdempotencia(chave, jobID)
+		if !ok {
+			responderJobExistente(w, existente)
+			return
+		}
+		defer func() {
+			if !iniciado {
+				liberarIdempotencia(chave, jobID)
+			}
+		}()
+	}
+	progresso, ok := registrarProgresso(jobID)
+	if !ok {
+		http.Error(w, "Já existe um job em andamento com este job_id", http.StatusConflict)
+		return
+	}
+	liberar = append(liberar, func() { progresso.finalizar(jobID) })
+	w.Header().Set("X-Job-ID", jobID)
+
+	baseFileName := nomeBaseSaida(camposNomeSaida{
+		Inicio:        time.Now(),
+		CapitalModo:   capitalModo,
+		CapitalMinimo: capitalMinimo,
+		CapitalMaximo: capitalMaximo,
+		UFs:           ufs,
+		CNAEs:         cnaes,
+		JobID:         jobID,
+	})
+	if reprocessar {
+		baseFileName += "_reprocessado"
+	}
+	outputFileName := baseFileName + extensaoSaida(formato)
+	if compressao == compressaoGzip {
+		outputFileName += extensaoGzip
+	}
+
+	// CNPJs já presentes no arquivo de append_to não são gravados de novo;
+	// o CSV de erros continua sendo um arquivo novo do job
+	var jaGravados map[string]struct{}
+	if acrescentarA != "" {
+		if saidaEmUso(caminhoSaida(acrescentarA)) {
+			http.Error(w, "Já existe um job em andamento gravando em "+acrescentarA, http.StatusConflict)
+			return
+		}
+		jaGravados, err = lerCNPJsGravados(caminhoSaida(acrescentarA), novoLayoutTabela(opcoes).cabecalho())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		outputFileName = acrescentarA
+	}
+
+	var saida escritorSaida
+	var porUF *saidaPorUF
+	if divisao == divisaoUF {
+		porUF = novaSaidaPorUF(caminhoSaida(baseFileName), formato, opcoes, compressao)
+		saida = porUF
+	} else {
+		var destino io.Writer
+		if inline {
+			w.Header().Set("Content-Type", tipoConteudoSaida(formato))
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", strings.TrimSuffix(outputFileName, extensaoGzip)))
+			if compressao == compressaoGzip {
+				w.Header().Set("Content-Encoding", codificacaoGzip)
+			}
+			destino = w
+		} else {
+			criar := criarArquivoSaida
+			if acrescentarA != "" {
+				criar = func(nome string) (*os.File, error) {
+					return os.OpenFile(nome, os.O_WRONLY|os.O_APPEND, 0)
+				}
+			}
+			outputFile, err := criar(caminhoSaida(outputFileName))
+			if errors.Is(err, fs.ErrExist) {
+				http.Error(w, "Já existe um arquivo de saída "+outputFileName+"; confira OUTPUT_NAME_TEMPLATE", http.StatusConflict)
+				return
+			}
+			if err != nil {
+				http.Error(w, "Erro ao criar arquivo de saída: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			liberar = append(liberar, func() { outputFile.Close() })
+			destino = outputFile
+		}
+		// O gzip é fechado depois da saída e antes do arquivo, pela ordem inversa
+		// de liberar
+		if compressao == compressaoGzip {
+			var fecharGzip func() error
+			destino, fecharGzip = comprimirSaida(destino)
+			liberar = append(liberar, func() {
+				if err := fecharGzip(); err != nil {
+					slog.Error("Erro ao concluir a compressão da saída", "event", "output_close_failed", "job_id", jobID, "error", err)
+				}
+			})
+		}
+		saida = novoEscritorSaida(destino, formato, opcoes)
+	}
+	liberar = append(liberar, func() {
+		if err := saida.Fechar(); err != nil {
+			slog.Error("Erro ao concluir o arquivo de saída", "event", "output_close_failed", "job_id", jobID, "error", err)
+		}
+	})
+
+	// Com output_db as empresas vão também para a tabela empresas do SQLite
+	if outputDB != "" {
+		banco, err := abrirSaidaBanco(caminhoSaida(outputDB))
+		if err != nil {
+			http.Error(w, "Erro ao abrir o banco de saída: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// O banco é concluído junto com a saída, por multiplaSaida.Fechar
+		saida = multiplaSaida{saida, banco}
+	}
 
-	outputCSV := csv.NewWriter(outputFile)
-	defer outputCSV.Flush()
+	outputPath := caminhoSaida(outputFileName)
+	if inline || porUF != nil {
+		outputPath = ""
+	}
+	// O contexto do job deriva de contextoJobs para ser interrompido tanto
+	// no encerramento do servidor quanto em POST /jobs/{id}/cancel
+	ctxJob, cancelarJob := context.WithCancel(contextoJobs)
+	liberar = append(liberar, cancelarJob)
+	job := registrarJob(jobID, nomeEntrada, outputPath, cancelarJob)
+	if duracaoMaxima > 0 {
+		// O prazo de max_duration vale para o job inteiro, desde o upload
+		var cancelarPrazo context.CancelFunc
+		ctxJob, cancelarPrazo = context.WithTimeout(ctxJob, duracaoMaxima)
+		liberar = append(liberar, cancelarPrazo)
+	}
 
 	// Escrever cabeçalho
-	if err := outputCSV.Write([]string{
-		"CNPJ",
-		"RazaoSocial",
-		"NomeFantasia",
-		"CapitalSocial",
-		"Logradouro",
-		"Municipio",
-		"UF",
-		"CEP",
-		"DDD", 
-		"Telefone",
-		"Email",
-	}); err != nil {
+	if err := saida.Cabecalho(); err != nil {
+		job.finalizar(statusInterrupted)
+		notificarConclusao(callbackURL, job.snapshot(), err)
 		http.Error(w, "Erro ao escrever cabeçalho: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	reader := csv.NewReader(file)
-	reader.Comma = ';'
-	reader.LazyQuotes = true
+	// CNPJs que não puderam ser consultados vão para um CSV de erros ao lado
+	// da saída; no modo inline nenhum arquivo é mantido no servidor
+	var errosCSV *csv.Writer
+	errosFileName := nomeArquivoErros(baseFileName)
+	if !inline {
+		errosFile, err := criarArquivoSaida(caminhoSaida(errosFileName))
+		continuarErros := false
+		if errors.Is(err, fs.ErrExist) && entrada.caminho != "" {
+			// Retomado no mesmo segundo em que começou, o job repete o nome
+			// do CSV de erros e continua o arquivo da execução anterior
+			errosFile, err = os.OpenFile(caminhoSaida(errosFileName), os.O_WRONLY|os.O_APPEND, 0)
+			continuarErros = err == nil
+		}
+		if err != nil {
+			job.finalizar(statusInterrupted)
+			notificarConclusao(callbackURL, job.snapshot(), err)
+			http.Error(w, "Erro ao criar arquivo de erros: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		liberar = append(liberar, func() { errosFile.Close() })
+
+		errosCSV = csv.NewWriter(errosFile)
+		liberar = append(liberar, errosCSV.Flush)
 
-	records, err := reader.ReadAll()
-	if err != nil {
-		http.Error(w, "Erro ao ler o arquivo CSV: "+err.Error(), http.StatusBadRequest)
-		return
+		if !continuarErros {
+			if err := errosCSV.Write(cabecalhoErros); err != nil {
+				job.finalizar(statusInterrupted)
+				notificarConclusao(callbackURL, job.snapshot(), err)
+				http.Error(w, "Erro ao escrever cabeçalho: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
 	}
 
-	// Canal para controlar o processamento
-	done := make(chan bool)
+	// Canal para controlar o processamento; com buffer para que o job em
+	// segundo plano termine mesmo sem ninguém esperando por ele
+	done := make(chan bool, 1)
+	var resumo *resumoProcessamento
+
+	// O checkpoint e ordered=1 acompanham quais registros já foram concluídos
+	var linhas *linhasJob
+	if (retomavel && caminhoEntrada != "") || ordenada {
+		linhas = novasLinhasJob(entrada.retomarDe)
+	}
+	if retomavel && caminhoEntrada != "" {
+		checkpoint = novoCheckpoint(jobID, entrada.nome, caminhoEntrada, outputFileName, reprocessar,
+			camposCheckpoint(r), linhas)
+	}
 
+	iniciado = true
 	go func() {
-		log.Println("Iniciando processamento do arquivo:", header.Filename)
-		processRecords(records, outputCSV)
-		log.Println("Processamento concluído. Resultados salvos em:", outputFileName)
+		inicio := time.Now()
+		slog.Info("Iniciando processamento do arquivo", "event", "job_started", "job_id", jobID, "filename", nomeEntrada)
+		metricas.jobs.Add(1)
+		limiter := newRateLimiter(rps)
+
+		resumo = processRecords(ctxJob, readers, saida, jobConfig{
+			CapitalModo:    capitalModo,
+			CapitalMinimo:  capitalMinimo,
+			CapitalMaximo:  capitalMaximo,
+			Workers:        workers,
+			Limite:         limite,
+			MaxRequisicoes: maxRequisicoes,
+			MaxErros:       maxErrosConsecutivos,
+			Deslocamento:   deslocamento,
+			Percentil:      percentil,
+			SomenteAtivas:  somenteAtivas,
+			SomenteSimples: somenteSimples,
+			IncluirSocios:  incluirSocios,
+			Geocodificar:   geocodificar,
+			IncluirTodas:   incluirTodas,
+			ExigirEmail:    exigirEmail,
+			ExigirTelefone: exigirTelefone,
+			Colunas:        colunas,
+			Cabecalho:      cabecalho,
+			CNAEs:          cnaes,
+			UFs:            ufs,
+			Municipios:     municipios,
+			NomeContem:     nomeContem,
+			NomeCampo:      nomeCampo,
+			Portes:         portes,
+			Naturezas:      naturezas,
+			FundadaApos:    fundadaApos,
+			Provedor:       provedorCNPJ,
+			Geocodificador: geocodificadorCEP,
+			Limiter:        limiter,
+			CacheTTL:       cacheTTL,
+			IgnorarCache:   reprocessar || semCache,
+			Reprocessar:    reprocessar,
+			SemCache:       semCache,
+			JaGravados:     jaGravados,
+			Timeout:        timeoutConsulta,
+			Progresso:      progresso,
+			Job:            job,
+			ErrosCSV:       errosCSV,
+			Linhas:         linhas,
+			Ordenada:       ordenada,
+			PularRegistros: entrada.retomarDe,
+		})
+		limiter.Stop()
+
+		// As saídas são concluídas antes de o job constar como encerrado em
+		// /jobs e antes de o handler retomar a resposta no modo inline
+		liberarRecursos(liberar)
+		if porUF != nil {
+			job.definirArquivos(porUF.nomes())
+		}
+
+		status := statusDone
+		var errJob error
+		if contextoJobs.Err() != nil {
+			status = statusInterrupted
+		} else if job.foiCancelado() {
+			status = statusCancelled
+		} else if prazoEsgotado(ctxJob) {
+			status = statusTimedOut
+		} else if resumo.OrcamentoEsgotado.Load() {
+			status = statusBudgetExhausted
+		} else if resumo.EntradaMalformada.Load() {
+			status = statusMalformedInput
+			errJob = fmt.Errorf("o arquivo de entrada parece malformado: mais de %d registros inválidos seguidos", maxErrosConsecutivos)
+			job.definirErro(errJob)
+		}
+		checkpoint.encerrar(status)
+		job.finalizar(status)
+		notificarConclusao(callbackURL, job.snapshot(), errJob)
+		slog.Info("Processamento finalizado", "event", "job_finished", "job_id", jobID, "status", status,
+			"output", outputPath, "inline", inline, "processed", resumo.Processados.Load(),
+			"matched", resumo.Encontradas.Load(), "duration_ms", time.Since(inicio).Milliseconds())
 		done <- true
 	}()
 
+	// Com split_by os arquivos só são conhecidos ao fim do job
+	resultados := outputFileName
+	if porUF != nil {
+		resultados = baseFileName + "_<UF>" + porUF.extensao + ", um arquivo por UF"
+	}
+	if emSegundoPlano {
+		linkResultados := fmt.Sprintf(`<a href="/download?file=%s">Baixar resultados</a>`, url.QueryEscape(outputFileName))
+		if porUF != nil {
+			linkResultados = fmt.Sprintf(`<a href="/jobs/%s">Arquivos gerados</a>`, jobID)
+		}
+		w.Header().Set("Location", "/jobs/"+jobID)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, `
+	<html>
+		<head><title>Busca de Empresas</title></head>
+		<body>
+			<p>Arquivo %s recebido (capital social %s). O processamento continua em segundo plano.</p>
+			<p>Job: %s (situação em <a href="/jobs/%s">/jobs/%s</a>, progresso em <a href="/progress/%s">/progress/%s</a>)</p>
+			<p>Ao terminar, os resultados ficam em: %s</p>
+			%s
+			<a href="/download?file=%s">Baixar erros</a>
+		</body>
+	</html>
+	`, html.EscapeString(nomeEntrada), descreverCapital(capitalModo, capitalMinimo, capitalMaximo),
+			jobID, jobID, jobID, jobID, jobID, html.EscapeString(resultados),
+			linkResultados, url.QueryEscape(errosFileName))
+		return
+	}
+
 	// Esperar o processamento terminar antes de retornar a resposta
 	<-done
 
-	fmt.Fprintf(w, "Arquivo %s processado com sucesso. Resultados salvos em: %s", header.Filename, outputFileName)
-}
-
-func processRecords(records [][]string, outputCSV *csv.Writer) {
-	for _, record := range records {
-		if len(record) < 28 {
-			continue
-		}
+	if inline {
+		return
+	}
 
-		// Extrair CNPJ
-		cnpj := strings.Trim(record[0], `" `) + strings.Trim(record[1], `" `) + strings.Trim(record[2], `" `)
+	status := "processado com sucesso"
+	if contextoJobs.Err() != nil {
+		status = "interrompido pelo encerramento do servidor; resultados parciais"
+	} else if job.foiCancelado() {
+		status = "cancelado a pedido; resultados parciais"
+	} else if prazoEsgotado(ctxJob) {
+		status = fmt.Sprintf("interrompido ao atingir a duração máxima de %s; CNPJs restantes listados no arquivo de erros", duracaoMaxima)
+	} else if resumo.LimiteAtingido.Load() {
+		status = fmt.Sprintf("processado até atingir o limite de %d empresas; registros restantes não consultados", limite)
+	} else if resumo.OrcamentoEsgotado.Load() {
+		status = fmt.Sprintf("processado até esgotar o máximo de %d consultas; CNPJs restantes listados no arquivo de erros", maxRequisicoes)
+	} else if resumo.EntradaMalformada.Load() {
+		status = fmt.Sprintf("interrompido: o arquivo de entrada parece malformado (mais de %d registros inválidos seguidos); confira o delimitador e o mapeamento de colunas", maxErrosConsecutivos)
+	}
 
-		if !validarCNPJ(cnpj) {
-			continue
+	linkResultados := fmt.Sprintf(`<a href="/download?file=%s">Baixar resultados</a>`, url.QueryEscape(outputFileName))
+	if porUF != nil {
+		var links []string
+		for _, nome := range porUF.nomes() {
+			links = append(links, fmt.Sprintf(`<a href="/download?file=%s">%s</a>`, url.QueryEscape(nome), html.EscapeString(nome)))
 		}
-
-		// Verificar cache
-		fileMutex.Lock()
-		if lastProcessed, exists := processedCNPJs[cnpj]; exists && time.Since(lastProcessed) < 2*time.Hour {
-			fileMutex.Unlock()
-			continue
+		linkResultados = strings.Join(links, "\n\t\t\t")
+		if len(links) == 0 {
+			linkResultados = "<p>Nenhuma empresa gravada; nenhum arquivo por UF criado</p>"
 		}
-		fileMutex.Unlock()
+	}
 
-		// Consultar API
-		empresa, err := consultarCNPJ(cnpj)
-		if err != nil {
-			log.Printf("Erro ao consultar CNPJ %s: %v", cnpj, err)
-			continue
-		}
+	var banco string
+	if outputDB != "" {
+		banco = fmt.Sprintf("\n\t\t\t<p>Empresas também gravadas na tabela empresas de %s</p>", html.EscapeString(outputDB))
+	}
+	if acrescentarA != "" {
+		banco += fmt.Sprintf("\n\t\t\t<p>CNPJs já presentes em %s, não gravados de novo: %d</p>",
+			html.EscapeString(acrescentarA), resumo.JaGravados.Load())
+	}
+	if percentil > 0 {
+		banco += fmt.Sprintf("\n\t\t\t<p>Gravadas só as empresas entre os %s%% de maior capital social; qualificadas não gravadas: %d</p>",
+			strconv.FormatFloat(percentil, 'f', -1, 64), resumo.ForaDoPercentil.Load())
+	}
 
-		// Atualizar cache
-		fileMutex.Lock()
-		processedCNPJs[cnpj] = time.Now()
-		fileMutex.Unlock()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, `
+	<html>
+		<head><title>Busca de Empresas</title></head>
+		<body>
+			<p>Arquivo %s %s (capital social %s). Resultados salvos em: %s. CNPJs não encontrados na base: %d</p>
+			<p>CNPJs não processados, incluindo os não encontrados: %d (lista em %s)</p>
+			<p>CNPJs repetidos no arquivo, consultados uma única vez: %d</p>
+			<p>Registros lidos: %d (ilegíveis: %d)</p>
+			<p>Empresas gravadas com telefone fora do padrão, mantido como no arquivo: %d</p>
+			<p>Empresas gravadas sem e-mail por endereço inválido: %d</p>
+			<p>Empresas descartadas por falta de e-mail ou telefone exigido: %d</p>
+			<p>Empresas gravadas com texto fora do UTF-8 corrigido: %d</p>
+			<p>Capital social das %d empresas gravadas: total R$ %.2f, média R$ %.2f, mínimo R$ %.2f, máximo R$ %.2f</p>
+			<p>UFs com mais empresas gravadas: %s</p>%s
+			<p>Job: %s (progresso em <a href="/progress/%s">/progress/%s</a>)</p>
+			%s
+			<a href="/download?file=%s">Baixar erros</a>
+		</body>
+	</html>
+	`, html.EscapeString(nomeEntrada), status, descreverCapital(capitalModo, capitalMinimo, capitalMaximo), html.EscapeString(resultados),
+		resumo.NaoEncontrados.Load(), resumo.Erros.Load(), html.EscapeString(errosFileName), resumo.Duplicados.Load(),
+		resumo.Total.Load(), resumo.Ilegiveis.Load(), resumo.TelefonesInvalidos.Load(), resumo.EmailsInvalidos.Load(),
+		resumo.SemContato.Load(), resumo.UTF8Invalido.Load(), resumo.Estatisticas.Matches, resumo.Estatisticas.CapitalTotal, resumo.Estatisticas.CapitalMedio,
+		resumo.Estatisticas.CapitalMinimo, resumo.Estatisticas.CapitalMaximo, html.EscapeString(descreverUFs(resumo.Estatisticas.TopUFs)),
+		banco, jobID, jobID, jobID, linkResultados, url.QueryEscape(errosFileName))
+}
 
-		// Verificar capital social
-		if empresa.CapitalSocial > 50000 {
-			// Extrair telefone e email do *arquivo CSV de entrada*
-			ddd := strings.Trim(record[21], `" `)   
-            telefone := strings.Trim(record[22], `" `) // Índice para o telefone no seu CSV
-            email := strings.Trim(record[27], `" `)   // **Corrigido: Índice para o e-mail no seu CSV**
+// liberarRecursos executa as funções de liberação na ordem inversa em que
+// foram registradas, como fariam os defers correspondentes.
+func liberarRecursos(liberar []func()) {
+	for i := len(liberar) - 1; i >= 0; i-- {
+		liberar[i]()
+	}
+}
 
-            // Escrever no arquivo com mutex
-            fileMutex.Lock()
-            if err := outputCSV.Write([]string{
-                cnpj,
-                empresa.RazaoSocial,
-                empresa.NomeFantasia,
-                strconv.FormatFloat(empresa.CapitalSocial, 'f', 2, 64),
-                empresa.Logradouro,
-                empresa.Municipio,
-                empresa.UF,
-                empresa.Cep,
-				ddd,  
-                telefone, 
-                email,    
-            }); err != nil {
-                log.Printf("Erro ao escrever no arquivo de saída: %v", err)
-            }
-            outputCSV.Flush()
-            fileMutex.Unlock()
-        }
+// downloadHandler devolve um arquivo de saída gerado por uploadHandler.
+// Apenas nomes de OUTPUT_DIR com o prefixo fixo de OUTPUT_NAME_TEMPLATE
+// (empresas_capital_ por padrão) e extensão .csv, .jsonl ou .xlsx são
+// aceitos, para impedir acesso a outros arquivos do servidor.
+// Com delete_after_download=1 o arquivo é removido do servidor depois de
+// enviado por inteiro; downloads parciais, interrompidos ou respondidos com
+// 304 o mantêm.
+func downloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
 
-        time.Sleep(1 * time.Second)
+	nome := r.URL.Query().Get("file")
+	if !nomeSaidaValido(nome) {
+		http.Error(w, "Nome de arquivo inválido", http.StatusBadRequest)
+		return
 	}
-}
+	remover := r.URL.Query().Get("delete_after_download") == "1"
 
-func consultarCNPJ(cnpj string) (*Empresa, error) {
-	url := fmt.Sprintf("https://minhareceita.org/%s", cnpj)
+	caminho := caminhoSaida(nome)
+	file, err := os.Open(caminho)
+	if os.IsNotExist(err) {
+		http.Error(w, "Arquivo não encontrado", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Erro ao abrir o arquivo: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
 
-	resp, err := client.Get(url)
+	info, err := file.Stat()
 	if err != nil {
-		return nil, fmt.Errorf("erro na requisição HTTP: %v", err)
+		http.Error(w, "Erro ao abrir o arquivo: "+err.Error(), http.StatusInternalServerError)
+		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("status code não OK: %d", resp.StatusCode)
+	enviado := &envioContado{ResponseWriter: w}
+	if enviarSaida(enviado, r, nome, info, file) && remover && enviado.completo(info.Size()) {
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			slog.Warn("Arquivo mantido: envio não confirmado", "event", "download_delete_skipped", "file", nome, "error", err)
+			return
+		}
+		file.Close()
+		if err := os.Remove(caminho); err != nil {
+			slog.Error("Erro ao remover o arquivo baixado", "event", "download_delete_failed", "file", nome, "error", err)
+			return
+		}
+		slog.Info("Arquivo removido após o download", "event", "download_deleted", "file", nome, "bytes", enviado.bytes)
 	}
+}
 
-	body, err := io.ReadAll(resp.Body)
+// enviarSaida escreve o arquivo de saída nome em w e informa se o conteúdo
+// foi transmitido até o fim.
+func enviarSaida(w *envioContado, r *http.Request, nome string, info os.FileInfo, file *os.File) bool {
+	// Saídas comprimidas vão com Content-Encoding gzip e o nome sem .gz, já
+	// que o cliente as descomprime; quem não aceita gzip recebe o conteúdo
+	// descomprimido pelo servidor
+	nomeOriginal := strings.TrimSuffix(nome, extensaoGzip)
+	w.Header().Set("Content-Type", tipoConteudoSaida(formatoPorNome(nomeOriginal)))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", nomeOriginal))
+	if nomeOriginal == nome {
+		http.ServeContent(w, r, nome, info.ModTime(), file)
+		return true
+	}
+	w.Header().Add("Vary", "Accept-Encoding")
+	if aceitaGzip(r.Header.Get("Accept-Encoding")) {
+		w.Header().Set("Content-Encoding", codificacaoGzip)
+		http.ServeContent(w, r, nome, info.ModTime(), file)
+		return true
+	}
+	gz, err := gzip.NewReader(file)
 	if err != nil {
-		return nil, fmt.Errorf("erro ao ler resposta: %v", err)
+		http.Error(w, "Erro ao ler o arquivo: "+err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	defer gz.Close()
+	if _, err := io.Copy(w, gz); err != nil {
+		slog.Error("Erro ao enviar o arquivo", "event", "download_failed", "file", nome, "error", err)
+		return false
 	}
+	// Descomprimido, o conteúdo enviado é maior que o arquivo: basta ter
+	// chegado ao fim do gzip sem erro
+	w.descomprimido = true
+	return true
+}
 
-	var empresa Empresa
-	err = json.Unmarshal(body, &empresa)
-	if err != nil {
-		return nil, fmt.Errorf("erro ao decodificar JSON: %v", err)
+// envioContado registra o status e os bytes do corpo escritos na resposta,
+// para saber se um download terminou por inteiro.
+type envioContado struct {
+	http.ResponseWriter
+	status        int
+	bytes         int64
+	descomprimido bool
+}
+
+func (e *envioContado) WriteHeader(status int) {
+	if e.status == 0 {
+		e.status = status
 	}
+	e.ResponseWriter.WriteHeader(status)
+}
 
-	return &empresa, nil
+func (e *envioContado) Write(p []byte) (int, error) {
+	if e.status == 0 {
+		e.status = http.StatusOK
+	}
+	n, err := e.ResponseWriter.Write(p)
+	e.bytes += int64(n)
+	return n, err
 }
 
-func validarCNPJ(cnpj string) bool {
-	return len(cnpj) == 14
-}
\ No newline at end of file
+func (e *envioContado) Unwrap() http.ResponseWriter { return e.ResponseWriter }
+
+// completo informa se a resposta foi um 200 com o arquivo de tamanho bytes
+// inteiro; respostas 206 de Range ou 304 não contam.
+func (e *envioContado) completo(tamanho int64) bool {
+	if e.status != http.StatusOK {
+		return false
+	}
+	return e.descomprimido || e.bytes == tamanho
+}
+
+// formatoPorNome identifica o formato de um arquivo de saída pela extensão.
+func formatoPorNome(nome string) string {
+	for _, formato := range []string{formatoJSONL, formatoXLSX} {
+		if strings.HasSuffix(nome, extensaoSaida(formato)) {
+			return formato
+		}
+	}
+	return formatoCSV
+}
+
+// nomeSaidaValido informa se nome é um arquivo de saída gerado pelo servidor,
+// sem componentes de caminho que permitam sair do diretório de saída.
+func nomeSaidaValido(nome string) bool {
+	if strings.ContainsAny(nome, `/\`) || strings.Contains(nome, "..") {
+		return false
+	}
+	if !strings.HasPrefix(nome, prefixoNomeSaida) {
+		return false
+	}
+	nome = strings.TrimSuffix(nome, extensaoGzip)
+	for _, formato := range []string{formatoCSV, formatoJSONL, formatoXLSX} {
+		if strings.HasSuffix(nome, extensaoSaida(formato)) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseCapitalCampo interpreta um campo de capital social do formulário,
+// usando padrao quando o valor está ausente ou é inválido.
+func parseCapitalCampo(valor string, padrao float64) float64 {
+	valor = strings.TrimSpace(valor)
+	if valor == "" {
+		return padrao
+	}
+
+	capital, err := parseCapital(valor)
+	if err != nil {
+		return padrao
+	}
+	return capital
+}
+
+// urlBaseConfigurada lê a URL base de uma API da variável de ambiente,
+// sem a barra final, para não gerar "//" ao montar os caminhos. Sem a
+// variável vale padrao.
+func urlBaseConfigurada(variavel, padrao string) string {
+	u := strings.TrimSpace(os.Getenv(variavel))
+	if u == "" {
+		return padrao
+	}
+	return strings.TrimRight(u, "/")
+}
+
+// parseDuracao interpreta uma duração de configuração (ex: "30m", "6h"),
+// usando padrao quando o valor está ausente, inválido ou não é positivo.
+func parseDuracao(valor string, padrao time.Duration) time.Duration {
+	d, err := time.ParseDuration(strings.TrimSpace(valor))
+	if err != nil || d <= 0 {
+		return padrao
+	}
+	return d
+}
+
+// parseDuracaoMaxima interpreta o campo max_duration, uma duração do Go
+// como 2h ou 90m. Vazio significa sem limite.
+func parseDuracaoMaxima(valor string) (time.Duration, error) {
+	valor = strings.TrimSpace(valor)
+	if valor == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(valor)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("max_duration inválido: %q (use uma duração como 2h ou 30m)", valor)
+	}
+	return d, nil
+}
+
+// dentroDaFaixa informa se o capital é maior que o mínimo e não ultrapassa
+// o máximo. Um máximo igual a zero significa faixa sem limite superior.
+func dentroDaFaixa(capital, capitalMinimo, capitalMaximo float64) bool {
+	if capital <= capitalMinimo {
+		return false
+	}
+	return capitalMaximo == 0 || capital <= capitalMaximo
+}
+
+// sufixoFaixa monta o trecho do nome do arquivo de saída que descreve a faixa.
+func sufixoFaixa(capitalMinimo, capitalMaximo float64) string {
+	sufixo := strconv.FormatFloat(capitalMinimo, 'f', -1, 64)
+	if capitalMaximo > 0 {
+		sufixo += "_ate_" + strconv.FormatFloat(capitalMaximo, 'f', -1, 64)
+	}
+	return sufixo
+}
+
+// descreverFaixa descreve a faixa de capital social para a mensagem de resposta.
+func descreverFaixa(capitalMinimo, capitalMaximo float64) string {
+	if capitalMaximo > 0 {
+		return fmt.Sprintf("acima de R$ %.2f até R$ %.2f", capitalMinimo, capitalMaximo)
+	}
+	return fmt.Sprintf("acima de R$ %.2f, sem limite superior", capitalMinimo)
+}
+
+// nomeFiltroCapital descreve o filtro de capital social no nome dos arquivos
+// de saída, valor do marcador {capital} de OUTPUT_NAME_TEMPLATE.
+func nomeFiltroCapital(modo string, capitalMinimo, capitalMaximo float64) string {
+	switch modo {
+	case capitalModoIgualZero:
+		return "zero"
+	case capitalModoTodos:
+		return "todos"
+	}
+	return "maior_" + sufixoFaixa(capitalMinimo, capitalMaximo)
+}
+
+// descreverCapital descreve o filtro de capital social para a mensagem de
+// resposta.
+func descreverCapital(modo string, capitalMinimo, capitalMaximo float64) string {
+	switch modo {
+	case capitalModoIgualZero:
+		return "igual a zero ou não informado"
+	case capitalModoTodos:
+		return "sem filtro"
+	}
+	return descreverFaixa(capitalMinimo, capitalMaximo)
+}
+
+// Limites aceitos para o campo workers (goroutines consultando a API).
+const (
+	workersPadrao = 4
+	workersMaximo = 32
+)
+
+// jobConfig reúne os parâmetros de um processamento de arquivo.
+type jobConfig struct {
+	CapitalModo    string // capital_modo; vazio equivale a capitalModoMaior
+	CapitalMinimo  float64
+	CapitalMaximo  float64
+	Workers        int
+	Limite         int     // máximo de empresas gravadas; zero para todas
+	MaxRequisicoes int     // máximo de consultas à API (max_requests); zero para sem limite
+	MaxErros       int     // registros inválidos seguidos que encerram o job (max_consecutive_errors); zero para sem limite
+	Deslocamento   int     // empresas qualificadas ignoradas antes da primeira gravada
+	Percentil      float64 // grava só essa porcentagem das qualificadas de maior capital (top_percentile), guardadas em memória até o fim do job, cerca de 1 KB por empresa; zero para todas
+	SomenteAtivas  bool
+	SomenteSimples bool // só optantes pelo Simples Nacional (somente_simples)
+	IncluirSocios  bool
+	Geocodificar   bool // consulta as coordenadas do CEP das empresas qualificadas (geocode)
+	IncluirTodas   bool // grava também as empresas fora dos filtros (include_all)
+	ExigirEmail    bool // descarta as empresas sem e-mail válido (require_email)
+	ExigirTelefone bool // descarta as empresas sem telefone válido (require_telefone)
+	Colunas        mapeamentoColunas
+	Cabecalho      string // tratamento da primeira linha (has_header); vazio detecta
+	CNAEs          map[string]struct{}
+	UFs            map[string]struct{}
+	Municipios     map[string]struct{} // nomes já normalizados por normalizarTexto
+	NomeContem     string              // termo de nome_contem normalizado; vazio para não filtrar
+	NomeCampo      string              // campos comparados com NomeContem (nome_campo)
+	Portes         map[string]struct{}
+	Naturezas      map[string]struct{} // códigos de natureza jurídica sem traço
+	FundadaApos    time.Time           // zero para não filtrar pela data de início de atividade
+	Provedor       provedor            // fonte das consultas de CNPJ, em geral provedorCNPJ
+	Geocodificador geocodificador      // fonte das coordenadas com Geocodificar, em geral geocodificadorCEP
+	Limiter        *rateLimiter
+	CacheTTL       time.Duration
+	IgnorarCache   bool                // consulta mesmo os CNPJs presentes no cache
+	Reprocessar    bool                // a entrada é um CSV de erros enviado a /reprocess
+	SemCache       bool                // também não registra no cache os CNPJs consultados (no_cache)
+	JaGravados     map[string]struct{} // CNPJs já presentes na saída de append_to
+	Timeout        time.Duration       // limite de cada consulta de CNPJ
+
+	// Progresso e Job recebem as atualizações do processamento; podem ser nil
+	Progresso *progressoJob
+	Job       *registroJob
+
+	// ErrosCSV recebe os CNPJs que não puderam ser processados; pode ser nil
+	ErrosCSV *csv.Writer
+
+	// DryRun apenas lê e contabiliza os registros, sem consultar a API
+	DryRun bool
+
+	// Linhas acompanha os registros concluídos, para o checkpoint e para
+	// Ordenada; pode ser nil. PularRegistros é a quantidade de registros
+	// iniciais já concluídos por uma execução anterior, que não são
+	// processados de novo
+	Linhas         *linhasJob
+	PularRegistros int64
+
+	// Ordenada grava as empresas na ordem da entrada (ordered), exigindo
+	// Linhas. Os resultados que chegam antes de um registro anterior ainda
+	// em consulta ficam em memória até ele terminar
+	Ordenada bool
+}
+
+// tarefa é um registro do CSV de entrada pronto para consulta na API.
+type tarefa struct {
+	cnpj     string
+	ddd      string
+	telefone string
+	email    string
+	linha    int64 // posição do registro na entrada, para o checkpoint
+
+	// repassados são os valores das colunas de passthrough_cols, na ordem
+	// de mapeamentoColunas.Repassadas
+	repassados []string
+}
+
+// resumoProcessamento acumula os totais de um processamento. Os contadores
+// são atualizados concorrentemente pelos workers.
+type resumoProcessamento struct {
+	Total          atomic.Int64 // registros lidos até o momento
+	Processados    atomic.Int64
+	Encontradas    atomic.Int64
+	NaoEncontrados atomic.Int64
+	Erros          atomic.Int64
+	Duplicados     atomic.Int64
+	Ilegiveis      atomic.Int64
+	Validos        atomic.Int64 // registros com CNPJ válido, incluindo repetidos
+	EmCache        atomic.Int64 // CNPJs não consultados por estarem no cache
+	JaGravados     atomic.Int64 // CNPJs não consultados por já estarem na saída de append_to
+
+	// TelefonesInvalidos conta as linhas gravadas com telefone fora do
+	// padrão, mantido como veio no arquivo de entrada
+	TelefonesInvalidos atomic.Int64
+
+	// EmailsInvalidos conta as linhas gravadas com o e-mail em branco por
+	// não ser um endereço válido
+	EmailsInvalidos atomic.Int64
+
+	// UTF8Invalido conta as linhas gravadas com algum campo que continha
+	// bytes fora do UTF-8, substituídos por marcadorUTF8Invalido
+	UTF8Invalido atomic.Int64
+
+	// SemContato conta as empresas descartadas por require_email ou
+	// require_telefone
+	SemContato atomic.Int64
+
+	// LimiteAtingido indica que o job parou ao gravar cfg.Limite empresas
+	LimiteAtingido atomic.Bool
+
+	// ForaDoPercentil conta as empresas qualificadas não gravadas por
+	// ficarem abaixo de cfg.Percentil
+	ForaDoPercentil atomic.Int64
+
+	// Retidas conta as empresas qualificadas guardadas em memória por
+	// cfg.Percentil, que só passam a Encontradas ao serem gravadas no fim
+	// do job
+	Retidas atomic.Int64
+
+	// Consultas conta as consultas à API feitas pelo job; OrcamentoEsgotado
+	// indica que cfg.MaxRequisicoes foi atingido e os CNPJs restantes foram
+	// para o arquivo de erros sem consulta
+	Consultas         atomic.Int64
+	OrcamentoEsgotado atomic.Bool
+
+	// EntradaMalformada indica que a leitura parou após mais de cfg.MaxErros
+	// registros inválidos seguidos
+	EntradaMalformada atomic.Bool
+
+	// Estatisticas resume as empresas gravadas; preenchido ao fim do job
+	Estatisticas estatisticas
+
+	progresso *progressoJob
+	job       *registroJob
+	limiter   *rateLimiter // informa a taxa efetiva ao registro de jobs
+}
+
+// reservarConsulta conta uma consulta à API e informa se ela cabe no
+// orçamento de max_requests. CNPJs em cache ou repetidos nunca chegam aqui.
+func (r *resumoProcessamento) reservarConsulta(maximo int) bool {
+	if r.Consultas.Add(1) <= int64(maximo) || maximo == 0 {
+		return true
+	}
+	r.OrcamentoEsgotado.Store(true)
+	return false
+}
+
+// recusarPorOrcamento registra no arquivo de erros um CNPJ não consultado
+// por falta de orçamento.
+func (r *resumoProcessamento) recusarPorOrcamento(t tarefa, cfg jobConfig) {
+	r.Erros.Add(1)
+	registrarErro(cfg.ErrosCSV, t.cnpj, motivoOrcamento)
+	cfg.Linhas.concluir(t.linha)
+	r.processado()
+}
+
+// recusarPorDisjuntor registra no arquivo de erros um CNPJ não consultado
+// por estar aberto o disjuntor do upstream, para ser reprocessado depois.
+func (r *resumoProcessamento) recusarPorDisjuntor(t tarefa, cfg jobConfig) {
+	r.Erros.Add(1)
+	registrarErro(cfg.ErrosCSV, t.cnpj, motivoDisjuntor)
+	cfg.Linhas.concluir(t.linha)
+	r.processado()
+}
+
+// prazoEsgotado informa se ctx terminou pelo prazo de max_duration, e não
+// por cancelamento ou encerramento do servidor.
+func prazoEsgotado(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.DeadlineExceeded)
+}
+
+// consultaInterrompida informa se ctx terminou por cancelamento ou pelo
+// encerramento do servidor. O registro da consulta então não é concluído:
+// fica pendente no checkpoint, para ser consultado de novo ao retomar.
+func consultaInterrompida(ctx context.Context) bool {
+	return ctx.Err() != nil && !prazoEsgotado(ctx)
+}
+
+// recusarPorPrazo registra no arquivo de erros um CNPJ não consultado por
+// ter se esgotado o prazo de max_duration.
+func (r *resumoProcessamento) recusarPorPrazo(t tarefa, cfg jobConfig) {
+	r.Erros.Add(1)
+	registrarErro(cfg.ErrosCSV, t.cnpj, motivoPrazo)
+	cfg.Linhas.concluir(t.linha)
+	r.processado()
+}
+
+// processado contabiliza um registro concluído e publica o progresso.
+func (r *resumoProcessamento) processado() {
+	r.Processados.Add(1)
+	metricas.processados.Add(1)
+	r.publicar()
+}
+
+// publicar envia o estado atual aos inscritos em /progress e ao registro
+// de jobs, quando configurados.
+func (r *resumoProcessamento) publicar() {
+	processados, encontradas, retidas := r.Processados.Load(), r.Encontradas.Load(), r.Retidas.Load()
+	if r.job != nil {
+		var rps float64
+		if r.limiter != nil {
+			rps = r.limiter.Taxa()
+		}
+		r.job.atualizar(processados, encontradas, retidas, rps)
+	}
+	if r.progresso != nil {
+		r.progresso.publicar(eventoProgresso{
+			Processed: processados,
+			Total:     r.Total.Load(),
+			Matched:   encontradas,
+			Held:      retidas,
+		})
+	}
+}
+
+// resultado é uma empresa consultada que passou pelos filtros ou, com
+// include_all, qualquer empresa consultada com sucesso.
+type resultado struct {
+	tarefa
+	empresa     *Empresa
+	atende      bool        // passou pelos filtros do job
+	coordenadas coordenadas // preenchidas apenas com geocode
+}
+
+// parseInteiroCampo interpreta um valor inteiro (campo do formulário ou
+// variável de ambiente), usando padrao quando ausente ou inválido e
+// limitando o valor à faixa [minimo, maximo].
+func parseInteiroCampo(valor string, padrao, minimo, maximo int) int {
+	n, err := strconv.Atoi(strings.TrimSpace(valor))
+	if err != nil {
+		return padrao
+	}
+	if n < minimo {
+		return minimo
+	}
+	if n > maximo {
+		return maximo
+	}
+	return n
+}
+
+// parseFlag interpreta um campo booleano do formulário (checkbox ou
+// valores como "1", "true" e "sim").
+func parseFlag(valor string) bool {
+	switch strings.ToLower(strings.TrimSpace(valor)) {
+	case "1", "true", "on", "sim", "s":
+		return true
+	}
+	return false
+}
+
+// processRecords distribui os registros entre cfg.Workers goroutines que
+// consultam a API e repassam as empresas qualificadas para um único escritor,
+// responsável por serializar as linhas no CSV de saída. Os arquivos de
+// readers são lidos em sequência, com um único resumo.
+func processRecords(ctx context.Context, readers []*csv.Reader, saida escritorSaida, cfg jobConfig) *resumoProcessamento {
+	resumo := &resumoProcessamento{progresso: cfg.Progresso, job: cfg.Job, limiter: cfg.Limiter}
+
+	// Ao atingir o limite de empresas o restante do arquivo não é consultado
+	ctx, cancelar := context.WithCancel(ctx)
+	defer cancelar()
+
+	tarefas := make(chan tarefa)
+	resultados := make(chan resultado)
+
+	// Com provedor em lote os workers consultam os lotes de um só agrupador
+	var lotes <-chan []tarefa
+	lote, emLote := cfg.Provedor.(provedorLote)
+	if emLote && tamanhoLote > 1 {
+		lotes = agruparLotes(ctx, tarefas, cfg, resumo)
+	}
+	var workers sync.WaitGroup
+	for i := 0; i < cfg.Workers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			if lotes != nil {
+				consultarLotes(ctx, lote, lotes, resultados, cfg, resumo)
+				return
+			}
+			consultarTarefas(ctx, tarefas, resultados, cfg, resumo)
+		}()
+	}
+
+	escrita := make(chan struct{})
+	go func() {
+		defer close(escrita)
+		pulados := 0
+		var acumulador acumuladorEstatisticas
+		defer func() { resumo.Estatisticas = acumulador.resultado() }()
+		type retida struct {
+			res                 resultado
+			telefoneOK, emailOK bool
+		}
+		var retidas []retida
+		var escrever func(res resultado, telefoneOK, emailOK bool)
+		gravar := func(res resultado) {
+			// Consultas em andamento ao atingir o limite são descartadas
+			if resumo.LimiteAtingido.Load() {
+				return
+			}
+
+			var telefoneOK, emailOK bool
+			telefoneInformado := res.ddd != "" || res.telefone != ""
+			res.ddd, res.telefone, telefoneOK = normalizePhone(res.ddd, res.telefone)
+			res.email, emailOK = normalizeEmail(res.email)
+
+			// Com require_email e require_telefone a empresa sem o contato
+			// válido deixa de atender aos filtros
+			if res.atende && ((cfg.ExigirEmail && res.email == "") || (cfg.ExigirTelefone && !telefoneOK)) {
+				resumo.SemContato.Add(1)
+				res.atende = false
+				if !cfg.IncluirTodas {
+					return
+				}
+			}
+
+			// Com include_all as empresas fora dos filtros também são gravadas,
+			// mas não contam para offset, limit nem para as estatísticas
+			if res.atende && pulados < cfg.Deslocamento {
+				pulados++
+				return
+			}
+
+			// Com top_percentile as empresas qualificadas ficam em memória
+			// até o fim do job, quando se conhece a distribuição do capital,
+			// e são informadas no progresso como retidas
+			if cfg.Percentil > 0 {
+				retidas = append(retidas, retida{res, telefoneOK || !telefoneInformado, emailOK})
+				resumo.Retidas.Add(1)
+				resumo.publicar()
+				return
+			}
+			escrever(res, telefoneOK || !telefoneInformado, emailOK)
+		}
+		escrever = func(res resultado, telefoneOK, emailOK bool) {
+			if !telefoneOK {
+				resumo.TelefonesInvalidos.Add(1)
+			}
+			if !emailOK {
+				resumo.EmailsInvalidos.Add(1)
+				registrarErro(cfg.ErrosCSV, res.cnpj, motivoEmailInvalido)
+			}
+
+			if sanitizarResultado(&res) {
+				resumo.UTF8Invalido.Add(1)
+			}
+
+			escreverResultado(saida, res)
+			if !res.atende {
+				return
+			}
+			metricas.encontradas.Add(1)
+			acumulador.adicionar(res.empresa)
+			if n := resumo.Encontradas.Add(1); cfg.Limite > 0 && n >= int64(cfg.Limite) {
+				resumo.LimiteAtingido.Store(true)
+				cancelar()
+			}
+			resumo.publicar()
+		}
+		// O registro de cada resultado só conta como concluído depois de
+		// gravado. Com Ordenada um resultado espera até que todos os
+		// registros anteriores tenham sido concluídos; os que restarem quando
+		// os workers pararem são gravados ao final, ainda em ordem
+		var espera []resultado
+		for res := range resultados {
+			if !cfg.Ordenada {
+				gravar(res)
+				cfg.Linhas.concluir(res.linha)
+				continue
+			}
+			i, _ := slices.BinarySearchFunc(espera, res.linha, func(r resultado, linha int64) int {
+				return cmp.Compare(r.linha, linha)
+			})
+			espera = slices.Insert(espera, i, res)
+			for len(espera) > 0 && espera[0].linha == cfg.Linhas.concluidas() {
+				gravar(espera[0])
+				cfg.Linhas.concluir(espera[0].linha)
+				espera = espera[1:]
+			}
+		}
+		for _, res := range espera {
+			gravar(res)
+			cfg.Linhas.concluir(res.linha)
+		}
+
+		// Do maior para o menor capital, mantendo a ordem de chegada nos
+		// empates
+		slices.SortStableFunc(retidas, func(a, b retida) int {
+			return cmp.Compare(b.res.empresa.CapitalSocial, a.res.empresa.CapitalSocial)
+		})
+		manter := quantidadePercentil(len(retidas), cfg.Percentil)
+		resumo.ForaDoPercentil.Store(int64(len(retidas) - manter))
+		resumo.Retidas.Store(0)
+		for _, r := range retidas[:manter] {
+			escrever(r.res, r.telefoneOK, r.emailOK)
+		}
+	}()
+
+	enfileirarTarefas(ctx, readers, tarefas, cfg, resumo)
+	close(tarefas)
+	workers.Wait()
+	close(resultados)
+	<-escrita
+	resumo.publicar()
+	if resumo.job != nil {
+		resumo.job.definirEstatisticas(resumo.Estatisticas)
+	}
+
+	return resumo
+}
+
+// enfileirarTarefas lê os registros de entrada um a um, sem carregar o
+// arquivo inteiro em memória, e envia para os workers apenas a primeira
+// ocorrência de cada CNPJ válido que ainda não está no cache, considerando
+// todos os arquivos de readers. Os registros são numerados em sequência de um
+// arquivo para o outro.
+func enfileirarTarefas(ctx context.Context, readers []*csv.Reader, tarefas chan<- tarefa, cfg jobConfig, resumo *resumoProcessamento) {
+	vistos := make(map[string]struct{})
+	linha := int64(0)
+	// Com mais de cfg.MaxErros registros inválidos seguidos a entrada parece
+	// malformada (delimitador ou mapeamento errado) e a leitura para antes
+	// de gastar consultas com o restante do arquivo
+	invalidos := 0
+	desistir := func() bool {
+		invalidos++
+		if cfg.MaxErros == 0 || invalidos <= cfg.MaxErros {
+			return false
+		}
+		resumo.EntradaMalformada.Store(true)
+		slog.Warn("Arquivo de entrada parece malformado; leitura interrompida", "event", "input_malformed",
+			"consecutive_errors", invalidos, "max_consecutive_errors", cfg.MaxErros)
+		return true
+	}
+	for _, reader := range readers {
+		ler, _ := leitorRegistros(reader, cfg.Colunas, cfg.Cabecalho)
+		// Esgotado o prazo de max_duration a leitura continua, para que os CNPJs
+		// restantes constem do arquivo de erros
+		for ; ctx.Err() == nil || prazoEsgotado(ctx); linha++ {
+			// Os registros anteriores já foram concluídos ou enviados aos workers
+			cfg.Linhas.lido(linha)
+			record, err := ler()
+			if err == io.EOF {
+				break
+			}
+			// Na retomada de um job os registros já concluídos são pulados
+			if linha < cfg.PularRegistros && (err == nil || errors.As(err, new(*csv.ParseError))) {
+				continue
+			}
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				// O csv.Reader segue para o próximo registro após um erro de formato
+				resumo.Total.Add(1)
+				resumo.Ilegiveis.Add(1)
+				resumo.processado()
+				slog.Warn("Registro ilegível no arquivo de entrada", "event", "record_unreadable", "error", err)
+				if desistir() {
+					return
+				}
+				continue
+			}
+			if err != nil {
+				slog.Error("Erro ao ler o arquivo de entrada", "event", "input_read_failed", "error", err)
+				return
+			}
+			resumo.Total.Add(1)
+
+			// O mínimo de colunas vem do mapeamento, não do layout da Receita
+			if !cfg.Colunas.cabe(record) {
+				linhaRegistro, _ := reader.FieldPos(0)
+				slog.Debug("Registro com menos colunas que o mapeamento", "event", "record_too_short",
+					"row", linhaRegistro, "columns", len(record), "required", cfg.Colunas.maiorIndice()+1)
+				resumo.processado()
+				if desistir() {
+					return
+				}
+				continue
+			}
+			t, ok := extrairTarefa(record, cfg.Colunas)
+			if !ok {
+				resumo.processado()
+				if desistir() {
+					return
+				}
+				continue
+			}
+			invalidos = 0
+			resumo.Validos.Add(1)
+
+			// No reprocessamento, os CNPJs que o job original gravou na saída
+			// e só anotou no CSV de erros não são consultados de novo
+			if cfg.Reprocessar && !motivoRepetivel(record) {
+				resumo.processado()
+				continue
+			}
+
+			// Ignorar CNPJs repetidos no mesmo arquivo ou em outro arquivo do job
+			if _, repetido := vistos[t.cnpj]; repetido {
+				resumo.Duplicados.Add(1)
+				resumo.processado()
+				continue
+			}
+			vistos[t.cnpj] = struct{}{}
+
+			if _, gravado := cfg.JaGravados[t.cnpj]; gravado {
+				resumo.JaGravados.Add(1)
+				resumo.processado()
+				continue
+			}
+
+			if !cfg.IgnorarCache {
+				if emCache(t.cnpj, cfg.CacheTTL) {
+					resumo.EmCache.Add(1)
+					metricas.cacheHits.Add(1)
+					resumo.processado()
+					continue
+				}
+				metricas.cacheMisses.Add(1)
+			}
+
+			if cfg.DryRun {
+				resumo.processado()
+				continue
+			}
+
+			if prazoEsgotado(ctx) {
+				resumo.recusarPorPrazo(t, cfg)
+				continue
+			}
+			t.linha = linha
+			cfg.Linhas.iniciar(linha)
+			select {
+			case tarefas <- t:
+			case <-ctx.Done():
+				if !prazoEsgotado(ctx) {
+					return
+				}
+				resumo.recusarPorPrazo(t, cfg)
+			}
+		}
+	}
+}
+
+// extrairTarefa monta a tarefa de um registro de entrada segundo o
+// mapeamento de colunas. Retorna false para registros sem todas as colunas
+// mapeadas e para CNPJs inválidos.
+func extrairTarefa(record []string, colunas mapeamentoColunas) (tarefa, bool) {
+	if !colunas.cabe(record) {
+		return tarefa{}, false
+	}
+
+	// Extrair CNPJ
+	cnpj, ok := colunas.extrairCNPJ(record)
+	if !ok || !validarCNPJ(cnpj) {
+		return tarefa{}, false
+	}
+
+	// Extrair telefone e email do *arquivo CSV de entrada*
+	t := tarefa{
+		cnpj:     cnpj,
+		ddd:      campo(record, colunas.DDD),
+		telefone: campo(record, colunas.Telefone),
+		email:    campo(record, colunas.Email),
+	}
+	for _, r := range colunas.Repassadas {
+		t.repassados = append(t.repassados, record[r.Indice])
+	}
+	return t, true
+}
+
+// emCache informa se o CNPJ foi consultado há menos de ttl.
+func emCache(cnpj string, ttl time.Duration) bool {
+	lastProcessed, exists := processedCNPJs.Get(cnpj)
+	if exists && time.Since(lastProcessed) >= ttl {
+		processedCNPJs.Remove(cnpj)
+		return false
+	}
+	return exists
+}
+
+// consultarTarefas é o laço de um worker: consulta cada CNPJ respeitando o
+// limitador compartilhado e repassa as empresas que atendem aos filtros.
+func consultarTarefas(ctx context.Context, tarefas <-chan tarefa, resultados chan<- resultado, cfg jobConfig, resumo *resumoProcessamento) {
+	for t := range tarefas {
+		// Tarefas recebidas depois do prazo de max_duration não são consultadas
+		if prazoEsgotado(ctx) {
+			resumo.recusarPorPrazo(t, cfg)
+			continue
+		}
+		// Com o upstream fora do ar o CNPJ falha na hora, sem gastar o
+		// orçamento nem esperar o limitador
+		if disjuntorUpstream.aberto() {
+			resumo.recusarPorDisjuntor(t, cfg)
+			continue
+		}
+		if !resumo.reservarConsulta(cfg.MaxRequisicoes) {
+			resumo.recusarPorOrcamento(t, cfg)
+			continue
+		}
+
+		// Respeitar o limite de requisições antes de consultar a API
+		if err := cfg.Limiter.Wait(ctx); err != nil {
+			if prazoEsgotado(ctx) {
+				resumo.recusarPorPrazo(t, cfg)
+				continue
+			}
+			slog.Info("Processamento interrompido", "event", "job_cancelled", "error", err)
+			return
+		}
+
+		// Com resultado, o registro só é concluído no checkpoint depois de
+		// gravado
+		if empresa, ok := consultarTarefa(ctx, t, cfg, resumo); ok || (empresa != nil && cfg.IncluirTodas) {
+			resultados <- novoResultado(ctx, t, empresa, ok, cfg)
+		} else if !consultaInterrompida(ctx) {
+			cfg.Linhas.concluir(t.linha)
+		}
+		resumo.processado()
+	}
+}
+
+// novoResultado monta o resultado de uma consulta. Com geocode as empresas
+// que atendem aos filtros recebem as coordenadas do seu CEP.
+func novoResultado(ctx context.Context, t tarefa, empresa *Empresa, atende bool, cfg jobConfig) resultado {
+	res := resultado{tarefa: t, empresa: empresa, atende: atende}
+	if atende && cfg.Geocodificar {
+		geoCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+		res.coordenadas = geocodificarCEP(geoCtx, cfg.Geocodificador, empresa.Cep)
+		cancel()
+	}
+	return res
+}
+
+// consultarTarefa consulta o CNPJ de uma tarefa e informa se a empresa
+// atende aos filtros configurados.
+func consultarTarefa(ctx context.Context, t tarefa, cfg jobConfig, resumo *resumoProcessamento) (*Empresa, bool) {
+	// Consultar API
+	inicio := time.Now()
+	consultaCtx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	empresa, err := consultarCNPJ(consultaCtx, cfg.Provedor, t.cnpj)
+	cancel()
+	return tratarConsulta(ctx, t, empresa, err, time.Since(inicio), cfg, resumo)
+}
+
+// tratarConsulta registra o resultado da consulta de uma tarefa (erros,
+// log e cache) e informa se a empresa atende aos filtros configurados.
+func tratarConsulta(ctx context.Context, t tarefa, empresa *Empresa, err error, tempo time.Duration, cfg jobConfig, resumo *resumoProcessamento) (*Empresa, bool) {
+	duracao := tempo.Milliseconds()
+	if prazoEsgotado(ctx) {
+		// Consulta interrompida pelo prazo de max_duration
+		resumo.Erros.Add(1)
+		registrarErro(cfg.ErrosCSV, t.cnpj, motivoPrazo)
+		return nil, false
+	}
+	if ctx.Err() != nil {
+		// Job interrompido no meio da consulta; o CNPJ não conta como erro
+		return nil, false
+	}
+	if err != nil {
+		resumo.Erros.Add(1)
+		registrarErro(cfg.ErrosCSV, t.cnpj, classificarErro(err))
+	}
+	if errors.Is(err, ErrCNPJNotFound) {
+		resumo.NaoEncontrados.Add(1)
+		slog.Info("CNPJ não encontrado na base", "event", "lookup_not_found", "cnpj", t.cnpj, "duration_ms", duracao)
+		return nil, false
+	}
+	if err != nil {
+		slog.Error("Erro ao consultar CNPJ", "event", "lookup_failed", "cnpj", t.cnpj, "duration_ms", duracao, "error", err)
+		return nil, false
+	}
+	slog.Debug("CNPJ consultado", "event", "lookup_ok", "cnpj", t.cnpj, "duration_ms", duracao)
+
+	if !cfg.IncluirSocios {
+		empresa.Socios = nil
+	}
+
+	// Atualizar cache; com no_cache o job não afeta os demais
+	if !cfg.SemCache {
+		processedCNPJs.Set(t.cnpj, time.Now())
+	}
+
+	return empresa, atendeFiltros(empresa, cfg)
+}
+
+// atendeFiltros aplica à empresa consultada os filtros configurados no job.
+func atendeFiltros(empresa *Empresa, cfg jobConfig) bool {
+	// Verificar capital social
+	if !capitalAtende(empresa.CapitalSocial, cfg.CapitalModo, cfg.CapitalMinimo, cfg.CapitalMaximo) {
+		return false
+	}
+
+	// Verificar situação cadastral
+	if cfg.SomenteAtivas && !strings.EqualFold(strings.TrimSpace(empresa.SituacaoCadastral), "ATIVA") {
+		return false
+	}
+
+	// Verificar opção pelo Simples; sem a informação da API a empresa não passa
+	if cfg.SomenteSimples && (empresa.OpcaoSimples == nil || !*empresa.OpcaoSimples) {
+		return false
+	}
+
+	// Verificar CNAE principal
+	if len(cfg.CNAEs) > 0 {
+		if _, ok := cfg.CNAEs[formatarCNAE(empresa.CnaePrincipalCodigo)]; !ok {
+			return false
+		}
+	}
+
+	// Verificar UF
+	if len(cfg.UFs) > 0 {
+		if _, ok := cfg.UFs[strings.ToUpper(strings.TrimSpace(empresa.UF))]; !ok {
+			return false
+		}
+	}
+
+	// Verificar município, sem diferenciar maiúsculas nem acentos
+	if len(cfg.Municipios) > 0 {
+		if _, ok := cfg.Municipios[normalizarTexto(empresa.Municipio)]; !ok {
+			return false
+		}
+	}
+
+	// Verificar se o nome contém o termo, sem diferenciar maiúsculas nem
+	// acentos
+	if cfg.NomeContem != "" && !nomeContemTermo(empresa, cfg.NomeContem, cfg.NomeCampo) {
+		return false
+	}
+
+	// Verificar porte
+	if len(cfg.Portes) > 0 {
+		if _, ok := cfg.Portes[empresa.Porte]; !ok {
+			return false
+		}
+	}
+
+	// Verificar natureza jurídica
+	if len(cfg.Naturezas) > 0 {
+		if _, ok := cfg.Naturezas[string(empresa.NaturezaJuridicaCodigo)]; !ok {
+			return false
+		}
+	}
+
+	// Verificar data de início de atividade; sem data informada pela API
+	// não é possível confirmar, então a empresa fica de fora
+	if !cfg.FundadaApos.IsZero() {
+		inicio := empresa.DataInicioAtividade.Time
+		if inicio.IsZero() || inicio.Before(cfg.FundadaApos) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ufsValidas são as siglas das unidades federativas brasileiras.
+var ufsValidas = map[string]struct{}{
+	"AC": {}, "AL": {}, "AP": {}, "AM": {}, "BA": {}, "CE": {}, "DF": {},
+	"ES": {}, "GO": {}, "MA": {}, "MT": {}, "MS": {}, "MG": {}, "PA": {},
+	"PB": {}, "PR": {}, "PE": {}, "PI": {}, "RJ": {}, "RN": {}, "RS": {},
+	"RO": {}, "RR": {}, "SC": {}, "SP": {}, "SE": {}, "TO": {},
+}
+
+// parseUFs interpreta a lista de UFs separadas por vírgula do formulário.
+// Uma lista vazia significa que todas as UFs são aceitas.
+func parseUFs(valor string) (map[string]struct{}, error) {
+	ufs := make(map[string]struct{})
+	for _, item := range strings.Split(valor, ",") {
+		uf := strings.ToUpper(strings.TrimSpace(item))
+		if uf == "" {
+			continue
+		}
+		if _, ok := ufsValidas[uf]; !ok {
+			return nil, fmt.Errorf("UF inválida: %q", item)
+		}
+		ufs[uf] = struct{}{}
+	}
+	return ufs, nil
+}
+
+// parseMunicipios interpreta a lista de municípios separados por vírgula
+// do formulário. Uma lista vazia significa que todos são aceitos.
+func parseMunicipios(valor string) map[string]struct{} {
+	municipios := make(map[string]struct{})
+	for _, item := range strings.Split(valor, ",") {
+		if m := normalizarTexto(item); m != "" {
+			municipios[m] = struct{}{}
+		}
+	}
+	return municipios
+}
+
+// Campos de nome aceitos em nome_campo.
+const (
+	campoNomeRazao    = "razao_social"
+	campoNomeFantasia = "nome_fantasia"
+	campoNomeAmbos    = "ambos"
+)
+
+// parseCampoNome valida o campo nome_campo, que indica em quais nomes da
+// empresa o termo de nome_contem é procurado. Vazio procura nos dois.
+func parseCampoNome(valor string) (string, error) {
+	switch campo := strings.ToLower(strings.TrimSpace(valor)); campo {
+	case "":
+		return campoNomeAmbos, nil
+	case campoNomeRazao, campoNomeFantasia, campoNomeAmbos:
+		return campo, nil
+	}
+	return "", fmt.Errorf("nome_campo inválido: %q (use razao_social, nome_fantasia ou ambos)", valor)
+}
+
+// nomeContemTermo informa se a razão social ou o nome fantasia da empresa,
+// conforme campo, contém termo, já normalizado por normalizarTexto.
+func nomeContemTermo(empresa *Empresa, termo, campo string) bool {
+	if campo != campoNomeFantasia && strings.Contains(normalizarTexto(empresa.RazaoSocial), termo) {
+		return true
+	}
+	return campo != campoNomeRazao && strings.Contains(normalizarTexto(empresa.NomeFantasia), termo)
+}
+
+// Códigos de porte usados na saída e no filtro porte.
+const (
+	porteME     = "ME"
+	porteEPP    = "EPP"
+	porteDemais = "DEMAIS"
+)
+
+// normalizarPorte converte o porte descrito pela API ("MICRO EMPRESA",
+// "EMPRESA DE PEQUENO PORTE", "DEMAIS") para o código estável
+// correspondente. Portes não informados ou desconhecidos resultam em vazio.
+func normalizarPorte(porte string) string {
+	switch strings.ToUpper(strings.TrimSpace(porte)) {
+	case "MICRO EMPRESA", "MICROEMPRESA", porteME:
+		return porteME
+	case "EMPRESA DE PEQUENO PORTE", porteEPP:
+		return porteEPP
+	case porteDemais:
+		return porteDemais
+	}
+	return ""
+}
+
+// parsePortes interpreta a lista de portes separados por vírgula do
+// formulário, aceitando os códigos ou as descrições da API. Uma lista vazia
+// significa que todos os portes são aceitos.
+func parsePortes(valor string) (map[string]struct{}, error) {
+	portes := make(map[string]struct{})
+	for _, item := range strings.Split(valor, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		porte := normalizarPorte(item)
+		if porte == "" {
+			return nil, fmt.Errorf("porte inválido: %q (use ME, EPP ou DEMAIS)", item)
+		}
+		portes[porte] = struct{}{}
+	}
+	return portes, nil
+}
+
+// normalizarNatureza reduz o código de natureza jurídica aos dígitos, como
+// "206-2" para "2062", para que API e formulário usem a mesma forma.
+func normalizarNatureza(codigo string) string {
+	return somenteDigitos(codigo)
+}
+
+// parseNaturezas interpreta a lista de códigos de natureza jurídica
+// separados por vírgula do formulário, com ou sem traço ("206-2" ou "2062").
+// Uma lista vazia significa que todas as naturezas são aceitas.
+func parseNaturezas(valor string) (map[string]struct{}, error) {
+	naturezas := make(map[string]struct{})
+	for _, item := range strings.Split(valor, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		codigo := normalizarNatureza(item)
+		if len(codigo) != 4 {
+			return nil, fmt.Errorf("código de natureza jurídica inválido: %q", item)
+		}
+		naturezas[codigo] = struct{}{}
+	}
+	return naturezas, nil
+}
+
+// formatarCNAE representa o código CNAE com os 7 dígitos, preservando os
+// zeros à esquerda que a API omite ao enviar o código como número.
+func formatarCNAE(codigo int) string {
+	if codigo <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%07d", codigo)
+}
+
+// parseCNAEs interpreta a lista de códigos CNAE separados por vírgula do
+// formulário. A pontuação é ignorada, então "6201-5/01" e "6201501" são
+// equivalentes. Uma lista vazia significa que todos os CNAEs são aceitos.
+func parseCNAEs(valor string) (map[string]struct{}, error) {
+	cnaes := make(map[string]struct{})
+	for _, item := range strings.Split(valor, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		codigo := somenteDigitos(item)
+		if len(codigo) != 7 {
+			return nil, fmt.Errorf("código CNAE inválido: %q", item)
+		}
+		cnaes[codigo] = struct{}{}
+	}
+	return cnaes, nil
+}
+
+// validarCNPJ verifica o formato e os dígitos verificadores do CNPJ.
+// Caracteres não numéricos (pontos, barras, traços) são ignorados.
+func validarCNPJ(cnpj string) bool {
+	digitos := make([]int, 0, 14)
+	for _, c := range cnpj {
+		if c >= '0' && c <= '9' {
+			digitos = append(digitos, int(c-'0'))
+		}
+	}
+
+	if len(digitos) != 14 {
+		return false
+	}
+
+	// Rejeitar sequências de dígitos iguais (ex: 00000000000000)
+	iguais := true
+	for _, d := range digitos[1:] {
+		if d != digitos[0] {
+			iguais = false
+			break
+		}
+	}
+	if iguais {
+		return false
+	}
+
+	pesos1 := []int{5, 4, 3, 2, 9, 8, 7, 6, 5, 4, 3, 2}
+	pesos2 := []int{6, 5, 4, 3, 2, 9, 8, 7, 6, 5, 4, 3, 2}
+
+	return digitos[12] == digitoVerificador(digitos[:12], pesos1) &&
+		digitos[13] == digitoVerificador(digitos[:13], pesos2)
+}
+
+// digitoVerificador calcula um dígito verificador do CNPJ pelo módulo 11.
+func digitoVerificador(digitos, pesos []int) int {
+	soma := 0
+	for i, d := range digitos {
+		soma += d * pesos[i]
+	}
+	resto := soma % 11
+	if resto < 2 {
+		return 0
+	}
+	return 11 - resto
+}
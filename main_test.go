@@ -0,0 +1,758 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"io"
+	"maps"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestValidarCNPJ(t *testing.T) {
+	casos := []struct {
+		cnpj string
+		want bool
+	}{
+		{"11222333000181", true},
+		{"11.222.333/0001-81", true},
+		{"33000167000101", true}, // Petrobras
+		{"00000000000191", true}, // Banco do Brasil, com zeros à esquerda
+		{"19131243000197", true},
+		{"11444777000161", true},
+		{"11222333000182", false}, // segundo dígito errado
+		{"11222333000191", false}, // primeiro dígito errado
+		{"1122233300018", false},  // 13 dígitos
+		{"112223330001811", false},
+		{"", false},
+		{"00000000000000", false}, // dígitos iguais, embora os verificadores confiram
+		{"11111111111111", false},
+		{"abcdefghijklmn", false},
+	}
+	for _, c := range casos {
+		if got := validarCNPJ(c.cnpj); got != c.want {
+			t.Errorf("validarCNPJ(%q) = %v, quer %v", c.cnpj, got, c.want)
+		}
+	}
+}
+
+func TestDigitoVerificador(t *testing.T) {
+	base := []int{1, 1, 2, 2, 2, 3, 3, 3, 0, 0, 0, 1}
+	if got := digitoVerificador(base, []int{5, 4, 3, 2, 9, 8, 7, 6, 5, 4, 3, 2}); got != 8 {
+		t.Errorf("primeiro dígito = %d, quer 8", got)
+	}
+	if got := digitoVerificador(append(base, 8), []int{6, 5, 4, 3, 2, 9, 8, 7, 6, 5, 4, 3, 2}); got != 1 {
+		t.Errorf("segundo dígito = %d, quer 1", got)
+	}
+	// Resto menor que 2 dá dígito 0
+	if got := digitoVerificador([]int{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, []int{5, 4, 3, 2, 9, 8, 7, 6, 5, 4, 3, 2}); got != 0 {
+		t.Errorf("dígito de zeros = %d, quer 0", got)
+	}
+}
+
+func TestParseCapitalCampo(t *testing.T) {
+	casos := []struct {
+		valor string
+		want  float64
+	}{
+		{"", capitalMinimoPadrao},
+		{"  ", capitalMinimoPadrao},
+		{"1000000", 1000000},
+		{" 250000.50 ", 250000.50},
+		{"250000,50", 250000.50},
+		{"0", 0},
+		{"-10", capitalMinimoPadrao},
+		{"abc", capitalMinimoPadrao},
+		{"NaN", capitalMinimoPadrao},
+		{"Inf", capitalMinimoPadrao},
+	}
+	for _, c := range casos {
+		if got := parseCapitalCampo(c.valor, capitalMinimoPadrao); got != c.want {
+			t.Errorf("parseCapitalCampo(%q) = %v, quer %v", c.valor, got, c.want)
+		}
+	}
+}
+
+func TestDentroDaFaixa(t *testing.T) {
+	casos := []struct {
+		nome              string
+		capital, min, max float64
+		want              bool
+	}{
+		{"sem limite superior, acima do mínimo", 1e9, 50000, 0, true},
+		{"sem limite superior, igual ao mínimo", 50000, 50000, 0, false},
+		{"faixa fechada, dentro", 75000, 50000, 100000, true},
+		{"faixa fechada, no máximo", 100000, 50000, 100000, true},
+		{"faixa fechada, acima do máximo", 100000.01, 50000, 100000, false},
+		{"faixa fechada, abaixo do mínimo", 10000, 50000, 100000, false},
+		{"mínimo zero", 0.01, 0, 0, true},
+	}
+	for _, c := range casos {
+		if got := dentroDaFaixa(c.capital, c.min, c.max); got != c.want {
+			t.Errorf("%s: dentroDaFaixa(%v, %v, %v) = %v, quer %v", c.nome, c.capital, c.min, c.max, got, c.want)
+		}
+	}
+}
+
+func TestDescricaoFaixa(t *testing.T) {
+	if got, want := sufixoFaixa(50000, 0), "50000"; got != want {
+		t.Errorf("sufixoFaixa sem máximo = %q, quer %q", got, want)
+	}
+	if got, want := sufixoFaixa(50000, 250000.5), "50000_ate_250000.5"; got != want {
+		t.Errorf("sufixoFaixa com máximo = %q, quer %q", got, want)
+	}
+	if got, want := descreverFaixa(50000, 0), "acima de R$ 50000.00, sem limite superior"; got != want {
+		t.Errorf("descreverFaixa sem máximo = %q, quer %q", got, want)
+	}
+	if got, want := descreverFaixa(50000, 100000), "acima de R$ 50000.00 até R$ 100000.00"; got != want {
+		t.Errorf("descreverFaixa com máximo = %q, quer %q", got, want)
+	}
+}
+
+func TestUploadFaixaCapital(t *testing.T) {
+	abaixo, dentro, acima := cnpjTeste("112223330001"), cnpjTeste("191312430001"), cnpjTeste("114447770001")
+	empresas := map[string]Empresa{}
+	for cnpj, capital := range map[string]float64{abaixo: 10000, dentro: 80000, acima: 500000} {
+		e := empresaTeste("EMPRESA")
+		e.CapitalSocial = capital
+		empresas[cnpj] = e
+	}
+	entrada := linhaReceita(abaixo, "", "", "") + linhaReceita(dentro, "", "", "") + linhaReceita(acima, "", "", "")
+
+	casos := []struct {
+		nome      string
+		campos    map[string]string
+		want      []string
+		arquivo   string
+		descricao string
+	}{
+		{"sem limite superior", map[string]string{"workers": "1", "capital_minimo": "50000"}, []string{dentro, acima},
+			"empresas_capital_maior_50000_", "acima de R$ 50000.00, sem limite superior"},
+		{"faixa fechada", map[string]string{"workers": "1", "capital_minimo": "50000", "capital_maximo": "100000"}, []string{dentro},
+			"empresas_capital_maior_50000_ate_100000_", "acima de R$ 50000.00 até R$ 100000.00"},
+	}
+	for _, c := range casos {
+		t.Run(c.nome, func(t *testing.T) {
+			usarAmbienteTeste(t, &provedorFalso{empresas: empresas})
+			rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", c.campos, arquivoTeste{"entrada.csv", entrada})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("/upload: %s", mensagemErro(rec))
+			}
+			if !strings.Contains(rec.Body.String(), c.descricao) {
+				t.Errorf("resposta sem a faixa %q:\n%s", c.descricao, rec.Body.String())
+			}
+			saida := lerArquivoSaida(t, c.arquivo)
+			cabecalho, linhas := lerSaidaCSV(t, saida)
+			if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, c.want) {
+				t.Errorf("CNPJs = %v, quer %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestUploadFaixaCapitalInvertida(t *testing.T) {
+	usarAmbienteTeste(t, &provedorFalso{})
+	rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", map[string]string{"capital_minimo": "100000", "capital_maximo": "50000"},
+		arquivoTeste{"entrada.csv", linhaReceita(cnpjTeste("112223330001"), "", "", "")})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("/upload com máximo abaixo do mínimo: %s, quer 400", mensagemErro(rec))
+	}
+}
+
+func TestWorkersGravamTodasAsEmpresas(t *testing.T) {
+	cnpjs := cnpjsTeste(12)
+	empresas := map[string]Empresa{}
+	var entrada strings.Builder
+	var want []string
+	for i, cnpj := range cnpjs {
+		entrada.WriteString(linhaReceita(cnpj, "", "", ""))
+		e := empresaTeste("EMPRESA")
+		if i%3 == 0 {
+			e.CapitalSocial = 1000 // fora do filtro padrão
+		} else {
+			want = append(want, cnpj)
+		}
+		empresas[cnpj] = e
+	}
+
+	for _, workers := range []string{"1", "4", "32"} {
+		t.Run("workers="+workers, func(t *testing.T) {
+			usarAmbienteTeste(t, &provedorFalso{empresas: empresas})
+			rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"workers": workers},
+				arquivoTeste{"entrada.csv", entrada.String()})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("/upload: %s", mensagemErro(rec))
+			}
+			cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+			got := coluna(t, cabecalho, linhas, "CNPJ")
+			slices.Sort(got)
+			if !slices.Equal(got, want) {
+				t.Errorf("%d empresas gravadas, quer %d: %v", len(got), len(want), got)
+			}
+		})
+	}
+}
+
+func TestResumoContaNaoEncontrados(t *testing.T) {
+	encontrado := cnpjTeste("112223330001")
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{encontrado: empresaTeste("A")}})
+
+	entrada := linhaReceita(encontrado, "", "", "") + linhaReceita(cnpjTeste("191312430001"), "", "", "") +
+		linhaReceita(cnpjTeste("114447770001"), "", "", "")
+	rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", nil, arquivoTeste{"entrada.csv", entrada})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	if corpo := rec.Body.String(); !strings.Contains(corpo, "CNPJs não encontrados na base: 2<") {
+		t.Errorf("resumo sem os 2 não encontrados:\n%s", corpo)
+	}
+}
+
+func TestCacheTTL(t *testing.T) {
+	dentro, vencido := cnpjTeste("112223330001"), cnpjTeste("191312430001")
+	p := &provedorFalso{empresas: map[string]Empresa{dentro: empresaTeste("A"), vencido: empresaTeste("B")}}
+	usarAmbienteTeste(t, p)
+	ttl := cacheTTL
+	t.Cleanup(func() { cacheTTL = ttl })
+	cacheTTL = time.Hour
+	processedCNPJs.Set(dentro, time.Now().Add(-59*time.Minute))
+	processedCNPJs.Set(vencido, time.Now().Add(-61*time.Minute))
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", nil,
+		arquivoTeste{"entrada.csv", linhaReceita(dentro, "", "", "") + linhaReceita(vencido, "", "", "")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.consultas[dentro] != 0 || p.consultas[vencido] != 1 {
+		t.Errorf("consultas = %v; quer só o CNPJ consultado há mais que o TTL", p.consultas)
+	}
+}
+
+func TestParseDuracao(t *testing.T) {
+	casos := map[string]time.Duration{
+		"":       2 * time.Hour,
+		"30m":    30 * time.Minute,
+		" 24h ":  24 * time.Hour,
+		"1 hora": 2 * time.Hour,
+		"-5m":    2 * time.Hour,
+		"0s":     2 * time.Hour,
+	}
+	for valor, want := range casos {
+		if got := parseDuracao(valor, cacheTTLPadrao); got != want {
+			t.Errorf("parseDuracao(%q) = %v, quer %v", valor, got, want)
+		}
+	}
+}
+
+func TestUploadInline(t *testing.T) {
+	cnpj := cnpjTeste("112223330001")
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{cnpj: empresaTeste("EMPRESA A")}})
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", nil,
+		arquivoTeste{"entrada.csv", linhaReceita(cnpj, "11", "33334444", "contato@empresa.com.br")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/csv") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if cd := rec.Header().Get("Content-Disposition"); !strings.HasPrefix(cd, `attachment; filename="empresas_capital_maior_50000_`) {
+		t.Errorf("Content-Disposition = %q", cd)
+	}
+	cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+	if len(linhas) != 1 {
+		t.Fatalf("linhas = %v, quer uma", linhas)
+	}
+	for nome, want := range map[string]string{"CNPJ": cnpj, "RazaoSocial": "EMPRESA A", "CapitalSocial": "100000.00",
+		"UF": "SP", "DDD": "11", "Telefone": "+55 (11) 3333-4444", "Email": "contato@empresa.com.br"} {
+		if got := coluna(t, cabecalho, linhas, nome)[0]; got != want {
+			t.Errorf("%s = %q, quer %q", nome, got, want)
+		}
+	}
+	if nomes, _ := filepath.Glob(filepath.Join(diretorioSaida, "empresas_capital_maior_*")); len(nomes) != 0 {
+		t.Errorf("arquivos gravados no servidor: %v", nomes)
+	}
+}
+
+func TestFiltroSituacaoCadastral(t *testing.T) {
+	ativa, baixada := "11222333000181", "19131243000197"
+	transporte := &transporteFalso{respostas: map[string]respostaFalsa{
+		"/" + ativa: {http.StatusOK, `{"cnpj":"` + ativa + `","razao_social":"ATIVA LTDA","capital_social":100000,` +
+			`"uf":"SP","descricao_situacao_cadastral":"ATIVA"}`},
+		"/" + baixada: {http.StatusOK, `{"cnpj":"` + baixada + `","razao_social":"BAIXADA LTDA","capital_social":100000,` +
+			`"uf":"SP","descricao_situacao_cadastral":"BAIXADA"}`},
+	}}
+	p := minhaReceita{baseURL: "http://minhareceita.teste", cliente: &http.Client{Transport: transporte}}
+	entrada := linhaReceita(ativa, "", "", "") + linhaReceita(baixada, "", "", "")
+
+	usarAmbienteTeste(t, p)
+	empresa, err := consultarCNPJ(context.Background(), p, baixada)
+	if err != nil {
+		t.Fatalf("consultarCNPJ: %v", err)
+	}
+	if empresa.SituacaoCadastral != "BAIXADA" {
+		t.Errorf("SituacaoCadastral = %q, quer BAIXADA", empresa.SituacaoCadastral)
+	}
+
+	casos := []struct {
+		nome   string
+		campos map[string]string
+		want   []string
+	}{
+		{"todas", map[string]string{"workers": "1"}, []string{ativa, baixada}},
+		{"somente ativas", map[string]string{"workers": "1", "somente_ativas": "1"}, []string{ativa}},
+	}
+	for _, c := range casos {
+		t.Run(c.nome, func(t *testing.T) {
+			usarAmbienteTeste(t, p)
+			rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", c.campos, arquivoTeste{"entrada.csv", entrada})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("/upload: %s", mensagemErro(rec))
+			}
+			cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+			if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, c.want) {
+				t.Errorf("CNPJs = %v, quer %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestCNAEPrincipal(t *testing.T) {
+	software, comercio := "11222333000181", "19131243000197"
+	transporte := &transporteFalso{respostas: map[string]respostaFalsa{
+		"/" + software: {http.StatusOK, `{"cnpj":"` + software + `","razao_social":"SOFTWARE LTDA","capital_social":100000,` +
+			`"cnae_fiscal":6201501,"cnae_fiscal_descricao":"Desenvolvimento de programas de computador sob encomenda"}`},
+		"/" + comercio: {http.StatusOK, `{"cnpj":"` + comercio + `","razao_social":"COMERCIO LTDA","capital_social":100000,` +
+			`"cnae_fiscal":4711302,"cnae_fiscal_descricao":"Comércio varejista de mercadorias em geral"}`},
+	}}
+	p := minhaReceita{baseURL: "http://minhareceita.teste", cliente: &http.Client{Transport: transporte}}
+	entrada := linhaReceita(software, "", "", "") + linhaReceita(comercio, "", "", "")
+
+	casos := []struct {
+		nome   string
+		cnae   string
+		want   []string
+		codigo []string
+	}{
+		{"sem filtro", "", []string{software, comercio}, []string{"6201501", "4711302"}},
+		{"um código pontuado", "6201-5/01", []string{software}, []string{"6201501"}},
+		{"vários códigos", "4711302, 6201501", []string{software, comercio}, []string{"6201501", "4711302"}},
+		{"nenhum confere", "8599604", nil, nil},
+	}
+	for _, c := range casos {
+		t.Run(c.nome, func(t *testing.T) {
+			usarAmbienteTeste(t, p)
+			rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"workers": "1", "cnae": c.cnae},
+				arquivoTeste{"entrada.csv", entrada})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("/upload: %s", mensagemErro(rec))
+			}
+			cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+			if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, c.want) {
+				t.Errorf("CNPJs = %v, quer %v", got, c.want)
+			}
+			if got := coluna(t, cabecalho, linhas, "CnaePrincipalCodigo"); !slices.Equal(got, c.codigo) {
+				t.Errorf("CnaePrincipalCodigo = %v, quer %v", got, c.codigo)
+			}
+		})
+	}
+
+	usarAmbienteTeste(t, p)
+	empresa, err := consultarCNPJ(context.Background(), p, comercio)
+	if err != nil {
+		t.Fatalf("consultarCNPJ: %v", err)
+	}
+	if empresa.CnaePrincipalCodigo != 4711302 || empresa.CnaePrincipalDescricao != "Comércio varejista de mercadorias em geral" {
+		t.Errorf("CNAE = %d %q", empresa.CnaePrincipalCodigo, empresa.CnaePrincipalDescricao)
+	}
+}
+
+func TestParseCNAEs(t *testing.T) {
+	cnaes, err := parseCNAEs(" 6201-5/01,4711302,, ")
+	if err != nil {
+		t.Fatalf("parseCNAEs: %v", err)
+	}
+	if len(cnaes) != 2 {
+		t.Errorf("cnaes = %v, quer 6201501 e 4711302", cnaes)
+	}
+	for _, codigo := range []string{"6201501", "4711302"} {
+		if _, ok := cnaes[codigo]; !ok {
+			t.Errorf("código %s ausente em %v", codigo, cnaes)
+		}
+	}
+	if _, err := parseCNAEs("62015"); err == nil {
+		t.Error("código com menos de 7 dígitos aceito")
+	}
+	if got := formatarCNAE(111301); got != "0111301" {
+		t.Errorf("formatarCNAE(111301) = %q, quer 0111301", got)
+	}
+}
+
+func TestFiltroUF(t *testing.T) {
+	sp, rj, mg := cnpjTeste("112223330001"), cnpjTeste("191312430001"), cnpjTeste("114447770001")
+	empresas := map[string]Empresa{}
+	for cnpj, uf := range map[string]string{sp: "SP", rj: "RJ", mg: "MG"} {
+		e := empresaTeste("EMPRESA")
+		e.UF = uf
+		empresas[cnpj] = e
+	}
+	entrada := linhaReceita(sp, "", "", "") + linhaReceita(rj, "", "", "") + linhaReceita(mg, "", "", "")
+
+	casos := []struct {
+		nome string
+		ufs  string
+		want []string
+	}{
+		{"todas", "", []string{sp, rj, mg}},
+		{"uma UF", "rj", []string{rj}},
+		{"várias UFs", " SP, mg ", []string{sp, mg}},
+	}
+	for _, c := range casos {
+		t.Run(c.nome, func(t *testing.T) {
+			usarAmbienteTeste(t, &provedorFalso{empresas: empresas})
+			rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"workers": "1", "uf": c.ufs},
+				arquivoTeste{"entrada.csv", entrada})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("/upload: %s", mensagemErro(rec))
+			}
+			cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+			if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, c.want) {
+				t.Errorf("CNPJs = %v, quer %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestFiltroUFInvalida(t *testing.T) {
+	usarAmbienteTeste(t, &provedorFalso{})
+	rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", map[string]string{"uf": "SP,XX"},
+		arquivoTeste{"entrada.csv", linhaReceita(cnpjTeste("112223330001"), "", "", "")})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("/upload com UF XX: %s, quer 400", mensagemErro(rec))
+	}
+}
+
+// provedorInterrompido cancela o contexto dos jobs ao receber a consulta de
+// número apos, como um SIGTERM no meio do processamento.
+type provedorInterrompido struct {
+	provedorFalso
+	apos     int
+	cancelar context.CancelFunc
+}
+
+func (p *provedorInterrompido) Consultar(ctx context.Context, cnpj string) (*Empresa, error) {
+	if p.totalConsultas() >= p.apos {
+		p.cancelar()
+	}
+	return p.provedorFalso.Consultar(ctx, cnpj)
+}
+
+func TestEncerramentoDeixaSaidaValida(t *testing.T) {
+	cnpjs := cnpjsTeste(40)
+	p := &provedorInterrompido{provedorFalso: provedorFalso{empresas: map[string]Empresa{}}, apos: 5}
+	var entrada strings.Builder
+	for _, cnpj := range cnpjs {
+		entrada.WriteString(linhaReceita(cnpj, "11", "32345678", ""))
+		p.empresas[cnpj] = empresaTeste("EMPRESA")
+	}
+	usarAmbienteTeste(t, p)
+	anterior := contextoJobs
+	t.Cleanup(func() { contextoJobs = anterior })
+	contextoJobs, p.cancelar = context.WithCancel(context.Background())
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", nil,
+		arquivoTeste{"entrada.csv", entrada.String()})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	if !strings.Contains(rec.Body.String(), "interrompido pelo encerramento do servidor") {
+		t.Errorf("resposta sem o job interrompido:\n%s", rec.Body.String())
+	}
+
+	saida := lerArquivoSaida(t, "empresas_")
+	if !strings.HasSuffix(saida, "\n") {
+		t.Errorf("saída termina no meio de uma linha: %q", saida[max(0, len(saida)-80):])
+	}
+	// lerSaidaCSV falha em linhas com menos colunas que o cabeçalho
+	_, linhas := lerSaidaCSV(t, saida)
+	if len(linhas) == 0 || len(linhas) >= len(cnpjs) {
+		t.Errorf("%d linhas gravadas; quer as consultadas antes do encerramento, menos que %d", len(linhas), len(cnpjs))
+	}
+}
+
+func TestDuplicadosConsultadosUmaVez(t *testing.T) {
+	a, b := cnpjTeste("112223330001"), cnpjTeste("191312430001")
+	p := &provedorFalso{empresas: map[string]Empresa{a: empresaTeste("A"), b: empresaTeste("B")}}
+	usarAmbienteTeste(t, p)
+
+	entrada := linhaReceita(a, "", "", "") + linhaReceita(b, "", "", "") + linhaReceita(a, "", "", "") +
+		linhaReceita(a, "", "", "") + linhaReceita(b, "", "", "")
+	rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", map[string]string{"workers": "4"},
+		arquivoTeste{"entrada.csv", entrada})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	p.mu.Lock()
+	consultas := maps.Clone(p.consultas)
+	p.mu.Unlock()
+	if consultas[a] != 1 || consultas[b] != 1 {
+		t.Errorf("consultas = %v, quer uma por CNPJ", consultas)
+	}
+	if !strings.Contains(rec.Body.String(), "CNPJs repetidos no arquivo, consultados uma única vez: 3<") {
+		t.Errorf("resumo sem os 3 repetidos:\n%s", rec.Body.String())
+	}
+	_, linhas := lerSaidaCSV(t, lerArquivoSaida(t, "empresas_"))
+	if len(linhas) != 2 {
+		t.Errorf("%d linhas gravadas, quer 2", len(linhas))
+	}
+}
+
+// entradaGerada produz sob demanda total linhas no layout da Receita,
+// repetindo os CNPJs de base, e conta os bytes já entregues ao leitor.
+type entradaGerada struct {
+	base     []string
+	total    int
+	linha    int
+	pendente []byte
+	lidos    atomic.Int64
+}
+
+func (e *entradaGerada) Read(p []byte) (int, error) {
+	for len(e.pendente) == 0 {
+		if e.linha == e.total {
+			return 0, io.EOF
+		}
+		e.pendente = []byte(linhaReceita(e.base[e.linha%len(e.base)], "11", "32345678", ""))
+		e.linha++
+	}
+	n := copy(p, e.pendente)
+	e.pendente = e.pendente[n:]
+	e.lidos.Add(int64(n))
+	return n, nil
+}
+
+// leitorEntradaTeste prepara r como o uploadHandler prepara o arquivo
+// enviado.
+func leitorEntradaTeste(r io.Reader) *csv.Reader {
+	input := decodificarEntrada(bufio.NewReaderSize(r, tamanhoAmostraDelimitador), encodingAuto)
+	reader := csv.NewReader(input)
+	reader.Comma = detectarDelimitador(lerPrimeiraLinha(input, 0))
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
+	return reader
+}
+
+func TestEntradaLidaEmStreaming(t *testing.T) {
+	usarAmbienteTeste(t, &provedorFalso{})
+
+	// Cerca de 50 MB de entrada: os primeiros CNPJs chegam aos workers depois
+	// de lida só uma fração do arquivo
+	entrada := &entradaGerada{base: cnpjsTeste(100), total: 500_000}
+	reader := leitorEntradaTeste(entrada)
+	ctx, cancelar := context.WithCancel(context.Background())
+	tarefas := make(chan tarefa)
+	go func() {
+		enfileirarTarefas(ctx, []*csv.Reader{reader}, tarefas, jobConfig{Colunas: mapeamentoPadrao}, &resumoProcessamento{})
+		close(tarefas)
+	}()
+	for range 10 {
+		<-tarefas
+	}
+	if lidos := entrada.lidos.Load(); lidos > 1<<20 {
+		t.Errorf("%d bytes lidos para enfileirar 10 CNPJs; a entrada deve ser lida aos poucos", lidos)
+	}
+	cancelar()
+	for range tarefas {
+	}
+	if entrada.linha == entrada.total {
+		t.Error("entrada lida até o fim depois do cancelamento")
+	}
+}
+
+func TestEntradaStreamingIgualReadAll(t *testing.T) {
+	usarAmbienteTeste(t, &provedorFalso{})
+	var entrada strings.Builder
+	for _, cnpj := range cnpjsTeste(300) {
+		entrada.WriteString(linhaReceita(cnpj, "", "", ""))
+	}
+
+	leitor := csv.NewReader(strings.NewReader(entrada.String()))
+	leitor.Comma = ';'
+	registros, err := leitor.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for _, r := range registros {
+		want = append(want, r[0]+r[1]+r[2])
+	}
+	reader := leitorEntradaTeste(strings.NewReader(entrada.String()))
+	tarefas := make(chan tarefa, len(want))
+	enfileirarTarefas(context.Background(), []*csv.Reader{reader}, tarefas, jobConfig{Colunas: mapeamentoPadrao}, &resumoProcessamento{})
+	close(tarefas)
+	var got []string
+	for tf := range tarefas {
+		got = append(got, tf.cnpj)
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("%d CNPJs em streaming, %d com ReadAll; quer os mesmos, na mesma ordem", len(got), len(want))
+	}
+}
+
+func TestNormalizarPorte(t *testing.T) {
+	casos := map[string]string{
+		"MICRO EMPRESA":            porteME,
+		"Microempresa":             porteME,
+		"ME":                       porteME,
+		"EMPRESA DE PEQUENO PORTE": porteEPP,
+		" epp ":                    porteEPP,
+		"DEMAIS":                   porteDemais,
+		"":                         "",
+		"NAO INFORMADO":            "",
+	}
+	for entrada, want := range casos {
+		if got := normalizarPorte(entrada); got != want {
+			t.Errorf("normalizarPorte(%q) = %q, quer %q", entrada, got, want)
+		}
+	}
+}
+
+func TestFiltroPorte(t *testing.T) {
+	micro, pequena, grande := "11222333000181", "19131243000197", "11444777000161"
+	transporte := &transporteFalso{respostas: map[string]respostaFalsa{}}
+	for cnpj, porte := range map[string]string{micro: "MICRO EMPRESA", pequena: "EMPRESA DE PEQUENO PORTE", grande: "DEMAIS"} {
+		transporte.respostas["/"+cnpj] = respostaFalsa{http.StatusOK,
+			`{"cnpj":"` + cnpj + `","razao_social":"EMPRESA","capital_social":100000,"porte":"` + porte + `"}`}
+	}
+	p := minhaReceita{baseURL: "http://minhareceita.teste", cliente: &http.Client{Transport: transporte}}
+	entrada := linhaReceita(micro, "", "", "") + linhaReceita(pequena, "", "", "") + linhaReceita(grande, "", "", "")
+
+	casos := []struct {
+		nome, porte  string
+		want, portes []string
+	}{
+		{"sem filtro", "", []string{micro, pequena, grande}, []string{porteME, porteEPP, porteDemais}},
+		{"códigos", "me, EPP", []string{micro, pequena}, []string{porteME, porteEPP}},
+		{"descrição da API", "Empresa de Pequeno Porte", []string{pequena}, []string{porteEPP}},
+	}
+	for _, c := range casos {
+		t.Run(c.nome, func(t *testing.T) {
+			usarAmbienteTeste(t, p)
+			rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"workers": "1", "porte": c.porte},
+				arquivoTeste{"entrada.csv", entrada})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("/upload: %s", mensagemErro(rec))
+			}
+			cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+			if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, c.want) {
+				t.Errorf("CNPJs = %v, quer %v", got, c.want)
+			}
+			if got := coluna(t, cabecalho, linhas, "Porte"); !slices.Equal(got, c.portes) {
+				t.Errorf("Porte = %v, quer %v", got, c.portes)
+			}
+		})
+	}
+
+	usarAmbienteTeste(t, p)
+	rec := enviarFormulario(t, uploadHandler, "/upload", map[string]string{"porte": "GRANDE"}, arquivoTeste{"entrada.csv", entrada})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("porte desconhecido: %s, quer 400", mensagemErro(rec))
+	}
+}
+
+func TestLimiteEDeslocamento(t *testing.T) {
+	cnpjs := cnpjsTeste(10)
+	empresas := map[string]Empresa{}
+	var entrada strings.Builder
+	for _, cnpj := range cnpjs {
+		empresas[cnpj] = empresaTeste("EMPRESA")
+		entrada.WriteString(linhaReceita(cnpj, "", "", ""))
+	}
+
+	casos := []struct {
+		limit, offset string
+		want          []string
+		atingido      bool
+	}{
+		{"0", "0", cnpjs, false},
+		{"3", "0", cnpjs[:3], true},
+		{"0", "4", cnpjs[4:], false},
+		{"3", "4", cnpjs[4:7], true},
+		{"5", "8", cnpjs[8:], false},
+		{"2", "20", nil, false},
+	}
+	for _, c := range casos {
+		t.Run("limit="+c.limit+",offset="+c.offset, func(t *testing.T) {
+			p := &provedorFalso{empresas: empresas}
+			usarAmbienteTeste(t, p)
+			rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", map[string]string{
+				"workers": "1", "limit": c.limit, "offset": c.offset,
+			}, arquivoTeste{"entrada.csv", entrada.String()})
+			if rec.Code != http.StatusOK {
+				t.Fatalf("/upload: %s", mensagemErro(rec))
+			}
+			cabecalho, linhas := lerSaidaCSV(t, lerArquivoSaida(t, "empresas_"))
+			if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, c.want) {
+				t.Errorf("CNPJs = %v, quer %v", got, c.want)
+			}
+			if atingido := strings.Contains(rec.Body.String(), "atingir o limite"); atingido != c.atingido {
+				t.Errorf("resumo informa limite atingido = %v, quer %v", atingido, c.atingido)
+			}
+			// Atingido o limite, os registros restantes não são consultados
+			if n := p.totalConsultas(); c.atingido && n == len(cnpjs) {
+				t.Errorf("%d consultas; o limite deve interromper as demais", n)
+			}
+		})
+	}
+}
+
+func TestEntradaMalformadaEncerraJob(t *testing.T) {
+	cnpjs := cnpjsTeste(2)
+	invalidas := func(n int) string {
+		return strings.Repeat("lixo;sem;cnpj\n", n)
+	}
+	casos := []struct {
+		nome, entrada, limite string
+		malformada            bool
+		lidos, consultas      int
+	}{
+		{"toda inválida", invalidas(50), "10", true, 11, 0},
+		// Cada registro válido zera a contagem
+		{"válidos intercalados", invalidas(8) + linhaReceita(cnpjs[0], "", "", "") + invalidas(8) +
+			linhaReceita(cnpjs[1], "", "", "") + invalidas(8), "10", false, 26, 2},
+		{"sem limite", invalidas(50), "0", false, 50, 0},
+	}
+	for _, c := range casos {
+		t.Run(c.nome, func(t *testing.T) {
+			p := &provedorFalso{empresas: map[string]Empresa{cnpjs[0]: empresaTeste("A"), cnpjs[1]: empresaTeste("B")}}
+			usarAmbienteTeste(t, p)
+
+			rec := enviarFormulario(t, uploadHandler, "/upload", map[string]string{"max_consecutive_errors": c.limite},
+				arquivoTeste{"entrada.csv", c.entrada})
+			if rec.Code != http.StatusAccepted {
+				t.Fatalf("/upload: %s, quer 202", mensagemErro(rec))
+			}
+			job := esperarJob(t, rec.Header().Get("X-Job-ID"))
+			if malformada := job.Status == statusMalformedInput; malformada != c.malformada {
+				t.Errorf("status = %q, erro %q", job.Status, job.Error)
+			}
+			if c.malformada && !strings.Contains(job.Error, "parece malformado") {
+				t.Errorf("erro do job = %q, quer a entrada malformada", job.Error)
+			}
+			if job.Processed != int64(c.lidos) {
+				t.Errorf("%d registros processados, quer %d", job.Processed, c.lidos)
+			}
+			if n := p.totalConsultas(); n != c.consultas {
+				t.Errorf("%d consultas, quer %d", n, c.consultas)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Limites superiores, em segundos, dos buckets de api_request_duration_seconds.
+var bucketsDuracao = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metricas reúne os contadores expostos em /metrics pelo cliente do
+// Prometheus. Os valores vivem apenas em memória e recomeçam a cada início.
+var metricas = novoRegistroMetricas()
+
+// registroMetricas guarda os contadores lidos também por /stats em atômicos,
+// expostos ao Prometheus por CounterFunc; as consultas aos provedores, que
+// só aparecem em /metrics, ficam nos coletores do cliente.
+type registroMetricas struct {
+	processados atomic.Int64
+	encontradas atomic.Int64
+	cacheHits   atomic.Int64
+	cacheMisses atomic.Int64 // CNPJs verificados no cache e não encontrados
+	jobs        atomic.Int64
+	consultas   atomic.Int64 // consultas concluídas, com ou sem erro
+
+	registro    *prometheus.Registry
+	requisicoes *prometheus.CounterVec // consultas por status (ok ou motivo do erro)
+	duracao     prometheus.Histogram
+	manipulador http.Handler
+}
+
+func novoRegistroMetricas() *registroMetricas {
+	m := &registroMetricas{
+		registro: prometheus.NewRegistry(),
+		requisicoes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "api_requests_total",
+			Help: "Consultas de CNPJ aos provedores, por status.",
+		}, []string{"status"}),
+		duracao: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "api_request_duration_seconds",
+			Help:    "Duração das consultas de CNPJ, incluindo novas tentativas.",
+			Buckets: bucketsDuracao,
+		}),
+	}
+	m.registro.MustRegister(
+		contador("cnpjs_processed_total", "Registros de entrada processados.", &m.processados),
+		contador("cnpjs_matched_total", "Empresas que atenderam aos filtros e foram gravadas.", &m.encontradas),
+		contador("cache_hits_total", "CNPJs não consultados por estarem no cache.", &m.cacheHits),
+		contador("jobs_started_total", "Jobs de processamento iniciados.", &m.jobs),
+		m.requisicoes,
+		m.duracao,
+	)
+	m.manipulador = promhttp.HandlerFor(m.registro, promhttp.HandlerOpts{})
+	return m
+}
+
+// contador expõe valor ao Prometheus como o contador nome.
+func contador(nome, ajuda string, valor *atomic.Int64) prometheus.CounterFunc {
+	return prometheus.NewCounterFunc(prometheus.CounterOpts{Name: nome, Help: ajuda}, func() float64 {
+		return float64(valor.Load())
+	})
+}
+
+// consulta contabiliza uma consulta de CNPJ concluída com o status dado.
+func (m *registroMetricas) consulta(status string, duracao time.Duration) {
+	m.consultas.Add(1)
+	m.requisicoes.WithLabelValues(status).Inc()
+	m.duracao.Observe(duracao.Seconds())
+}
+
+// metricsHandler expõe as métricas no formato de exposição do Prometheus.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	metricas.manipulador.ServeHTTP(w, r)
+}
+
+// respostaStats é o corpo JSON de /stats, um resumo de metricas desde o
+// início do servidor.
+type respostaStats struct {
+	CacheSize    int     `json:"cache_size"`
+	CacheHits    int64   `json:"cache_hits"`
+	CacheHitRate float64 `json:"cache_hit_rate"` // acertos sobre consultas ao cache, de 0 a 1
+	Jobs         int64   `json:"jobs"`
+	Processed    int64   `json:"processed"`
+	Matches      int64   `json:"matches"`
+	APICalls     int64   `json:"api_calls"`
+}
+
+// statsHandler responde com um resumo legível da atividade do servidor, sem
+// exigir a leitura do formato do Prometheus em /metrics.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	m := metricas
+	resposta := respostaStats{
+		CacheSize: processedCNPJs.Len(),
+		CacheHits: m.cacheHits.Load(),
+		Jobs:      m.jobs.Load(),
+		Processed: m.processados.Load(),
+		Matches:   m.encontradas.Load(),
+	}
+	if total := resposta.CacheHits + m.cacheMisses.Load(); total > 0 {
+		resposta.CacheHitRate = float64(resposta.CacheHits) / float64(total)
+	}
+	resposta.APICalls = m.consultas.Load()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resposta)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lerMetricas raspa /metrics e devolve o valor de cada série, indexado pelo
+// nome com os rótulos, como api_requests_total{status="ok"}.
+func lerMetricas(t *testing.T) map[string]float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/metrics: %s", mensagemErro(rec))
+	}
+	series := make(map[string]float64)
+	sc := bufio.NewScanner(rec.Body)
+	for sc.Scan() {
+		linha := sc.Text()
+		if linha == "" || strings.HasPrefix(linha, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(linha, ' ')
+		valor, err := strconv.ParseFloat(linha[i+1:], 64)
+		if err != nil {
+			t.Fatalf("linha inválida em /metrics: %q", linha)
+		}
+		series[linha[:i]] = valor
+	}
+	return series
+}
+
+func TestMetricsContaConsultasDoJob(t *testing.T) {
+	encontrada, ausente := cnpjTeste("112223330001"), cnpjTeste("191312430001")
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{encontrada: empresaTeste("EMPRESA TESTE LTDA")}})
+	antes := lerMetricas(t)
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{},
+		arquivoTeste{"entrada.csv", linhaReceita(encontrada, "11", "32345678", "") + linhaReceita(ausente, "11", "32345679", "")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	depois := lerMetricas(t)
+
+	for _, nome := range []string{
+		"cnpjs_processed_total", "cnpjs_matched_total", "cache_hits_total",
+		`api_requests_total{status="ok"}`, `api_requests_total{status="not-found"}`,
+		`api_request_duration_seconds_bucket{le="+Inf"}`, "api_request_duration_seconds_count",
+	} {
+		if _, ok := depois[nome]; !ok {
+			t.Errorf("/metrics sem %s", nome)
+		}
+	}
+	incrementos := map[string]float64{
+		"cnpjs_processed_total":                  2,
+		"cnpjs_matched_total":                    1,
+		`api_requests_total{status="ok"}`:        1,
+		`api_requests_total{status="not-found"}`: 1,
+		"api_request_duration_seconds_count":     2,
+	}
+	for nome, want := range incrementos {
+		if got := depois[nome] - antes[nome]; got != want {
+			t.Errorf("%s aumentou %v, quer %v", nome, got, want)
+		}
+	}
+}
+
+// lerStats decodifica a resposta de /stats.
+func lerStats(t *testing.T) respostaStats {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	statsHandler(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var s respostaStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &s); rec.Code != http.StatusOK || err != nil {
+		t.Fatalf("/stats: %s, %v", mensagemErro(rec), err)
+	}
+	return s
+}
+
+func TestStatsRefleteJob(t *testing.T) {
+	encontrada, ausente, emCache := cnpjTeste("112223330001"), cnpjTeste("191312430001"), cnpjTeste("114447770001")
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{encontrada: empresaTeste("A")}})
+	processedCNPJs.Set(emCache, time.Now())
+	antes := lerStats(t)
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", nil, arquivoTeste{"entrada.csv",
+		linhaReceita(encontrada, "", "", "") + linhaReceita(ausente, "", "", "") + linhaReceita(emCache, "", "", "")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	depois := lerStats(t)
+
+	// O CNPJ não encontrado não entra no cache
+	got := respostaStats{
+		CacheSize: depois.CacheSize,
+		CacheHits: depois.CacheHits - antes.CacheHits,
+		Jobs:      depois.Jobs - antes.Jobs,
+		Processed: depois.Processed - antes.Processed,
+		Matches:   depois.Matches - antes.Matches,
+		APICalls:  depois.APICalls - antes.APICalls,
+	}
+	want := respostaStats{CacheSize: 2, CacheHits: 1, Jobs: 1, Processed: 3, Matches: 1, APICalls: 2}
+	if got != want {
+		t.Errorf("variação em /stats = %+v, quer %+v", got, want)
+	}
+	if depois.CacheHitRate <= 0 || depois.CacheHitRate > 1 {
+		t.Errorf("cache_hit_rate = %v, quer entre 0 e 1 depois de um acerto", depois.CacheHitRate)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// modeloNomeSaidaPadrao produz nomes como
+// empresas_capital_maior_50000_20240101_120000_3f9a1c2e4b5d6a7f.csv, com as
+// UFs e os CNAEs quando o job os filtra. O ID do job distingue dois jobs com
+// os mesmos filtros iniciados no mesmo segundo.
+const modeloNomeSaidaPadrao = "empresas_capital_{capital}_{uf}_{cnae}_{date}_{job}{ext}"
+
+var (
+	// modeloNomeSaida monta o nome dos arquivos de saída; pode ser ajustado
+	// pela variável de ambiente OUTPUT_NAME_TEMPLATE
+	modeloNomeSaida = modeloNomeSaidaPadrao
+
+	// prefixoNomeSaida é o texto fixo do início de modeloNomeSaida, exigido
+	// de todo arquivo de saída servido por /download
+	prefixoNomeSaida = "empresas_capital_"
+)
+
+// marcadoresNomeSaida são os campos aceitos em OUTPUT_NAME_TEMPLATE.
+var marcadoresNomeSaida = map[string]bool{
+	"date":        true, // início do job, como 20240101_120000
+	"capital":     true, // filtro de capital: maior_50000, maior_0_ate_100000, zero ou todos
+	"capital_min": true,
+	"capital_max": true, // vazio sem limite superior
+	"uf":          true, // UFs filtradas separadas por hífen, como RJ-SP
+	"cnae":        true,
+	"job":         true, // ID do job; vazio na linha de comando
+	"ext":         true, // extensão do formato de saída, como .csv
+}
+
+var marcadorNome = regexp.MustCompile(`\{[^{}]*\}`)
+
+// configurarModeloNome valida e adota o modelo de OUTPUT_NAME_TEMPLATE;
+// vazio mantém modeloNomeSaidaPadrao. O modelo precisa começar com um texto
+// fixo, que restringe os arquivos servidos por /download, e ter {job} ou
+// {date}, para que jobs diferentes não disputem o mesmo arquivo; {ext}, se
+// usado, precisa ficar no fim: a extensão é sempre a do formato de saída.
+func configurarModeloNome(modelo string) error {
+	modelo = strings.TrimSpace(modelo)
+	if modelo == "" {
+		return nil
+	}
+	for _, m := range marcadorNome.FindAllString(modelo, -1) {
+		if !marcadoresNomeSaida[strings.Trim(m, "{}")] {
+			return fmt.Errorf("OUTPUT_NAME_TEMPLATE: marcador desconhecido %s", m)
+		}
+	}
+	semExtensao := strings.TrimSuffix(modelo, "{ext}")
+	if strings.Contains(semExtensao, "{ext}") {
+		return fmt.Errorf("OUTPUT_NAME_TEMPLATE: {ext} só pode aparecer no fim do modelo")
+	}
+	if !strings.Contains(modelo, "{job}") && !strings.Contains(modelo, "{date}") {
+		return fmt.Errorf("OUTPUT_NAME_TEMPLATE precisa de {job} ou {date} para distinguir os jobs")
+	}
+	fixo, _, _ := strings.Cut(modelo, "{")
+	prefixo := sanitizarNomeArquivo(fixo)
+	if prefixo == "" {
+		return fmt.Errorf("OUTPUT_NAME_TEMPLATE precisa começar com um texto fixo, como empresas_")
+	}
+	modeloNomeSaida, prefixoNomeSaida = modelo, prefixo
+	return nil
+}
+
+// camposNomeSaida são os valores disponíveis para os marcadores do modelo.
+type camposNomeSaida struct {
+	Inicio        time.Time
+	CapitalModo   string
+	CapitalMinimo float64
+	CapitalMaximo float64
+	UFs           map[string]struct{}
+	CNAEs         map[string]struct{}
+	JobID         string
+}
+
+// nomeBaseSaida expande modeloNomeSaida com os campos do job, sem a
+// extensão, que é acrescentada conforme o formato. Cada valor e o nome
+// final passam por sanitizarNomeArquivo.
+func nomeBaseSaida(c camposNomeSaida) string {
+	valores := map[string]string{
+		"date":        c.Inicio.Format("20060102_150405"),
+		"capital":     nomeFiltroCapital(c.CapitalModo, c.CapitalMinimo, c.CapitalMaximo),
+		"capital_min": strconv.FormatFloat(c.CapitalMinimo, 'f', -1, 64),
+		"uf":          strings.Join(slices.Sorted(maps.Keys(c.UFs)), "-"),
+		"cnae":        strings.Join(slices.Sorted(maps.Keys(c.CNAEs)), "-"),
+		"job":         c.JobID,
+	}
+	if c.CapitalMaximo > 0 {
+		valores["capital_max"] = strconv.FormatFloat(c.CapitalMaximo, 'f', -1, 64)
+	}
+	nome := marcadorNome.ReplaceAllStringFunc(strings.TrimSuffix(modeloNomeSaida, "{ext}"), func(m string) string {
+		return sanitizarNomeArquivo(valores[strings.Trim(m, "{}")])
+	})
+	return sanitizarNomeArquivo(nome)
+}
+
+var (
+	caracteresProibidosNome  = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+	separadoresRepetidosNome = regexp.MustCompile(`_{2,}`)
+	pontosRepetidosNome      = regexp.MustCompile(`\.{2,}`)
+)
+
+// sanitizarNomeArquivo troca por _ os caracteres fora de letras ASCII,
+// dígitos, ponto, hífen e sublinhado, junta os _ e os pontos repetidos,
+// como os deixados por marcadores vazios, e apara os separadores das pontas.
+func sanitizarNomeArquivo(nome string) string {
+	nome = caracteresProibidosNome.ReplaceAllString(nome, "_")
+	nome = separadoresRepetidosNome.ReplaceAllString(nome, "_")
+	nome = pontosRepetidosNome.ReplaceAllString(nome, ".")
+	return strings.Trim(nome, "._-")
+}
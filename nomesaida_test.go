@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// usarModeloNome adota modelo durante o teste, restaurando o padrão ao fim.
+func usarModeloNome(t *testing.T, modelo string) {
+	t.Helper()
+	modeloAnterior, prefixoAnterior := modeloNomeSaida, prefixoNomeSaida
+	t.Cleanup(func() { modeloNomeSaida, prefixoNomeSaida = modeloAnterior, prefixoAnterior })
+	if err := configurarModeloNome(modelo); err != nil {
+		t.Fatalf("configurarModeloNome(%q): %v", modelo, err)
+	}
+}
+
+func TestNomeBaseSaida(t *testing.T) {
+	inicio := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	casos := []struct {
+		nome   string
+		modelo string
+		campos camposNomeSaida
+		want   string
+	}{
+		{
+			nome:   "padrão sem filtros de UF e CNAE",
+			campos: camposNomeSaida{Inicio: inicio, CapitalMinimo: 50000, JobID: "abc123"},
+			want:   "empresas_capital_maior_50000_20240102_150405_abc123",
+		},
+		{
+			nome: "padrão com faixa, UFs e CNAEs",
+			campos: camposNomeSaida{Inicio: inicio, CapitalMinimo: 0, CapitalMaximo: 100000, JobID: "j1",
+				UFs: map[string]struct{}{"SP": {}, "RJ": {}}, CNAEs: map[string]struct{}{"6201501": {}}},
+			want: "empresas_capital_maior_0_ate_100000_RJ-SP_6201501_20240102_150405_j1",
+		},
+		{
+			nome:   "modo igual a zero",
+			campos: camposNomeSaida{Inicio: inicio, CapitalModo: capitalModoIgualZero, JobID: "j1"},
+			want:   "empresas_capital_zero_20240102_150405_j1",
+		},
+		{
+			nome:   "modelo próprio com {ext}",
+			modelo: "relatorio_{capital_min}_{capital_max}_{date}{ext}",
+			campos: camposNomeSaida{Inicio: inicio, CapitalMinimo: 1500.5, CapitalMaximo: 9000},
+			want:   "relatorio_1500.5_9000_20240102_150405",
+		},
+		{
+			nome:   "marcadores vazios não deixam separadores repetidos",
+			modelo: "rel_{uf}_{cnae}_{job}",
+			campos: camposNomeSaida{Inicio: inicio},
+			want:   "rel",
+		},
+		{
+			nome:   "valores com caracteres de caminho",
+			modelo: "rel_{job}_{date}",
+			campos: camposNomeSaida{Inicio: inicio, JobID: "../../etc/passwd"},
+			want:   "rel_etc_passwd_20240102_150405",
+		},
+		{
+			nome:   "texto fixo com espaços e acentos",
+			modelo: "relatório mensal {date}",
+			campos: camposNomeSaida{Inicio: inicio},
+			want:   "relat_rio_mensal_20240102_150405",
+		},
+	}
+	for _, c := range casos {
+		t.Run(c.nome, func(t *testing.T) {
+			if c.modelo != "" {
+				usarModeloNome(t, c.modelo)
+			}
+			if got := nomeBaseSaida(c.campos); got != c.want {
+				t.Errorf("nomeBaseSaida = %q, quer %q", got, c.want)
+			}
+		})
+	}
+}
+
+func TestSanitizarNomeArquivo(t *testing.T) {
+	casos := map[string]string{
+		"empresas_SP":      "empresas_SP",
+		"a/b\\c":           "a_b_c",
+		"..":               "",
+		"a..b":             "a.b",
+		"__a__b__":         "a_b",
+		"São Paulo":        "S_o_Paulo",
+		"x\x00y":           "x_y",
+		"-lider.-":         "lider",
+		"maior_0_ate_1e+6": "maior_0_ate_1e_6",
+	}
+	for entrada, want := range casos {
+		if got := sanitizarNomeArquivo(entrada); got != want {
+			t.Errorf("sanitizarNomeArquivo(%q) = %q, quer %q", entrada, got, want)
+		}
+	}
+}
+
+func TestConfigurarModeloNomeInvalido(t *testing.T) {
+	usarModeloNome(t, "")
+	for _, modelo := range []string{
+		"{date}_empresas",         // sem texto fixo no início
+		"empresas_{foo}_{date}",   // marcador desconhecido
+		"empresas_{ext}_{date}",   // {ext} fora do fim
+		"empresas_{capital}{ext}", // sem {job} nem {date}
+	} {
+		if err := configurarModeloNome(modelo); err == nil {
+			t.Errorf("configurarModeloNome(%q) aceitou o modelo", modelo)
+		}
+	}
+	if modeloNomeSaida != modeloNomeSaidaPadrao {
+		t.Errorf("modelo inválido substituiu o padrão: %q", modeloNomeSaida)
+	}
+}
+
+func TestPrefixoModeloNomeRestringeDownload(t *testing.T) {
+	usarModeloNome(t, "relatorio_{date}{ext}")
+	if !nomeSaidaValido("relatorio_20240102_150405.csv") {
+		t.Error("saída do modelo configurado recusada")
+	}
+	if nomeSaidaValido("empresas_capital_maior_50000_20240102_150405.csv") {
+		t.Error("nome fora do prefixo do modelo aceito")
+	}
+}
+
+func TestCriarArquivoSaidaNaoSobrescreve(t *testing.T) {
+	caminho := filepath.Join(t.TempDir(), "empresas_capital_maior_50000.csv")
+	f, err := criarArquivoSaida(caminho)
+	if err != nil {
+		t.Fatalf("primeira criação: %v", err)
+	}
+	f.Close()
+	if _, err := criarArquivoSaida(caminho); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("segunda criação: erro = %v, quer fs.ErrExist", err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOrcamentoDeRequisicoes(t *testing.T) {
+	cnpjs := cnpjsTeste(10)
+	p := &provedorFalso{empresas: map[string]Empresa{}}
+	var entrada strings.Builder
+	for _, cnpj := range cnpjs {
+		p.empresas[cnpj] = empresaTeste("EMPRESA")
+		entrada.WriteString(linhaReceita(cnpj, "", "", ""))
+	}
+	// Repetidos e CNPJs em cache não gastam o orçamento
+	entrada.WriteString(linhaReceita(cnpjs[9], "", "", ""))
+	usarAmbienteTeste(t, p)
+	processedCNPJs.Set(cnpjs[0], time.Now())
+	processedCNPJs.Set(cnpjs[1], time.Now())
+
+	rec := enviarFormulario(t, uploadHandler, "/upload", map[string]string{"max_requests": "3", "workers": "4"},
+		arquivoTeste{"entrada.csv", entrada.String()})
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("/upload: %s, quer 202", mensagemErro(rec))
+	}
+	job := esperarJob(t, rec.Header().Get("X-Job-ID"))
+	if job.Status != statusBudgetExhausted || job.Matched != 3 {
+		t.Errorf("job = %+v, quer budget_exhausted com 3 empresas", job)
+	}
+	if n := p.totalConsultas(); n != 3 {
+		t.Errorf("%d consultas à API, quer 3", n)
+	}
+
+	// O restante não consultado fica no CSV de erros
+	caminhos, _ := filepath.Glob(filepath.Join(diretorioSaida, "*_erros.csv"))
+	if len(caminhos) != 1 {
+		t.Fatalf("arquivos de erros = %v, quer 1", caminhos)
+	}
+	dados, err := os.ReadFile(caminhos[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, erros := lerSaidaCSV(t, string(dados))
+	consultados := make(map[string]bool)
+	for _, cnpj := range cnpjs[2:] {
+		consultados[cnpj] = p.consultas[cnpj] > 0
+	}
+	var restantes []string
+	for _, e := range erros {
+		if e[1] != motivoOrcamento || consultados[e[0]] {
+			t.Errorf("linha de erro %q, quer só CNPJs não consultados com %s", e, motivoOrcamento)
+		}
+		restantes = append(restantes, e[0])
+	}
+	slices.Sort(restantes)
+	if len(slices.Compact(slices.Clone(restantes))) != 5 || len(restantes) != 5 {
+		t.Errorf("CNPJs fora do orçamento = %v, quer os 5 não consultados", restantes)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// provedorAtrasado responde cada CNPJ depois do seu atraso, para que as
+// consultas terminem fora da ordem da entrada.
+type provedorAtrasado struct {
+	provedorFalso
+	atrasos map[string]time.Duration
+}
+
+func (p *provedorAtrasado) Consultar(ctx context.Context, cnpj string) (*Empresa, error) {
+	time.Sleep(p.atrasos[cnpj])
+	return p.provedorFalso.Consultar(ctx, cnpj)
+}
+
+func TestSaidaOrdenadaComVariosWorkers(t *testing.T) {
+	cnpjs := cnpjsTeste(8)
+	p := &provedorAtrasado{provedorFalso: provedorFalso{empresas: map[string]Empresa{}}, atrasos: map[string]time.Duration{}}
+	var entrada strings.Builder
+	var encontrados []string
+	for i, cnpj := range cnpjs {
+		entrada.WriteString(linhaReceita(cnpj, "", "", ""))
+		// Os primeiros registros demoram mais que o intervalo do limitador
+		// entre duas consultas; um em cada três não existe
+		p.atrasos[cnpj] = time.Duration(len(cnpjs)-i) * 60 * time.Millisecond
+		if i%3 != 0 {
+			p.empresas[cnpj] = empresaTeste("EMPRESA " + cnpj)
+			encontrados = append(encontrados, cnpj)
+		}
+	}
+	usarAmbienteTeste(t, p)
+
+	for execucao := range 3 {
+		processedCNPJs = novoCacheLRU[time.Time](maxEntradasCachePadrao)
+		rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"ordered": "1", "workers": "4"},
+			arquivoTeste{"entrada.csv", entrada.String()})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("execução %d: %s", execucao, mensagemErro(rec))
+		}
+		cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+		if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, encontrados) {
+			t.Errorf("execução %d: CNPJs = %v, quer a ordem da entrada %v", execucao, got, encontrados)
+		}
+	}
+}
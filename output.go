@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// Formatos aceitos no campo output_format do formulário.
+const (
+	formatoCSV   = "csv"
+	formatoJSONL = "jsonl"
+	formatoXLSX  = "xlsx"
+)
+
+// escritorSaida grava as empresas qualificadas de um job em um formato de
+// saída. As chamadas são serializadas por escreverResultado. Fechar conclui
+// a saída ao fim do job (formatos como XLSX só ficam válidos depois dele).
+type escritorSaida interface {
+	Cabecalho() error
+	Escrever(res resultado) error
+	Flush() error
+	Fechar() error
+}
+
+// opcoesSaida ajusta o conteúdo gravado além das colunas padrão.
+type opcoesSaida struct {
+	// Socios acrescenta a coluna Socios ao CSV e ao XLSX, com os sócios em JSON
+	Socios bool
+
+	// Coordenadas acrescenta as colunas Latitude e Longitude, obtidas pelo
+	// CEP com geocode
+	Coordenadas bool
+
+	// Simples acrescenta as colunas OpcaoSimples e OpcaoMEI (true/false, ou
+	// vazias quando a API não informa)
+	Simples bool
+
+	// Matched acrescenta a coluna Matched (true/false), usada com include_all
+	// para separar as empresas que passaram pelos filtros
+	Matched bool
+
+	// Repassadas são os nomes das colunas de passthrough_cols, gravadas no
+	// fim com os valores copiados da entrada
+	Repassadas []string
+
+	// Colunas seleciona e ordena as colunas do CSV e do XLSX; vazio grava todas.
+	// Os nomes já devem ter passado por parseColunasSaida
+	Colunas []string
+
+	// BOM grava o BOM UTF-8 antes do cabeçalho do CSV, para que o Excel
+	// reconheça a codificação e exiba os acentos corretamente
+	BOM bool
+
+	// Continuacao omite o BOM e o cabeçalho, ao acrescentar linhas a um CSV
+	// de saída que já os tem
+	Continuacao bool
+
+	// VirgulaDecimal grava o CapitalSocial do CSV com vírgula decimal, como
+	// o Excel em português espera. Como a vírgula também é o delimitador, o
+	// csv.Writer põe o valor entre aspas. O XLSX e o JSON Lines gravam o
+	// capital como número e não mudam
+	VirgulaDecimal bool
+}
+
+// cabecalhoCompleto devolve todas as colunas disponíveis no CSV, antes da
+// seleção de Colunas.
+func (o opcoesSaida) cabecalhoCompleto() []string {
+	cabecalho := cabecalhoSaida[:len(cabecalhoSaida):len(cabecalhoSaida)]
+	if o.Socios {
+		cabecalho = append(cabecalho, "Socios")
+	}
+	if o.Coordenadas {
+		cabecalho = append(cabecalho, "Latitude", "Longitude")
+	}
+	if o.Simples {
+		cabecalho = append(cabecalho, "OpcaoSimples", "OpcaoMEI")
+	}
+	if o.Matched {
+		cabecalho = append(cabecalho, "Matched")
+	}
+	return append(cabecalho, o.Repassadas...)
+}
+
+// novoEscritorSaida cria o escritor do formato pedido sobre w.
+func novoEscritorSaida(w io.Writer, formato string, opcoes opcoesSaida) escritorSaida {
+	if formato == formatoJSONL {
+		buf := bufio.NewWriter(w)
+		return &jsonlSaida{buf: buf, enc: json.NewEncoder(buf), coordenadas: opcoes.Coordenadas, matched: opcoes.Matched,
+			repassadas: opcoes.Repassadas}
+	}
+
+	tabela := novoLayoutTabela(opcoes)
+	if formato == formatoXLSX {
+		return &xlsxSaida{layoutTabela: tabela, destino: w}
+	}
+	return &csvSaida{layoutTabela: tabela, destino: w, w: csv.NewWriter(w), capital: tabela.coluna("CapitalSocial")}
+}
+
+// layoutTabela monta as linhas dos formatos tabulares (CSV e XLSX) segundo
+// as opções de saída.
+type layoutTabela struct {
+	opcoes  opcoesSaida
+	indices []int // posições das colunas selecionadas; nil para todas
+}
+
+func novoLayoutTabela(opcoes opcoesSaida) layoutTabela {
+	t := layoutTabela{opcoes: opcoes}
+	if len(opcoes.Colunas) > 0 {
+		posicao := make(map[string]int)
+		for i, nome := range opcoes.cabecalhoCompleto() {
+			posicao[nome] = i
+		}
+		for _, nome := range opcoes.Colunas {
+			t.indices = append(t.indices, posicao[nome])
+		}
+	}
+	return t
+}
+
+func (t layoutTabela) cabecalho() []string {
+	return t.selecionar(t.opcoes.cabecalhoCompleto())
+}
+
+// coluna devolve a posição da coluna nome nas linhas, ou -1 se ela não foi
+// selecionada.
+func (t layoutTabela) coluna(nome string) int {
+	for i, n := range t.cabecalho() {
+		if n == nome {
+			return i
+		}
+	}
+	return -1
+}
+
+func (t layoutTabela) linha(res resultado) ([]string, error) {
+	linha := linhaSaida(res)
+	if t.opcoes.Socios {
+		socios, err := sociosJSON(res.empresa.Socios)
+		if err != nil {
+			return nil, err
+		}
+		linha = append(linha, socios)
+	}
+	if t.opcoes.Coordenadas {
+		linha = append(linha, res.coordenadas.Latitude, res.coordenadas.Longitude)
+	}
+	if t.opcoes.Simples {
+		linha = append(linha, formatarOpcao(res.empresa.OpcaoSimples), formatarOpcao(res.empresa.OpcaoMEI))
+	}
+	if t.opcoes.Matched {
+		linha = append(linha, strconv.FormatBool(res.atende))
+	}
+	linha = append(linha, res.repassados...)
+	return t.selecionar(linha), nil
+}
+
+// formatarOpcao grava uma opção da empresa como true ou false, ou vazia
+// quando desconhecida.
+func formatarOpcao(opcao *bool) string {
+	if opcao == nil {
+		return ""
+	}
+	return strconv.FormatBool(*opcao)
+}
+
+// selecionar reduz uma linha completa às colunas escolhidas em columns.
+func (t layoutTabela) selecionar(linha []string) []string {
+	if t.indices == nil {
+		return linha
+	}
+	selecionada := make([]string, len(t.indices))
+	for i, j := range t.indices {
+		selecionada[i] = linha[j]
+	}
+	return selecionada
+}
+
+// parseColunasSaida interpreta o campo columns do formulário: nomes de
+// colunas do CSV separados por vírgula, na ordem desejada, sem diferenciar
+// maiúsculas. Vazio mantém todas as colunas. As colunas Socios, Latitude e
+// Longitude, OpcaoSimples e OpcaoMEI e Matched só existem com
+// include_socios, geocode, include_simples e include_all, indicados em
+// opcoes.
+func parseColunasSaida(valor string, opcoes opcoesSaida) ([]string, error) {
+	if strings.TrimSpace(valor) == "" {
+		return nil, nil
+	}
+
+	conhecidas := make(map[string]string)
+	todas := opcoesSaida{Socios: true, Coordenadas: true, Simples: true, Matched: true, Repassadas: opcoes.Repassadas}
+	for _, nome := range todas.cabecalhoCompleto() {
+		conhecidas[strings.ToLower(nome)] = nome
+	}
+
+	var colunas []string
+	escolhidas := make(map[string]struct{})
+	for _, item := range strings.Split(valor, ",") {
+		nome, ok := conhecidas[strings.ToLower(strings.TrimSpace(item))]
+		if !ok {
+			return nil, fmt.Errorf("coluna desconhecida em columns: %q", strings.TrimSpace(item))
+		}
+		if nome == "Socios" && !opcoes.Socios {
+			return nil, fmt.Errorf("a coluna Socios exige include_socios")
+		}
+		if (nome == "Latitude" || nome == "Longitude") && !opcoes.Coordenadas {
+			return nil, fmt.Errorf("a coluna %s exige geocode", nome)
+		}
+		if (nome == "OpcaoSimples" || nome == "OpcaoMEI") && !opcoes.Simples {
+			return nil, fmt.Errorf("a coluna %s exige include_simples", nome)
+		}
+		if nome == "Matched" && !opcoes.Matched {
+			return nil, fmt.Errorf("a coluna Matched exige include_all")
+		}
+		if _, repetida := escolhidas[nome]; repetida {
+			return nil, fmt.Errorf("coluna repetida em columns: %q", nome)
+		}
+		escolhidas[nome] = struct{}{}
+		colunas = append(colunas, nome)
+	}
+	return colunas, nil
+}
+
+// parseFormatoSaida normaliza o campo output_format, com CSV como padrão.
+func parseFormatoSaida(valor string) (string, error) {
+	switch strings.ToLower(strings.TrimSpace(valor)) {
+	case "", formatoCSV:
+		return formatoCSV, nil
+	case formatoJSONL, "ndjson":
+		return formatoJSONL, nil
+	case formatoXLSX:
+		return formatoXLSX, nil
+	}
+	return "", fmt.Errorf("output_format inválido: %q (use csv, jsonl ou xlsx)", valor)
+}
+
+// parseSeparadorDecimal interpreta o campo decimal_separator: "." (padrão)
+// ou ",", e informa se o capital social vai com vírgula decimal.
+func parseSeparadorDecimal(valor string) (bool, error) {
+	switch strings.TrimSpace(valor) {
+	case "", ".":
+		return false, nil
+	case ",":
+		return true, nil
+	}
+	return false, fmt.Errorf("decimal_separator inválido: %q (use . ou ,)", valor)
+}
+
+// extensaoSaida e tipoConteudoSaida descrevem o arquivo de cada formato.
+func extensaoSaida(formato string) string {
+	switch formato {
+	case formatoJSONL:
+		return ".jsonl"
+	case formatoXLSX:
+		return ".xlsx"
+	}
+	return ".csv"
+}
+
+func tipoConteudoSaida(formato string) string {
+	switch formato {
+	case formatoJSONL:
+		return "application/x-ndjson; charset=utf-8"
+	case formatoXLSX:
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// cabecalhoSaida são as colunas do CSV de saída, na ordem de linhaSaida.
+var cabecalhoSaida = []string{
+	"CNPJ",
+	"RazaoSocial",
+	"NomeFantasia",
+	"CapitalSocial",
+	"Logradouro",
+	"Numero",
+	"Complemento",
+	"Bairro",
+	"Municipio",
+	"CodigoMunicipioIBGE",
+	"UF",
+	"CEP",
+	"DDD",
+	"Telefone",
+	"Email",
+	"CnaePrincipalCodigo",
+	"CnaePrincipalDescricao",
+	"DataInicioAtividade",
+	"Porte",
+	"NaturezaJuridicaCodigo",
+	"NaturezaJuridicaDescricao",
+}
+
+// linhaSaida monta a linha do CSV de saída de uma empresa qualificada.
+func linhaSaida(res resultado) []string {
+	empresa := res.empresa
+	return []string{
+		res.cnpj,
+		empresa.RazaoSocial,
+		empresa.NomeFantasia,
+		strconv.FormatFloat(empresa.CapitalSocial, 'f', 2, 64),
+		empresa.Logradouro,
+		empresa.Numero,
+		empresa.Complemento,
+		empresa.Bairro,
+		empresa.Municipio,
+		string(empresa.CodigoMunicipio),
+		empresa.UF,
+		empresa.Cep,
+		res.ddd,
+		res.telefone,
+		res.email,
+		formatarCNAE(empresa.CnaePrincipalCodigo),
+		empresa.CnaePrincipalDescricao,
+		empresa.DataInicioAtividade.String(),
+		empresa.Porte,
+		string(empresa.NaturezaJuridicaCodigo),
+		empresa.NaturezaJuridicaDescricao,
+	}
+}
+
+// csvSaida grava uma linha por empresa, com o cabeçalho cabecalhoSaida.
+type csvSaida struct {
+	layoutTabela
+	destino io.Writer
+	w       *csv.Writer
+	capital int // posição da coluna CapitalSocial; -1 se não selecionada
+}
+
+func (s *csvSaida) Cabecalho() error {
+	if s.opcoes.Continuacao {
+		return nil
+	}
+	// O csv.Writer ainda não gravou nada, então o BOM vai direto ao destino
+	if s.opcoes.BOM {
+		if _, err := s.destino.Write(bomUTF8); err != nil {
+			return err
+		}
+	}
+	return s.w.Write(s.cabecalho())
+}
+
+func (s *csvSaida) Escrever(res resultado) error {
+	linha, err := s.linha(res)
+	if err != nil {
+		return err
+	}
+	if s.opcoes.VirgulaDecimal && s.capital >= 0 {
+		linha[s.capital] = strings.Replace(linha[s.capital], ".", ",", 1)
+	}
+	return s.w.Write(linha)
+}
+
+// sociosJSON serializa os sócios para a coluna Socios do CSV, que é plano;
+// empresas sem sócios informados ficam com a coluna vazia.
+func sociosJSON(socios []Socio) (string, error) {
+	if len(socios) == 0 {
+		return "", nil
+	}
+	b, err := json.Marshal(socios)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (s *csvSaida) Flush() error {
+	s.w.Flush()
+	return s.w.Error()
+}
+
+func (s *csvSaida) Fechar() error {
+	return s.Flush()
+}
+
+// empresaJSONL é o objeto gravado em cada linha da saída JSON Lines: os
+// dados da API acrescidos dos contatos lidos do arquivo de entrada.
+type empresaJSONL struct {
+	*Empresa
+	DDD      string `json:"ddd"`
+	Telefone string `json:"telefone"`
+	Email    string `json:"email"`
+
+	// Latitude e Longitude só são gravadas com geocode, quando conhecidas
+	Latitude  string `json:"latitude,omitempty"`
+	Longitude string `json:"longitude,omitempty"`
+
+	// Matched só é gravado com include_all
+	Matched *bool `json:"matched,omitempty"`
+
+	// Passthrough traz as colunas de passthrough_cols pelo nome escolhido
+	Passthrough map[string]string `json:"passthrough,omitempty"`
+}
+
+// jsonlSaida grava um objeto JSON por linha (JSON Lines), sem cabeçalho.
+type jsonlSaida struct {
+	buf         *bufio.Writer
+	enc         *json.Encoder
+	coordenadas bool
+	matched     bool
+	repassadas  []string
+}
+
+func (s *jsonlSaida) Cabecalho() error {
+	return nil
+}
+
+func (s *jsonlSaida) Escrever(res resultado) error {
+	linha := empresaJSONL{
+		Empresa:  res.empresa,
+		DDD:      res.ddd,
+		Telefone: res.telefone,
+		Email:    res.email,
+	}
+	if s.coordenadas {
+		linha.Latitude, linha.Longitude = res.coordenadas.Latitude, res.coordenadas.Longitude
+	}
+	if s.matched {
+		linha.Matched = &res.atende
+	}
+	if len(s.repassadas) > 0 {
+		linha.Passthrough = make(map[string]string, len(s.repassadas))
+		for i, nome := range s.repassadas {
+			linha.Passthrough[nome] = res.repassados[i]
+		}
+	}
+	return s.enc.Encode(linha)
+}
+
+func (s *jsonlSaida) Flush() error {
+	return s.buf.Flush()
+}
+
+func (s *jsonlSaida) Fechar() error {
+	return s.Flush()
+}
+
+// multiplaSaida repassa cada empresa a várias saídas, como o arquivo do job
+// e o banco SQLite.
+type multiplaSaida []escritorSaida
+
+func (m multiplaSaida) Cabecalho() error {
+	for _, s := range m {
+		if err := s.Cabecalho(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiplaSaida) Escrever(res resultado) error {
+	for _, s := range m {
+		if err := s.Escrever(res); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m multiplaSaida) Flush() error {
+	for _, s := range m {
+		if err := s.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fechar conclui todas as saídas, mesmo quando uma delas falha.
+func (m multiplaSaida) Fechar() error {
+	var erros []error
+	for _, s := range m {
+		erros = append(erros, s.Fechar())
+	}
+	return errors.Join(erros...)
+}
+
+// escreverResultado grava uma empresa qualificada na saída do job.
+func escreverResultado(saida escritorSaida, res resultado) {
+	// Escrever no arquivo com mutex
+	fileMutex.Lock()
+	defer fileMutex.Unlock()
+
+	if err := saida.Escrever(res); err != nil {
+		slog.Error("Erro ao escrever no arquivo de saída", "event", "output_write_failed", "cnpj", res.cnpj, "error", err)
+	}
+	if err := saida.Flush(); err != nil {
+		slog.Error("Erro ao escrever no arquivo de saída", "event", "output_write_failed", "cnpj", res.cnpj, "error", err)
+	}
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaidaJSONLMesmasEmpresasDoCSV(t *testing.T) {
+	cnpjs := cnpjsTeste(6)
+	empresas := map[string]Empresa{}
+	var entrada strings.Builder
+	for i, cnpj := range cnpjs {
+		e := empresaTeste("EMPRESA")
+		if i%2 == 1 {
+			e.CapitalSocial = 1000 // fora do filtro padrão
+		}
+		empresas[cnpj] = e
+		entrada.WriteString(linhaReceita(cnpj, "11", "32345678", "contato@empresa.com.br"))
+	}
+
+	enviar := func(formato string) string {
+		t.Helper()
+		usarAmbienteTeste(t, &provedorFalso{empresas: empresas})
+		rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"workers": "1", "output_format": formato},
+			arquivoTeste{"entrada.csv", entrada.String()})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("/upload em %s: %s", formato, mensagemErro(rec))
+		}
+		return rec.Body.String()
+	}
+
+	cabecalho, linhas := lerSaidaCSV(t, enviar(formatoCSV))
+	doCSV := coluna(t, cabecalho, linhas, "CNPJ")
+
+	var doJSONL []string
+	leitor := bufio.NewScanner(strings.NewReader(enviar(formatoJSONL)))
+	for leitor.Scan() {
+		// Empresa tem UnmarshalJSON próprio, então os contatos são lidos à parte
+		var empresa Empresa
+		var contato struct {
+			DDD      string `json:"ddd"`
+			Telefone string `json:"telefone"`
+			Email    string `json:"email"`
+		}
+		if err := json.Unmarshal(leitor.Bytes(), &empresa); err != nil {
+			t.Fatalf("linha JSONL inválida %q: %v", leitor.Text(), err)
+		}
+		if err := json.Unmarshal(leitor.Bytes(), &contato); err != nil {
+			t.Fatal(err)
+		}
+		if empresa.RazaoSocial != "EMPRESA" || contato.DDD != "11" || contato.Telefone == "" || contato.Email != "contato@empresa.com.br" {
+			t.Errorf("linha JSONL = %s", leitor.Text())
+		}
+		doJSONL = append(doJSONL, empresa.CNPJ)
+	}
+
+	if len(doJSONL) != 3 || !slices.Equal(doJSONL, doCSV) {
+		t.Errorf("CNPJs no JSONL = %v, no CSV = %v; quer as mesmas 3 empresas", doJSONL, doCSV)
+	}
+}
+
+func TestSaidaSocios(t *testing.T) {
+	comSocios, qsaNulo, semQSA := "11222333000181", "19131243000197", "11444777000161"
+	transporte := &transporteFalso{respostas: map[string]respostaFalsa{
+		"/" + comSocios: {http.StatusOK, `{"cnpj":"` + comSocios + `","razao_social":"A","capital_social":100000,"qsa":[` +
+			`{"nome_socio":"MARIA DA SILVA","qualificacao_socio":"Sócio-Administrador"},` +
+			`{"nome_socio":"JOÃO \"JOCA\" SOUZA","qualificacao_socio":"Sócio"}]}`},
+		"/" + qsaNulo: {http.StatusOK, `{"cnpj":"` + qsaNulo + `","razao_social":"B","capital_social":100000,"qsa":null}`},
+		"/" + semQSA:  {http.StatusOK, `{"cnpj":"` + semQSA + `","razao_social":"C","capital_social":100000}`},
+	}}
+	p := minhaReceita{baseURL: "http://minhareceita.teste", cliente: &http.Client{Transport: transporte}}
+	entrada := linhaReceita(comSocios, "", "", "") + linhaReceita(qsaNulo, "", "", "") + linhaReceita(semQSA, "", "", "")
+
+	usarAmbienteTeste(t, p)
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"workers": "1", "include_socios": "1"},
+		arquivoTeste{"entrada.csv", entrada})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+	colunaSocios := coluna(t, cabecalho, linhas, "Socios")
+	if len(colunaSocios) != 3 || colunaSocios[1] != "" || colunaSocios[2] != "" {
+		t.Fatalf("Socios = %q, quer vazio sem qsa", colunaSocios)
+	}
+	var socios []Socio
+	if err := json.Unmarshal([]byte(colunaSocios[0]), &socios); err != nil {
+		t.Fatalf("coluna Socios não é JSON: %q", colunaSocios[0])
+	}
+	want := []Socio{{"MARIA DA SILVA", "Sócio-Administrador"}, {`JOÃO "JOCA" SOUZA`, "Sócio"}}
+	if !slices.Equal(socios, want) {
+		t.Errorf("sócios = %+v, quer %+v", socios, want)
+	}
+
+	// Sem include_socios a coluna não existe
+	usarAmbienteTeste(t, p)
+	rec = enviarFormulario(t, uploadHandler, "/upload?inline=1", nil, arquivoTeste{"entrada.csv", entrada})
+	if cabecalho, _ := lerSaidaCSV(t, rec.Body.String()); slices.Contains(cabecalho, "Socios") {
+		t.Errorf("coluna Socios sem include_socios: %v", cabecalho)
+	}
+}
+
+func TestSaidaColunasSelecionadas(t *testing.T) {
+	cnpj := cnpjTeste("112223330001")
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{cnpj: empresaTeste("EMPRESA LTDA")}})
+	entrada := arquivoTeste{"entrada.csv", linhaReceita(cnpj, "11", "32345678", "")}
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"columns": " razaosocial, CNPJ,UF"}, entrada)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+	if want := []string{"RazaoSocial", "CNPJ", "UF"}; !slices.Equal(cabecalho, want) {
+		t.Errorf("cabeçalho = %v, quer %v", cabecalho, want)
+	}
+	if want := [][]string{{"EMPRESA LTDA", cnpj, "SP"}}; !slices.EqualFunc(linhas, want, slices.Equal) {
+		t.Errorf("linhas = %q, quer %q", linhas, want)
+	}
+
+	for _, columns := range []string{"CNPJ,Faturamento", "CNPJ,cnpj", "CNPJ,Socios"} {
+		rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"columns": columns}, entrada)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("columns=%q: status = %d, quer %d", columns, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestIncluirTodasComColunaMatched(t *testing.T) {
+	atende, pequena, ausente := cnpjTeste("112223330001"), cnpjTeste("191312430001"), cnpjTeste("114447770001")
+	abaixo := empresaTeste("PEQUENA LTDA")
+	abaixo.CapitalSocial = 1000
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{atende: empresaTeste("GRANDE LTDA"), pequena: abaixo}})
+	entrada := arquivoTeste{"entrada.csv", linhaReceita(atende, "", "", "") + linhaReceita(pequena, "", "", "") +
+		linhaReceita(ausente, "", "", "")}
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"include_all": "1", "workers": "1"}, entrada)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+	if cabecalho[len(cabecalho)-1] != "Matched" {
+		t.Errorf("cabeçalho = %v, quer Matched por último", cabecalho)
+	}
+	if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, []string{atende, pequena}) {
+		t.Errorf("CNPJs = %v, quer as duas empresas encontradas", got)
+	}
+	if got := coluna(t, cabecalho, linhas, "Matched"); !slices.Equal(got, []string{"true", "false"}) {
+		t.Errorf("Matched = %v, quer true, false", got)
+	}
+
+	// Sem include_all só a empresa que atende ao filtro é gravada, sem a coluna
+	processedCNPJs = novoCacheLRU[time.Time](maxEntradasCachePadrao)
+	rec = enviarFormulario(t, uploadHandler, "/upload?inline=1", nil, entrada)
+	cabecalho, linhas = lerSaidaCSV(t, rec.Body.String())
+	if slices.Contains(cabecalho, "Matched") || len(linhas) != 1 {
+		t.Errorf("sem include_all: cabeçalho %v e %d linhas, quer 1 linha sem Matched", cabecalho, len(linhas))
+	}
+}
+
+func TestSaidaEnderecoCompleto(t *testing.T) {
+	completo, parcial := cnpjTeste("112223330001"), cnpjTeste("191312430001")
+	transporte := &transporteFalso{respostas: map[string]respostaFalsa{
+		"/mr/" + completo: {http.StatusOK, `{"cnpj":"` + completo + `","razao_social":"A","capital_social":100000,` +
+			`"logradouro":"AVENIDA PAULISTA","numero":"1578","complemento":"ANDAR 5 SALA 52","bairro":"BELA VISTA",` +
+			`"municipio":"SAO PAULO","uf":"SP","cep":"01310200","descricao_situacao_cadastral":"ATIVA"}`},
+		"/mr/" + parcial: {http.StatusOK, `{"cnpj":"` + parcial + `","razao_social":"B","capital_social":100000,` +
+			`"logradouro":"RUA DIREITA","numero":null,"complemento":"","municipio":"SAO PAULO","uf":"SP",` +
+			`"descricao_situacao_cadastral":"ATIVA"}`},
+	}}
+	usarAmbienteTeste(t, minhaReceita{baseURL: "http://minhareceita.teste/mr", cliente: &http.Client{Transport: transporte}})
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{
+		"workers": "1", "columns": "CNPJ,Logradouro,Numero,Complemento,Bairro,Municipio,UF,CEP",
+	}, arquivoTeste{"entrada.csv", linhaReceita(completo, "", "", "") + linhaReceita(parcial, "", "", "")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	_, linhas := lerSaidaCSV(t, rec.Body.String())
+	want := [][]string{
+		{completo, "AVENIDA PAULISTA", "1578", "ANDAR 5 SALA 52", "BELA VISTA", "SAO PAULO", "SP", "01310-200"},
+		{parcial, "RUA DIREITA", "", "", "", "SAO PAULO", "SP", ""},
+	}
+	if !slices.EqualFunc(linhas, want, slices.Equal) {
+		t.Errorf("linhas = %q, quer %q", linhas, want)
+	}
+}
+
+func TestSaidaSeparadorDecimal(t *testing.T) {
+	cnpj := cnpjTeste("112223330001")
+	empresa := empresaTeste("A")
+	empresa.CapitalSocial = 1234567.89
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{cnpj: empresa}})
+
+	for separador, want := range map[string]struct{ bruto, capital string }{
+		"":  {cnpj + ",A,1234567.89,SP\n", "1234567.89"},
+		".": {cnpj + ",A,1234567.89,SP\n", "1234567.89"},
+		// A vírgula decimal vai entre aspas para não ser lida como delimitador
+		",": {cnpj + `,A,"1234567,89",SP` + "\n", "1234567,89"},
+	} {
+		processedCNPJs = novoCacheLRU[time.Time](maxEntradasCachePadrao)
+		rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{
+			"decimal_separator": separador, "columns": "CNPJ,RazaoSocial,CapitalSocial,UF",
+		}, arquivoTeste{"entrada.csv", linhaReceita(cnpj, "", "", "")})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("/upload com %q: %s", separador, mensagemErro(rec))
+		}
+		if !strings.HasSuffix(rec.Body.String(), want.bruto) {
+			t.Errorf("decimal_separator %q: saída %q, quer a linha %q", separador, rec.Body.String(), want.bruto)
+		}
+		cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+		if got := coluna(t, cabecalho, linhas, "CapitalSocial"); !slices.Equal(got, []string{want.capital}) {
+			t.Errorf("decimal_separator %q: CapitalSocial = %q, quer %q", separador, got, want.capital)
+		}
+	}
+
+	// O JSON Lines mantém o capital como número
+	processedCNPJs = novoCacheLRU[time.Time](maxEntradasCachePadrao)
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"decimal_separator": ",", "output_format": "jsonl"},
+		arquivoTeste{"entrada.csv", linhaReceita(cnpj, "", "", "")})
+	if !strings.Contains(rec.Body.String(), `"capital_social":1234567.89`) {
+		t.Errorf("JSONL com decimal_separator ,: %s", rec.Body.String())
+	}
+
+	rec = enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"decimal_separator": ";"},
+		arquivoTeste{"entrada.csv", linhaReceita(cnpj, "", "", "")})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("decimal_separator inválido: status = %d, quer 400", rec.Code)
+	}
+}
+
+func TestSaidaEFiltroSimples(t *testing.T) {
+	optante, naoOptante, semInformacao := cnpjTeste("112223330001"), cnpjTeste("191312430001"), cnpjTeste("114447770001")
+	sim, nao := true, false
+	empresas := map[string]Empresa{optante: empresaTeste("A"), naoOptante: empresaTeste("B"), semInformacao: empresaTeste("C")}
+	for cnpj, opcao := range map[string]*bool{optante: &sim, naoOptante: &nao} {
+		e := empresas[cnpj]
+		e.OpcaoSimples, e.OpcaoMEI = opcao, &nao
+		empresas[cnpj] = e
+	}
+	usarAmbienteTeste(t, &provedorFalso{empresas: empresas})
+	entrada := linhaReceita(optante, "", "", "") + linhaReceita(naoOptante, "", "", "") + linhaReceita(semInformacao, "", "", "")
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"include_simples": "1", "ordered": "1"},
+		arquivoTeste{"entrada.csv", entrada})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+	if got, want := coluna(t, cabecalho, linhas, "OpcaoSimples"), []string{"true", "false", ""}; !slices.Equal(got, want) {
+		t.Errorf("OpcaoSimples = %q, quer %q", got, want)
+	}
+	if got, want := coluna(t, cabecalho, linhas, "OpcaoMEI"), []string{"false", "false", ""}; !slices.Equal(got, want) {
+		t.Errorf("OpcaoMEI = %q, quer %q", got, want)
+	}
+
+	// somente_simples descarta também quem a API não informa
+	processedCNPJs = novoCacheLRU[time.Time](maxEntradasCachePadrao)
+	rec = enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"somente_simples": "1"},
+		arquivoTeste{"entrada.csv", entrada})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	cabecalho, linhas = lerSaidaCSV(t, rec.Body.String())
+	if got := coluna(t, cabecalho, linhas, "CNPJ"); !slices.Equal(got, []string{optante}) {
+		t.Errorf("CNPJs com somente_simples = %v, quer só %s", got, optante)
+	}
+	if slices.Contains(cabecalho, "OpcaoSimples") {
+		t.Errorf("colunas do Simples sem include_simples: %v", cabecalho)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Quantidade de registros lidos por /preview.
+const linhasPreview = 10
+
+// linhaPreview mostra como um registro de entrada é lido com o mapeamento
+// de colunas informado.
+type linhaPreview struct {
+	Row       int    `json:"row"`
+	CNPJ      string `json:"cnpj"`
+	ValidCNPJ bool   `json:"valid_cnpj"`
+	DDD       string `json:"ddd"`
+	Telefone  string `json:"telefone"`
+	Email     string `json:"email"`
+	Error     string `json:"error,omitempty"`
+}
+
+// respostaPreview é o corpo JSON de /preview.
+type respostaPreview struct {
+	Delimiter     string         `json:"delimiter"`
+	HeaderSkipped bool           `json:"header_skipped"`
+	Rows          []linhaPreview `json:"rows"`
+}
+
+// previewHandler lê só os primeiros registros do arquivo enviado e mostra
+// o CNPJ, o DDD, o telefone e o e-mail extraídos de cada um com os campos de
+// mapeamento de /upload, sem consultar a API, para conferir o mapeamento
+// antes de um processamento longo.
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := r.ParseMultipartForm(10 << 20); err != nil {
+		http.Error(w, "Erro ao analisar o formulário: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	encoding, err := parseEncoding(r.FormValue("encoding"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	colunas, err := parseMapeamento(r.FormValue)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	cabecalho, err := parseCabecalhoEntrada(r.FormValue("has_header"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opcoesEntrada, err := parseOpcoesLeitor(r.FormValue)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "Erro ao obter o arquivo: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+
+	reader, err := novoLeitorEntrada(header.Filename, file, encoding, opcoesEntrada)
+	if errors.Is(err, errNaoCSV) {
+		http.Error(w, "Por favor, envie um arquivo CSV", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resposta := respostaPreview{Delimiter: string(reader.Comma), Rows: []linhaPreview{}}
+	ler, pulado := leitorRegistros(reader, colunas, cabecalho)
+	for linha := 1; linha <= linhasPreview; linha++ {
+		record, err := ler()
+		if err == io.EOF {
+			break
+		}
+		// row é a linha do arquivo, contando o cabeçalho pulado
+		numero := linha
+		if *pulado {
+			numero++
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			resposta.Rows = append(resposta.Rows, linhaPreview{Row: numero, Error: err.Error()})
+			continue
+		}
+		if err != nil {
+			http.Error(w, "Erro ao ler o arquivo de entrada: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		resposta.Rows = append(resposta.Rows, previewRegistro(numero, record, colunas))
+	}
+	resposta.HeaderSkipped = *pulado
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resposta)
+}
+
+// previewRegistro aplica o mapeamento a um registro como extrairTarefa,
+// mantendo o CNPJ montado mesmo quando ele é inválido.
+func previewRegistro(linha int, record []string, colunas mapeamentoColunas) linhaPreview {
+	p := linhaPreview{Row: linha}
+	if !colunas.cabe(record) {
+		p.Error = fmt.Sprintf("registro com %d colunas; o mapeamento usa a coluna %d", len(record), colunas.maiorIndice())
+		return p
+	}
+
+	cnpj, ok := colunas.extrairCNPJ(record)
+	p.CNPJ = cnpj
+	p.ValidCNPJ = ok && validarCNPJ(cnpj)
+	if !ok {
+		p.Error = "partes do CNPJ fora do tamanho esperado"
+	} else if !p.ValidCNPJ {
+		p.Error = "CNPJ inválido"
+	}
+	p.DDD = campo(record, colunas.DDD)
+	p.Telefone = campo(record, colunas.Telefone)
+	p.Email = campo(record, colunas.Email)
+	return p
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPreviewUsaMapeamento(t *testing.T) {
+	p := &provedorFalso{empresas: map[string]Empresa{}}
+	usarAmbienteTeste(t, p)
+
+	cnpjs := cnpjsTeste(12)
+	var entrada strings.Builder
+	for i, cnpj := range cnpjs {
+		if i == 1 {
+			cnpj = cnpj[:13] + string('0'+(cnpj[13]-'0'+1)%10) // dígito verificador errado
+		}
+		fmt.Fprintf(&entrada, "contato%d@empresa.com.br;%s;%s;%s;11;3234567%d\n", i, cnpj[:8], cnpj[8:12], cnpj[12:], i%10)
+	}
+
+	rec := enviarFormulario(t, previewHandler, "/preview", map[string]string{
+		"col_cnpj_parts": "1,2,3", "col_ddd": "4", "col_telefone": "5", "col_email": "0",
+	}, arquivoTeste{"entrada.csv", entrada.String()})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/preview: %s", mensagemErro(rec))
+	}
+	var resposta respostaPreview
+	if err := json.Unmarshal(rec.Body.Bytes(), &resposta); err != nil {
+		t.Fatalf("JSON inválido: %v\n%s", err, rec.Body.String())
+	}
+
+	if resposta.Delimiter != ";" || len(resposta.Rows) != linhasPreview {
+		t.Fatalf("delimitador %q e %d linhas, quer ; e %d", resposta.Delimiter, len(resposta.Rows), linhasPreview)
+	}
+	want := linhaPreview{Row: 1, CNPJ: cnpjs[0], ValidCNPJ: true, DDD: "11", Telefone: "32345670", Email: "contato0@empresa.com.br"}
+	if resposta.Rows[0] != want {
+		t.Errorf("primeira linha = %+v, quer %+v", resposta.Rows[0], want)
+	}
+	if r := resposta.Rows[1]; r.ValidCNPJ || r.Error == "" || r.Email != "contato1@empresa.com.br" {
+		t.Errorf("linha com CNPJ inválido = %+v", r)
+	}
+	if n := p.totalConsultas(); n != 0 {
+		t.Errorf("%d consultas à API pelo preview, quer 0", n)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Tempo que o progresso de um job concluído continua disponível em /progress.
+const retencaoProgresso = 10 * time.Minute
+
+// jobIDValido restringe os IDs de job informados pelo cliente.
+var jobIDValido = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// eventoProgresso é o estado de um job enviado aos inscritos via SSE. Como
+// a entrada é lida em streaming, Total conta os registros lidos até o
+// momento e só representa o arquivo inteiro no evento final.
+type eventoProgresso struct {
+	Processed int64 `json:"processed"`
+	Total     int64 `json:"total"`
+	Matched   int64 `json:"matched"`
+
+	// Held conta as empresas qualificadas retidas por top_percentile, que
+	// só entram em Matched ao serem gravadas no fim do job
+	Held int64 `json:"held,omitempty"`
+}
+
+// progressoJob guarda o último estado de um job e repassa cada atualização
+// aos clientes inscritos em /progress/{jobID}.
+type progressoJob struct {
+	mu         sync.Mutex
+	atual      eventoProgresso
+	finalizado bool
+	inscritos  map[chan eventoProgresso]struct{}
+}
+
+var (
+	progressos      = make(map[string]*progressoJob)
+	progressosMutex sync.Mutex
+)
+
+// novoJobID gera um identificador aleatório para um job.
+func novoJobID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// registrarProgresso cria o acompanhamento de progresso de um job. Retorna
+// false se já existe um job em andamento com o mesmo ID.
+func registrarProgresso(jobID string) (*progressoJob, bool) {
+	p := &progressoJob{inscritos: make(map[chan eventoProgresso]struct{})}
+
+	progressosMutex.Lock()
+	defer progressosMutex.Unlock()
+
+	if existente, ok := progressos[jobID]; ok {
+		existente.mu.Lock()
+		emAndamento := !existente.finalizado
+		existente.mu.Unlock()
+		if emAndamento {
+			return nil, false
+		}
+	}
+	progressos[jobID] = p
+
+	return p, true
+}
+
+func obterProgresso(jobID string) *progressoJob {
+	progressosMutex.Lock()
+	defer progressosMutex.Unlock()
+	return progressos[jobID]
+}
+
+// publicar registra o novo estado e o envia aos inscritos. Inscritos lentos
+// perdem eventos intermediários, mas sempre recebem o estado final.
+func (p *progressoJob) publicar(ev eventoProgresso) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.atual = ev
+	for ch := range p.inscritos {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// finalizar encerra os inscritos e agenda a remoção do job do registro.
+func (p *progressoJob) finalizar(jobID string) {
+	p.mu.Lock()
+	p.finalizado = true
+	for ch := range p.inscritos {
+		close(ch)
+	}
+	p.inscritos = nil
+	p.mu.Unlock()
+
+	time.AfterFunc(retencaoProgresso, func() {
+		progressosMutex.Lock()
+		defer progressosMutex.Unlock()
+		if progressos[jobID] == p {
+			delete(progressos, jobID)
+		}
+	})
+}
+
+// inscrever devolve o estado atual e um canal com as próximas atualizações.
+// O canal é nil quando o job já terminou.
+func (p *progressoJob) inscrever() (eventoProgresso, chan eventoProgresso) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.finalizado {
+		return p.atual, nil
+	}
+	ch := make(chan eventoProgresso, 16)
+	p.inscritos[ch] = struct{}{}
+	return p.atual, ch
+}
+
+func (p *progressoJob) cancelarInscricao(ch chan eventoProgresso) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.inscritos[ch]; ok {
+		delete(p.inscritos, ch)
+		close(ch)
+	}
+}
+
+func (p *progressoJob) estado() eventoProgresso {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.atual
+}
+
+// progressHandler transmite o progresso de um job como Server-Sent Events,
+// encerrando a conexão depois do evento final.
+func progressHandler(w http.ResponseWriter, r *http.Request) {
+	p := obterProgresso(r.PathValue("jobID"))
+	if p == nil {
+		http.Error(w, "Job não encontrado", http.StatusNotFound)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming não suportado", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	enviar := func(ev eventoProgresso) bool {
+		dados, err := json.Marshal(ev)
+		if err != nil {
+			return false
+		}
+		if _, err := fmt.Fprintf(w, "data: %s\n\n", dados); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+
+	atual, ch := p.inscrever()
+	if !enviar(atual) || ch == nil {
+		return
+	}
+	defer p.cancelarInscricao(ch)
+
+	for {
+		select {
+		case ev, ok := <-ch:
+			if !ok {
+				enviar(p.estado())
+				return
+			}
+			if !enviar(ev) {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
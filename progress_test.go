@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// provedorRetido só responde às consultas depois que liberar é fechado,
+// mantendo o job em andamento enquanto o teste se inscreve no progresso.
+type provedorRetido struct {
+	provedorFalso
+	liberar chan struct{}
+}
+
+func (p *provedorRetido) Consultar(ctx context.Context, cnpj string) (*Empresa, error) {
+	select {
+	case <-p.liberar:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return p.provedorFalso.Consultar(ctx, cnpj)
+}
+
+// esperarProgresso aguarda o job jobID aparecer no registro de progresso.
+func esperarProgresso(t *testing.T, jobID string) {
+	t.Helper()
+	for prazo := time.Now().Add(5 * time.Second); obterProgresso(jobID) == nil; time.Sleep(time.Millisecond) {
+		if time.Now().After(prazo) {
+			t.Fatalf("job %s não registrado", jobID)
+		}
+	}
+}
+
+func TestProgressoSSE(t *testing.T) {
+	cnpjs := cnpjsTeste(5)
+	p := &provedorRetido{provedorFalso: provedorFalso{empresas: map[string]Empresa{}}, liberar: make(chan struct{})}
+	var entrada strings.Builder
+	for i, cnpj := range cnpjs {
+		entrada.WriteString(linhaReceita(cnpj, "", "", ""))
+		if i%2 == 0 {
+			p.empresas[cnpj] = empresaTeste("EMPRESA")
+		}
+	}
+	usarAmbienteTeste(t, p)
+
+	const jobID = "progresso-sse"
+	respostaUpload := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		respostaUpload <- enviarFormulario(t, uploadHandler, "/upload?wait=1", map[string]string{"job_id": jobID},
+			arquivoTeste{"entrada.csv", entrada.String()})
+	}()
+	esperarProgresso(t, jobID)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/progress/{jobID}", progressHandler)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/progress/" + jobID)
+	if err != nil {
+		close(p.liberar)
+		t.Fatalf("GET /progress: %v", err)
+	}
+	defer resp.Body.Close()
+	if tipo := resp.Header.Get("Content-Type"); tipo != "text/event-stream" {
+		t.Errorf("Content-Type = %q", tipo)
+	}
+	close(p.liberar)
+
+	// O servidor encerra o stream depois do evento final
+	var eventos []eventoProgresso
+	linhas := bufio.NewScanner(resp.Body)
+	for linhas.Scan() {
+		dados, ok := strings.CutPrefix(linhas.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var ev eventoProgresso
+		if err := json.Unmarshal([]byte(dados), &ev); err != nil {
+			t.Fatalf("evento inválido %q: %v", dados, err)
+		}
+		eventos = append(eventos, ev)
+	}
+	if len(eventos) < 2 {
+		t.Fatalf("eventos = %+v, quer o estado inicial e as atualizações", eventos)
+	}
+	for i := 1; i < len(eventos); i++ {
+		if eventos[i].Processed < eventos[i-1].Processed {
+			t.Errorf("progresso regrediu: %+v", eventos)
+		}
+	}
+	final := eventos[len(eventos)-1]
+	if final != (eventoProgresso{Processed: 5, Total: 5, Matched: 3}) {
+		t.Errorf("evento final = %+v, quer 5 processados de 5, 3 encontradas", final)
+	}
+	if rec := <-respostaUpload; rec.Code != http.StatusOK || rec.Header().Get("X-Job-ID") != jobID {
+		t.Errorf("/upload: %s, X-Job-ID %q", mensagemErro(rec), rec.Header().Get("X-Job-ID"))
+	}
+}
+
+func TestProgressoJobDesconhecido(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/progress/{jobID}", progressHandler)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/progress/inexistente", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("status = %d, quer 404", rec.Code)
+	}
+}
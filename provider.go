@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrCNPJNotFound indica que a API não possui o CNPJ consultado na base.
+var ErrCNPJNotFound = errors.New("CNPJ não encontrado")
+
+// Backoff inicial entre tentativas de consulta; dobra a cada nova falha.
+var backoffInicial = 500 * time.Millisecond
+
+// provedor é uma fonte de dados cadastrais de CNPJ. Cada implementação
+// converte o formato da sua API para Empresa e respeita o prazo de ctx.
+type provedor interface {
+	Consultar(ctx context.Context, cnpj string) (*Empresa, error)
+}
+
+// novoProvedor monta o provedor padrão: minhareceita.org com failover para
+// a BrasilAPI, usando as URLs configuradas e fazendo as requisições com
+// cliente.
+func novoProvedor(cliente *http.Client) provedor {
+	return failover{
+		primario:   minhaReceita{baseURL: minhaReceitaURL, cliente: cliente, chave: chaveAPI},
+		secundario: brasilAPI{baseURL: brasilAPIURL, cliente: cliente, chave: chaveBrasilAPI},
+	}
+}
+
+// consultarCNPJ consulta o CNPJ no provedor p, em geral provedorCNPJ.
+// Quando ctx expira ou é cancelado, a espera para e retorna ctx.Err().
+// Porte, CEP e natureza jurídica são normalizados aqui, por normalizarEmpresa,
+// para que todos os provedores usem os mesmos códigos.
+// Consultas simultâneas ao mesmo CNPJ compartilham uma única requisição,
+// limitada por timeoutConsulta. Com o disjuntor do upstream aberto a
+// consulta falha na hora com ErrUpstreamIndisponivel.
+func consultarCNPJ(ctx context.Context, p provedor, cnpj string) (*Empresa, error) {
+	return consultarEmGrupo(ctx, cnpj, timeoutConsulta, func(ctx context.Context) (*Empresa, error) {
+		inicio := time.Now()
+		// A consulta pode terminar depois do job que a iniciou; o resultado
+		// vai para o mesmo disjuntor que a liberou
+		d := disjuntorUpstream
+		liberada, teste := d.permitir()
+		if !liberada {
+			return nil, ErrUpstreamIndisponivel
+		}
+		empresa, err := p.Consultar(ctx, cnpj)
+		d.registrar(ctx, teste, err)
+		if err != nil {
+			metricas.consulta(classificarErro(err), time.Since(inicio))
+			return nil, err
+		}
+		metricas.consulta("ok", time.Since(inicio))
+		normalizarEmpresa(empresa)
+		return empresa, nil
+	})
+}
+
+// normalizarEmpresa converte os campos codificados de forma diferente por
+// cada provedor para a forma usada nos filtros e nas saídas.
+func normalizarEmpresa(empresa *Empresa) {
+	empresa.Porte = normalizarPorte(empresa.Porte)
+	empresa.Cep = normalizeCEP(empresa.Cep)
+	empresa.NaturezaJuridicaCodigo = codigoTexto(normalizarNatureza(string(empresa.NaturezaJuridicaCodigo)))
+}
+
+// minhaReceita consulta a API do minhareceita.org ou de uma instância
+// própria, que pode exigir a chave em chave.
+type minhaReceita struct {
+	baseURL string
+	cliente *http.Client
+	chave   credencialAPI
+}
+
+func (p minhaReceita) Consultar(ctx context.Context, cnpj string) (*Empresa, error) {
+	var empresa Empresa
+	err := comRetentativas(ctx, cnpj, func() error {
+		return requisitarJSON(ctx, p.cliente, p.chave, fmt.Sprintf("%s/%s", p.baseURL, cnpj), &empresa)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &empresa, nil
+}
+
+// brasilAPI consulta o endpoint de CNPJ da BrasilAPI, ou de um gateway à
+// sua frente que pode exigir a chave em chave.
+type brasilAPI struct {
+	baseURL string
+	cliente *http.Client
+	chave   credencialAPI
+}
+
+// brasilAPIEmpresa é o formato de resposta de /api/cnpj/v1/{cnpj}.
+type brasilAPIEmpresa struct {
+	CNPJ                       string      `json:"cnpj"`
+	RazaoSocial                string      `json:"razao_social"`
+	NomeFantasia               string      `json:"nome_fantasia"`
+	CapitalSocial              capitalJSON `json:"capital_social"`
+	DescricaoTipoLogradouro    string      `json:"descricao_tipo_de_logradouro"`
+	Logradouro                 string      `json:"logradouro"`
+	Numero                     string      `json:"numero"`
+	Complemento                string      `json:"complemento"`
+	Bairro                     string      `json:"bairro"`
+	Municipio                  string      `json:"municipio"`
+	CodigoMunicipioIBGE        codigoTexto `json:"codigo_municipio_ibge"`
+	UF                         string      `json:"uf"`
+	Cep                        string      `json:"cep"`
+	DescricaoSituacaoCadastral string      `json:"descricao_situacao_cadastral"`
+	CnaeFiscal                 int         `json:"cnae_fiscal"`
+	CnaeFiscalDescricao        string      `json:"cnae_fiscal_descricao"`
+	DataInicioAtividade        dataISO     `json:"data_inicio_atividade"`
+	Porte                      string      `json:"porte"`
+	CodigoNaturezaJuridica     codigoTexto `json:"codigo_natureza_juridica"`
+	NaturezaJuridica           string      `json:"natureza_juridica"`
+	QSA                        []Socio     `json:"qsa"`
+	OpcaoPeloSimples           *bool       `json:"opcao_pelo_simples"`
+	OpcaoPeloMEI               *bool       `json:"opcao_pelo_mei"`
+}
+
+func (p brasilAPI) Consultar(ctx context.Context, cnpj string) (*Empresa, error) {
+	var dados brasilAPIEmpresa
+	err := comRetentativas(ctx, cnpj, func() error {
+		return requisitarJSON(ctx, p.cliente, p.chave, fmt.Sprintf("%s/%s", p.baseURL, cnpj), &dados)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return dados.empresa(), nil
+}
+
+// empresa converte a resposta da BrasilAPI para Empresa.
+func (d brasilAPIEmpresa) empresa() *Empresa {
+	logradouro := d.Logradouro
+	if d.DescricaoTipoLogradouro != "" {
+		logradouro = d.DescricaoTipoLogradouro + " " + logradouro
+	}
+
+	return &Empresa{
+		CNPJ:                      d.CNPJ,
+		RazaoSocial:               d.RazaoSocial,
+		NomeFantasia:              d.NomeFantasia,
+		CapitalSocial:             float64(d.CapitalSocial),
+		Logradouro:                logradouro,
+		Numero:                    d.Numero,
+		Complemento:               d.Complemento,
+		Bairro:                    d.Bairro,
+		Municipio:                 d.Municipio,
+		CodigoMunicipio:           d.CodigoMunicipioIBGE,
+		UF:                        d.UF,
+		Cep:                       d.Cep,
+		SituacaoCadastral:         d.DescricaoSituacaoCadastral,
+		CnaePrincipalCodigo:       d.CnaeFiscal,
+		CnaePrincipalDescricao:    d.CnaeFiscalDescricao,
+		DataInicioAtividade:       d.DataInicioAtividade,
+		Porte:                     d.Porte,
+		NaturezaJuridicaCodigo:    d.CodigoNaturezaJuridica,
+		NaturezaJuridicaDescricao: d.NaturezaJuridica,
+		Socios:                    d.QSA,
+		OpcaoSimples:              d.OpcaoPeloSimples,
+		OpcaoMEI:                  d.OpcaoPeloMEI,
+	}
+}
+
+// failover consulta o provedor secundário quando o principal falha por
+// indisponibilidade (erro de rede, 429 ou 5xx). CNPJs inexistentes e
+// demais erros do principal são devolvidos sem nova consulta.
+type failover struct {
+	primario   provedor
+	secundario provedor
+}
+
+func (p failover) Consultar(ctx context.Context, cnpj string) (*Empresa, error) {
+	empresa, err := p.primario.Consultar(ctx, cnpj)
+
+	var transitorio *erroTransitorio
+	if err == nil || !errors.As(err, &transitorio) {
+		return empresa, err
+	}
+
+	slog.Warn("Provedor principal indisponível; consultando o secundário", "event", "provider_failover", "cnpj", cnpj, "error", err)
+	return p.secundario.Consultar(ctx, cnpj)
+}
+
+// erroTransitorio marca falhas que podem ter sucesso em uma nova tentativa
+// (erros de rede, 429 e 5xx). retryAfter guarda a espera pedida pela API.
+type erroTransitorio struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *erroTransitorio) Error() string { return e.err.Error() }
+func (e *erroTransitorio) Unwrap() error { return e.err }
+
+// comRetentativas executa requisicao, repetindo-a com backoff exponencial
+// em falhas transitórias até maxTentativas vezes ou até ctx terminar.
+func comRetentativas(ctx context.Context, cnpj string, requisicao func() error) error {
+	espera := backoffInicial
+	var err error
+	for tentativa := 1; tentativa <= maxTentativas; tentativa++ {
+		err = requisicao()
+		if err == nil {
+			return nil
+		}
+
+		var transitorio *erroTransitorio
+		if !errors.As(err, &transitorio) || tentativa == maxTentativas {
+			break
+		}
+
+		atraso := espera
+		if transitorio.retryAfter > atraso {
+			atraso = transitorio.retryAfter
+		}
+		slog.Warn("Tentativa de consulta falhou", "event", "lookup_retry", "cnpj", cnpj,
+			"attempt", tentativa, "max_attempts", maxTentativas, "retry_in_ms", atraso.Milliseconds(), "error", err)
+		select {
+		case <-time.After(atraso):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		espera *= 2
+	}
+
+	return err
+}
+
+// requisitarJSON faz uma única requisição GET, autenticada com chave, e
+// decodifica a resposta em destino.
+// Quando ctx termina durante a requisição o erro devolvido é ctx.Err(), que
+// não é transitório: não há nova tentativa nem failover depois do prazo.
+func requisitarJSON(ctx context.Context, cliente *http.Client, chave credencialAPI, url string, destino any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return fmt.Errorf("erro ao montar requisição: %w", err)
+	}
+	chave.autenticar(req)
+	return executarRequisicao(ctx, cliente, req, destino)
+}
+
+// executarRequisicao envia req por cliente com o User-Agent configurado e
+// decodifica a resposta JSON em destino, classificando as falhas como
+// requisitarJSON.
+func executarRequisicao(ctx context.Context, cliente *http.Client, req *http.Request, destino any) error {
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := cliente.Do(req)
+	if ctx.Err() != nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return ctx.Err()
+	}
+	if err != nil {
+		return &erroTransitorio{err: fmt.Errorf("erro na requisição HTTP: %w", err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		// Sinaliza aos rateLimiter que a taxa atual está acima do aceito
+		respostas429.Add(1)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return &erroTransitorio{
+			err:        fmt.Errorf("status code não OK: %d", resp.StatusCode),
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrCNPJNotFound
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code não OK: %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		return &erroTransitorio{err: fmt.Errorf("erro ao ler resposta: %w", err)}
+	}
+
+	if err := json.Unmarshal(body, destino); err != nil {
+		return fmt.Errorf("erro ao decodificar JSON: %w", err)
+	}
+
+	return nil
+}
+
+// parseRetryAfter interpreta o cabeçalho Retry-After, que pode vir em
+// segundos ou como data HTTP. Retorna zero quando ausente ou inválido.
+func parseRetryAfter(valor string) time.Duration {
+	if valor == "" {
+		return 0
+	}
+	if segundos, err := strconv.Atoi(valor); err == nil && segundos > 0 {
+		return time.Duration(segundos) * time.Second
+	}
+	if data, err := http.ParseTime(valor); err == nil {
+		if atraso := time.Until(data); atraso > 0 {
+			return atraso
+		}
+	}
+	return 0
+}
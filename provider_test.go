@@ -0,0 +1,470 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// transporteFalso responde às requisições com respostas prontas por
+// caminho, sem acessar a rede, e guarda as requisições recebidas.
+type transporteFalso struct {
+	mu          sync.Mutex
+	respostas   map[string]respostaFalsa
+	requisicoes []*http.Request
+}
+
+type respostaFalsa struct {
+	status int
+	corpo  string
+}
+
+func (t *transporteFalso) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	t.requisicoes = append(t.requisicoes, req)
+	r, ok := t.respostas[req.URL.Path]
+	t.mu.Unlock()
+	if !ok {
+		r = respostaFalsa{status: http.StatusNotFound, corpo: `{"message":"not found"}`}
+	}
+	return &http.Response{
+		StatusCode: r.status,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(r.corpo)),
+		Request:    req,
+	}, nil
+}
+
+func (t *transporteFalso) urls() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var urls []string
+	for _, req := range t.requisicoes {
+		urls = append(urls, req.URL.String())
+	}
+	return urls
+}
+
+// cabecalho devolve o cabeçalho nome de cada requisição recebida.
+func (t *transporteFalso) cabecalho(nome string) []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var valores []string
+	for _, req := range t.requisicoes {
+		valores = append(valores, req.Header.Get(nome))
+	}
+	return valores
+}
+
+func TestConsultarCNPJClienteInjetado(t *testing.T) {
+	transporte := &transporteFalso{respostas: map[string]respostaFalsa{
+		"/11222333000181": {http.StatusOK, `{"cnpj":"11222333000181","razao_social":"EMPRESA TESTE LTDA",` +
+			`"capital_social":150000,"uf":"SP","cep":"01310100","porte":"DEMAIS","codigo_natureza_juridica":2062}`},
+	}}
+	p := minhaReceita{baseURL: "http://minhareceita.teste", cliente: &http.Client{Transport: transporte}}
+
+	empresa, err := consultarCNPJ(context.Background(), p, "11222333000181")
+	if err != nil {
+		t.Fatalf("consultarCNPJ: %v", err)
+	}
+	if empresa.RazaoSocial != "EMPRESA TESTE LTDA" || empresa.CapitalSocial != 150000 || empresa.UF != "SP" {
+		t.Errorf("empresa = %+v", empresa)
+	}
+	if empresa.Cep != "01310-100" {
+		t.Errorf("CEP = %q, quer normalizado 01310-100", empresa.Cep)
+	}
+	if got := transporte.urls(); len(got) != 1 || got[0] != "http://minhareceita.teste/11222333000181" {
+		t.Errorf("URLs pedidas = %v", got)
+	}
+}
+
+func TestMinhaReceitaURLConfigurada(t *testing.T) {
+	var caminhos []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		caminhos = append(caminhos, r.URL.Path)
+		w.Write([]byte(`{"cnpj":"11222333000181","razao_social":"EMPRESA TESTE LTDA"}`))
+	}))
+	defer srv.Close()
+
+	anterior := minhaReceitaURL
+	defer func() { minhaReceitaURL = anterior }()
+	t.Setenv("MINHA_RECEITA_URL", srv.URL+"/instancia/")
+	minhaReceitaURL = urlBaseConfigurada("MINHA_RECEITA_URL", anterior)
+
+	if _, err := consultarCNPJ(context.Background(), novoProvedor(srv.Client()), "11222333000181"); err != nil {
+		t.Fatalf("consultarCNPJ: %v", err)
+	}
+	if len(caminhos) != 1 || caminhos[0] != "/instancia/11222333000181" {
+		t.Errorf("caminhos pedidos = %v, quer /instancia/11222333000181", caminhos)
+	}
+
+	t.Setenv("MINHA_RECEITA_URL", "")
+	if got := urlBaseConfigurada("MINHA_RECEITA_URL", "https://minhareceita.org"); got != "https://minhareceita.org" {
+		t.Errorf("sem a variável: %q, quer o host público", got)
+	}
+}
+
+func TestConsultarCNPJBrasilAPI(t *testing.T) {
+	transporte := &transporteFalso{respostas: map[string]respostaFalsa{
+		"/api/cnpj/v1/11222333000181": {http.StatusOK, `{"cnpj":"11222333000181","razao_social":"EMPRESA TESTE LTDA",` +
+			`"capital_social":"150000.00","descricao_tipo_de_logradouro":"AVENIDA","logradouro":"PAULISTA","numero":"1000",` +
+			`"municipio":"SAO PAULO","codigo_municipio_ibge":3550308,"uf":"SP","cep":"01310100",` +
+			`"descricao_situacao_cadastral":"ATIVA","cnae_fiscal":6201501,"data_inicio_atividade":"2010-05-20",` +
+			`"porte":"MICRO EMPRESA","codigo_natureza_juridica":2062,"natureza_juridica":"Sociedade Empresária Limitada",` +
+			`"qsa":[{"nome_socio":"FULANO DE TAL","qualificacao_socio":"Sócio-Administrador"}],"opcao_pelo_simples":true}`},
+	}}
+	p := brasilAPI{baseURL: "http://brasilapi.teste/api/cnpj/v1", cliente: &http.Client{Transport: transporte}}
+
+	e, err := consultarCNPJ(context.Background(), p, "11222333000181")
+	if err != nil {
+		t.Fatalf("consultarCNPJ: %v", err)
+	}
+	if e.RazaoSocial != "EMPRESA TESTE LTDA" || e.CapitalSocial != 150000 || e.Logradouro != "AVENIDA PAULISTA" {
+		t.Errorf("empresa = %+v", e)
+	}
+	if e.CodigoMunicipio != "3550308" || e.Cep != "01310-100" || e.SituacaoCadastral != "ATIVA" || e.CnaePrincipalCodigo != 6201501 {
+		t.Errorf("endereço e atividade = %q %q %q %d", e.CodigoMunicipio, e.Cep, e.SituacaoCadastral, e.CnaePrincipalCodigo)
+	}
+	if e.Porte != porteME || e.NaturezaJuridicaCodigo != "2062" || e.DataInicioAtividade.Format("2006-01-02") != "2010-05-20" {
+		t.Errorf("porte, natureza e início = %q %q %v", e.Porte, e.NaturezaJuridicaCodigo, e.DataInicioAtividade)
+	}
+	if len(e.Socios) != 1 || e.Socios[0].Nome != "FULANO DE TAL" || e.OpcaoSimples == nil || !*e.OpcaoSimples || e.OpcaoMEI != nil {
+		t.Errorf("sócios e opções = %+v %v %v", e.Socios, e.OpcaoSimples, e.OpcaoMEI)
+	}
+}
+
+func TestFailoverSoEmIndisponibilidade(t *testing.T) {
+	usarTentativas(t, 1)
+	casos := []struct {
+		nome       string
+		primario   respostaFalsa
+		secundario bool
+	}{
+		{"503 consulta o secundário", respostaFalsa{http.StatusServiceUnavailable, `{}`}, true},
+		{"429 consulta o secundário", respostaFalsa{http.StatusTooManyRequests, `{}`}, true},
+		{"400 não consulta", respostaFalsa{http.StatusBadRequest, `{}`}, false},
+		{"JSON inválido não consulta", respostaFalsa{http.StatusOK, `{`}, false},
+	}
+	for _, c := range casos {
+		t.Run(c.nome, func(t *testing.T) {
+			transporte := &transporteFalso{respostas: map[string]respostaFalsa{
+				"/mr/11222333000181":  c.primario,
+				"/api/11222333000181": {http.StatusOK, `{"cnpj":"11222333000181","razao_social":"DA BRASILAPI"}`},
+			}}
+			cliente := &http.Client{Transport: transporte}
+			p := failover{
+				primario:   minhaReceita{baseURL: "http://minhareceita.teste/mr", cliente: cliente},
+				secundario: brasilAPI{baseURL: "http://brasilapi.teste/api", cliente: cliente},
+			}
+
+			e, err := p.Consultar(context.Background(), "11222333000181")
+			if n := len(transporte.urls()); c.secundario && (err != nil || e.RazaoSocial != "DA BRASILAPI" || n != 2) {
+				t.Errorf("empresa = %+v, erro = %v, %d requisições; quer a resposta da BrasilAPI", e, err, n)
+			} else if !c.secundario && (err == nil || n != 1) {
+				t.Errorf("erro = %v, %d requisições; quer o erro do principal sem failover", err, n)
+			}
+		})
+	}
+}
+
+func TestConsultarCNPJNaoEncontrado(t *testing.T) {
+	transporte := &transporteFalso{}
+	p := minhaReceita{baseURL: "http://minhareceita.teste", cliente: &http.Client{Transport: transporte}}
+
+	_, err := consultarCNPJ(context.Background(), p, "19131243000197")
+	if err != ErrCNPJNotFound {
+		t.Fatalf("erro = %v, quer ErrCNPJNotFound", err)
+	}
+	if n := len(transporte.urls()); n != 1 {
+		t.Errorf("%d requisições; CNPJ inexistente não deve ser repetido", n)
+	}
+}
+
+func TestNaoEncontradoPorProvedor(t *testing.T) {
+	transporte := &transporteFalso{}
+	cliente := &http.Client{Transport: transporte}
+	provedores := map[string]provedor{
+		"brasilapi": brasilAPI{baseURL: "http://brasilapi.teste/api", cliente: cliente},
+		"failover": failover{
+			primario:   minhaReceita{baseURL: "http://minhareceita.teste/mr", cliente: cliente},
+			secundario: brasilAPI{baseURL: "http://brasilapi.teste/api", cliente: cliente},
+		},
+	}
+	for nome, p := range provedores {
+		transporte.requisicoes = nil
+		if _, err := consultarCNPJ(context.Background(), p, "19131243000197"); !errors.Is(err, ErrCNPJNotFound) {
+			t.Errorf("%s: erro = %v, quer ErrCNPJNotFound", nome, err)
+		}
+		// Um 404 do principal é definitivo: o secundário não é consultado
+		if n := len(transporte.urls()); n != 1 {
+			t.Errorf("%s: %d requisições, quer 1", nome, n)
+		}
+	}
+}
+
+func TestGeocodificarClienteInjetado(t *testing.T) {
+	transporte := &transporteFalso{respostas: map[string]respostaFalsa{
+		"/cep/01310100": {http.StatusOK, `{"location":{"coordinates":{"latitude":"-23.56","longitude":-46.65}}}`},
+	}}
+	g := brasilAPICEP{baseURL: "http://cep.teste/cep", cliente: &http.Client{Transport: transporte}}
+
+	c, err := g.Geocodificar(context.Background(), "01310100")
+	if err != nil {
+		t.Fatalf("Geocodificar: %v", err)
+	}
+	if c.Latitude != "-23.56" || c.Longitude != "-46.65" {
+		t.Errorf("coordenadas = %+v", c)
+	}
+}
+
+func TestChaveAPISoNoMinhaReceita(t *testing.T) {
+	tentativas := maxTentativas
+	maxTentativas = 1
+	defer func() { maxTentativas = tentativas }()
+
+	transporte := &transporteFalso{respostas: map[string]respostaFalsa{
+		"/mr/11222333000181":  {http.StatusServiceUnavailable, `{}`},
+		"/api/11222333000181": {http.StatusOK, `{"cnpj":"11222333000181","razao_social":"EMPRESA TESTE LTDA"}`},
+	}}
+	cliente := &http.Client{Transport: transporte}
+	p := failover{
+		primario:   minhaReceita{baseURL: "http://minhareceita.teste/mr", cliente: cliente, chave: credencialAPI{"X-API-Key", "segredo"}},
+		secundario: brasilAPI{baseURL: "http://brasilapi.teste/api", cliente: cliente},
+	}
+
+	if _, err := p.Consultar(context.Background(), "11222333000181"); err != nil {
+		t.Fatalf("Consultar: %v", err)
+	}
+	if got := transporte.urls(); len(got) != 2 || !strings.HasPrefix(got[1], "http://brasilapi.teste/") {
+		t.Fatalf("URLs pedidas = %v, quer o minhareceita e depois a BrasilAPI", got)
+	}
+	if got := transporte.cabecalho("X-API-Key"); got[0] != "segredo" || got[1] != "" {
+		t.Errorf("X-API-Key por requisição = %q; a BrasilAPI não deve receber a chave", got)
+	}
+}
+
+func TestChaveBrasilAPI(t *testing.T) {
+	usarTentativas(t, 1)
+	urls, chaves := [2]string{minhaReceitaURL, brasilAPIURL}, [2]credencialAPI{chaveAPI, chaveBrasilAPI}
+	t.Cleanup(func() {
+		minhaReceitaURL, brasilAPIURL = urls[0], urls[1]
+		chaveAPI, chaveBrasilAPI = chaves[0], chaves[1]
+	})
+	minhaReceitaURL, brasilAPIURL = "http://minhareceita.teste/mr", "http://brasilapi.teste/api"
+	chaveAPI = novaCredencial("", "")
+
+	for _, c := range []struct{ nome, chave string }{
+		{"definida", "Bearer segredo"},
+		{"ausente", ""},
+	} {
+		t.Run(c.nome, func(t *testing.T) {
+			transporte := &transporteFalso{respostas: map[string]respostaFalsa{
+				"/mr/11222333000181":  {http.StatusServiceUnavailable, `{}`},
+				"/api/11222333000181": {http.StatusOK, `{"cnpj":"11222333000181","razao_social":"EMPRESA TESTE LTDA"}`},
+			}}
+			chaveBrasilAPI = novaCredencial(c.chave, "Authorization")
+
+			if _, err := novoProvedor(&http.Client{Transport: transporte}).Consultar(context.Background(), "11222333000181"); err != nil {
+				t.Fatalf("Consultar: %v", err)
+			}
+			// A chave da BrasilAPI não vai para o minhareceita
+			if got := transporte.cabecalho("Authorization"); len(got) != 2 || got[0] != "" || got[1] != c.chave {
+				t.Errorf("Authorization por requisição = %q, quer %q só na BrasilAPI", got, c.chave)
+			}
+		})
+	}
+}
+
+func TestConsultarCNPJRespeitaPrazo(t *testing.T) {
+	var requisicoes atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requisicoes.Add(1)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+	p := minhaReceita{baseURL: srv.URL, cliente: srv.Client()}
+	anterior := timeoutConsulta
+	t.Cleanup(func() { timeoutConsulta = anterior })
+	timeoutConsulta = 100 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	inicio := time.Now()
+	_, err := consultarCNPJ(ctx, p, "11222333000181")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("erro = %v, quer context.DeadlineExceeded", err)
+	}
+	if d := time.Since(inicio); d > time.Second {
+		t.Errorf("consulta levou %v com prazo de 50ms", d)
+	}
+	// A requisição compartilhada para em timeoutConsulta; o prazo esgotado
+	// não é transitório e não há nova tentativa
+	srv.Close()
+	if n := requisicoes.Load(); n != 1 {
+		t.Errorf("%d requisições, quer 1", n)
+	}
+}
+
+func TestUploadPrazoPorConsulta(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	usarAmbienteTeste(t, minhaReceita{baseURL: srv.URL, cliente: srv.Client()})
+	anterior := timeoutConsulta
+	t.Cleanup(func() { timeoutConsulta = anterior })
+	timeoutConsulta = 50 * time.Millisecond
+
+	cnpj := cnpjTeste("112223330001")
+	rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", nil, arquivoTeste{"entrada.csv", linhaReceita(cnpj, "", "", "")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	caminhos, _ := filepath.Glob(filepath.Join(diretorioSaida, "*_erros.csv"))
+	if len(caminhos) != 1 {
+		t.Fatalf("arquivos de erros = %v", caminhos)
+	}
+	if dados, _ := os.ReadFile(caminhos[0]); !strings.Contains(string(dados), cnpj+","+motivoTimeout) {
+		t.Errorf("arquivo de erros sem o timeout:\n%s", dados)
+	}
+}
+
+// usarTentativas ajusta maxTentativas e um backoff curto durante o teste.
+func usarTentativas(t *testing.T, n int) {
+	t.Helper()
+	tentativas, backoff := maxTentativas, backoffInicial
+	t.Cleanup(func() { maxTentativas, backoffInicial = tentativas, backoff })
+	maxTentativas, backoffInicial = n, time.Millisecond
+}
+
+func TestConsultarCNPJRepeteFalhasTransitorias(t *testing.T) {
+	usarTentativas(t, 3)
+	usarAmbienteTeste(t, nil)
+	var pedidos atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch pedidos.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.WriteHeader(http.StatusBadGateway)
+		default:
+			io.WriteString(w, `{"cnpj":"11222333000181","razao_social":"EMPRESA TESTE LTDA"}`)
+		}
+	}))
+	defer srv.Close()
+
+	empresa, err := consultarCNPJ(context.Background(), minhaReceita{baseURL: srv.URL, cliente: srv.Client()}, "11222333000181")
+	if err != nil {
+		t.Fatalf("consultarCNPJ: %v", err)
+	}
+	if empresa.RazaoSocial != "EMPRESA TESTE LTDA" {
+		t.Errorf("empresa = %+v", empresa)
+	}
+	if n := pedidos.Load(); n != 3 {
+		t.Errorf("%d pedidos, quer 3: duas falhas e o sucesso", n)
+	}
+}
+
+func TestConsultarCNPJNaoRepeteErrosDefinitivos(t *testing.T) {
+	usarTentativas(t, 3)
+	usarAmbienteTeste(t, nil)
+	for _, status := range []int{http.StatusBadRequest, http.StatusForbidden} {
+		var pedidos atomic.Int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			pedidos.Add(1)
+			w.WriteHeader(status)
+		}))
+		_, err := consultarCNPJ(context.Background(), minhaReceita{baseURL: srv.URL, cliente: srv.Client()}, "11222333000181")
+		srv.Close()
+		if err == nil {
+			t.Errorf("status %d: consulta sem erro", status)
+		}
+		if n := pedidos.Load(); n != 1 {
+			t.Errorf("status %d: %d pedidos, quer 1", status, n)
+		}
+	}
+}
+
+func TestConsultarCNPJDesisteAposMaxTentativas(t *testing.T) {
+	usarTentativas(t, 2)
+	usarAmbienteTeste(t, nil)
+	var pedidos atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pedidos.Add(1)
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	_, err := consultarCNPJ(context.Background(), minhaReceita{baseURL: srv.URL, cliente: srv.Client()}, "11222333000181")
+	var transitorio *erroTransitorio
+	if !errors.As(err, &transitorio) {
+		t.Errorf("erro = %v, quer erroTransitorio", err)
+	}
+	if n := pedidos.Load(); n != 2 {
+		t.Errorf("%d pedidos, quer 2", n)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	casos := map[string]time.Duration{
+		"":       0,
+		"5":      5 * time.Second,
+		"0":      0,
+		"-3":     0,
+		"amanhã": 0,
+		time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat): 0,
+	}
+	for valor, want := range casos {
+		if got := parseRetryAfter(valor); got != want {
+			t.Errorf("parseRetryAfter(%q) = %s, quer %s", valor, got, want)
+		}
+	}
+	futuro := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(futuro); got <= 50*time.Second || got > time.Minute {
+		t.Errorf("parseRetryAfter(%q) = %s, quer cerca de 1m", futuro, got)
+	}
+}
+
+func TestOpcaoSimplesNaResposta(t *testing.T) {
+	casos := []struct {
+		campos               string
+		wantSimples, wantMEI string
+	}{
+		{`,"opcao_pelo_simples":true,"opcao_pelo_mei":false`, "true", "false"},
+		{`,"opcao_pelo_simples":false,"opcao_pelo_mei":true`, "false", "true"},
+		{`,"opcao_pelo_simples":null,"opcao_pelo_mei":null`, "", ""},
+		{``, "", ""},
+	}
+	for _, c := range casos {
+		corpo := `{"cnpj":"11222333000181","razao_social":"A","capital_social":1000` + c.campos + `}`
+		transporte := &transporteFalso{respostas: map[string]respostaFalsa{
+			"/api/cnpj/v1/11222333000181": {http.StatusOK, corpo},
+			"/mr/11222333000181":          {http.StatusOK, corpo},
+		}}
+		cliente := &http.Client{Transport: transporte}
+		for nome, p := range map[string]provedor{
+			"BrasilAPI":     brasilAPI{baseURL: "http://brasilapi.teste/api/cnpj/v1", cliente: cliente},
+			"Minha Receita": minhaReceita{baseURL: "http://minhareceita.teste/mr", cliente: cliente},
+		} {
+			e, err := p.Consultar(context.Background(), "11222333000181")
+			if err != nil {
+				t.Fatalf("%s com %s: %v", nome, corpo, err)
+			}
+			if got, gotMEI := formatarOpcao(e.OpcaoSimples), formatarOpcao(e.OpcaoMEI); got != c.wantSimples || gotMEI != c.wantMEI {
+				t.Errorf("%s com %s: OpcaoSimples = %q, OpcaoMEI = %q; quer %q, %q", nome, corpo, got, gotMEI, c.wantSimples, c.wantMEI)
+			}
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"time"
+)
+
+// Prazos padrão das conexões do servidor HTTP, ajustáveis pelas variáveis
+// de ambiente HTTP_READ_HEADER_TIMEOUT, HTTP_READ_TIMEOUT,
+// HTTP_WRITE_TIMEOUT e HTTP_IDLE_TIMEOUT.
+const (
+	prazoLeituraCabecalhoPadrao = 10 * time.Second
+	prazoLeituraPadrao          = time.Minute
+	prazoEscritaPadrao          = time.Minute
+	prazoOciosoPadrao           = 2 * time.Minute
+)
+
+// novoServidor monta o servidor HTTP com os prazos de leitura, escrita e
+// ociosidade configurados, para que conexões lentas ou paradas não fiquem
+// abertas indefinidamente. Rotas que respondem durante todo o processamento
+// usam semPrazo.
+func novoServidor(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		ReadHeaderTimeout: parseDuracao(os.Getenv("HTTP_READ_HEADER_TIMEOUT"), prazoLeituraCabecalhoPadrao),
+		ReadTimeout:       parseDuracao(os.Getenv("HTTP_READ_TIMEOUT"), prazoLeituraPadrao),
+		WriteTimeout:      parseDuracao(os.Getenv("HTTP_WRITE_TIMEOUT"), prazoEscritaPadrao),
+		IdleTimeout:       parseDuracao(os.Getenv("HTTP_IDLE_TIMEOUT"), prazoOciosoPadrao),
+	}
+}
+
+// semPrazo remove o prazo de escrita da conexão antes de chamar h: o
+// processamento síncrono (inline, wait=1), o download e o acompanhamento em
+// /progress podem durar bem mais que ele. O prazo de leitura continua valendo,
+// para que um cliente parado no meio do envio não prenda a conexão; uploads
+// maiores que HTTP_READ_TIMEOUT permite exigem aumentá-lo.
+func semPrazo(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		h(w, r)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestNovoServidorPrazos(t *testing.T) {
+	srv := novoServidor(":8080")
+	if srv.Addr != ":8080" {
+		t.Errorf("Addr = %q", srv.Addr)
+	}
+	if srv.ReadHeaderTimeout != prazoLeituraCabecalhoPadrao || srv.ReadTimeout != prazoLeituraPadrao ||
+		srv.WriteTimeout != prazoEscritaPadrao || srv.IdleTimeout != prazoOciosoPadrao {
+		t.Errorf("prazos padrão = %v, %v, %v, %v", srv.ReadHeaderTimeout, srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+
+	t.Setenv("HTTP_READ_HEADER_TIMEOUT", "5s")
+	t.Setenv("HTTP_READ_TIMEOUT", "30s")
+	t.Setenv("HTTP_WRITE_TIMEOUT", "2m")
+	t.Setenv("HTTP_IDLE_TIMEOUT", "-1s") // inválido: fica o padrão
+	srv = novoServidor(":8080")
+	if srv.ReadHeaderTimeout != 5*time.Second || srv.ReadTimeout != 30*time.Second ||
+		srv.WriteTimeout != 2*time.Minute || srv.IdleTimeout != prazoOciosoPadrao {
+		t.Errorf("prazos configurados = %v, %v, %v, %v", srv.ReadHeaderTimeout, srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+}
+
+func TestSemPrazoPermiteRespostaLonga(t *testing.T) {
+	lento := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(150 * time.Millisecond)
+		io.WriteString(w, "ok")
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/lento", lento)
+	mux.HandleFunc("/sem-prazo", semPrazo(lento))
+	srv := httptest.NewUnstartedServer(mux)
+	srv.Config.WriteTimeout = 50 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	// Passado o WriteTimeout o servidor fecha a conexão sem resposta
+	if resp, err := http.Get(srv.URL + "/lento"); err == nil {
+		resp.Body.Close()
+		t.Error("resposta passou do WriteTimeout sem semPrazo")
+	}
+	resp, err := http.Get(srv.URL + "/sem-prazo")
+	if err != nil {
+		t.Fatalf("semPrazo: %v", err)
+	}
+	defer resp.Body.Close()
+	if corpo, _ := io.ReadAll(resp.Body); string(corpo) != "ok" {
+		t.Errorf("corpo = %q, quer ok", corpo)
+	}
+}
+
+func TestSemPrazoMantemPrazoDeLeitura(t *testing.T) {
+	leitura := make(chan error, 1)
+	srv := httptest.NewUnstartedServer(semPrazo(func(w http.ResponseWriter, r *http.Request) {
+		_, err := io.ReadAll(r.Body)
+		leitura <- err
+	}))
+	srv.Config.ReadTimeout = 50 * time.Millisecond
+	srv.Start()
+	defer srv.Close()
+
+	// O cliente envia o começo do corpo e para
+	corpo, escrita := io.Pipe()
+	defer escrita.Close()
+	go escrita.Write([]byte("CNPJ\n"))
+	go func() {
+		if resp, err := http.Post(srv.URL, "text/csv", corpo); err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	select {
+	case err := <-leitura:
+		if err == nil {
+			t.Error("leitura do corpo parado terminou sem erro, quer o ReadTimeout")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("leitura do corpo parado não respeitou o ReadTimeout")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// consultasEmAndamento evita que jobs paralelos consultem o mesmo CNPJ ao
+// mesmo tempo, antes de qualquer um deles atualizar o cache.
+var consultasEmAndamento = &singleflight.Group{}
+
+// consultarEmGrupo executa consulta para o CNPJ, ou se junta à execução já
+// em andamento, e devolve a cada chamador uma cópia da empresa, que pode ser
+// ajustada sem afetar os demais.
+//
+// A consulta compartilhada não pertence a nenhum chamador: roda sem o
+// cancelamento de quem a iniciou e com o próprio prazo, para que o
+// cancelamento de um job não falhe os que esperam o mesmo CNPJ. Cada
+// chamador espera só enquanto o seu ctx durar, e um panic na consulta chega
+// a todos como erro.
+func consultarEmGrupo(ctx context.Context, cnpj string, prazo time.Duration, consulta func(ctx context.Context) (*Empresa, error)) (*Empresa, error) {
+	resposta := consultasEmAndamento.DoChan(cnpj, func() (empresa any, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic na consulta de %s: %v", cnpj, r)
+			}
+		}()
+		consultaCtx, cancel := context.WithTimeoutCause(context.WithoutCancel(ctx), prazo, errPrazoConsulta)
+		defer cancel()
+		return consulta(consultaCtx)
+	})
+
+	select {
+	case r := <-resposta:
+		if r.Err != nil {
+			return nil, r.Err
+		}
+		copia := *r.Val.(*Empresa)
+		return &copia, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConsultasSimultaneasUmaRequisicao(t *testing.T) {
+	cnpj := cnpjTeste("112223330001")
+	p := &provedorRetido{provedorFalso: provedorFalso{empresas: map[string]Empresa{cnpj: empresaTeste("A LTDA")}}, liberar: make(chan struct{})}
+	usarAmbienteTeste(t, p)
+
+	const simultaneas = 50
+	var iniciadas, prontas sync.WaitGroup
+	resultados := make([]*Empresa, simultaneas)
+	erros := make([]error, simultaneas)
+	iniciadas.Add(simultaneas)
+	prontas.Add(simultaneas)
+	for i := range simultaneas {
+		go func() {
+			defer prontas.Done()
+			iniciadas.Done()
+			resultados[i], erros[i] = consultarCNPJ(context.Background(), p, cnpj)
+		}()
+	}
+	// Dá tempo para todas as consultas chegarem à que está retida
+	iniciadas.Wait()
+	time.Sleep(50 * time.Millisecond)
+	close(p.liberar)
+	prontas.Wait()
+
+	if n := p.totalConsultas(); n != 1 {
+		t.Errorf("%d requisições ao provedor, quer 1", n)
+	}
+	for i, empresa := range resultados {
+		if erros[i] != nil || empresa == nil || empresa.RazaoSocial != "A LTDA" {
+			t.Fatalf("consulta %d = %+v, %v", i, empresa, erros[i])
+		}
+	}
+	// Cada chamador recebe a própria cópia
+	resultados[0].RazaoSocial = "ALTERADA"
+	if resultados[1].RazaoSocial != "A LTDA" {
+		t.Error("alterar uma empresa devolvida alterou a de outro chamador")
+	}
+}
+
+func TestUploadsSimultaneosMesmoCNPJ(t *testing.T) {
+	cnpj := cnpjTeste("112223330001")
+	p := &provedorRetido{provedorFalso: provedorFalso{empresas: map[string]Empresa{cnpj: empresaTeste("A LTDA")}}, liberar: make(chan struct{})}
+	usarAmbienteTeste(t, p)
+
+	var ids []string
+	for range 2 {
+		rec := enviarFormulario(t, uploadHandler, "/upload", nil, arquivoTeste{"entrada.csv", linhaReceita(cnpj, "", "", "")})
+		if rec.Code != http.StatusAccepted {
+			close(p.liberar)
+			t.Fatalf("/upload: %s, quer 202", mensagemErro(rec))
+		}
+		ids = append(ids, rec.Header().Get("X-Job-ID"))
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(p.liberar)
+	for _, id := range ids {
+		if job := esperarJob(t, id); job.Status != statusDone || job.Matched != 1 {
+			t.Errorf("job %s = %+v, quer concluído com 1 empresa", id, job)
+		}
+	}
+
+	if n := p.totalConsultas(); n != 1 {
+		t.Errorf("%d requisições ao provedor para os dois jobs, quer 1", n)
+	}
+	if _, ok := processedCNPJs.Get(cnpj); !ok {
+		t.Error("CNPJ consultado ficou fora do cache")
+	}
+}
+
+func TestCancelarQuemIniciouNaoFalhaOsDemais(t *testing.T) {
+	cnpj := cnpjTeste("112223330001")
+	p := &provedorRetido{provedorFalso: provedorFalso{empresas: map[string]Empresa{cnpj: empresaTeste("A LTDA")}}, liberar: make(chan struct{})}
+	usarAmbienteTeste(t, p)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	erroLider := make(chan error, 1)
+	go func() {
+		_, err := consultarCNPJ(ctx, p, cnpj)
+		erroLider <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	type resposta struct {
+		empresa *Empresa
+		err     error
+	}
+	outra := make(chan resposta, 1)
+	go func() {
+		empresa, err := consultarCNPJ(context.Background(), p, cnpj)
+		outra <- resposta{empresa, err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Quem iniciou desiste na hora; a consulta continua para quem espera
+	cancel()
+	if err := <-erroLider; !errors.Is(err, context.Canceled) {
+		t.Errorf("erro de quem iniciou = %v, quer context.Canceled", err)
+	}
+	close(p.liberar)
+	if r := <-outra; r.err != nil || r.empresa == nil || r.empresa.RazaoSocial != "A LTDA" {
+		t.Errorf("consulta compartilhada = %+v, %v; quer a empresa", r.empresa, r.err)
+	}
+	if n := p.totalConsultas(); n != 1 {
+		t.Errorf("%d requisições ao provedor, quer 1", n)
+	}
+}
+
+// provedorComPanic entra em panic em toda consulta, depois de liberar.
+type provedorComPanic struct{ liberar chan struct{} }
+
+func (p *provedorComPanic) Consultar(context.Context, string) (*Empresa, error) {
+	<-p.liberar
+	panic("falha inesperada")
+}
+
+func TestPanicNaConsultaNaoPrendeOsDemais(t *testing.T) {
+	cnpj := cnpjTeste("112223330001")
+	p := &provedorComPanic{liberar: make(chan struct{})}
+	usarAmbienteTeste(t, p)
+
+	const simultaneas = 3
+	erros := make(chan error, simultaneas)
+	for range simultaneas {
+		go func() {
+			_, err := consultarCNPJ(context.Background(), p, cnpj)
+			erros <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(p.liberar)
+
+	prazo := time.After(time.Second)
+	for range simultaneas {
+		select {
+		case err := <-erros:
+			if err == nil || !strings.Contains(err.Error(), "falha inesperada") {
+				t.Errorf("erro = %v, quer o panic da consulta", err)
+			}
+		case <-prazo:
+			t.Fatal("chamadores presos após o panic da consulta")
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	_ "modernc.org/sqlite"
+)
+
+// driverSQLite é o nome registrado pelo driver modernc.org/sqlite, escrito
+// em Go puro para que o binário continue sem depender de cgo.
+const driverSQLite = "sqlite"
+
+// Linhas gravadas por transação; cada lote é confirmado ao ser completado
+// para que um job interrompido mantenha o que já foi gravado.
+const loteSQLite = 500
+
+const criarTabelaEmpresas = `CREATE TABLE IF NOT EXISTS empresas (
+	cnpj                   TEXT PRIMARY KEY,
+	razao_social           TEXT,
+	nome_fantasia          TEXT,
+	capital_social         REAL,
+	logradouro             TEXT,
+	numero                 TEXT,
+	complemento            TEXT,
+	bairro                 TEXT,
+	municipio              TEXT,
+	codigo_municipio_ibge  TEXT,
+	natureza_juridica      TEXT,
+	natureza_juridica_desc TEXT,
+	uf                     TEXT,
+	cep                    TEXT,
+	situacao_cadastral     TEXT,
+	cnae_fiscal            TEXT,
+	cnae_fiscal_descricao  TEXT,
+	data_inicio_atividade  TEXT,
+	porte                  TEXT,
+	socios                 TEXT,
+	ddd                    TEXT,
+	telefone               TEXT,
+	email                  TEXT
+)`
+
+const inserirEmpresa = `INSERT INTO empresas (
+	cnpj, razao_social, nome_fantasia, capital_social, logradouro, municipio, uf, cep,
+	situacao_cadastral, cnae_fiscal, cnae_fiscal_descricao, data_inicio_atividade, porte,
+	socios, ddd, telefone, email, codigo_municipio_ibge, natureza_juridica, natureza_juridica_desc,
+	numero, complemento, bairro
+) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT(cnpj) DO UPDATE SET
+	razao_social = excluded.razao_social,
+	nome_fantasia = excluded.nome_fantasia,
+	capital_social = excluded.capital_social,
+	logradouro = excluded.logradouro,
+	municipio = excluded.municipio,
+	uf = excluded.uf,
+	cep = excluded.cep,
+	situacao_cadastral = excluded.situacao_cadastral,
+	cnae_fiscal = excluded.cnae_fiscal,
+	cnae_fiscal_descricao = excluded.cnae_fiscal_descricao,
+	data_inicio_atividade = excluded.data_inicio_atividade,
+	porte = excluded.porte,
+	socios = excluded.socios,
+	ddd = excluded.ddd,
+	telefone = excluded.telefone,
+	email = excluded.email,
+	codigo_municipio_ibge = excluded.codigo_municipio_ibge,
+	natureza_juridica = excluded.natureza_juridica,
+	natureza_juridica_desc = excluded.natureza_juridica_desc,
+	numero = excluded.numero,
+	complemento = excluded.complemento,
+	bairro = excluded.bairro`
+
+// parseSaidaBanco valida o campo output_db: o nome de um arquivo SQLite no
+// diretório do servidor, com extensão .db, .sqlite ou .sqlite3. Vazio
+// desativa a gravação em banco.
+func parseSaidaBanco(valor string) (string, error) {
+	nome := strings.TrimSpace(valor)
+	if nome == "" {
+		return "", nil
+	}
+	if strings.ContainsAny(nome, `/\`) || strings.Contains(nome, "..") {
+		return "", fmt.Errorf("output_db inválido: %q (informe apenas o nome do arquivo)", valor)
+	}
+	switch strings.ToLower(filepath.Ext(nome)) {
+	case ".db", ".sqlite", ".sqlite3":
+	default:
+		return "", fmt.Errorf("output_db inválido: %q (use a extensão .db, .sqlite ou .sqlite3)", valor)
+	}
+	return nome, nil
+}
+
+// bancoSaida grava as empresas qualificadas na tabela empresas de um
+// arquivo SQLite, atualizando a linha quando o CNPJ já existe.
+type bancoSaida struct {
+	db     *sql.DB
+	tx     *sql.Tx
+	stmt   *sql.Stmt
+	noLote int
+}
+
+// abrirSaidaBanco abre ou cria o arquivo SQLite em caminho.
+func abrirSaidaBanco(caminho string) (*bancoSaida, error) {
+	db, err := sql.Open(driverSQLite, caminho)
+	if err != nil {
+		return nil, err
+	}
+	// Um único escritor por arquivo evita SQLITE_BUSY entre conexões
+	db.SetMaxOpenConns(1)
+	return &bancoSaida{db: db}, nil
+}
+
+func (b *bancoSaida) Cabecalho() error {
+	if _, err := b.db.Exec(criarTabelaEmpresas); err != nil {
+		return err
+	}
+	return b.iniciarLote()
+}
+
+func (b *bancoSaida) iniciarLote() error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(inserirEmpresa)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	b.tx, b.stmt, b.noLote = tx, stmt, 0
+	return nil
+}
+
+// Escrever grava só as empresas que passaram pelos filtros; com include_all
+// as demais ficam apenas no arquivo de saída.
+func (b *bancoSaida) Escrever(res resultado) error {
+	if !res.atende {
+		return nil
+	}
+	empresa := res.empresa
+	socios, err := sociosJSON(empresa.Socios)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.stmt.Exec(
+		res.cnpj, empresa.RazaoSocial, empresa.NomeFantasia, empresa.CapitalSocial,
+		empresa.Logradouro, empresa.Municipio, empresa.UF, empresa.Cep,
+		empresa.SituacaoCadastral, formatarCNAE(empresa.CnaePrincipalCodigo), empresa.CnaePrincipalDescricao,
+		empresa.DataInicioAtividade.String(), empresa.Porte,
+		socios, res.ddd, res.telefone, res.email, string(empresa.CodigoMunicipio),
+		string(empresa.NaturezaJuridicaCodigo), empresa.NaturezaJuridicaDescricao,
+		empresa.Numero, empresa.Complemento, empresa.Bairro,
+	)
+	if err != nil {
+		return fmt.Errorf("erro ao gravar o CNPJ %s no banco: %w", res.cnpj, err)
+	}
+
+	b.noLote++
+	if b.noLote < loteSQLite {
+		return nil
+	}
+	if err := b.confirmarLote(); err != nil {
+		return err
+	}
+	return b.iniciarLote()
+}
+
+// Flush é chamado a cada linha por escreverResultado; as linhas são
+// confirmadas em lotes por Escrever e, ao final, por Fechar.
+func (b *bancoSaida) Flush() error {
+	return nil
+}
+
+func (b *bancoSaida) confirmarLote() error {
+	b.stmt.Close()
+	err := b.tx.Commit()
+	b.tx, b.stmt = nil, nil
+	return err
+}
+
+// Fechar confirma o último lote e fecha o arquivo.
+func (b *bancoSaida) Fechar() error {
+	var err error
+	if b.tx != nil {
+		err = b.confirmarLote()
+	}
+	if errFechar := b.db.Close(); err == nil {
+		err = errFechar
+	}
+	return err
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUploadGravaBancoSQLite(t *testing.T) {
+	a, b, pequena := cnpjTeste("112223330001"), cnpjTeste("191312430001"), cnpjTeste("114447770001")
+	semCapital := empresaTeste("PEQUENA LTDA")
+	semCapital.CapitalSocial = 1000
+	p := &provedorFalso{empresas: map[string]Empresa{a: empresaTeste("A LTDA"), b: empresaTeste("B LTDA"), pequena: semCapital}}
+	usarAmbienteTeste(t, p)
+
+	enviar := func() {
+		t.Helper()
+		rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", map[string]string{"output_db": "empresas.db"},
+			arquivoTeste{"entrada.csv", linhaReceita(a, "11", "32345678", "contato@a.com.br") +
+				linhaReceita(b, "", "", "") + linhaReceita(pequena, "", "", "")})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("/upload: %s", mensagemErro(rec))
+		}
+	}
+	enviar()
+
+	// Um segundo envio com dados novos atualiza as linhas, sem duplicá-las
+	p.mu.Lock()
+	atualizada := p.empresas[a]
+	atualizada.RazaoSocial = "A RENOMEADA LTDA"
+	p.empresas[a] = atualizada
+	p.mu.Unlock()
+	processedCNPJs = novoCacheLRU[time.Time](maxEntradasCachePadrao)
+	enviar()
+
+	db, err := sql.Open(driverSQLite, filepath.Join(diretorioSaida, "empresas.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM empresas`).Scan(&total); err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 {
+		t.Errorf("%d linhas na tabela, quer 2", total)
+	}
+	var razao, uf, telefone, email string
+	var capital float64
+	err = db.QueryRow(`SELECT razao_social, uf, capital_social, telefone, email FROM empresas WHERE cnpj = ?`, a).
+		Scan(&razao, &uf, &capital, &telefone, &email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if razao != "A RENOMEADA LTDA" || uf != "SP" || capital != 100000 || telefone != "+55 (11) 3234-5678" || email != "contato@a.com.br" {
+		t.Errorf("linha de %s = %q, %q, %v, %q, %q", a, razao, uf, capital, telefone, email)
+	}
+}
+
+func TestParseSaidaBanco(t *testing.T) {
+	for valor, want := range map[string]string{"": "", " empresas.db ": "empresas.db", "dados.SQLITE3": "dados.SQLITE3"} {
+		if got, err := parseSaidaBanco(valor); err != nil || got != want {
+			t.Errorf("parseSaidaBanco(%q) = %q, %v; quer %q", valor, got, err, want)
+		}
+	}
+	for _, valor := range []string{"../empresas.db", "dir/empresas.db", "empresas.csv"} {
+		if _, err := parseSaidaBanco(valor); err == nil {
+			t.Errorf("parseSaidaBanco(%q) aceito", valor)
+		}
+	}
+}
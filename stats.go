@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Quantidade de UFs listadas em estatisticas.TopUFs.
+const topUFsMaximo = 5
+
+// estatisticas resume as empresas gravadas por um job.
+type estatisticas struct {
+	Matches       int64        `json:"matches"`
+	CapitalTotal  float64      `json:"capital_total"`
+	CapitalMedio  float64      `json:"capital_average"`
+	CapitalMinimo float64      `json:"capital_min"`
+	CapitalMaximo float64      `json:"capital_max"`
+	TopUFs        []contagemUF `json:"top_ufs"`
+}
+
+type contagemUF struct {
+	UF      string `json:"uf"`
+	Matches int64  `json:"matches"`
+}
+
+// acumuladorEstatisticas soma as empresas à medida que são gravadas. É
+// usado apenas pela goroutine escritora de processRecords.
+type acumuladorEstatisticas struct {
+	n        int64
+	soma     float64
+	min, max float64
+	porUF    map[string]int64
+}
+
+func (a *acumuladorEstatisticas) adicionar(empresa *Empresa) {
+	capital := empresa.CapitalSocial
+	if a.n == 0 || capital < a.min {
+		a.min = capital
+	}
+	if a.n == 0 || capital > a.max {
+		a.max = capital
+	}
+	a.n++
+	a.soma += capital
+
+	if a.porUF == nil {
+		a.porUF = make(map[string]int64)
+	}
+	if uf := strings.ToUpper(strings.TrimSpace(empresa.UF)); uf != "" {
+		a.porUF[uf]++
+	}
+}
+
+// resultado calcula as estatísticas acumuladas; as UFs empatadas saem em
+// ordem alfabética.
+func (a *acumuladorEstatisticas) resultado() estatisticas {
+	est := estatisticas{
+		Matches:       a.n,
+		CapitalTotal:  a.soma,
+		CapitalMinimo: a.min,
+		CapitalMaximo: a.max,
+		TopUFs:        []contagemUF{},
+	}
+	if a.n > 0 {
+		est.CapitalMedio = a.soma / float64(a.n)
+	}
+
+	for uf, n := range a.porUF {
+		est.TopUFs = append(est.TopUFs, contagemUF{UF: uf, Matches: n})
+	}
+	sort.Slice(est.TopUFs, func(i, j int) bool {
+		if est.TopUFs[i].Matches != est.TopUFs[j].Matches {
+			return est.TopUFs[i].Matches > est.TopUFs[j].Matches
+		}
+		return est.TopUFs[i].UF < est.TopUFs[j].UF
+	})
+	if len(est.TopUFs) > topUFsMaximo {
+		est.TopUFs = est.TopUFs[:topUFsMaximo]
+	}
+	return est
+}
+
+// descreverUFs formata as UFs mais frequentes para o resumo em HTML.
+func descreverUFs(ufs []contagemUF) string {
+	if len(ufs) == 0 {
+		return "nenhuma"
+	}
+	partes := make([]string, len(ufs))
+	for i, c := range ufs {
+		partes[i] = fmt.Sprintf("%s (%d)", c.UF, c.Matches)
+	}
+	return strings.Join(partes, ", ")
+}
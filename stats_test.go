@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestAcumuladorEstatisticas(t *testing.T) {
+	var a acumuladorEstatisticas
+	for _, e := range []struct {
+		uf      string
+		capital float64
+	}{
+		{"SP", 100000}, {"SP", 300000}, {"SP", 60000}, {"RJ", 80000}, {"RJ", 1000000},
+		{"mg", 55000}, {"BA", 70000}, {"PR", 90000}, {"AC", 51000}, {"", 75000},
+	} {
+		a.adicionar(&Empresa{UF: e.uf, CapitalSocial: e.capital})
+	}
+
+	got := a.resultado()
+	want := estatisticas{
+		Matches:       10,
+		CapitalTotal:  1881000,
+		CapitalMedio:  188100,
+		CapitalMinimo: 51000,
+		CapitalMaximo: 1000000,
+		// Empatadas em ordem alfabética; a empresa sem UF não conta
+		TopUFs: []contagemUF{{"SP", 3}, {"RJ", 2}, {"AC", 1}, {"BA", 1}, {"MG", 1}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("estatísticas = %+v, quer %+v", got, want)
+	}
+
+	var vazio acumuladorEstatisticas
+	if got := vazio.resultado(); got.Matches != 0 || got.CapitalMedio != 0 || got.TopUFs == nil {
+		t.Errorf("sem empresas = %+v, quer zeros e lista de UFs vazia", got)
+	}
+	if got := descreverUFs(want.TopUFs[:2]); got != "SP (3), RJ (2)" {
+		t.Errorf("descreverUFs = %q", got)
+	}
+}
+
+func TestEstatisticasDoJob(t *testing.T) {
+	cnpjs := cnpjsTeste(4)
+	empresas := map[string]Empresa{}
+	for i, c := range []struct {
+		uf      string
+		capital float64
+	}{{"SP", 100000}, {"RJ", 200000}, {"SP", 60000}, {"SP", 1000}} {
+		e := empresaTeste("EMPRESA")
+		e.UF, e.CapitalSocial = c.uf, c.capital
+		empresas[cnpjs[i]] = e
+	}
+	usarAmbienteTeste(t, &provedorFalso{empresas: empresas})
+
+	var entrada string
+	for _, cnpj := range cnpjs {
+		entrada += linhaReceita(cnpj, "", "", "")
+	}
+	rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", nil, arquivoTeste{"entrada.csv", entrada})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+
+	// A empresa abaixo do capital mínimo não entra nas estatísticas
+	var job Job
+	consultarJob(t, "/jobs/"+rec.Header().Get("X-Job-ID"), &job)
+	want := &estatisticas{Matches: 3, CapitalTotal: 360000, CapitalMedio: 120000, CapitalMinimo: 60000, CapitalMaximo: 200000,
+		TopUFs: []contagemUF{{"SP", 2}, {"RJ", 1}}}
+	if !reflect.DeepEqual(job.Stats, want) {
+		t.Errorf("stats = %+v, quer %+v", job.Stats, want)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// marcadorUTF8Invalido substitui, na saída, cada trecho de bytes que não
+// forma UTF-8 válido.
+const marcadorUTF8Invalido = "\uFFFD"
+
+// normalizarTexto prepara nomes para comparação: minúsculas, sem acentos e
+// com espaços repetidos reduzidos a um, de modo que "São  Paulo" e
+// "SAO PAULO" fiquem iguais. Os acentos são removidos pela decomposição NFD,
+// que separa cada letra das marcas combinantes (unicode.Mn) descartadas.
+func normalizarTexto(s string) string {
+	var b strings.Builder
+	b.Grow(len(s))
+	for _, r := range norm.NFD.String(s) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// sanitizarUTF8 troca por marcadorUTF8Invalido os trechos inválidos de cada
+// campo e informa se algum foi alterado.
+func sanitizarUTF8(campos ...*string) bool {
+	alterado := false
+	for _, campo := range campos {
+		if !utf8.ValidString(*campo) {
+			*campo = strings.ToValidUTF8(*campo, marcadorUTF8Invalido)
+			alterado = true
+		}
+	}
+	return alterado
+}
+
+// sanitizarResultado garante que todos os textos de res sejam UTF-8 válido
+// antes da gravação e informa se algum foi corrigido. A empresa e os sócios
+// são copiados antes de alterados, pois podem ser compartilhados com outras
+// consultas.
+func sanitizarResultado(res *resultado) bool {
+	alterado := sanitizarUTF8(&res.cnpj, &res.ddd, &res.telefone, &res.email,
+		&res.coordenadas.Latitude, &res.coordenadas.Longitude)
+	if res.empresa == nil {
+		return alterado
+	}
+
+	e := *res.empresa
+	codigoMunicipio, codigoNatureza := string(e.CodigoMunicipio), string(e.NaturezaJuridicaCodigo)
+	empresaAlterada := sanitizarUTF8(&e.CNPJ, &e.RazaoSocial, &e.NomeFantasia, &e.Logradouro,
+		&e.Numero, &e.Complemento, &e.Bairro, &e.Municipio, &codigoMunicipio, &e.UF, &e.Cep,
+		&e.SituacaoCadastral, &e.CnaePrincipalDescricao, &e.Porte, &codigoNatureza,
+		&e.NaturezaJuridicaDescricao)
+	e.CodigoMunicipio, e.NaturezaJuridicaCodigo = codigoTexto(codigoMunicipio), codigoTexto(codigoNatureza)
+
+	sociosCopiados := false
+	for i, s := range e.Socios {
+		if !sanitizarUTF8(&s.Nome, &s.Qualificacao) {
+			continue
+		}
+		if !sociosCopiados {
+			e.Socios = append([]Socio(nil), e.Socios...)
+			sociosCopiados = true
+		}
+		e.Socios[i] = s
+		empresaAlterada = true
+	}
+
+	if empresaAlterada {
+		res.empresa = &e
+	}
+	return alterado || empresaAlterada
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestNormalizarTexto(t *testing.T) {
+	casos := map[string]string{
+		"São  Paulo":              "sao paulo",
+		"SAO PAULO":               "sao paulo",
+		" Santo André ":           "santo andre",
+		"Mogi-Guaçu":              "mogi-guacu",
+		"JOÃO PESSOA":             "joao pessoa",
+		"Ñandú Ÿpsilon":           "nandu ypsilon",
+		"Pau d'Alho":              "pau d'alho",
+		"Ba\u0301rbara":           "barbara", // acento já decomposto
+		"Açaí\tLtda":              "acai ltda",
+		"Teixeira de Freitas-BA ": "teixeira de freitas-ba",
+	}
+	for entrada, want := range casos {
+		if got := normalizarTexto(entrada); got != want {
+			t.Errorf("normalizarTexto(%q) = %q, quer %q", entrada, got, want)
+		}
+	}
+}
+
+func TestFiltroMunicipioSemAcento(t *testing.T) {
+	capital, santoAndre, campinas := cnpjTeste("112223330001"), cnpjTeste("191312430001"), cnpjTeste("114447770001")
+	empresas := map[string]Empresa{capital: empresaTeste("A"), santoAndre: empresaTeste("B"), campinas: empresaTeste("C")}
+	for cnpj, municipio := range map[string]string{capital: "SAO PAULO", santoAndre: "SANTO ANDRE", campinas: "CAMPINAS"} {
+		e := empresas[cnpj]
+		e.Municipio = municipio
+		empresas[cnpj] = e
+	}
+	usarAmbienteTeste(t, &provedorFalso{empresas: empresas})
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"municipio": "São Paulo, santo  andré"},
+		arquivoTeste{"entrada.csv", linhaReceita(capital, "", "", "") + linhaReceita(santoAndre, "", "", "") +
+			linhaReceita(campinas, "", "", "")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+	got := coluna(t, cabecalho, linhas, "Municipio")
+	slices.Sort(got)
+	if want := []string{"SANTO ANDRE", "SAO PAULO"}; !slices.Equal(got, want) {
+		t.Errorf("municípios na saída = %v, quer %v", got, want)
+	}
+}
+
+func TestNomeContemTermo(t *testing.T) {
+	empresa := &Empresa{RazaoSocial: "TRANSPORTES SÃO JOÃO LTDA", NomeFantasia: "Expresso Açaí"}
+	casos := []struct {
+		termo, campo string
+		want         bool
+	}{
+		{"Transporte", campoNomeAmbos, true},
+		{"são joão", campoNomeRazao, true},
+		{"acai", campoNomeAmbos, true},
+		{"AÇAÍ", campoNomeFantasia, true},
+		{"acai", campoNomeRazao, false},
+		{"transporte", campoNomeFantasia, false},
+		{"logistica", campoNomeAmbos, false},
+	}
+	for _, c := range casos {
+		if got := nomeContemTermo(empresa, normalizarTexto(c.termo), c.campo); got != c.want {
+			t.Errorf("nomeContemTermo(%q, %s) = %v, quer %v", c.termo, c.campo, got, c.want)
+		}
+	}
+}
+
+func TestFiltroNomeContem(t *testing.T) {
+	razao, fantasia, nenhum := cnpjTeste("112223330001"), cnpjTeste("191312430001"), cnpjTeste("114447770001")
+	comFantasia := empresaTeste("COMERCIO SILVA LTDA")
+	comFantasia.NomeFantasia = "Silva Transportação"
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{
+		razao: empresaTeste("TRANSPORTES ÁGUIA LTDA"), fantasia: comFantasia, nenhum: empresaTeste("PADARIA CENTRAL"),
+	}})
+	entrada := linhaReceita(razao, "", "", "") + linhaReceita(fantasia, "", "", "") + linhaReceita(nenhum, "", "", "")
+
+	for campo, want := range map[string][]string{
+		"":              {"COMERCIO SILVA LTDA", "TRANSPORTES ÁGUIA LTDA"},
+		"razao_social":  {"TRANSPORTES ÁGUIA LTDA"},
+		"nome_fantasia": {"COMERCIO SILVA LTDA"},
+	} {
+		processedCNPJs = novoCacheLRU[time.Time](maxEntradasCachePadrao)
+		rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"nome_contem": "Transpórt", "nome_campo": campo},
+			arquivoTeste{"entrada.csv", entrada})
+		if rec.Code != http.StatusOK {
+			t.Fatalf("/upload com nome_campo %q: %s", campo, mensagemErro(rec))
+		}
+		cabecalho, linhas := lerSaidaCSV(t, rec.Body.String())
+		got := coluna(t, cabecalho, linhas, "RazaoSocial")
+		slices.Sort(got)
+		if !slices.Equal(got, want) {
+			t.Errorf("nome_campo %q: razões sociais = %v, quer %v", campo, got, want)
+		}
+	}
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{"nome_contem": "x", "nome_campo": "cnpj"},
+		arquivoTeste{"entrada.csv", entrada})
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("nome_campo inválido: status = %d, quer 400", rec.Code)
+	}
+}
+
+func TestSanitizarResultadoPreservaEmpresa(t *testing.T) {
+	empresa := &Empresa{RazaoSocial: "PADARIA S\xe3O JOS\xc9", Socios: []Socio{{Nome: "JO\xc3O"}, {Nome: "MARIA"}}}
+	res := resultado{empresa: empresa}
+	if !sanitizarResultado(&res) {
+		t.Fatal("sanitizarResultado não relatou a correção")
+	}
+	if want := "PADARIA S" + marcadorUTF8Invalido + "O JOS" + marcadorUTF8Invalido; res.empresa.RazaoSocial != want {
+		t.Errorf("RazaoSocial = %q, quer %q", res.empresa.RazaoSocial, want)
+	}
+	if got := res.empresa.Socios[0].Nome; got != "JO"+marcadorUTF8Invalido+"O" {
+		t.Errorf("sócio = %q", got)
+	}
+	// A empresa original pode estar no cache e não é alterada
+	if empresa.RazaoSocial != "PADARIA S\xe3O JOS\xc9" || empresa.Socios[0].Nome != "JO\xc3O" {
+		t.Errorf("empresa original alterada: %+v", empresa)
+	}
+
+	valido := resultado{empresa: &Empresa{RazaoSocial: "SÃO JOSÉ"}}
+	if sanitizarResultado(&valido) || valido.empresa.RazaoSocial != "SÃO JOSÉ" {
+		t.Errorf("texto válido alterado: %q", valido.empresa.RazaoSocial)
+	}
+}
+
+func TestUploadCorrigeUTF8Invalido(t *testing.T) {
+	invalida, valida := cnpjTeste("112223330001"), cnpjTeste("191312430001")
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{
+		invalida: empresaTeste("COM\xe9RCIO \xff\xfe LTDA"), valida: empresaTeste("COMÉRCIO BOM LTDA"),
+	}})
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?wait=1", map[string]string{"workers": "1"},
+		arquivoTeste{"entrada.csv", linhaReceita(invalida, "", "", "") + linhaReceita(valida, "", "", "")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+	if !strings.Contains(rec.Body.String(), "texto fora do UTF-8 corrigido: 1<") {
+		t.Errorf("resumo sem a contagem de linhas corrigidas:\n%s", rec.Body.String())
+	}
+
+	saida := lerArquivoSaida(t, "empresas_")
+	if !utf8.ValidString(saida) {
+		t.Fatalf("saída com UTF-8 inválido: %q", saida)
+	}
+	cabecalho, linhas := lerSaidaCSV(t, saida)
+	want := []string{"COM" + marcadorUTF8Invalido + "RCIO " + marcadorUTF8Invalido + " LTDA", "COMÉRCIO BOM LTDA"}
+	if got := coluna(t, cabecalho, linhas, "RazaoSocial"); !slices.Equal(got, want) {
+		t.Errorf("RazaoSocial = %q, quer %q", got, want)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Identificação da build, definida na compilação com
+//
+//	go build -ldflags "-X main.versao=1.2.0 -X main.commit=$(git rev-parse --short HEAD) -X main.dataBuild=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Sem -ldflags ficam os valores de desenvolvimento abaixo.
+var (
+	versao    = "dev"
+	commit    = "unknown"
+	dataBuild = "unknown"
+)
+
+// respostaVersao é o corpo JSON de /version.
+type respostaVersao struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+// versionHandler responde com a identificação da build em execução.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Método não permitido", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(respostaVersao{Version: versao, Commit: commit, BuildDate: dataBuild})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestVersion(t *testing.T) {
+	rec := httptest.NewRecorder()
+	versionHandler(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/version: %s", mensagemErro(rec))
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	var corpo map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &corpo); err != nil {
+		t.Fatalf("JSON inválido: %v: %s", err, rec.Body.String())
+	}
+	if got := slices.Sorted(maps.Keys(corpo)); !slices.Equal(got, []string{"build_date", "commit", "version"}) {
+		t.Errorf("chaves = %v", got)
+	}
+	// Sem -ldflags valem os valores de desenvolvimento
+	want := map[string]string{"version": "dev", "commit": "unknown", "build_date": "unknown"}
+	if !maps.Equal(corpo, want) {
+		t.Errorf("/version = %v, quer %v", corpo, want)
+	}
+
+	rec = httptest.NewRecorder()
+	versionHandler(rec, httptest.NewRequest(http.MethodPost, "/version", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /version: status = %d, quer 405", rec.Code)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Entrega do callback_url: cada tentativa tem seu próprio prazo e as falhas
+// são repetidas com backoff, sem afetar a situação do job.
+const (
+	timeoutCallback    = 10 * time.Second
+	tentativasCallback = 3
+	backoffCallback    = time.Second
+)
+
+// clienteCallback envia as notificações de callback_url, só a endereços
+// públicos; o prazo de cada tentativa vem de timeoutCallback.
+var clienteCallback = novoClienteExterno(enderecoPublico)
+
+// notificacaoJob é o corpo JSON enviado ao callback_url ao fim do job.
+type notificacaoJob struct {
+	JobID      string   `json:"job_id"`
+	Status     string   `json:"status"`
+	Matched    int64    `json:"matched"`
+	Held       int64    `json:"held,omitempty"`
+	OutputPath string   `json:"output_path,omitempty"`
+	Files      []string `json:"files,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// parseCallbackURL valida o campo callback_url: uma URL http ou https
+// absoluta. Vazio desativa a notificação. Um IP interno escrito na URL é
+// recusado já aqui; nomes que resolvem para a rede interna são recusados por
+// clienteCallback na entrega.
+func parseCallbackURL(valor string) (string, error) {
+	valor = strings.TrimSpace(valor)
+	if valor == "" {
+		return "", nil
+	}
+	u, err := url.Parse(valor)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("callback_url inválido: %q (use uma URL http ou https)", valor)
+	}
+	if ip, err := netip.ParseAddr(u.Hostname()); err == nil && !enderecoPublico(ip) {
+		return "", fmt.Errorf("callback_url inválido: %q (%w)", valor, errDestinoInterno)
+	}
+	return u.String(), nil
+}
+
+// notificarConclusao envia a situação final do job a callbackURL em segundo
+// plano. errJob descreve a falha que encerrou o job, quando houver.
+func notificarConclusao(callbackURL string, job Job, errJob error) {
+	if callbackURL == "" {
+		return
+	}
+	notificacao := notificacaoJob{
+		JobID:      job.ID,
+		Status:     job.Status,
+		Matched:    job.Matched,
+		Held:       job.Held,
+		OutputPath: job.OutputPath,
+		Files:      job.Files,
+	}
+	if errJob != nil {
+		notificacao.Error = errJob.Error()
+	}
+	go entregarCallback(clienteCallback, callbackURL, notificacao)
+}
+
+// entregarCallback faz o POST da notificação por cliente, repetindo-o em
+// erros de rede e respostas fora da faixa 2xx; um destino interno não é
+// tentado de novo.
+func entregarCallback(cliente *http.Client, callbackURL string, notificacao notificacaoJob) {
+	corpo, err := json.Marshal(notificacao)
+	if err != nil {
+		slog.Error("Erro ao montar a notificação do job", "event", "callback_failed", "job_id", notificacao.JobID, "error", err)
+		return
+	}
+
+	espera := backoffCallback
+	for tentativa := 1; tentativa <= tentativasCallback; tentativa++ {
+		err = enviarCallback(cliente, callbackURL, corpo)
+		if err == nil {
+			slog.Info("Notificação do job entregue", "event", "callback_sent", "job_id", notificacao.JobID, "url", callbackURL)
+			return
+		}
+		if errors.Is(err, errDestinoInterno) {
+			break
+		}
+		if tentativa < tentativasCallback {
+			slog.Warn("Tentativa de notificação falhou", "event", "callback_retry", "job_id", notificacao.JobID,
+				"attempt", tentativa, "max_attempts", tentativasCallback, "error", err)
+			time.Sleep(espera)
+			espera *= 2
+		}
+	}
+	slog.Error("Não foi possível notificar o fim do job", "event", "callback_failed", "job_id", notificacao.JobID,
+		"url", callbackURL, "error", err)
+}
+
+func enviarCallback(cliente *http.Client, callbackURL string, corpo []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutCallback)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(corpo))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := cliente.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status code não OK: %d", resp.StatusCode)
+	}
+	return nil
+}
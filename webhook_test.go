@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEntregarCallbackEnviaNotificacao(t *testing.T) {
+	recebida := make(chan notificacaoJob, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("pedido = %s com Content-Type %q", r.Method, r.Header.Get("Content-Type"))
+		}
+		var n notificacaoJob
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Errorf("corpo inválido: %v", err)
+		}
+		recebida <- n
+	}))
+	defer srv.Close()
+
+	// O servidor de teste escuta em 127.0.0.1, recusado pelo cliente padrão
+	cliente := novoClienteExterno(func(netip.Addr) bool { return true })
+	entregarCallback(cliente, srv.URL+"/fim", notificacaoJob{JobID: "abc123", Status: "completed", Matched: 7,
+		OutputPath: "empresas_capital_maior_50000_abc123.csv"})
+
+	select {
+	case n := <-recebida:
+		if n.JobID != "abc123" || n.Status != "completed" || n.Matched != 7 || n.OutputPath != "empresas_capital_maior_50000_abc123.csv" {
+			t.Errorf("notificação = %+v", n)
+		}
+	default:
+		t.Fatal("callback não recebido")
+	}
+}
+
+func TestEntregarCallbackRecusaEnderecoInterno(t *testing.T) {
+	var pedidos atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pedidos.Add(1)
+	}))
+	defer srv.Close()
+
+	inicio := time.Now()
+	entregarCallback(novoClienteExterno(enderecoPublico), srv.URL, notificacaoJob{JobID: "abc123"})
+	if n := pedidos.Load(); n != 0 {
+		t.Errorf("servidor interno recebeu %d pedidos", n)
+	}
+	if d := time.Since(inicio); d >= backoffCallback {
+		t.Errorf("entrega durou %s; destino interno não deve ser repetido", d)
+	}
+}
+
+func TestParseCallbackURL(t *testing.T) {
+	aceitas := []string{"", "https://exemplo.com.br/fim", "http://200.152.38.1:8080/jobs"}
+	for _, valor := range aceitas {
+		if _, err := parseCallbackURL(valor); err != nil {
+			t.Errorf("parseCallbackURL(%q): %v", valor, err)
+		}
+	}
+	recusadas := []string{
+		"ftp://exemplo.com.br/fim",
+		"/fim",
+		"http://127.0.0.1:8080/fim",
+		"http://169.254.169.254/latest/meta-data",
+		"http://10.0.0.5/fim",
+		"http://[::1]/fim",
+	}
+	for _, valor := range recusadas {
+		if _, err := parseCallbackURL(valor); err == nil {
+			t.Errorf("parseCallbackURL(%q) aceitou a URL", valor)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"strconv"
+
+	"github.com/xuri/excelize/v2"
+)
+
+// nomePlanilhaXLSX é o nome da única planilha das saídas XLSX.
+const nomePlanilhaXLSX = "Empresas"
+
+// formatoMoedaXLSX formata o capital social em reais.
+var formatoMoedaXLSX = `"R$" #,##0.00`
+
+// xlsxSaida grava as mesmas colunas do CSV em uma planilha XLSX, com o
+// cabeçalho em negrito e o capital social formatado como moeda. As linhas
+// passam pelo StreamWriter do excelize, que as mantém em um arquivo
+// temporário a partir de certo tamanho, sem guardar a planilha em memória;
+// o XLSX só é gravado em destino por Fechar.
+type xlsxSaida struct {
+	layoutTabela
+	destino  io.Writer
+	arquivo  *excelize.File
+	planilha *excelize.StreamWriter
+	negrito  int // estilos registrados no arquivo
+	moeda    int
+	capital  int // coluna do capital social na seleção; -1 se ausente
+	linhas   int
+	fechado  bool
+}
+
+func (s *xlsxSaida) Cabecalho() error {
+	s.arquivo = excelize.NewFile()
+	if err := s.arquivo.SetSheetName("Sheet1", nomePlanilhaXLSX); err != nil {
+		return err
+	}
+	var err error
+	if s.negrito, err = s.arquivo.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}}); err != nil {
+		return err
+	}
+	if s.moeda, err = s.arquivo.NewStyle(&excelize.Style{CustomNumFmt: &formatoMoedaXLSX}); err != nil {
+		return err
+	}
+	if s.planilha, err = s.arquivo.NewStreamWriter(nomePlanilhaXLSX); err != nil {
+		return err
+	}
+
+	s.capital = s.coluna("CapitalSocial")
+	return s.escreverLinha(s.cabecalho(), true)
+}
+
+func (s *xlsxSaida) Escrever(res resultado) error {
+	linha, err := s.linha(res)
+	if err != nil {
+		return err
+	}
+	return s.escreverLinha(linha, false)
+}
+
+// escreverLinha grava uma linha da planilha com textos, exceto o capital
+// social, gravado como número para que a formatação de moeda valha.
+func (s *xlsxSaida) escreverLinha(valores []string, cabecalho bool) error {
+	celulas := make([]any, len(valores))
+	for i, valor := range valores {
+		celula := excelize.Cell{Value: valor}
+		if cabecalho {
+			celula.StyleID = s.negrito
+		} else if i == s.capital {
+			if capital, err := strconv.ParseFloat(valor, 64); err == nil {
+				celula = excelize.Cell{StyleID: s.moeda, Value: capital}
+			}
+		}
+		celulas[i] = celula
+	}
+
+	s.linhas++
+	inicio, err := excelize.CoordinatesToCellName(1, s.linhas)
+	if err != nil {
+		return err
+	}
+	return s.planilha.SetRow(inicio, celulas)
+}
+
+// Flush não grava nada: o pacote XLSX só pode ser montado ao fim, em Fechar.
+func (s *xlsxSaida) Flush() error {
+	return nil
+}
+
+// Fechar encerra a planilha e grava o arquivo XLSX em destino; antes disso
+// nada é gravado.
+func (s *xlsxSaida) Fechar() error {
+	if s.fechado || s.arquivo == nil {
+		return nil
+	}
+	s.fechado = true
+	defer s.arquivo.Close()
+	if err := s.planilha.Flush(); err != nil {
+		return err
+	}
+	_, err := s.arquivo.WriteTo(s.destino)
+	return err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/xuri/excelize/v2"
+)
+
+func TestSaidaXLSX(t *testing.T) {
+	cnpj := cnpjTeste("112223330001")
+	empresa := empresaTeste("EMPRESA & FILHOS <LTDA>")
+	empresa.CapitalSocial = 1234567.89
+	usarAmbienteTeste(t, &provedorFalso{empresas: map[string]Empresa{cnpj: empresa}})
+
+	rec := enviarFormulario(t, uploadHandler, "/upload?inline=1", map[string]string{
+		"output_format": "xlsx", "columns": "CNPJ,RazaoSocial,CapitalSocial,UF",
+	}, arquivoTeste{"entrada.csv", linhaReceita(cnpj, "11", "32345678", "")})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("/upload: %s", mensagemErro(rec))
+	}
+
+	f, err := excelize.OpenReader(rec.Body)
+	if err != nil {
+		t.Fatalf("XLSX inválido: %v", err)
+	}
+	defer f.Close()
+	if got := f.GetSheetList(); !slices.Equal(got, []string{nomePlanilhaXLSX}) {
+		t.Errorf("planilhas = %v", got)
+	}
+	linhas, err := f.GetRows(nomePlanilhaXLSX, excelize.Options{RawCellValue: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"CNPJ", "RazaoSocial", "CapitalSocial", "UF"},
+		{cnpj, "EMPRESA & FILHOS <LTDA>", "1234567.89", "SP"},
+	}
+	if !slices.EqualFunc(linhas, want, slices.Equal) {
+		t.Errorf("linhas = %q, quer %q", linhas, want)
+	}
+
+	estilo, err := f.GetCellStyle(nomePlanilhaXLSX, "A1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := f.GetStyle(estilo); err != nil || s.Font == nil || !s.Font.Bold {
+		t.Errorf("cabeçalho sem negrito: %+v, %v", s, err)
+	}
+	if tipo, _ := f.GetCellType(nomePlanilhaXLSX, "C2"); tipo != excelize.CellTypeUnset && tipo != excelize.CellTypeNumber {
+		t.Errorf("capital social gravado como %v, quer número", tipo)
+	}
+	if valor, _ := f.GetCellValue(nomePlanilhaXLSX, "C2"); !strings.Contains(valor, "R$") {
+		t.Errorf("capital social formatado = %q, quer moeda em reais", valor)
+	}
+}